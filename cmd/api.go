@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+	"github.com/meiking/tidb-metrics-crawler/pkg/sink"
+)
+
+// apiRow is a row as served by the query API. JSON has no NaN or ±Inf, so
+// non-finite values are served as null.
+type apiRow struct {
+	common.ProcessedData
+	Value *float64 `json:"value"`
+}
+
+// newAPIHandler serves the rows kept by snapshots: /metrics lists the metric
+// names and /metrics/<name>?instance=<instance> returns a metric's latest
+// rows. The health probes are served alongside.
+func newAPIHandler(snapshots *sink.SnapshotSink, health *runHealth) http.Handler {
+	mux := http.NewServeMux()
+	health.register(mux)
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, snapshots.Metrics())
+	})
+	mux.HandleFunc("/metrics/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/metrics/")
+		rows, ok := snapshots.Latest(name, r.URL.Query().Get("instance"))
+		if !ok {
+			http.Error(w, "no rows for metric "+name, http.StatusNotFound)
+			return
+		}
+
+		out := make([]apiRow, len(rows))
+		for i, row := range rows {
+			out[i].ProcessedData = row
+			if v := row.Value; !math.IsNaN(v) && !math.IsInf(v, 0) {
+				out[i].Value = &v
+			}
+		}
+		writeJSON(w, out)
+	})
+	return mux
+}
+
+// writeJSON writes v as the JSON response
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write API response: %v", err)
+	}
+}
+
+// startAPIServer serves the query API on addr until ctx is cancelled
+func startAPIServer(ctx context.Context, addr string, snapshots *sink.SnapshotSink, health *runHealth) {
+	server := &http.Server{
+		Addr:    addr,
+		Handler: newAPIHandler(snapshots, health),
+	}
+
+	go func() {
+		log.Printf("Serving the query API on http://%s/metrics", addr)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("API server error: %v", err)
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Failed to shut down API server: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+	"github.com/meiking/tidb-metrics-crawler/pkg/sink"
+)
+
+// discardSink drops every row
+type discardSink struct{}
+
+func (discardSink) Write(string, []common.ProcessedData) error { return nil }
+func (discardSink) Close() error                               { return nil }
+
+// servedRow is a row as decoded from the API
+type servedRow struct {
+	PrometheusInstance string            `json:"prometheusInstance"`
+	MetricName         string            `json:"metricName"`
+	Timestamp          time.Time         `json:"timestamp"`
+	Value              *float64          `json:"value"`
+	Labels             map[string]string `json:"labels"`
+}
+
+// apiGet requests path from handler and decodes the JSON response into v
+func apiGet(t *testing.T, handler http.Handler, path string, v interface{}) int {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	if rec.Code == http.StatusOK {
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("GET %s Content-Type = %q, want application/json", path, ct)
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Fatalf("GET %s returned %q: %v", path, rec.Body.String(), err)
+		}
+	}
+	return rec.Code
+}
+
+func TestAPIHandlerServesLatestRows(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	rows := func(instance string, minutes ...int) []common.ProcessedData {
+		var data []common.ProcessedData
+		for _, m := range minutes {
+			value := float64(m)
+			if m == 5 {
+				value = math.NaN()
+			}
+			data = append(data, common.ProcessedData{
+				PrometheusInstance: instance,
+				MetricName:         "qps",
+				Timestamp:          start.Add(time.Duration(m) * time.Minute),
+				Value:              value,
+				Labels:             map[string]string{"job": "tidb"},
+			})
+		}
+		return data
+	}
+
+	// Four rows are kept per metric, so the first batch's oldest rows go
+	snapshots := sink.NewSnapshotSink(discardSink{}, 4)
+	for _, batch := range [][]common.ProcessedData{rows("prom-a", 0, 1), rows("prom-b", 0, 1), rows("prom-a", 4, 5)} {
+		if err := snapshots.Write("qps", batch); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+	if err := snapshots.Write("tps", rows("prom-a", 0)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	health := &runHealth{}
+	handler := newAPIHandler(snapshots, health)
+
+	var names []string
+	if code := apiGet(t, handler, "/metrics", &names); code != http.StatusOK || !reflect.DeepEqual(names, []string{"qps", "tps"}) {
+		t.Errorf("GET /metrics = %d %v, want 200 [qps tps]", code, names)
+	}
+
+	tests := []struct {
+		path string
+		want []string // Instance and minute of each row
+	}{
+		{"/metrics/qps", []string{"prom-b 0", "prom-b 1", "prom-a 4", "prom-a 5"}},
+		{"/metrics/qps?instance=prom-a", []string{"prom-a 4", "prom-a 5"}},
+		{"/metrics/qps?instance=prom-c", []string{}},
+		{"/metrics/tps", []string{"prom-a 0"}},
+	}
+	for _, tt := range tests {
+		var served []servedRow
+		if code := apiGet(t, handler, tt.path, &served); code != http.StatusOK {
+			t.Errorf("GET %s = %d, want 200", tt.path, code)
+			continue
+		}
+		got := []string{}
+		for _, row := range served {
+			minute := int(row.Timestamp.Sub(start) / time.Minute)
+			got = append(got, fmt.Sprintf("%s %d", row.PrometheusInstance, minute))
+			if row.MetricName == "" || row.Labels["job"] != "tidb" {
+				t.Errorf("GET %s: row %+v, want the metric name and job label", tt.path, row)
+			}
+			// NaN cannot be encoded in JSON, so it is served as null
+			if minute == 5 && row.Value != nil || minute != 5 && (row.Value == nil || *row.Value != float64(minute)) {
+				t.Errorf("GET %s: row at minute %d valued %v, want %d or null for NaN", tt.path, minute, row.Value, minute)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("GET %s rows = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+
+	if code := apiGet(t, handler, "/metrics/latency", nil); code != http.StatusNotFound {
+		t.Errorf("GET /metrics/latency = %d, want 404 for a metric without rows", code)
+	}
+
+	// The health probes are served next to the rows
+	if code := apiGet(t, handler, "/readyz", nil); code != http.StatusServiceUnavailable {
+		t.Errorf("GET /readyz = %d during the run, want 503", code)
+	}
+	health.finish(nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("GET /readyz = %d after the run succeeded, want 200", rec.Code)
+	}
+}
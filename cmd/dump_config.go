@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"gopkg.in/yaml.v3"
+)
+
+// runDumpConfig prints the effective configuration with secrets redacted
+func runDumpConfig(args []string) error {
+	fs := flag.NewFlagSet("dump-config", flag.ExitOnError)
+	cfgFlags := addConfigFlags(fs)
+	format := fs.String("format", "yaml", "Output format: yaml or json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := cfgFlags.load()
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %v", err)
+	}
+	return dumpConfig(os.Stdout, cfg, *format)
+}
+
+// dumpConfig writes cfg with secrets redacted as YAML or JSON
+func dumpConfig(out io.Writer, cfg *config.Config, format string) error {
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(cfg.Redact()); err != nil {
+		return err
+	}
+	data := buf.Bytes()
+
+	switch format {
+	case "yaml":
+	case "json":
+		// Round-trip through YAML so JSON keys match the config file
+		var generic map[string]interface{}
+		if err := yaml.Unmarshal(data, &generic); err != nil {
+			return err
+		}
+		var err error
+		if data, err = json.MarshalIndent(generic, "", "  "); err != nil {
+			return err
+		}
+		data = append(data, '\n')
+	default:
+		return fmt.Errorf("unsupported format: %s", format)
+	}
+
+	_, err := out.Write(data)
+	return err
+}
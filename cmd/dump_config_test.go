@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDumpConfigAppliesOverridesAndRedacts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(path, []byte(`
+prometheus_instances:
+  - name: prom
+    address: http://prom:9090
+    password: hunter2
+time_range:
+  start: "2024-01-01T00:00:00Z"
+  end: "2024-01-02T00:00:00Z"
+  step: 1m
+sink:
+  type: mysql
+  mysql:
+    dsn: root:dbpass@tcp(db:4000)/metrics
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The flags go through the same loading as a run
+	fs := flag.NewFlagSet("dump-config", flag.ContinueOnError)
+	cfgFlags := addConfigFlags(fs)
+	if err := fs.Parse([]string{"-config", path, "-step", "30s", "-start", "now-1h"}); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := cfgFlags.load()
+	if err != nil {
+		t.Fatalf("load() error = %v", err)
+	}
+
+	var yamlOut bytes.Buffer
+	if err := dumpConfig(&yamlOut, cfg, "yaml"); err != nil {
+		t.Fatalf("dumpConfig(yaml) error = %v", err)
+	}
+	for _, want := range []string{"start: now-1h", "end: \"2024-01-02T00:00:00Z\"", "step: 30s", "dsn: root:****@tcp(db:4000)/metrics"} {
+		if !strings.Contains(yamlOut.String(), want) {
+			t.Errorf("YAML output lacks %q:\n%s", want, yamlOut.String())
+		}
+	}
+
+	var jsonOut bytes.Buffer
+	if err := dumpConfig(&jsonOut, cfg, "json"); err != nil {
+		t.Fatalf("dumpConfig(json) error = %v", err)
+	}
+	var dumped struct {
+		TimeRange struct {
+			Start, End, Step string
+		} `json:"time_range"`
+		PrometheusInstances []struct {
+			Password string
+		} `json:"prometheus_instances"`
+	}
+	if err := json.Unmarshal(jsonOut.Bytes(), &dumped); err != nil {
+		t.Fatalf("JSON output does not parse: %v\n%s", err, jsonOut.String())
+	}
+	if dumped.TimeRange.Start != "now-1h" || dumped.TimeRange.Step != "30s" || dumped.TimeRange.End != "2024-01-02T00:00:00Z" {
+		t.Errorf("JSON time range = %+v, want the flags over the file", dumped.TimeRange)
+	}
+	if len(dumped.PrometheusInstances) != 1 || dumped.PrometheusInstances[0].Password == "" {
+		t.Errorf("JSON instances = %+v, want the password masked, not dropped", dumped.PrometheusInstances)
+	}
+
+	for _, out := range []string{yamlOut.String(), jsonOut.String()} {
+		for _, secret := range []string{"hunter2", "dbpass"} {
+			if strings.Contains(out, secret) {
+				t.Errorf("output holds the secret %q", secret)
+			}
+		}
+	}
+
+	if err := dumpConfig(&bytes.Buffer{}, cfg, "toml"); err == nil {
+		t.Error("dumpConfig() accepted an unsupported format")
+	}
+}
+
+func TestDumpConfigRejectsInvalidOverride(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("time_range:\n  step: 1m\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fs := flag.NewFlagSet("dump-config", flag.ContinueOnError)
+	cfgFlags := addConfigFlags(fs)
+	if err := fs.Parse([]string{"-config", path, "-step", "soon"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfgFlags.load(); err == nil {
+		t.Error("load() accepted an invalid -step")
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+// configFlags holds the flags shared by every command that loads a configuration
+type configFlags struct {
+	paths       *configPaths
+	vars        configVars
+	prometheus  *string
+	start       *string
+	end         *string
+	step        *string
+	incremental *bool
+	noColor     *bool
+
+	maxConcurrencyPerInstance *int
+}
+
+// addConfigFlags registers the configuration flags on fs
+func addConfigFlags(fs *flag.FlagSet) *configFlags {
+	paths := &configPaths{paths: []string{"etc/config.yaml"}}
+	fs.Var(paths, "config", "Configuration file or directory; repeat or separate with commas to merge later files over earlier ones")
+	vars := make(configVars)
+	fs.Var(vars, "var", "Query variable as name=value, overriding the config's variables (repeatable)")
+	return &configFlags{
+		paths:       paths,
+		vars:        vars,
+		prometheus:  fs.String("prometheus", "", "Comma-separated list of Prometheus addresses (overrides config)"),
+		start:       fs.String("start", "", "Start time, RFC3339 or relative like now-24h or now-7d; overrides time_range.start in the config"),
+		end:         fs.String("end", "", "End time, RFC3339, now or relative like now-1h; overrides time_range.end in the config"),
+		step:        fs.String("step", "", "Step interval (overrides config)"),
+		incremental: fs.Bool("incremental", false, "Only fetch data newer than the last timestamp stored in the sink"),
+		noColor:     fs.Bool("no-color", false, "Disable colors in the table sink"),
+
+		maxConcurrencyPerInstance: fs.Int("max-concurrency-per-instance", 0, "Maximum in-flight queries per Prometheus instance (overrides config)"),
+	}
+}
+
+// load reads the configuration file and applies command-line overrides
+func (f *configFlags) load() (*config.Config, error) {
+	cfg, err := config.LoadWithVariables(f.vars, f.paths.paths...)
+	if err != nil {
+		return nil, err
+	}
+
+	err = cfg.ApplyOverrides(config.Overrides{
+		Prometheus:  *f.prometheus,
+		Start:       *f.start,
+		End:         *f.end,
+		Step:        *f.step,
+		Incremental: *f.incremental,
+		NoColor:     *f.noColor,
+
+		MaxConcurrencyPerInstance: *f.maxConcurrencyPerInstance,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// configPaths collects -config values. The first one given replaces the
+// default path, and each may hold several comma-separated paths.
+type configPaths struct {
+	paths []string
+	set   bool
+}
+
+func (p *configPaths) String() string {
+	if p == nil {
+		return ""
+	}
+	return strings.Join(p.paths, ",")
+}
+
+func (p *configPaths) Set(value string) error {
+	if !p.set {
+		p.paths, p.set = nil, true
+	}
+	for _, path := range strings.Split(value, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			p.paths = append(p.paths, path)
+		}
+	}
+	return nil
+}
+
+// configVars collects -var name=value flags
+type configVars map[string]string
+
+func (v configVars) String() string {
+	pairs := make([]string, 0, len(v))
+	for name, value := range v {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (v configVars) Set(value string) error {
+	name, val, ok := strings.Cut(value, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("expected name=value, got %q", value)
+	}
+	v[name] = val
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+)
+
+// runHealth is the state behind the /healthz and /readyz probes
+type runHealth struct {
+	mu   sync.Mutex
+	done bool  // The run has finished
+	err  error // Error the run finished with
+}
+
+// finish records the outcome of the run
+func (h *runHealth) finish(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.done, h.err = true, err
+}
+
+// register adds the probes to mux: /healthz answers while the process
+// serves, /readyz only once the run has succeeded
+func (h *runHealth) register(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		h.mu.Lock()
+		done, err := h.done, h.err
+		h.mu.Unlock()
+
+		switch {
+		case !done:
+			http.Error(w, "run in progress", http.StatusServiceUnavailable)
+		case err != nil:
+			http.Error(w, "run failed: "+err.Error(), http.StatusServiceUnavailable)
+		default:
+			w.Write([]byte("ok\n"))
+		}
+	})
+}
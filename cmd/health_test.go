@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHealthProbesFollowTheRun(t *testing.T) {
+	health := &runHealth{}
+	mux := http.NewServeMux()
+	health.register(mux)
+	probe := func(path string) (int, string) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Code, rec.Body.String()
+	}
+
+	tests := []struct {
+		name      string
+		finish    func()
+		readyCode int
+		readyBody string
+	}{
+		{"running", func() {}, http.StatusServiceUnavailable, "run in progress"},
+		{"failed", func() { health.finish(errors.New("sink pre-check failed")) }, http.StatusServiceUnavailable, "run failed: sink pre-check failed"},
+		{"succeeded", func() { health.finish(nil) }, http.StatusOK, "ok"},
+	}
+	for _, tt := range tests {
+		tt.finish()
+		if code, _ := probe("/healthz"); code != http.StatusOK {
+			t.Errorf("%s: /healthz status = %d, want 200 while the process serves", tt.name, code)
+		}
+		code, body := probe("/readyz")
+		if code != tt.readyCode || !strings.Contains(body, tt.readyBody) {
+			t.Errorf("%s: /readyz = %d %q, want %d %q", tt.name, code, body, tt.readyCode, tt.readyBody)
+		}
+	}
+}
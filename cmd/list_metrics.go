@@ -0,0 +1,119 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"github.com/meiking/tidb-metrics-crawler/pkg/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+// runListMetrics prints the metric names known to a Prometheus instance, to
+// help write the metrics section of a configuration
+func runListMetrics(args []string) error {
+	fs := flag.NewFlagSet("list-metrics", flag.ExitOnError)
+	cfgFlags := addConfigFlags(fs)
+	instance := fs.String("instance", "", "Name of the Prometheus instance to list (default: the first configured)")
+	prefix := fs.String("prefix", "", "Only list names starting with this prefix, e.g. tikv_")
+	match := fs.String("match", "", "Only list names matching this regular expression (unanchored)")
+	withMetadata := fs.Bool("metadata", false, "Also print each metric's type and help")
+	fs.Parse(args)
+
+	var re *regexp.Regexp
+	if *match != "" {
+		var err error
+		if re, err = regexp.Compile(*match); err != nil {
+			return fmt.Errorf("invalid -match: %v", err)
+		}
+	}
+
+	cfg, err := cfgFlags.load()
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %v", err)
+	}
+	instanceCfg, err := findInstance(cfg.PrometheusInstances, *instance)
+	if err != nil {
+		return err
+	}
+	client, err := prometheus.NewClient(instanceCfg)
+	if err != nil {
+		return fmt.Errorf("invalid Prometheus instance %s: %v", instanceCfg.Name, err)
+	}
+
+	return listMetrics(os.Stdout, client, *prefix, re, *withMetadata)
+}
+
+// listMetrics writes the client's metric names starting with prefix and
+// matching re, if set, one per line or as a table with their metadata
+func listMetrics(out io.Writer, client prometheus.Client, prefix string, re *regexp.Regexp, withMetadata bool) error {
+	values, err := client.LabelValues(model.MetricNameLabel)
+	if err != nil {
+		return fmt.Errorf("failed to list metric names: %v", err)
+	}
+	names := filterMetricNames(values, prefix, re)
+
+	if !withMetadata {
+		for _, name := range names {
+			fmt.Fprintln(out, name)
+		}
+		return nil
+	}
+
+	metadata, err := client.Metadata("")
+	if err != nil {
+		return fmt.Errorf("failed to fetch metric metadata: %v", err)
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tTYPE\tHELP")
+	for _, name := range names {
+		// Targets may disagree; the first entry is representative
+		var metricType, help string
+		if entries := metadata[name]; len(entries) > 0 {
+			metricType, help = string(entries[0].Type), entries[0].Help
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", name, metricType, help)
+	}
+	return w.Flush()
+}
+
+// findInstance returns the configured instance called name, or the first
+// one when name is empty
+func findInstance(instances []config.PrometheusConfig, name string) (config.PrometheusConfig, error) {
+	if len(instances) == 0 {
+		return config.PrometheusConfig{}, fmt.Errorf("no Prometheus instances configured")
+	}
+	if name == "" {
+		return instances[0], nil
+	}
+	for _, instance := range instances {
+		if instance.Name == name {
+			return instance, nil
+		}
+	}
+	return config.PrometheusConfig{}, fmt.Errorf("unknown Prometheus instance: %s", name)
+}
+
+// filterMetricNames returns the sorted names starting with prefix and
+// matching re, if set
+func filterMetricNames(values model.LabelValues, prefix string, re *regexp.Regexp) []string {
+	names := make([]string, 0, len(values))
+	for _, v := range values {
+		name := string(v)
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if re != nil && !re.MatchString(name) {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"github.com/meiking/tidb-metrics-crawler/pkg/prometheus"
+)
+
+// newFakeNamesAPI serves the metric names and metadata of a small cluster
+func newFakeNamesAPI(t *testing.T) prometheus.Client {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/label/__name__/values":
+			w.Write([]byte(`{"status":"success","data":["tikv_store_size_bytes","pd_cluster_status","tikv_engine_size_bytes","tidb_server_query_total","tikv_grpc_msg_duration_seconds_bucket"]}`))
+		case "/api/v1/metadata":
+			w.Write([]byte(`{"status":"success","data":{
+				"tikv_engine_size_bytes":[{"type":"gauge","help":"Sizes of each column families","unit":""}],
+				"tikv_store_size_bytes":[{"type":"gauge","help":"Size of storage.","unit":""},{"type":"counter","help":"Stale help","unit":""}]
+			}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := prometheus.NewClient(config.PrometheusConfig{Name: "prom", Address: server.URL})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	return client
+}
+
+func TestListMetricsFilters(t *testing.T) {
+	client := newFakeNamesAPI(t)
+	tests := []struct {
+		name   string
+		prefix string
+		match  string
+		want   []string
+	}{
+		{"all, sorted", "", "", []string{"pd_cluster_status", "tidb_server_query_total", "tikv_engine_size_bytes", "tikv_grpc_msg_duration_seconds_bucket", "tikv_store_size_bytes"}},
+		{"prefix", "tikv_", "", []string{"tikv_engine_size_bytes", "tikv_grpc_msg_duration_seconds_bucket", "tikv_store_size_bytes"}},
+		{"unanchored match", "", "size", []string{"tikv_engine_size_bytes", "tikv_store_size_bytes"}},
+		{"prefix and match", "tikv_", "_bucket$", []string{"tikv_grpc_msg_duration_seconds_bucket"}},
+		{"nothing matches", "tiflash_", "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var re *regexp.Regexp
+			if tt.match != "" {
+				re = regexp.MustCompile(tt.match)
+			}
+			var out bytes.Buffer
+			if err := listMetrics(&out, client, tt.prefix, re, false); err != nil {
+				t.Fatalf("listMetrics() error = %v", err)
+			}
+			got := strings.Fields(out.String())
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("listed %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListMetricsWithMetadata(t *testing.T) {
+	var out bytes.Buffer
+	if err := listMetrics(&out, newFakeNamesAPI(t), "tikv_", regexp.MustCompile("size"), true); err != nil {
+		t.Fatalf("listMetrics() error = %v", err)
+	}
+	want := "NAME                    TYPE   HELP\n" +
+		"tikv_engine_size_bytes  gauge  Sizes of each column families\n" +
+		"tikv_store_size_bytes   gauge  Size of storage.\n"
+	if out.String() != want {
+		t.Errorf("listMetrics() wrote\n%s\nwant\n%s", out.String(), want)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/logfile"
+)
+
+// runLog receives a copy of the log with -log-file; nil otherwise
+var runLog *logfile.File
+
+// setLogOutput sends the log to terminal and, with -log-file, to the run's
+// log file. Terminal decorations such as the progress line stay out of the file.
+func setLogOutput(terminal io.Writer) {
+	if runLog == nil {
+		log.SetOutput(terminal)
+		return
+	}
+	log.SetOutput(io.MultiWriter(terminal, runLog))
+}
+
+// openRunLog starts copying the log to a file named after path and the run's
+// start time, rotated every maxSizeMB MiB with maxBackups rotated files kept.
+// The returned function flushes and closes it.
+func openRunLog(path string, maxSizeMB, maxBackups int) (func(), error) {
+	f, err := logfile.Open(logfile.RunPath(path, time.Now()), int64(maxSizeMB)<<20, maxBackups)
+	if err != nil {
+		return nil, err
+	}
+	runLog = f
+	setLogOutput(os.Stderr)
+	log.Printf("Writing log to %s", f.Path())
+
+	return func() {
+		log.SetOutput(os.Stderr)
+		runLog = nil
+		if err := f.Close(); err != nil {
+			log.Printf("Failed to close log file: %v", err)
+		}
+	}, nil
+}
@@ -1,74 +1,123 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
-	"strings"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
-	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
 	"github.com/meiking/tidb-metrics-crawler/pkg/processor"
 	"github.com/meiking/tidb-metrics-crawler/pkg/prometheus"
 	"github.com/meiking/tidb-metrics-crawler/pkg/sink"
 )
 
 func main() {
+	// Dispatch subcommands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "dump-config":
+			if err := runDumpConfig(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "purge-run":
+			if err := runPurgeRun(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "list-metrics":
+			if err := runListMetrics(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "version", "-version", "--version":
+			runVersion()
+			return
+		}
+	}
+
 	// Parse command line flags
-	configPath := flag.String("config", "etc/config.yaml", "Path to configuration file")
-	promAddrs := flag.String("prometheus", "", "Comma-separated list of Prometheus addresses (overrides config)")
-	st := flag.String("start", "", "Start time in RFC3339 format (overrides config)")
-	et := flag.String("end", "", "End time in RFC3339 format (overrides config)")
-	step := flag.String("step", "", "Step interval (overrides config)")
+	opts := crawlFlags{config: addConfigFlags(flag.CommandLine)}
+	flag.StringVar(&opts.pprofAddr, "pprof-addr", "", "Address to serve net/http/pprof and the /healthz and /readyz probes on, e.g. localhost:6060 (disabled if empty)")
+	flag.BoolVar(&opts.failOnEmpty, "fail-on-empty", false, "Exit non-zero if any metric produced no data")
+	flag.BoolVar(&opts.showProgress, "progress", false, "Draw the run's progress on the terminal")
+	flag.BoolVar(&opts.plan, "plan", false, "Print the batches, steps and query counts of the run and exit without querying")
+	flag.StringVar(&opts.apiAddr, "api-addr", "", "Address to serve the latest rows as JSON on, e.g. localhost:8080; keeps serving after the run until interrupted (disabled if empty)")
+	flag.IntVar(&opts.apiRows, "api-rows", sink.DefaultSnapshotRows, "Rows of each metric kept in memory for -api-addr")
+	logFile := flag.String("log-file", "", "Also write the log to this file, with the run's start time added to its name, e.g. logs/crawler.log (disabled if empty)")
+	logMaxSize := flag.Int("log-max-size", 0, "Rotate the -log-file after this many MiB (0: never)")
+	logMaxBackups := flag.Int("log-max-backups", 5, "Rotated -log-file files kept (0: all)")
 	flag.Parse()
 
-	// Load and parse configuration
-	cfg, err := config.Load(*configPath)
+	closeLog := func() {}
+	if *logFile != "" {
+		var err error
+		if closeLog, err = openRunLog(*logFile, *logMaxSize, *logMaxBackups); err != nil {
+			log.Fatalf("Failed to open log file: %v", err)
+		}
+	}
+
+	// The run has closed its sink by the time it returns; the error still
+	// goes to the log file before it is closed
+	err := runCrawl(opts)
+	if err != nil {
+		log.Printf("Run failed: %v", err)
+	}
+	closeLog()
 	if err != nil {
-		log.Fatalf("Failed to load configuration: %v", err)
+		os.Exit(1)
 	}
+}
 
-	var startTime, endTime time.Time
+// crawlFlags holds the flags of a crawl, the command run without a subcommand
+type crawlFlags struct {
+	config       *configFlags
+	pprofAddr    string
+	failOnEmpty  bool
+	showProgress bool
+	plan         bool
+	apiAddr      string
+	apiRows      int
+}
 
-	// Parse time range
-	if *st != "" {
-		startTime, err = time.Parse(time.RFC3339, *st)
-		if err != nil {
-			log.Fatalf("Invalid start time format: %v", err)
-		}
-	} else {
-		startTime, err = time.Parse(time.RFC3339, cfg.TimeRange.Start)
-		if err != nil {
-			log.Fatalf("Invalid start time format: %v", err)
-		}
+// runCrawl fetches the configured metrics into the configured sink. The sink
+// is closed before runCrawl returns, whether the run succeeded or not, so
+// buffered rows, file trailers and uploads are not lost on failure.
+func runCrawl(opts crawlFlags) (err error) {
+	// Main context, cancelled on interrupt or when the run returns
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	// Readiness follows the outcome of the run, including closing the sink
+	health := &runHealth{}
+	defer func() { health.finish(err) }()
+	if opts.pprofAddr != "" {
+		startPprofServer(ctx, opts.pprofAddr, health)
 	}
 
-	if *et != "" {
-		endTime, err = time.Parse(time.RFC3339, *et)
-		if err != nil {
-			log.Fatalf("Invalid end time format: %v", err)
-		}
-	} else {
-		endTime, err = time.Parse(time.RFC3339, cfg.TimeRange.End)
-		if err != nil {
-			log.Fatalf("Invalid end time format: %v", err)
-		}
+	// Load and parse configuration
+	cfg, err := opts.config.load()
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %v", err)
 	}
 
-	if *step != "" {
-		cfg.TimeRange.Step = *step
+	// Parse time range; relative times share one "now"
+	now := time.Now()
+	startTime, err := common.ParseTime(cfg.TimeRange.Start, now)
+	if err != nil {
+		return fmt.Errorf("invalid start time format: %v", err)
 	}
 
-	if *promAddrs != "" {
-		// Override Prometheus addresses from command line
-		var instances []config.PrometheusConfig
-		for _, addr := range strings.Split(*promAddrs, ",") {
-			instances = append(instances, config.PrometheusConfig{
-				Name:    addr,
-				Address: addr,
-				Timeout: "30s",
-			})
-		}
-		cfg.PrometheusInstances = instances
+	endTime, err := common.ParseTime(cfg.TimeRange.End, now)
+	if err != nil {
+		return fmt.Errorf("invalid end time format: %v", err)
 	}
 
 	// Create Prometheus clients
@@ -83,26 +132,91 @@ func main() {
 	}
 
 	if len(clients) == 0 {
-		log.Fatal("No valid Prometheus instances configured")
+		return errors.New("no valid Prometheus instances configured")
+	}
+
+	if opts.plan {
+		if err := printPlan(cfg, len(clients), startTime, endTime); err != nil {
+			return fmt.Errorf("failed to plan run: %v", err)
+		}
+		return nil
+	}
+
+	if cfg.Processor.DetectBackend {
+		processor.CheckBackends(clients, cfg.Metrics, cfg.Processor.MetadataLookup)
+	}
+
+	// Sinks read metric metadata when created
+	if cfg.Processor.MetadataLookup {
+		cfg.AddMetricMeta(processor.LookupMetadata(clients, cfg.Metrics))
 	}
 
 	// Create output sink
-	outputSink, err := sink.NewSink(cfg.Sink)
+	var outputSink sink.Sink
+	if len(cfg.Sinks) > 0 {
+		outputSink, err = sink.NewFanoutSink(ctx, cfg.Sinks, cfg.SinkFanout)
+	} else {
+		outputSink, err = sink.NewSink(ctx, cfg.Sink)
+	}
 	if err != nil {
-		log.Fatalf("Failed to create output sink: %v", err)
+		return fmt.Errorf("failed to create output sink: %v", err)
+	}
+	var snapshots *sink.SnapshotSink
+	if opts.apiAddr != "" {
+		snapshots = sink.NewSnapshotSink(outputSink, opts.apiRows)
+		outputSink = snapshots
+		startAPIServer(ctx, opts.apiAddr, snapshots, health)
+	}
+	// The sink is closed exactly once, early with -api-addr and otherwise on
+	// the way out. A sink that fails to finish its output fails the run.
+	closeSink := sync.OnceValue(outputSink.Close)
+	defer func() {
+		if closeErr := closeSink(); closeErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to close output sink: %v", closeErr))
+		} else if err == nil {
+			log.Println("Metrics processing completed successfully")
+		}
+	}()
+
+	// Fail fast on unreachable sinks or bad credentials rather than after fetching
+	if err := sink.Ping(ctx, outputSink); err != nil {
+		return fmt.Errorf("sink pre-check failed: %v", err)
 	}
-	defer outputSink.Close()
 
 	// Create and run processor
-	dataProcessor := processor.NewProcessor(clients, outputSink)
-	if err := dataProcessor.ProcessMetrics(
+	dataProcessor := processor.NewProcessor(clients, outputSink, cfg.Processor)
+	stopProgress := func() {}
+	if opts.showProgress {
+		stopProgress = startProgress(ctx, dataProcessor)
+	}
+	err = dataProcessor.ProcessMetrics(
+		ctx,
 		cfg.Metrics,
 		startTime,
 		endTime,
 		cfg.TimeRange.Step,
-	); err != nil {
-		log.Fatalf("Error processing metrics: %v", err)
+	)
+	stopProgress()
+	summary := dataProcessor.Summary()
+	summary.Log()
+	sink.RecordRun(outputSink, summary.Report())
+	if snapshots != nil {
+		// Finish the sink's output before idling; the kept rows stay served
+		closeErr := closeSink()
+		if closeErr != nil {
+			log.Printf("Failed to close output sink: %v", closeErr)
+		}
+		health.finish(errors.Join(err, closeErr))
+		log.Printf("Run finished; serving its rows on http://%s/metrics until interrupted", opts.apiAddr)
+		<-ctx.Done()
+	}
+	if err != nil {
+		return fmt.Errorf("error processing metrics: %w", err)
+	}
+
+	if opts.failOnEmpty && len(summary.EmptyMetrics) > 0 {
+		return fmt.Errorf("metrics produced no data: %v", summary.EmptyMetrics)
 	}
 
-	log.Println("Metrics processing completed successfully")
+	return nil
 }
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"github.com/meiking/tidb-metrics-crawler/pkg/processor"
+)
+
+// printPlan prints what a run of cfg would do over start to end on
+// instances, without querying Prometheus or opening the sink
+func printPlan(cfg *config.Config, instances int, start, end time.Time) error {
+	p := processor.NewProcessor(nil, nil, cfg.Processor)
+	plans, err := p.Plan(cfg.Metrics, start, end, cfg.TimeRange.Step)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Time range: %s to %s (%v) on %d instance(s)\n\n",
+		start.Format(time.RFC3339), end.Format(time.RFC3339), end.Sub(start), instances)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "METRIC\tTYPE\tSTEP\tBATCHES\tQUERIES\tPOINTS/SERIES\tFIRST WINDOW\tLAST WINDOW")
+	total := 0
+	var warnings []string
+	for _, plan := range plans {
+		if plan.Skipped != "" {
+			fmt.Fprintf(w, "%s\t%s\tskipped: %s\t\t\t\t\t\n", plan.Metric, plan.Type, plan.Skipped)
+			continue
+		}
+
+		queries := plan.Queries * instances
+		if plan.Compared > 0 {
+			queries = plan.Queries * plan.Compared
+		}
+		total += queries
+		step, first, last := "-", "-", "-"
+		switch {
+		case plan.Instant:
+			step = "instant"
+			first = end.Format(time.RFC3339)
+			last = first
+		case len(plan.Batches) > 0:
+			step = plan.Step.String()
+			first = formatWindow(plan.Batches[0])
+			last = formatWindow(plan.Batches[len(plan.Batches)-1])
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%d\t%s\t%s\n",
+			plan.Metric, plan.Type, step, len(plan.Batches), queries, plan.Points, first, last)
+
+		if plan.TooManyPoints() {
+			warnings = append(warnings, fmt.Sprintf("%s: %d points per series per batch exceed Prometheus' limit of %d; use a larger step or a smaller batch_window", plan.Metric, plan.Points, processor.MaxPointsPerSeries))
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Printf("\nTotal: %d queries\n", total)
+	if cfg.Processor.Incremental {
+		fmt.Println("Incremental: instances resume after the data already stored, so these counts are upper bounds")
+	}
+	for _, warning := range warnings {
+		fmt.Printf("Warning: %s\n", warning)
+	}
+	return nil
+}
+
+// formatWindow renders a batch's time range
+func formatWindow(batch processor.BatchWindow) string {
+	return batch.Start.Format(time.RFC3339) + " - " + batch.End.Format(time.RFC3339)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/processor"
+)
+
+// progressInterval is how often the progress line is redrawn
+const progressInterval = 500 * time.Millisecond
+
+// progressLine keeps a one-line progress display at the bottom of a
+// terminal. Log output goes through it, so log lines are printed above the
+// progress line instead of being mixed into it.
+type progressLine struct {
+	mu   sync.Mutex
+	out  *os.File
+	line string
+}
+
+// Write clears the progress line, prints p and redraws the line below it
+func (l *progressLine) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	fmt.Fprint(l.out, "\r\033[K")
+	n, err := l.out.Write(p)
+	fmt.Fprint(l.out, l.line)
+	return n, err
+}
+
+// set replaces the progress line
+func (l *progressLine) set(line string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.line = line
+	fmt.Fprint(l.out, "\r\033[K", line)
+}
+
+// startProgress draws the run's progress on stderr until the returned stop
+// function is called. Without a terminal, progress is only logged per batch.
+func startProgress(ctx context.Context, p *processor.Processor) (stop func()) {
+	if info, err := os.Stderr.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		log.Printf("Not drawing -progress, stderr is not a terminal")
+		return func() {}
+	}
+
+	line := &progressLine{out: os.Stderr}
+	setLogOutput(line)
+
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				line.set(formatProgress(p.Progress()))
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-finished
+		line.set(formatProgress(p.Progress()))
+		fmt.Fprintln(os.Stderr)
+		setLogOutput(os.Stderr)
+	}
+}
+
+// formatProgress renders progress as the progress line
+func formatProgress(progress processor.Progress) string {
+	if progress.Metric == "" {
+		return "[  0.0%] starting"
+	}
+	return fmt.Sprintf("[%5.1f%%] %s on %s %.1f%%", progress.Run, progress.Metric, progress.Instance, progress.Percent)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"github.com/meiking/tidb-metrics-crawler/pkg/sink"
+)
+
+// runPurgeRun deletes the rows of one run from every configured MySQL sink
+func runPurgeRun(args []string) error {
+	fs := flag.NewFlagSet("purge-run", flag.ExitOnError)
+	cfgFlags := addConfigFlags(fs)
+	runID := fs.String("run-id", "", "ID of the run to delete, as logged at the start of the run")
+	dryRun := fs.Bool("dry-run", false, "Only count the rows that would be deleted")
+	fs.Parse(args)
+
+	if *runID == "" {
+		return fmt.Errorf("-run-id is required")
+	}
+
+	cfg, err := cfgFlags.load()
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %v", err)
+	}
+
+	sinks := cfg.Sinks
+	if len(sinks) == 0 {
+		sinks = []config.SinkConfig{cfg.Sink}
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	purged := 0
+	for _, s := range sinks {
+		if s.Type != "mysql" {
+			continue
+		}
+		purged++
+
+		table := s.MySQL.Table
+		rows, err := sink.PurgeMySQLRun(ctx, s.MySQL, *runID, *dryRun)
+		if err != nil {
+			return fmt.Errorf("failed to purge run from table %s: %v", table, err)
+		}
+		if *dryRun {
+			fmt.Printf("%s: %d rows would be deleted\n", table, rows)
+		} else {
+			fmt.Printf("%s: %d rows deleted\n", table, rows)
+		}
+	}
+
+	if purged == 0 {
+		return fmt.Errorf("no MySQL sink configured")
+	}
+	return nil
+}
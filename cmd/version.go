@@ -0,0 +1,12 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/version"
+)
+
+// runVersion prints the build version, commit, date and Go version
+func runVersion() {
+	fmt.Println(version.BuildInfo())
+}
@@ -0,0 +1,107 @@
+// Package backoff computes the delays between retries shared by the
+// Prometheus client and the retrying sink: exponential growth from a base,
+// capped at a maximum, with optional full jitter so clients that failed
+// together do not retry together.
+package backoff
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+// Backoff yields the delay before each retry. It is safe for concurrent use.
+type Backoff struct {
+	Base       time.Duration // Delay before the first retry, before jitter
+	Max        time.Duration // Upper bound of any delay
+	Multiplier float64       // Growth per retry, at least 1
+	Jitter     bool          // Pick each delay uniformly between 0 and the capped delay
+
+	rng *seededRand // Nil to use the shared source
+}
+
+// seededRand is a random source that may be shared by goroutines
+type seededRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+// NextDelay returns the delay before retry attempt, counting from 1
+func (b *Backoff) NextDelay(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	delay := float64(b.Base) * math.Pow(b.Multiplier, float64(attempt-1))
+	if b.Max > 0 && delay > float64(b.Max) {
+		delay = float64(b.Max)
+	}
+	if limit := math.Nextafter(math.MaxInt64, 0); delay > limit {
+		delay = limit // Would overflow a Duration without a max
+	}
+	if !b.Jitter {
+		return time.Duration(delay)
+	}
+	return time.Duration(delay * b.float64())
+}
+
+// Seed makes the jitter sequence reproducible. Call it before the first
+// NextDelay.
+func (b *Backoff) Seed(seed uint64) {
+	b.rng = &seededRand{r: rand.New(rand.NewPCG(seed, seed))}
+}
+
+// float64 returns a number in [0, 1)
+func (b *Backoff) float64() float64 {
+	if b.rng == nil {
+		return rand.Float64()
+	}
+	b.rng.mu.Lock()
+	defer b.rng.mu.Unlock()
+	return b.rng.r.Float64()
+}
+
+// FromConfig returns the backoff set in cfg, taking unset fields from
+// defaults. Jitter is on unless cfg turns it off.
+func FromConfig(cfg config.RetryConfig, defaults Backoff) (*Backoff, error) {
+	b := &Backoff{
+		Base:       defaults.Base,
+		Max:        defaults.Max,
+		Multiplier: defaults.Multiplier,
+		Jitter:     true,
+	}
+
+	if cfg.Backoff != "" {
+		var err error
+		if b.Base, err = common.ParseDuration(cfg.Backoff); err != nil {
+			return nil, fmt.Errorf("invalid retry backoff: %v", err)
+		}
+	}
+	if cfg.MaxBackoff != "" {
+		var err error
+		if b.Max, err = common.ParseDuration(cfg.MaxBackoff); err != nil {
+			return nil, fmt.Errorf("invalid retry max_backoff: %v", err)
+		}
+	}
+	if cfg.Multiplier != 0 {
+		b.Multiplier = cfg.Multiplier
+	}
+	if cfg.Jitter != nil {
+		b.Jitter = *cfg.Jitter
+	}
+
+	if b.Base <= 0 {
+		return nil, fmt.Errorf("retry backoff must be positive")
+	}
+	if b.Max < b.Base {
+		return nil, fmt.Errorf("retry max_backoff must not be below backoff")
+	}
+	if b.Multiplier < 1 {
+		return nil, fmt.Errorf("retry multiplier must be at least 1")
+	}
+	return b, nil
+}
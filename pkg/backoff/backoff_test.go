@@ -0,0 +1,121 @@
+package backoff
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+func TestNextDelaySequence(t *testing.T) {
+	b := &Backoff{Base: 100 * time.Millisecond, Max: time.Second, Multiplier: 2}
+	want := []time.Duration{100, 200, 400, 800, 1000, 1000}
+	for i, w := range want {
+		if got := b.NextDelay(i + 1); got != w*time.Millisecond {
+			t.Errorf("NextDelay(%d) = %v, want %v", i+1, got, w*time.Millisecond)
+		}
+	}
+	if got := b.NextDelay(0); got != b.Base {
+		t.Errorf("NextDelay(0) = %v, want the base delay", got)
+	}
+
+	// Growth without a cap saturates instead of overflowing
+	unbounded := &Backoff{Base: time.Second, Multiplier: 10}
+	if got := unbounded.NextDelay(100); got <= 0 {
+		t.Errorf("uncapped NextDelay(100) = %v, want a positive delay", got)
+	}
+	// A multiplier of 1 is a constant delay
+	constant := &Backoff{Base: time.Second, Max: time.Minute, Multiplier: 1}
+	if got := constant.NextDelay(10); got != time.Second {
+		t.Errorf("constant NextDelay(10) = %v, want 1s", got)
+	}
+}
+
+func TestNextDelayJitterDistribution(t *testing.T) {
+	b := &Backoff{Base: 100 * time.Millisecond, Max: time.Second, Multiplier: 2, Jitter: true}
+	b.Seed(42)
+
+	// Full jitter spreads each delay uniformly below the capped delay
+	const samples = 10000
+	for _, attempt := range []int{1, 3, 8} {
+		limit := (&Backoff{Base: b.Base, Max: b.Max, Multiplier: b.Multiplier}).NextDelay(attempt)
+		var sum float64
+		var buckets [10]int
+		for i := 0; i < samples; i++ {
+			d := b.NextDelay(attempt)
+			if d < 0 || d >= limit {
+				t.Fatalf("attempt %d: delay %v outside [0, %v)", attempt, d, limit)
+			}
+			sum += float64(d)
+			buckets[int(float64(d)/float64(limit)*10)]++
+		}
+		if mean := sum / samples / float64(limit); math.Abs(mean-0.5) > 0.02 {
+			t.Errorf("attempt %d: mean delay %.3f of the limit, want about 0.5", attempt, mean)
+		}
+		for i, n := range buckets {
+			if n < samples/10*8/10 || n > samples/10*12/10 {
+				t.Errorf("attempt %d: %d delays in tenth %d of the range, want about %d", attempt, n, i, samples/10)
+			}
+		}
+	}
+}
+
+func TestSeedReproducible(t *testing.T) {
+	sequence := func(seed uint64) []time.Duration {
+		b := &Backoff{Base: time.Second, Max: time.Minute, Multiplier: 2, Jitter: true}
+		b.Seed(seed)
+		var delays []time.Duration
+		for attempt := 1; attempt <= 5; attempt++ {
+			delays = append(delays, b.NextDelay(attempt))
+		}
+		return delays
+	}
+
+	first, again, other := sequence(7), sequence(7), sequence(8)
+	for i := range first {
+		if first[i] != again[i] {
+			t.Fatalf("seed 7 gave %v, then %v", first, again)
+		}
+	}
+	same := true
+	for i := range first {
+		same = same && first[i] == other[i]
+	}
+	if same {
+		t.Errorf("seeds 7 and 8 both gave %v", first)
+	}
+}
+
+func TestFromConfig(t *testing.T) {
+	defaults := Backoff{Base: time.Second, Max: 30 * time.Second, Multiplier: 2}
+	off := false
+
+	b, err := FromConfig(config.RetryConfig{}, defaults)
+	if err != nil {
+		t.Fatalf("FromConfig() error = %v", err)
+	}
+	if b.Base != time.Second || b.Max != 30*time.Second || b.Multiplier != 2 || !b.Jitter {
+		t.Errorf("FromConfig() without settings = %+v, want the defaults with jitter", b)
+	}
+
+	b, err = FromConfig(config.RetryConfig{Backoff: "200ms", MaxBackoff: "5s", Multiplier: 3, Jitter: &off}, defaults)
+	if err != nil {
+		t.Fatalf("FromConfig() error = %v", err)
+	}
+	if b.Base != 200*time.Millisecond || b.Max != 5*time.Second || b.Multiplier != 3 || b.Jitter {
+		t.Errorf("FromConfig() = %+v, want the configured settings", b)
+	}
+
+	for _, cfg := range []config.RetryConfig{
+		{Backoff: "soon"},
+		{MaxBackoff: "later"},
+		{Backoff: "0s"},
+		{Backoff: "1m", MaxBackoff: "1s"},
+		{Multiplier: 0.5},
+	} {
+		if _, err := FromConfig(cfg, defaults); err == nil {
+			t.Errorf("FromConfig(%+v) accepted invalid settings", cfg)
+		}
+	}
+}
@@ -10,4 +10,8 @@ type ProcessedData struct {
 	Timestamp          time.Time         `json:"timestamp"`
 	Value              float64           `json:"value"`
 	Labels             map[string]string `json:"labels"`
+	Job                string            `json:"job,omitempty"`        // processor.job of the crawl that produced the row
+	RunID              string            `json:"runId,omitempty"`      // Unique ID of the run that produced the row
+	Checksum           string            `json:"checksum,omitempty"`   // RowChecksum of the row when processor.row_checksum is set
+	SeriesName         string            `json:"seriesName,omitempty"` // __name__ of the series when the metric sets keep_metric_name
 }
@@ -1,7 +1,17 @@
 package common
 
 import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
 )
 
 // MapToJSONString converts a map[string]string to a JSON string
@@ -17,3 +27,110 @@ func MapToJSONString(m map[string]string) (string, error) {
 
 	return string(data), nil
 }
+
+// SortedLabelKeys returns the keys of a label map in ascending order.
+// Sinks use it so labels are ordered identically everywhere.
+func SortedLabelKeys(labels map[string]string) []string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// labelSeparator separates label names and values when hashing; it cannot
+// appear in valid UTF-8 label values
+const labelSeparator = "\xff"
+
+// LabelsHash returns a stable hex-encoded SHA-1 of a label map that does not
+// depend on map iteration order. An empty map hashes to the SHA-1 of "".
+func LabelsHash(labels map[string]string) string {
+	h := sha1.New()
+	for _, k := range SortedLabelKeys(labels) {
+		h.Write([]byte(k))
+		h.Write([]byte(labelSeparator))
+		h.Write([]byte(labels[k]))
+		h.Write([]byte(labelSeparator))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// SeriesHash returns the LabelsHash of a row's labels, including its series
+// name as __name__ when set, so series of different underlying metrics with
+// the same labels hash differently
+func SeriesHash(item ProcessedData) string {
+	if item.SeriesName == "" {
+		return LabelsHash(item.Labels)
+	}
+	labels := make(map[string]string, len(item.Labels)+1)
+	for k, v := range item.Labels {
+		labels[k] = v
+	}
+	labels["__name__"] = item.SeriesName
+	return LabelsHash(labels)
+}
+
+// RowChecksum returns a hex-encoded SHA-256 of a row's instance, metric
+// name, timestamp, value and labels, with the series name as in SeriesHash.
+// Job and run ID are left out, so the same point crawled twice has the same
+// checksum. The timestamp is hashed in UTC and the labels through LabelsHash,
+// so neither the time zone nor map order matter.
+func RowChecksum(item ProcessedData) string {
+	h := sha256.New()
+	for _, field := range []string{
+		item.PrometheusInstance,
+		item.MetricName,
+		item.Timestamp.UTC().Format(time.RFC3339Nano),
+		strconv.FormatFloat(item.Value, 'g', -1, 64),
+		SeriesHash(item),
+	} {
+		h.Write([]byte(field))
+		h.Write([]byte(labelSeparator))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ParseDuration parses a Go duration ("1h30m", "1.5h") or a Prometheus
+// duration using y, w, d, h, m, s and ms units ("1d", "2w", "90m")
+func ParseDuration(s string) (time.Duration, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return d, nil
+	}
+
+	d, err := model.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q: expected a Go or Prometheus duration such as 30s, 5m, 1h or 1d", s)
+	}
+
+	return time.Duration(d), nil
+}
+
+// ParseTime parses an RFC3339 time or an expression relative to now:
+// "now", "now-24h", "now-7d" or "now+1h"
+func ParseTime(s string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+
+	rest, ok := strings.CutPrefix(strings.TrimSpace(s), "now")
+	if !ok {
+		return time.Time{}, fmt.Errorf("invalid time %q: expected RFC3339 or now[+-]<duration> such as now-24h", s)
+	}
+	if rest == "" {
+		return now, nil
+	}
+
+	sign := rest[0]
+	if sign != '-' && sign != '+' {
+		return time.Time{}, fmt.Errorf("invalid time %q: expected now-<duration> or now+<duration>", s)
+	}
+	d, err := ParseDuration(rest[1:])
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q: %v", s, err)
+	}
+	if sign == '-' {
+		d = -d
+	}
+	return now.Add(d), nil
+}
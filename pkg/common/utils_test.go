@@ -0,0 +1,189 @@
+package common
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Duration
+	}{
+		{"1d", 24 * time.Hour},
+		{"2w", 14 * 24 * time.Hour},
+		{"90m", 90 * time.Minute},
+		{"1y", 365 * 24 * time.Hour},
+		{"500ms", 500 * time.Millisecond},
+		{"1d12h", 36 * time.Hour},
+		// Go durations keep working
+		{"1h30m", 90 * time.Minute},
+		{"1.5h", 90 * time.Minute},
+		{"30s", 30 * time.Second},
+	}
+	for _, tc := range tests {
+		got, err := ParseDuration(tc.in)
+		if err != nil {
+			t.Errorf("ParseDuration(%q) error = %v", tc.in, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("ParseDuration(%q) = %v, want %v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestParseDurationInvalid(t *testing.T) {
+	for _, in := range []string{"1x", "", "d", "1.5d", "-1d", "1h1d"} {
+		if got, err := ParseDuration(in); err == nil {
+			t.Errorf("ParseDuration(%q) = %v, want an error", in, got)
+		}
+	}
+}
+
+func TestSortedLabelKeys(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   []string
+	}{
+		{"nil", nil, []string{}},
+		{"single", map[string]string{"job": "tidb"}, []string{"job"}},
+		{"many", map[string]string{"type": "Select", "instance": "tidb-0", "job": "tidb", "db": "test", "le": "0.5"}, []string{"db", "instance", "job", "le", "type"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := SortedLabelKeys(tc.labels); !slices.Equal(got, tc.want) {
+				t.Errorf("SortedLabelKeys() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLabelsHash(t *testing.T) {
+	// SHA-1 of ""
+	const emptyHash = "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	if got := LabelsHash(nil); got != emptyHash {
+		t.Errorf("LabelsHash(nil) = %s, want %s", got, emptyHash)
+	}
+	if got := LabelsHash(map[string]string{}); got != emptyHash {
+		t.Errorf("LabelsHash({}) = %s, want %s", got, emptyHash)
+	}
+
+	single := LabelsHash(map[string]string{"job": "tidb"})
+	if single == emptyHash || len(single) != 40 {
+		t.Errorf("LabelsHash of one label = %s, want a distinct SHA-1", single)
+	}
+
+	// Maps built in different orders iterate differently; the hash does not change
+	keys := []string{"instance", "job", "type", "db", "le", "zone", "region"}
+	want := ""
+	for i := 0; i < 20; i++ {
+		labels := make(map[string]string)
+		for j := range keys {
+			k := keys[(i+j)%len(keys)]
+			labels[k] = "value-" + k
+		}
+		got := LabelsHash(labels)
+		if want == "" {
+			want = got
+		} else if got != want {
+			t.Fatalf("LabelsHash() = %s after inserting in another order, want %s", got, want)
+		}
+	}
+
+	// Names and values cannot run into each other
+	a := LabelsHash(map[string]string{"a": "bc"})
+	b := LabelsHash(map[string]string{"ab": "c"})
+	if a == b {
+		t.Errorf("LabelsHash({a: bc}) = LabelsHash({ab: c}) = %s, want them to differ", a)
+	}
+}
+
+func TestRowChecksum(t *testing.T) {
+	base := ProcessedData{
+		PrometheusInstance: "prom",
+		MetricName:         "qps",
+		Timestamp:          time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		Value:              1.5,
+		Labels:             map[string]string{"job": "tidb", "instance": "tidb-0"},
+	}
+
+	// Pinned, so a change to the hashed form is noticed: stored checksums
+	// would stop matching recrawled rows
+	const want = "f6b65e18aafb6643c043b0a1bc2fe08ecb94b10987f850891aec4ef2bbfa3712"
+	if got := RowChecksum(base); got != want {
+		t.Errorf("RowChecksum() = %s, want %s", got, want)
+	}
+
+	same := map[string]func(*ProcessedData){
+		"labels built in another order": func(d *ProcessedData) {
+			d.Labels = make(map[string]string)
+			d.Labels["instance"] = "tidb-0"
+			d.Labels["job"] = "tidb"
+		},
+		"another time zone": func(d *ProcessedData) { d.Timestamp = d.Timestamp.In(time.FixedZone("CST", 8*3600)) },
+		"another run":       func(d *ProcessedData) { d.Job, d.RunID = "nightly", "run-2" },
+	}
+	for name, change := range same {
+		row := base
+		change(&row)
+		if got := RowChecksum(row); got != want {
+			t.Errorf("%s: RowChecksum() = %s, want %s", name, got, want)
+		}
+	}
+
+	different := map[string]func(*ProcessedData){
+		"value":       func(d *ProcessedData) { d.Value = 1.25 },
+		"timestamp":   func(d *ProcessedData) { d.Timestamp = d.Timestamp.Add(time.Second) },
+		"instance":    func(d *ProcessedData) { d.PrometheusInstance = "prom-b" },
+		"metric":      func(d *ProcessedData) { d.MetricName = "tps" },
+		"label value": func(d *ProcessedData) { d.Labels = map[string]string{"job": "tidb", "instance": "tidb-1"} },
+		"extra label": func(d *ProcessedData) { d.Labels = map[string]string{"job": "tidb", "instance": "tidb-0", "zone": "a"} },
+		"series name": func(d *ProcessedData) { d.SeriesName = `qps{job="tidb"}` },
+	}
+	for name, change := range different {
+		row := base
+		change(&row)
+		if got := RowChecksum(row); got == want {
+			t.Errorf("changing the %s left the checksum unchanged", name)
+		}
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2024, 5, 1, 8, 30, 0, 0, time.UTC)
+	tests := []struct {
+		in   string
+		want time.Time
+	}{
+		{"now", now},
+		{" now ", now},
+		{"now-7d", now.Add(-7 * 24 * time.Hour)},
+		{"now-24h", now.Add(-24 * time.Hour)},
+		{"now-1h30m", now.Add(-90 * time.Minute)},
+		{"now+2w", now.Add(14 * 24 * time.Hour)},
+		{"2024-04-01T00:00:00Z", time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{"2024-04-01T08:00:00+08:00", time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tc := range tests {
+		got, err := ParseTime(tc.in, now)
+		if err != nil {
+			t.Errorf("ParseTime(%q) error = %v", tc.in, err)
+			continue
+		}
+		if !got.Equal(tc.want) {
+			t.Errorf("ParseTime(%q) = %v, want %v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestParseTimeInvalid(t *testing.T) {
+	now := time.Date(2024, 5, 1, 8, 30, 0, 0, time.UTC)
+	for _, in := range []string{"", "yesterday", "now-", "now7d", "now*7d", "now-7x", "now--7d", "2024-04-01", "nowish"} {
+		if got, err := ParseTime(in, now); err == nil {
+			t.Errorf("ParseTime(%q) = %v, want an error", in, got)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package config
+
+import "testing"
+
+func TestMetricMetaPropagated(t *testing.T) {
+	cfg, err := loadYAML(t, `
+metrics:
+  - name: qps
+    query: sum(rate(tidb_server_query_total[1m]))
+    unit: ops
+  - name: uptime
+    query: time() - process_start_time_seconds
+sinks:
+  - type: csv
+    csv:
+      metadata_header: true
+  - type: mysql
+    mysql:
+      meta_table: metrics_meta
+`)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	want := map[string]MetricMeta{
+		"qps":    {Query: "sum(rate(tidb_server_query_total[1m]))", Unit: "ops"},
+		"uptime": {Query: "time() - process_start_time_seconds"},
+	}
+	for name, meta := range want {
+		if got := cfg.Sinks[0].CSV.Meta[name]; got != meta {
+			t.Errorf("CSV meta of %s = %+v, want %+v", name, got, meta)
+		}
+		if got := cfg.Sinks[1].MySQL.Meta[name]; got != meta {
+			t.Errorf("MySQL meta of %s = %+v, want %+v", name, got, meta)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package config
+
+import "strings"
+
+const (
+	defaultPrometheusTimeout = "30s"
+	defaultMySQLTable        = "prometheus_metrics"
+	defaultMySQLBatchSize    = 1000
+
+	// defaultMySQLMaxOpenConns is the default size of the MySQL connection pool
+	defaultMySQLMaxOpenConns = 10
+	// defaultMySQLMaxIdleConns is the default number of idle MySQL connections kept open
+	defaultMySQLMaxIdleConns = 5
+	// defaultMySQLConnMaxLifetime is the default maximum lifetime of a MySQL connection,
+	// kept below typical server wait_timeout values
+	defaultMySQLConnMaxLifetime = "3m"
+	// defaultMySQLInsertTimeout bounds a single batch insert
+	defaultMySQLInsertTimeout = "30s"
+)
+
+// applyDefaults fills in unset values so the loaded config reflects what will be used
+func (c *Config) applyDefaults() {
+	for i := range c.PrometheusInstances {
+		if c.PrometheusInstances[i].Timeout == "" {
+			c.PrometheusInstances[i].Timeout = defaultPrometheusTimeout
+		}
+	}
+
+	for _, s := range c.allSinks() {
+		// Sink types are matched case-insensitively; lower case is canonical
+		s.Type = strings.ToLower(strings.TrimSpace(s.Type))
+		s.MySQL = s.MySQL.WithDefaults()
+	}
+}
+
+// WithDefaults returns the settings with unset values filled in. Load
+// applies it to every MySQL sink; the sink applies it again so settings
+// built in code get the same defaults.
+func (m MySQLConfig) WithDefaults() MySQLConfig {
+	if m.Table == "" {
+		m.Table = defaultMySQLTable
+	}
+
+	if m.BatchSize <= 0 {
+		m.BatchSize = defaultMySQLBatchSize
+	}
+
+	if m.MaxOpenConns <= 0 {
+		m.MaxOpenConns = defaultMySQLMaxOpenConns
+	}
+
+	if m.MaxIdleConns <= 0 {
+		m.MaxIdleConns = defaultMySQLMaxIdleConns
+	}
+
+	if m.ConnMaxLifetime == "" {
+		m.ConnMaxLifetime = defaultMySQLConnMaxLifetime
+	}
+
+	if m.InsertTimeout == "" {
+		m.InsertTimeout = defaultMySQLInsertTimeout
+	}
+	return m
+}
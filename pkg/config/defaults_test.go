@@ -0,0 +1,32 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMySQLDefaults(t *testing.T) {
+	cfg, err := loadYAML(t, `
+sinks:
+  - type: mysql
+  - type: mysql
+    mysql:
+      table: custom
+      max_open_conns: 20
+`)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	got := cfg.Sinks[0].MySQL
+	if got.Table != "prometheus_metrics" || got.BatchSize != 1000 || got.MaxOpenConns != 10 ||
+		got.MaxIdleConns != 5 || got.ConnMaxLifetime != "3m" || got.InsertTimeout != "30s" {
+		t.Errorf("defaults = %+v", got)
+	}
+	if got := cfg.Sinks[1].MySQL; got.Table != "custom" || got.MaxOpenConns != 20 || got.MaxIdleConns != 5 {
+		t.Errorf("configured values were not kept: %+v", got)
+	}
+	if again := got.WithDefaults(); !reflect.DeepEqual(again, got) {
+		t.Errorf("WithDefaults() changed defaulted settings: %+v", again)
+	}
+}
@@ -0,0 +1,149 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// mergeKey identifies the items of a list that overlays merge into rather
+// than replace, such as prometheus_instances and metrics
+const mergeKey = "name"
+
+// expandConfigPaths replaces each directory in paths by the .yaml and .yml
+// files directly inside it, in name order
+func expandConfigPaths(paths []string) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		var inDir []string
+		for _, entry := range entries {
+			ext := filepath.Ext(entry.Name())
+			if !entry.IsDir() && (ext == ".yaml" || ext == ".yml") {
+				inDir = append(inDir, filepath.Join(path, entry.Name()))
+			}
+		}
+		if len(inDir) == 0 {
+			return nil, fmt.Errorf("no .yaml or .yml files in %s", path)
+		}
+		sort.Strings(inDir)
+		files = append(files, inDir...)
+	}
+	return files, nil
+}
+
+// readMerged parses files in order and merges each into the ones before it
+func readMerged(files []string) (*yaml.Node, error) {
+	var merged *yaml.Node
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var doc yaml.Node
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		if len(doc.Content) == 0 {
+			continue // Empty file
+		}
+		root := doc.Content[0]
+		if root.Kind != yaml.MappingNode {
+			return nil, fmt.Errorf("%s: top level must be a mapping", file)
+		}
+
+		if merged == nil {
+			merged = root
+		} else {
+			merged = mergeNodes(merged, root)
+		}
+	}
+	return merged, nil
+}
+
+// mergeNodes merges overlay into base. Mappings merge key by key, lists of
+// mappings that all have a name merge item by item (new names are appended),
+// and anything else in overlay replaces base.
+func mergeNodes(base, overlay *yaml.Node) *yaml.Node {
+	switch {
+	case base.Kind == yaml.MappingNode && overlay.Kind == yaml.MappingNode:
+		for i := 0; i+1 < len(overlay.Content); i += 2 {
+			key, value := overlay.Content[i], overlay.Content[i+1]
+			if j := mappingIndex(base, key.Value); j >= 0 {
+				base.Content[j+1] = mergeNodes(base.Content[j+1], value)
+			} else {
+				base.Content = append(base.Content, key, value)
+			}
+		}
+		return base
+	case base.Kind == yaml.SequenceNode && overlay.Kind == yaml.SequenceNode && keyedList(base) && keyedList(overlay):
+		for _, item := range overlay.Content {
+			name := mappingValue(item, mergeKey).Value
+			merged := false
+			for k, existing := range base.Content {
+				if mappingValue(existing, mergeKey).Value == name {
+					base.Content[k] = mergeNodes(existing, item)
+					merged = true
+					break
+				}
+			}
+			if !merged {
+				base.Content = append(base.Content, item)
+			}
+		}
+		return base
+	default:
+		return overlay
+	}
+}
+
+// keyedList reports whether every item of a list is a mapping with a scalar
+// name, so overlays can address items by it
+func keyedList(list *yaml.Node) bool {
+	if len(list.Content) == 0 {
+		return false
+	}
+	for _, item := range list.Content {
+		value := mappingValue(item, mergeKey)
+		if value == nil || value.Kind != yaml.ScalarNode {
+			return false
+		}
+	}
+	return true
+}
+
+// mappingIndex returns the index of key in a mapping node's content, or -1
+func mappingIndex(node *yaml.Node, key string) int {
+	if node.Kind != yaml.MappingNode {
+		return -1
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// mappingValue returns the value of key in a mapping node, or nil
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if i := mappingIndex(node, key); i >= 0 {
+		return node.Content[i+1]
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package config
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+const baseConfig = `
+prometheus_instances:
+  - name: prod-a
+    address: http://prom-a:9090
+  - name: prod-b
+    address: http://prom-b:9090
+    timeout: 1m
+metrics:
+  - name: qps
+    query: sum(rate(tidb_server_query_total[1m]))
+    label_keys: [instance, type]
+processor:
+  batch_window: 1h
+  metric_workers: 4
+`
+
+const overlayConfig = `
+prometheus_instances:
+  - name: prod-b
+    address: http://prom-b.staging:9090
+metrics:
+  - name: qps
+    label_keys: [instance]
+  - name: tps
+    query: sum(rate(tidb_session_transaction_duration_seconds_count[1m]))
+processor:
+  batch_window: 6h
+`
+
+// checkMerged verifies the merge of overlayConfig over baseConfig
+func checkMerged(t *testing.T, cfg *Config) {
+	t.Helper()
+	instances := cfg.PrometheusInstances
+	if len(instances) != 2 || instances[0].Name != "prod-a" || instances[1].Name != "prod-b" {
+		t.Fatalf("instances = %+v, want prod-a and prod-b in base order", instances)
+	}
+	if instances[0].Address != "http://prom-a:9090" {
+		t.Errorf("prod-a address = %s, want the base address kept", instances[0].Address)
+	}
+	if instances[1].Address != "http://prom-b.staging:9090" || instances[1].Timeout != "1m" {
+		t.Errorf("prod-b = %s with timeout %s, want the overlay address and the base timeout", instances[1].Address, instances[1].Timeout)
+	}
+
+	metrics := cfg.Metrics
+	if len(metrics) != 2 || metrics[0].Name != "qps" || metrics[1].Name != "tps" {
+		t.Fatalf("metrics = %+v, want qps then the added tps", metrics)
+	}
+	// Lists of scalars are replaced, not appended to
+	if metrics[0].Query != "sum(rate(tidb_server_query_total[1m]))" || !slices.Equal(metrics[0].LabelKeys, []string{"instance"}) {
+		t.Errorf("qps = %+v, want the base query with the overlay label_keys", metrics[0])
+	}
+	if metrics[1].Query != "sum(rate(tidb_session_transaction_duration_seconds_count[1m]))" {
+		t.Errorf("tps query = %s, want the overlay query", metrics[1].Query)
+	}
+
+	if cfg.Processor.BatchWindow != "6h" || cfg.Processor.MetricWorkers != 4 {
+		t.Errorf("processor = %+v, want the overlay batch_window and the base metric_workers", cfg.Processor)
+	}
+}
+
+func TestLoadMergesOverlay(t *testing.T) {
+	dir := t.TempDir()
+	base := writeFile(t, dir, "base.yaml", baseConfig)
+	overlay := writeFile(t, dir, "staging.yaml", overlayConfig)
+
+	cfg, err := Load(base, overlay)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	checkMerged(t, cfg)
+}
+
+func TestLoadMergesDirectoryInNameOrder(t *testing.T) {
+	dir := t.TempDir()
+	// Read in name order, not creation order; other files are ignored
+	writeFile(t, dir, "20-staging.yml", overlayConfig)
+	writeFile(t, dir, "10-base.yaml", baseConfig)
+	writeFile(t, dir, "README.md", "not: [valid")
+
+	cfg, err := Load(dir)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	checkMerged(t, cfg)
+}
+
+func TestLoadMergeErrors(t *testing.T) {
+	dir := t.TempDir()
+	base := writeFile(t, dir, "base.yaml", baseConfig)
+	tests := []struct {
+		name  string
+		paths []string
+	}{
+		{"missing file", []string{base, filepath.Join(dir, "missing.yaml")}},
+		{"not a mapping", []string{base, writeFile(t, dir, "list.yaml", "- name: prod-a\n")}},
+		{"directory without configs", []string{t.TempDir()}},
+	}
+	for _, tt := range tests {
+		if _, err := Load(tt.paths...); err == nil {
+			t.Errorf("%s: Load() succeeded", tt.name)
+		}
+	}
+}
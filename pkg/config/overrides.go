@@ -0,0 +1,63 @@
+package config
+
+import "strings"
+
+// Overrides contains command-line values that take precedence over the config file
+type Overrides struct {
+	Prometheus  string // Comma-separated Prometheus addresses
+	Start       string // Start time, RFC3339 or relative to now
+	End         string // End time, RFC3339 or relative to now
+	Step        string // Step interval
+	Incremental bool   // Enable incremental mode
+	NoColor     bool   // Disable colors in the table sink
+
+	MaxConcurrencyPerInstance int // In-flight queries allowed per Prometheus instance
+}
+
+// ApplyOverrides replaces config values with any non-empty overrides and
+// validates the result again, as Load validated the file's values only
+func (c *Config) ApplyOverrides(o Overrides) error {
+	if o.Start != "" {
+		c.TimeRange.Start = o.Start
+	}
+
+	if o.End != "" {
+		c.TimeRange.End = o.End
+	}
+
+	if o.Step != "" {
+		c.TimeRange.Step = o.Step
+	}
+
+	if o.Incremental {
+		c.Processor.Incremental = true
+	}
+
+	if o.NoColor {
+		for _, s := range c.allSinks() {
+			s.Table.Color = "never"
+		}
+	}
+
+	if o.Prometheus != "" {
+		// Override Prometheus addresses from command line
+		var instances []PrometheusConfig
+		for _, addr := range strings.Split(o.Prometheus, ",") {
+			instances = append(instances, PrometheusConfig{
+				Name:    addr,
+				Address: addr,
+				Timeout: defaultPrometheusTimeout,
+			})
+		}
+		c.PrometheusInstances = instances
+	}
+
+	// Applied last so it also covers instances given with -prometheus
+	if o.MaxConcurrencyPerInstance > 0 {
+		for i := range c.PrometheusInstances {
+			c.PrometheusInstances[i].MaxConcurrency = o.MaxConcurrencyPerInstance
+		}
+	}
+
+	return c.validate()
+}
@@ -0,0 +1,84 @@
+package config
+
+import "testing"
+
+const overridesYAML = `
+prometheus_instances:
+  - name: prom
+    address: http://prom:9090
+    timeout: 1m
+time_range:
+  start: "2024-01-01T00:00:00Z"
+  end: "2024-01-02T00:00:00Z"
+  step: 1m
+`
+
+func TestApplyOverrides(t *testing.T) {
+	// No overrides keep the file's values
+	cfg, err := loadYAML(t, overridesYAML)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if err := cfg.ApplyOverrides(Overrides{}); err != nil {
+		t.Fatalf("ApplyOverrides() error = %v", err)
+	}
+	if cfg.TimeRange != (TimeRangeConfig{Start: "2024-01-01T00:00:00Z", End: "2024-01-02T00:00:00Z", Step: "1m"}) || cfg.PrometheusInstances[0].Address != "http://prom:9090" {
+		t.Errorf("without overrides got %+v and %+v, want the file's values", cfg.TimeRange, cfg.PrometheusInstances)
+	}
+
+	// Command-line values beat the file's
+	cfg, err = loadYAML(t, overridesYAML)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	err = cfg.ApplyOverrides(Overrides{
+		Prometheus:                "http://a:9090,http://b:9090",
+		Start:                     "now-24h",
+		End:                       "now",
+		Step:                      "30s",
+		MaxConcurrencyPerInstance: 4,
+	})
+	if err != nil {
+		t.Fatalf("ApplyOverrides() error = %v", err)
+	}
+	if cfg.TimeRange != (TimeRangeConfig{Start: "now-24h", End: "now", Step: "30s"}) {
+		t.Errorf("time range = %+v, want the overrides", cfg.TimeRange)
+	}
+	if len(cfg.PrometheusInstances) != 2 {
+		t.Fatalf("instances = %+v, want the two overriding addresses", cfg.PrometheusInstances)
+	}
+	for i, addr := range []string{"http://a:9090", "http://b:9090"} {
+		got := cfg.PrometheusInstances[i]
+		if got.Name != addr || got.Address != addr || got.Timeout != defaultPrometheusTimeout || got.MaxConcurrency != 4 {
+			t.Errorf("instance %d = %+v, want %s named after its address with the default timeout and max concurrency 4", i, got, addr)
+		}
+	}
+}
+
+func TestApplyOverridesValidates(t *testing.T) {
+	tests := []struct {
+		name      string
+		overrides Overrides
+	}{
+		{"step", Overrides{Step: "fast"}},
+		{"negative step", Overrides{Step: "-1m"}},
+		{"start", Overrides{Start: "yesterday"}},
+		{"end", Overrides{End: "now*2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := loadYAML(t, overridesYAML)
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			if err := cfg.ApplyOverrides(tt.overrides); err == nil {
+				t.Errorf("ApplyOverrides(%+v) accepted an invalid value", tt.overrides)
+			}
+		})
+	}
+
+	// The file's values are checked the same way
+	if _, err := loadYAML(t, "time_range:\n  step: fast\n"); err == nil {
+		t.Error("Load() accepted an invalid step")
+	}
+}
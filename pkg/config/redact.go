@@ -0,0 +1,179 @@
+package config
+
+import (
+	"net/url"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// redactedValue replaces secrets in logs and config dumps
+const redactedValue = "****"
+
+// Redact returns a copy of the configuration with all secrets masked,
+// suitable for logging or dumping
+func (c Config) Redact() Config {
+	redacted := c
+
+	redacted.PrometheusInstances = make([]PrometheusConfig, len(c.PrometheusInstances))
+	for i, instance := range c.PrometheusInstances {
+		instance.Address = redactURL(instance.Address)
+		instance.Password = redactSecret(instance.Password)
+		if instance.OAuth2 != nil {
+			oauth2 := *instance.OAuth2
+			oauth2.ClientSecret = redactSecret(oauth2.ClientSecret)
+			instance.OAuth2 = &oauth2
+		}
+		redacted.PrometheusInstances[i] = instance
+	}
+
+	redacted.Sinks = append([]SinkConfig(nil), c.Sinks...)
+	for _, s := range redacted.allSinks() {
+		s.Feishu.AppSecret = redactSecret(s.Feishu.AppSecret)
+		s.MySQL.DSN = RedactDSN(s.MySQL.DSN)
+		s.Redis.Password = redactSecret(s.Redis.Password)
+		s.MongoDB.URI = redactURL(s.MongoDB.URI)
+		s.DingTalk.Webhook = redactURLQuery(s.DingTalk.Webhook)
+		s.DingTalk.Secret = redactSecret(s.DingTalk.Secret)
+		s.WeCom.Webhook = redactURLQuery(s.WeCom.Webhook)
+		s.Slack.BotToken = redactSecret(s.Slack.BotToken)
+		s.Discord.Webhook = redactURLPath(s.Discord.Webhook)
+		s.Email.Password = redactSecret(s.Email.Password)
+		s.Elasticsearch.Password = redactSecret(s.Elasticsearch.Password)
+		s.Elasticsearch.APIKey = redactSecret(s.Elasticsearch.APIKey)
+		s.OTLP.Headers = redactHeaders(s.OTLP.Headers)
+		s.GRPC.Metadata = redactHeaders(s.GRPC.Metadata)
+		s.VMImport.Password = redactSecret(s.VMImport.Password)
+		s.VMImport.BearerToken = redactSecret(s.VMImport.BearerToken)
+		s.Options = redactOptions(s.Options)
+	}
+
+	return redacted
+}
+
+// RedactDSN masks the password in a MySQL DSN, turning
+// user:pass@tcp(host:3306)/db into user:****@tcp(host:3306)/db
+func RedactDSN(dsn string) string {
+	// Same parsing order as go-sql-driver/mysql: the password may contain
+	// '/' or '@', so split on the last '/' and then the last '@' before it
+	slash := strings.LastIndex(dsn, "/")
+	if slash < 0 {
+		return dsn
+	}
+
+	at := strings.LastIndex(dsn[:slash], "@")
+	if at < 0 {
+		return dsn
+	}
+
+	colon := strings.Index(dsn[:at], ":")
+	if colon < 0 {
+		return dsn
+	}
+
+	return dsn[:colon+1] + redactedValue + dsn[at:]
+}
+
+// redactURL masks a password embedded in a URL's userinfo
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil {
+		return rawURL
+	}
+	if _, hasPassword := u.User.Password(); !hasPassword {
+		return rawURL
+	}
+	u.User = url.UserPassword(u.User.Username(), redactedValue)
+	return u.String()
+}
+
+// redactURLQuery masks every query parameter of a URL, such as the
+// access token of a robot webhook
+func redactURLQuery(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.RawQuery == "" {
+		return rawURL
+	}
+	params := strings.Split(u.RawQuery, "&")
+	for i, param := range params {
+		if key, _, found := strings.Cut(param, "="); found {
+			params[i] = key + "=" + redactedValue
+		}
+	}
+	u.RawQuery = strings.Join(params, "&")
+	return u.String()
+}
+
+// redactURLPath masks the last path segment of a URL, such as the token of
+// a Discord webhook
+func redactURLPath(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	path := u.EscapedPath()
+	i := strings.LastIndex(path, "/")
+	if i < 0 || i == len(path)-1 {
+		return rawURL
+	}
+	return strings.Replace(rawURL, path, path[:i+1]+redactedValue, 1)
+}
+
+// redactHeaders masks every header value, which may carry credentials
+func redactHeaders(headers map[string]string) map[string]string {
+	if headers == nil {
+		return nil
+	}
+	redacted := make(map[string]string, len(headers))
+	for name, value := range headers {
+		redacted[name] = redactSecret(value)
+	}
+	return redacted
+}
+
+// redactSecret masks a non-empty secret
+func redactSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redactedValue
+}
+
+// secretOptionWords mark option keys whose values are masked
+var secretOptionWords = []string{"password", "secret", "token", "key", "credential"}
+
+// redactOptions returns a copy of a custom sink's options with the values of
+// secret-looking keys masked, at any depth
+func redactOptions(node yaml.Node) yaml.Node {
+	redacted := node
+	if len(node.Content) == 0 {
+		return redacted
+	}
+
+	redacted.Content = make([]*yaml.Node, len(node.Content))
+	for i, child := range node.Content {
+		c := redactOptions(*child)
+		redacted.Content[i] = &c
+	}
+
+	if node.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(redacted.Content); i += 2 {
+			key, value := redacted.Content[i], redacted.Content[i+1]
+			if value.Kind == yaml.ScalarNode && isSecretOption(key.Value) {
+				value.Value = redactSecret(value.Value)
+			}
+		}
+	}
+	return redacted
+}
+
+// isSecretOption reports whether an option key looks like it holds a secret
+func isSecretOption(key string) bool {
+	key = strings.ToLower(key)
+	for _, word := range secretOptionWords {
+		if strings.Contains(key, word) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// resolveSecrets fills secret fields from their *_file companions
+func (c *Config) resolveSecrets() error {
+	for i := range c.PrometheusInstances {
+		instance := &c.PrometheusInstances[i]
+		if err := readSecretFile(&instance.Password, instance.PasswordFile, "prometheus_instances["+instance.Name+"].password"); err != nil {
+			return err
+		}
+		if instance.OAuth2 != nil {
+			if err := readSecretFile(&instance.OAuth2.ClientSecret, instance.OAuth2.ClientSecretFile, "prometheus_instances["+instance.Name+"].oauth2.client_secret"); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, s := range c.allSinks() {
+		if err := readSecretFile(&s.Feishu.AppSecret, s.Feishu.AppSecretFile, "sink.feishu.app_secret"); err != nil {
+			return err
+		}
+
+		if err := readSecretFile(&s.MySQL.DSN, s.MySQL.DSNFile, "sink.mysql.dsn"); err != nil {
+			return err
+		}
+
+		if err := readSecretFile(&s.DingTalk.Secret, s.DingTalk.SecretFile, "sink.dingtalk.secret"); err != nil {
+			return err
+		}
+
+		if err := readSecretFile(&s.Slack.BotToken, s.Slack.BotTokenFile, "sink.slack.bot_token"); err != nil {
+			return err
+		}
+
+		if err := readSecretFile(&s.Discord.Webhook, s.Discord.WebhookFile, "sink.discord.webhook"); err != nil {
+			return err
+		}
+
+		if err := readSecretFile(&s.Email.Password, s.Email.PasswordFile, "sink.email.password"); err != nil {
+			return err
+		}
+
+		if err := readSecretFile(&s.Elasticsearch.Password, s.Elasticsearch.PasswordFile, "sink.elasticsearch.password"); err != nil {
+			return err
+		}
+
+		if err := readSecretFile(&s.Elasticsearch.APIKey, s.Elasticsearch.APIKeyFile, "sink.elasticsearch.api_key"); err != nil {
+			return err
+		}
+
+		if err := readSecretFile(&s.Redis.Password, s.Redis.PasswordFile, "sink.redis.password"); err != nil {
+			return err
+		}
+
+		if err := readSecretFile(&s.MongoDB.URI, s.MongoDB.URIFile, "sink.mongodb.uri"); err != nil {
+			return err
+		}
+
+		if err := readSecretFile(&s.VMImport.Password, s.VMImport.PasswordFile, "sink.vm_import.password"); err != nil {
+			return err
+		}
+
+		if err := readSecretFile(&s.VMImport.BearerToken, s.VMImport.BearerTokenFile, "sink.vm_import.bearer_token"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readSecretFile reads a secret from path into value, trimming trailing whitespace.
+// It is an error to set both the inline value and the file.
+func readSecretFile(value *string, path, field string) error {
+	if path == "" {
+		return nil
+	}
+
+	if *value != "" {
+		return fmt.Errorf("%s and %s_file are mutually exclusive", field, field)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s_file: %v", field, err)
+	}
+
+	*value = strings.TrimRight(string(data), " \t\r\n")
+	return nil
+}
@@ -0,0 +1,110 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeFile writes content to name in dir and returns its path
+func writeFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// loadYAML loads a configuration from a single file holding content
+func loadYAML(t *testing.T, content string) (*Config, error) {
+	t.Helper()
+	return Load(writeFile(t, t.TempDir(), "config.yaml", content))
+}
+
+func TestSecretFiles(t *testing.T) {
+	dir := t.TempDir()
+	password := writeFile(t, dir, "password", "s3cret\n")
+	appSecret := writeFile(t, dir, "app_secret", "feishu-secret \r\n")
+	dsn := writeFile(t, dir, "dsn", "user:pw@tcp(db:4000)/metrics\n\n")
+
+	cfg, err := loadYAML(t, `
+prometheus_instances:
+  - name: prom
+    address: http://prom:9090
+    username: admin
+    password_file: `+password+`
+sink:
+  type: mysql
+  feishu:
+    app_secret_file: `+appSecret+`
+  mysql:
+    dsn_file: `+dsn+`
+`)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if got := cfg.PrometheusInstances[0].Password; got != "s3cret" {
+		t.Errorf("password = %q, want %q", got, "s3cret")
+	}
+	if got := cfg.Sink.Feishu.AppSecret; got != "feishu-secret" {
+		t.Errorf("app_secret = %q, want %q", got, "feishu-secret")
+	}
+	if got := cfg.Sink.MySQL.DSN; got != "user:pw@tcp(db:4000)/metrics" {
+		t.Errorf("dsn = %q", got)
+	}
+}
+
+func TestSecretInlineStillWorks(t *testing.T) {
+	cfg, err := loadYAML(t, `
+prometheus_instances:
+  - name: prom
+    address: http://prom:9090
+    password: inline
+`)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if got := cfg.PrometheusInstances[0].Password; got != "inline" {
+		t.Errorf("password = %q, want %q", got, "inline")
+	}
+}
+
+func TestSecretFileErrors(t *testing.T) {
+	dir := t.TempDir()
+	password := writeFile(t, dir, "password", "s3cret")
+
+	tests := []struct {
+		name    string
+		yaml    string
+		wantErr string
+	}{
+		{
+			name: "inline and file",
+			yaml: `
+prometheus_instances:
+  - name: prom
+    address: http://prom:9090
+    password: inline
+    password_file: ` + password,
+			wantErr: "prometheus_instances[prom].password and prometheus_instances[prom].password_file are mutually exclusive",
+		},
+		{
+			name: "unreadable file",
+			yaml: `
+sink:
+  mysql:
+    dsn_file: ` + filepath.Join(dir, "missing"),
+			wantErr: "failed to read sink.mysql.dsn_file",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadYAML(t, tt.yaml)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Load() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// expandVariables fills {{.name}} references in metric queries and match
+// selectors from variables, which overrides the config's own. Text without
+// "{{" is left untouched, and an undefined variable is an error.
+func (c *Config) expandVariables(overrides map[string]string) error {
+	vars := make(map[string]string, len(c.Variables)+len(overrides))
+	for k, v := range c.Variables {
+		vars[k] = v
+	}
+	for k, v := range overrides {
+		vars[k] = v
+	}
+
+	for i := range c.Metrics {
+		m := &c.Metrics[i]
+		var err error
+		if m.Query, err = expandTemplate(m.Name, m.Query, vars); err != nil {
+			return fmt.Errorf("query of metric %s: %v", m.Name, err)
+		}
+		for j := range m.Match {
+			if m.Match[j], err = expandTemplate(m.Name, m.Match[j], vars); err != nil {
+				return fmt.Errorf("match of metric %s: %v", m.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// expandTemplate executes text as a template over vars
+func expandTemplate(name, text string, vars map[string]string) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, vars); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
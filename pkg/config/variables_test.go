@@ -0,0 +1,114 @@
+package config
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+const variablesConfig = `
+variables:
+  cluster: prod
+  namespace: tidb-prod
+prometheus_instances:
+  - name: prom
+    address: http://prom:9090
+metrics:
+  - name: qps
+    query: sum(rate(tidb_server_query_total{tidb_cluster="{{.cluster}}", namespace="{{.namespace}}"}[1m]))
+  - name: tikv
+    type: federate
+    match: ['{tidb_cluster="{{.cluster}}", job="tikv"}']
+  - name: plain
+    query: sum by (instance) (rate(tidb_server_query_total{job="tidb"}[1m]))
+`
+
+func TestLoadExpandsVariables(t *testing.T) {
+	path := writeFile(t, t.TempDir(), "config.yaml", variablesConfig)
+	tests := []struct {
+		name      string
+		overrides map[string]string
+		qps       string
+		match     []string
+	}{
+		{
+			"configured",
+			nil,
+			`sum(rate(tidb_server_query_total{tidb_cluster="prod", namespace="tidb-prod"}[1m]))`,
+			[]string{`{tidb_cluster="prod", job="tikv"}`},
+		},
+		{
+			"overridden",
+			map[string]string{"cluster": "staging"},
+			`sum(rate(tidb_server_query_total{tidb_cluster="staging", namespace="tidb-prod"}[1m]))`,
+			[]string{`{tidb_cluster="staging", job="tikv"}`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := LoadWithVariables(tt.overrides, path)
+			if err != nil {
+				t.Fatalf("LoadWithVariables() error = %v", err)
+			}
+			if got := cfg.Metrics[0].Query; got != tt.qps {
+				t.Errorf("qps query = %s, want %s", got, tt.qps)
+			}
+			if got := cfg.Metrics[1].Match; !slices.Equal(got, tt.match) {
+				t.Errorf("tikv match = %q, want %q", got, tt.match)
+			}
+			// Without "{{" a query's braces are label matchers, not a template
+			if got, want := cfg.Metrics[2].Query, `sum by (instance) (rate(tidb_server_query_total{job="tidb"}[1m]))`; got != want {
+				t.Errorf("plain query = %s, want it untouched: %s", got, want)
+			}
+		})
+	}
+}
+
+func TestLoadVariableErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{
+			"undefined in query",
+			`
+variables:
+  cluster: prod
+metrics:
+  - name: qps
+    query: up{namespace="{{.namespace}}"}
+`,
+			`query of metric qps: template: qps:1:16: executing "qps" at <.namespace>: map has no entry for key "namespace"`,
+		},
+		{
+			"undefined in match",
+			`
+metrics:
+  - name: tikv
+    type: federate
+    match: ['{tidb_cluster="{{.cluster}}"}']
+`,
+			`match of metric tikv`,
+		},
+		{
+			"unparsable",
+			`
+variables:
+  cluster: prod
+metrics:
+  - name: qps
+    query: up{tidb_cluster="{{.cluster}"}
+`,
+			`query of metric qps: template: qps:1:`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadYAML(t, tt.content)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Load() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+// Package logfile keeps a copy of the crawler's log in a file per run,
+// rotating it by size so a long or chatty run cannot fill the disk.
+package logfile
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RunPath returns the log file of a run started at t: path with the run's
+// timestamp inserted before the extension, e.g. logs/crawler.log becomes
+// logs/crawler_20240501080000.log
+func RunPath(path string, t time.Time) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "_" + t.Format("20060102150405") + ext
+}
+
+// File is a log file rotated once it reaches a size. Rotated files are
+// renamed <path>.1, <path>.2 and so on, the lowest being the newest. It is
+// safe for concurrent use.
+type File struct {
+	mu         sync.Mutex
+	path       string
+	maxBytes   int64 // Rotate before a write would exceed this; 0 never rotates
+	maxBackups int   // Rotated files kept; 0 keeps all
+	file       *os.File
+	size       int64
+}
+
+// Open opens or appends to the log file at path, creating its directory
+func Open(path string, maxBytes int64, maxBackups int) (*File, error) {
+	if maxBytes < 0 || maxBackups < 0 {
+		return nil, fmt.Errorf("log file size and backups must not be negative")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %v", err)
+	}
+
+	f := &File{path: path, maxBytes: maxBytes, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Path returns the path of the current log file
+func (f *File) Path() string {
+	return f.path
+}
+
+// open opens the current log file for appending
+func (f *File) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat log file: %v", err)
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+// Write appends p, rotating first when it would take the file past its
+// maximum size. Writes are not buffered, so a crash loses nothing written.
+func (f *File) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	if f.maxBytes > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxBytes {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate closes the current file, shifts the rotated files up by one,
+// dropping those beyond maxBackups, and starts an empty file
+func (f *File) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return fmt.Errorf("failed to close log file: %v", err)
+	}
+	f.file = nil
+
+	// Find the highest existing backup, then shift from the top down
+	last := 0
+	for {
+		if _, err := os.Stat(f.backup(last + 1)); err != nil {
+			break
+		}
+		last++
+	}
+	for i := last; i >= 1; i-- {
+		if f.maxBackups > 0 && i >= f.maxBackups {
+			if err := os.Remove(f.backup(i)); err != nil {
+				return fmt.Errorf("failed to remove old log file: %v", err)
+			}
+			continue
+		}
+		if err := os.Rename(f.backup(i), f.backup(i+1)); err != nil {
+			return fmt.Errorf("failed to rotate log file: %v", err)
+		}
+	}
+	if err := os.Rename(f.path, f.backup(1)); err != nil {
+		return fmt.Errorf("failed to rotate log file: %v", err)
+	}
+	return f.open()
+}
+
+// backup returns the path of the i-th rotated file
+func (f *File) backup(i int) string {
+	return fmt.Sprintf("%s.%d", f.path, i)
+}
+
+// Close syncs the file to disk and closes it
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Sync()
+	if closeErr := f.file.Close(); err == nil {
+		err = closeErr
+	}
+	f.file = nil
+	return err
+}
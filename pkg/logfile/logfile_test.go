@@ -0,0 +1,140 @@
+package logfile
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// readFile returns the content of path, or "" when it does not exist
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ""
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRunPath(t *testing.T) {
+	at := time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"logs/crawler.log", "logs/crawler_20240501080000.log"},
+		{"crawler", "crawler_20240501080000"},
+		{"/var/log/crawler.run.txt", "/var/log/crawler.run_20240501080000.txt"},
+	}
+	for _, tt := range tests {
+		if got := RunPath(tt.path, at); got != tt.want {
+			t.Errorf("RunPath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestFileWritesAndRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "crawler.log")
+	// Two 10 byte lines fit before a rotation; two rotated files are kept
+	f, err := Open(path, 20, 2)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	logger := log.New(f, "", 0)
+	for i := 1; i <= 7; i++ {
+		logger.Printf("line-%04d", i)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	want := map[string]string{
+		path:        "line-0007\n",
+		path + ".1": "line-0005\nline-0006\n",
+		path + ".2": "line-0003\nline-0004\n",
+		path + ".3": "",
+	}
+	for p, content := range want {
+		if got := readFile(t, p); got != content {
+			t.Errorf("%s = %q, want %q", filepath.Base(p), got, content)
+		}
+	}
+}
+
+func TestFileKeepsAllBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "crawler.log")
+	f, err := Open(path, 10, 0)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	for i := 1; i <= 4; i++ {
+		fmt.Fprintf(f, "line-%04d\n", i)
+	}
+	f.Close()
+
+	for i, content := range []string{"line-0004\n", "line-0003\n", "line-0002\n", "line-0001\n"} {
+		p := path
+		if i > 0 {
+			p = fmt.Sprintf("%s.%d", path, i)
+		}
+		if got := readFile(t, p); got != content {
+			t.Errorf("%s = %q, want %q", filepath.Base(p), got, content)
+		}
+	}
+}
+
+func TestFileAppendsToExisting(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "crawler.log")
+	if err := os.WriteFile(path, []byte("earlier-run-\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The existing 13 bytes count towards the size
+	f, err := Open(path, 20, 1)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	if _, err := f.Write([]byte("line-0001\n")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	// A line longer than the limit still goes to a file of its own
+	long := "a line longer than twenty bytes\n"
+	if _, err := f.Write([]byte(long)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	f.Close()
+
+	if got := readFile(t, path); got != long {
+		t.Errorf("current file = %q, want %q", got, long)
+	}
+	if got := readFile(t, path+".1"); got != "line-0001\n" {
+		t.Errorf("crawler.log.1 = %q, want the line written before the long one", got)
+	}
+}
+
+func TestFileClosed(t *testing.T) {
+	f, err := Open(filepath.Join(t.TempDir(), "crawler.log"), 0, 0)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Errorf("second Close() error = %v, want nil", err)
+	}
+	if _, err := f.Write([]byte("late\n")); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Write() after Close error = %v, want os.ErrClosed", err)
+	}
+
+	if _, err := Open(filepath.Join(t.TempDir(), "crawler.log"), -1, 0); err == nil {
+		t.Error("Open() accepted a negative size")
+	}
+}
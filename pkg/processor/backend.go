@@ -0,0 +1,107 @@
+package processor
+
+import (
+	"log"
+	"strings"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"github.com/meiking/tidb-metrics-crawler/pkg/prometheus"
+)
+
+// Features some backends lack
+const (
+	featureExemplars = "exemplars"
+	featureRules     = "rules"
+	featureFederate  = "federate"
+	featureMetadata  = "metadata"
+)
+
+// backendGaps says why each flavor cannot serve a feature. Flavors and
+// features left out are assumed to work.
+var backendGaps = map[string]map[string]string{
+	prometheus.FlavorVictoriaMetrics: {
+		featureExemplars: "has no /api/v1/query_exemplars endpoint",
+		featureRules:     "serves rules and alerts only when vmalert is proxied with -vmalert.proxyURL",
+		featureMetadata:  "returns no metric metadata",
+	},
+	prometheus.FlavorThanos: {
+		featureFederate: "has no /federate endpoint",
+	},
+	prometheus.FlavorMimir: {
+		featureFederate: "has no /federate endpoint",
+	},
+	prometheus.FlavorCortex: {
+		featureFederate: "has no /federate endpoint",
+	},
+}
+
+// configuredFeatures returns the metrics using each feature a backend may
+// lack; metadata lookup is keyed to no metric
+func configuredFeatures(metrics []config.MetricConfig, metadataLookup bool) map[string][]string {
+	features := make(map[string][]string)
+	for _, metric := range metrics {
+		if metric.WithExemplars {
+			features[featureExemplars] = append(features[featureExemplars], metric.Name)
+		}
+		switch metric.Type {
+		case metricTypeRules, metricTypeAlerts:
+			features[featureRules] = append(features[featureRules], metric.Name)
+		case metricTypeFederate:
+			features[featureFederate] = append(features[featureFederate], metric.Name)
+		}
+	}
+	if metadataLookup {
+		features[featureMetadata] = nil
+	}
+	return features
+}
+
+// backendWarnings describes the configured features a flavor lacks, in a
+// fixed order
+func backendWarnings(flavor string, features map[string][]string) []string {
+	var warnings []string
+	for _, feature := range []string{featureExemplars, featureRules, featureFederate, featureMetadata} {
+		reason, ok := backendGaps[flavor][feature]
+		if !ok {
+			continue
+		}
+		metrics, used := features[feature]
+		if !used {
+			continue
+		}
+		if feature == featureMetadata {
+			warnings = append(warnings, reason+", so processor.metadata_lookup will find nothing")
+			continue
+		}
+		warnings = append(warnings, reason+", so these metrics may fail: "+strings.Join(metrics, ", "))
+	}
+	return warnings
+}
+
+// CheckBackends probes the server behind each client, logs its flavor and
+// warns about configured features it does not support. Probes are best
+// effort: a failed one is logged and the run goes on.
+func CheckBackends(clients []prometheus.Client, metrics []config.MetricConfig, metadataLookup bool) {
+	features := configuredFeatures(metrics, metadataLookup)
+	for _, client := range clients {
+		backend, err := client.DetectBackend()
+		if err != nil {
+			log.Printf("Warning: could not probe the backend of instance %s: %v", client.Name(), err)
+		}
+		if backend.Flavor == prometheus.FlavorUnknown {
+			if err == nil {
+				log.Printf("Instance %s: backend not recognised", client.Name())
+			}
+			continue
+		}
+
+		version := backend.Version
+		if version == "" {
+			version = "version unknown"
+		}
+		log.Printf("Instance %s: backend is %s (%s)", client.Name(), backend.Flavor, version)
+		for _, warning := range backendWarnings(backend.Flavor, features) {
+			log.Printf("Warning: instance %s is %s, which %s", client.Name(), backend.Flavor, warning)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package processor
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"github.com/meiking/tidb-metrics-crawler/pkg/prometheus"
+)
+
+func TestCheckBackendsWarnsAboutMissingFeatures(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	clients := []prometheus.Client{
+		&fakeClient{name: "prom", backend: prometheus.Backend{Flavor: prometheus.FlavorPrometheus, Version: "2.53.1"}},
+		&fakeClient{name: "vm", backend: prometheus.Backend{Flavor: prometheus.FlavorVictoriaMetrics}},
+		&fakeClient{name: "thanos", backend: prometheus.Backend{Flavor: prometheus.FlavorThanos, Version: "0.35.1"}},
+		&fakeClient{name: "other", backend: prometheus.Backend{Flavor: prometheus.FlavorUnknown}},
+	}
+	metrics := []config.MetricConfig{
+		{Name: "latency", Query: "latency", WithExemplars: true},
+		{Name: "rules", Type: metricTypeRules},
+		{Name: "tikv", Type: metricTypeFederate},
+		{Name: "qps", Query: "qps"},
+	}
+	CheckBackends(clients, metrics, true)
+
+	want := []string{
+		"Instance prom: backend is prometheus (2.53.1)",
+		"Instance vm: backend is victoriametrics (version unknown)",
+		"Warning: instance vm is victoriametrics, which has no /api/v1/query_exemplars endpoint, so these metrics may fail: latency",
+		"Warning: instance vm is victoriametrics, which serves rules and alerts only when vmalert is proxied with -vmalert.proxyURL, so these metrics may fail: rules",
+		"Warning: instance vm is victoriametrics, which returns no metric metadata, so processor.metadata_lookup will find nothing",
+		"Instance thanos: backend is thanos (0.35.1)",
+		"Warning: instance thanos is thanos, which has no /federate endpoint, so these metrics may fail: tikv",
+		"Instance other: backend not recognised",
+	}
+	var got []string
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		// Strip the date and time log.Printf prefixes
+		if fields := strings.SplitN(line, " ", 3); len(fields) == 3 {
+			got = append(got, fields[2])
+		}
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("logged:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestBackendWarningsOnlyForConfiguredFeatures(t *testing.T) {
+	features := configuredFeatures([]config.MetricConfig{{Name: "qps", Query: "qps"}}, false)
+	for _, flavor := range []string{prometheus.FlavorVictoriaMetrics, prometheus.FlavorThanos, prometheus.FlavorMimir, prometheus.FlavorCortex} {
+		if warnings := backendWarnings(flavor, features); len(warnings) != 0 {
+			t.Errorf("backendWarnings(%s) = %q for plain range queries, want none", flavor, warnings)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package processor
+
+import (
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// batchRange is the time range of one batch
+type batchRange struct {
+	start, end time.Time
+}
+
+// splitBatches splits the time range into window-sized batches
+func splitBatches(start, end time.Time, window time.Duration, align bool) []batchRange {
+	var batches []batchRange
+	for start.Before(end) {
+		batchStop := batchEnd(start, end, window, align)
+		batches = append(batches, batchRange{start: start, end: batchStop})
+		start = batchStop
+	}
+	return batches
+}
+
+// fetchResult is the outcome of one batch query
+type fetchResult struct {
+	value model.Value
+	err   error
+}
+
+// batchFetcher runs the queries of a metric's batches ahead of the batch
+// being written, at most workers at a time. Results are handed out in batch
+// order, so sink writes and the trackers fed by them still see time order,
+// and at most workers results are held in memory.
+type batchFetcher struct {
+	fetch   func(batchRange) (model.Value, error)
+	batches []batchRange
+	workers int
+	pending []chan fetchResult // Indexed by batch; nil until the query starts
+	started int
+}
+
+// newBatchFetcher creates a fetcher running fetch for batches with up to
+// workers queries in flight
+func newBatchFetcher(batches []batchRange, workers int, fetch func(batchRange) (model.Value, error)) *batchFetcher {
+	if workers < 1 {
+		workers = 1
+	}
+	return &batchFetcher{
+		fetch:   fetch,
+		batches: batches,
+		workers: workers,
+		pending: make([]chan fetchResult, len(batches)),
+	}
+}
+
+// result returns the result of batch i, waiting for its query if needed.
+// Batches must be consumed in order. The queries of batch i and the
+// following batches are started first, up to workers of them.
+func (f *batchFetcher) result(i int) (model.Value, error) {
+	if f.workers == 1 {
+		return f.fetch(f.batches[i])
+	}
+
+	for f.started < len(f.batches) && f.started < i+f.workers {
+		// Buffered, so a query still running when the caller gives up does not leak
+		ch := make(chan fetchResult, 1)
+		f.pending[f.started] = ch
+		go func(batch batchRange) {
+			value, err := f.fetch(batch)
+			ch <- fetchResult{value: value, err: err}
+		}(f.batches[f.started])
+		f.started++
+	}
+
+	r := <-f.pending[i]
+	f.pending[i] = nil
+	return r.value, r.err
+}
@@ -0,0 +1,113 @@
+package processor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"github.com/prometheus/common/model"
+)
+
+func TestSplitBatches(t *testing.T) {
+	tests := []struct {
+		name       string
+		start, end string
+		align      bool
+		want       [][2]string
+	}{
+		{
+			name:  "unaligned from start",
+			start: "2024-01-01T10:37:00Z", end: "2024-01-01T13:00:00Z",
+			want: [][2]string{
+				{"2024-01-01T10:37:00Z", "2024-01-01T11:37:00Z"},
+				{"2024-01-01T11:37:00Z", "2024-01-01T12:37:00Z"},
+				{"2024-01-01T12:37:00Z", "2024-01-01T13:00:00Z"},
+			},
+		},
+		{
+			name:  "aligned with partial first and last batches",
+			start: "2024-01-01T10:37:00Z", end: "2024-01-01T12:15:00Z", align: true,
+			want: [][2]string{
+				{"2024-01-01T10:37:00Z", "2024-01-01T11:00:00Z"},
+				{"2024-01-01T11:00:00Z", "2024-01-01T12:00:00Z"},
+				{"2024-01-01T12:00:00Z", "2024-01-01T12:15:00Z"},
+			},
+		},
+		{
+			name:  "aligned start on the hour",
+			start: "2024-01-01T10:00:00Z", end: "2024-01-01T12:00:00Z", align: true,
+			want: [][2]string{
+				{"2024-01-01T10:00:00Z", "2024-01-01T11:00:00Z"},
+				{"2024-01-01T11:00:00Z", "2024-01-01T12:00:00Z"},
+			},
+		},
+		{
+			name:  "aligned within one hour",
+			start: "2024-01-01T10:10:00Z", end: "2024-01-01T10:50:00Z", align: true,
+			want: [][2]string{{"2024-01-01T10:10:00Z", "2024-01-01T10:50:00Z"}},
+		},
+		{
+			name:  "empty range",
+			start: "2024-01-01T10:00:00Z", end: "2024-01-01T10:00:00Z",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitBatches(testTime(tt.start), testTime(tt.end), time.Hour, tt.align)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d batches %v, want %d", len(got), got, len(tt.want))
+			}
+			for i, want := range tt.want {
+				if !got[i].start.Equal(testTime(want[0])) || !got[i].end.Equal(testTime(want[1])) {
+					t.Errorf("batch %d = %s to %s, want %s to %s", i, got[i].start.Format(time.RFC3339), got[i].end.Format(time.RFC3339), want[0], want[1])
+				}
+			}
+		})
+	}
+}
+
+func TestBatchWorkersFetchAheadInOrder(t *testing.T) {
+	start, end := testTime("2024-01-01T00:00:00Z"), testTime("2024-01-02T00:00:00Z")
+	metrics := []config.MetricConfig{{Name: "qps", Query: "qps"}}
+
+	// run crawls 24 one-hour batches from a server taking latency per query
+	run := func(workers int) (time.Duration, []common.ProcessedData) {
+		client := &fakeClient{name: "prom"}
+		client.fetchRange = func(ctx context.Context, query string, start, end time.Time, step time.Duration) (model.Value, error) {
+			time.Sleep(20 * time.Millisecond)
+			return rangeMatrix(model.Metric{"job": "tidb"}, start, end, step), nil
+		}
+		out := newMemorySink()
+		p := newTestProcessor(out, config.ProcessorConfig{BatchWindow: "1h", BatchWorkers: workers}, client)
+
+		started := time.Now()
+		if err := p.ProcessMetrics(context.Background(), metrics, start, end, "15m"); err != nil {
+			t.Fatalf("ProcessMetrics() with %d workers error = %v", workers, err)
+		}
+		if n := len(client.fetched()); n != 24 {
+			t.Fatalf("%d workers ran %d queries, want 24", workers, n)
+		}
+		return time.Since(started), out.metricRows("qps")
+	}
+
+	serial, serialRows := run(1)
+	parallel, parallelRows := run(4)
+	if parallel > serial/2 {
+		t.Errorf("4 workers took %v, want well under the %v taken serially", parallel, serial)
+	}
+
+	if len(parallelRows) != len(serialRows) {
+		t.Fatalf("4 workers wrote %d rows, want the %d written serially", len(parallelRows), len(serialRows))
+	}
+	for i := range parallelRows {
+		if !parallelRows[i].Timestamp.Equal(serialRows[i].Timestamp) {
+			t.Fatalf("row %d at %v, want %v as written serially", i, parallelRows[i].Timestamp, serialRows[i].Timestamp)
+		}
+		if i > 0 && parallelRows[i].Timestamp.Before(parallelRows[i-1].Timestamp) {
+			t.Fatalf("row %d at %v is before the row at %v", i, parallelRows[i].Timestamp, parallelRows[i-1].Timestamp)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package processor
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/prometheus"
+)
+
+// defaultBreakerThreshold is the number of consecutive fetch failures after
+// which an instance is skipped when breaker_threshold is unset
+const defaultBreakerThreshold = 3
+
+// circuitBreaker skips a Prometheus instance after repeated fetch failures.
+// Once open, it stays open for the rest of the run unless a cooldown is set,
+// in which case a single probe is allowed through after the cooldown.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	instance  string
+	threshold int           // Consecutive failures before opening; <= 0 disables the breaker
+	cooldown  time.Duration // Time before a half-open probe; 0 means never
+	failures  int
+	open      bool
+	openedAt  time.Time
+	skipped   int // Number of metrics skipped while open
+	now       func() time.Time
+}
+
+// newCircuitBreaker creates a closed breaker for an instance
+func newCircuitBreaker(instance string, threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		instance:  instance,
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+// allow reports whether a metric may be fetched from the instance,
+// counting a skip when it may not
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.open {
+		return true
+	}
+
+	if b.cooldown > 0 && b.now().Sub(b.openedAt) >= b.cooldown {
+		// Half-open: let one probe through; a failure reopens the breaker
+		log.Printf("Probing Prometheus instance %s after %v cooldown", b.instance, b.cooldown)
+		b.open = false
+		b.failures = b.threshold - 1
+		return true
+	}
+
+	b.skipped++
+	return false
+}
+
+// recordSuccess closes the breaker
+func (b *circuitBreaker) recordSuccess() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+}
+
+// recordFailure counts a fetch failure and opens the breaker at the threshold
+func (b *circuitBreaker) recordFailure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.threshold <= 0 || b.open {
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.threshold {
+		b.open = true
+		b.openedAt = b.now()
+		if b.cooldown > 0 {
+			log.Printf("Prometheus instance %s failed %d consecutive fetches; skipping it for %v",
+				b.instance, b.failures, b.cooldown)
+			return
+		}
+		log.Printf("Prometheus instance %s failed %d consecutive fetches; skipping it for the rest of the run",
+			b.instance, b.failures)
+	}
+}
+
+// skips returns the number of metrics skipped while the breaker was open
+func (b *circuitBreaker) skips() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.skipped
+}
+
+// recordFetchError records a failed fetch. A rejected query shows that the
+// instance answered, so it counts as a success for the instance.
+func (b *circuitBreaker) recordFetchError(err error) {
+	if errors.Is(err, prometheus.ErrQueryRejected) {
+		b.recordSuccess()
+		return
+	}
+	b.recordFailure()
+}
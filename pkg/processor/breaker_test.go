@@ -0,0 +1,121 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"github.com/meiking/tidb-metrics-crawler/pkg/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+func TestCircuitBreakerOpens(t *testing.T) {
+	b := newCircuitBreaker("prom", 3, 0)
+
+	// A success resets the count of consecutive failures
+	b.recordFailure()
+	b.recordFailure()
+	b.recordSuccess()
+	b.recordFailure()
+	b.recordFailure()
+	if !b.allow() {
+		t.Fatal("breaker opened after 2 consecutive failures, want 3")
+	}
+
+	b.recordFailure()
+	for i := 0; i < 3; i++ {
+		if b.allow() {
+			t.Fatalf("breaker allowed metric %d after opening", i)
+		}
+	}
+	if got := b.skips(); got != 3 {
+		t.Errorf("skips() = %d, want 3", got)
+	}
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	now := testTime("2024-01-01T00:00:00Z")
+	b := newCircuitBreaker("prom", 2, time.Minute)
+	b.now = func() time.Time { return now }
+
+	b.recordFailure()
+	b.recordFailure()
+	if b.allow() {
+		t.Fatal("breaker allowed a metric right after opening")
+	}
+
+	// After the cooldown one probe goes through; its failure reopens the breaker
+	now = now.Add(time.Minute)
+	if !b.allow() {
+		t.Fatal("breaker did not let a probe through after the cooldown")
+	}
+	b.recordFailure()
+	if b.allow() {
+		t.Fatal("breaker stayed closed after the probe failed")
+	}
+
+	// A successful probe closes it
+	now = now.Add(time.Minute)
+	if !b.allow() {
+		t.Fatal("breaker did not let a second probe through")
+	}
+	b.recordSuccess()
+	b.recordFailure()
+	if !b.allow() {
+		t.Error("breaker reopened on the first failure after a successful probe")
+	}
+}
+
+func TestCircuitBreakerRejectedQuery(t *testing.T) {
+	b := newCircuitBreaker("prom", 1, 0)
+	b.recordFetchError(fmt.Errorf("bad query: %w", prometheus.ErrQueryRejected))
+	if !b.allow() {
+		t.Error("a rejected query opened the breaker")
+	}
+}
+
+func TestProcessMetricsSkipsUnhealthyInstance(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	down := &fakeClient{name: "down"}
+	down.fetchRange = func(ctx context.Context, query string, start, end time.Time, step time.Duration) (model.Value, error) {
+		return nil, errors.New("connection refused")
+	}
+	up := &fakeClient{name: "up"}
+	out := newMemorySink()
+	metrics := []config.MetricConfig{
+		{Name: "a", Query: "a"}, {Name: "b", Query: "b"}, {Name: "c", Query: "c"}, {Name: "d", Query: "d"},
+	}
+
+	p := newTestProcessor(out, config.ProcessorConfig{BreakerThreshold: 2}, down, up)
+	if err := p.ProcessMetrics(context.Background(), metrics, testTime("2024-01-01T00:00:00Z"), testTime("2024-01-01T01:00:00Z"), "1m"); err != nil {
+		t.Fatalf("ProcessMetrics() error = %v", err)
+	}
+
+	// Closed for a and b, open from then on
+	if got := len(down.fetched()); got != 2 {
+		t.Errorf("fetched %d times from the failing instance, want 2", got)
+	}
+	if got := len(up.fetched()); got != 4 {
+		t.Errorf("fetched %d times from the healthy instance, want 4", got)
+	}
+	summary := p.Summary()
+	if got := summary.Skipped["down"]; got != 2 {
+		t.Errorf("summary skipped %d metrics of the failing instance, want 2", got)
+	}
+	if got := len(summary.Failures); got != 2 {
+		t.Errorf("summary has %d failures, want the 2 before the breaker opened", got)
+	}
+	if got := strings.Count(logs.String(), "skipping it for the rest of the run"); got != 1 {
+		t.Errorf("logged the open breaker %d times, want once:\n%s", got, logs.String())
+	}
+}
@@ -0,0 +1,70 @@
+package processor
+
+import (
+	"log"
+	"sync"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+)
+
+// defaultSeriesWarningThreshold is the series count per metric that triggers
+// a cardinality warning when series_warning_threshold is unset
+const defaultSeriesWarningThreshold = 10000
+
+// seriesTracker counts the distinct series of each metric across instances
+// and batches, warning once when a metric exceeds the threshold
+type seriesTracker struct {
+	mu        sync.Mutex
+	threshold int                            // Disabled when negative
+	series    map[string]map[string]struct{} // Series identities keyed by metric name
+}
+
+// newSeriesTracker creates a tracker; a negative threshold disables it
+func newSeriesTracker(threshold int) *seriesTracker {
+	if threshold == 0 {
+		threshold = defaultSeriesWarningThreshold
+	}
+	return &seriesTracker{
+		threshold: threshold,
+		series:    make(map[string]map[string]struct{}),
+	}
+}
+
+// observe records a series of a metric, identified by its instance and labels
+func (t *seriesTracker) observe(metricName, instance string, labels map[string]string) {
+	if t.threshold < 0 {
+		return
+	}
+	id := instance + "\x00" + common.LabelsHash(labels)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	seen, ok := t.series[metricName]
+	if !ok {
+		seen = make(map[string]struct{})
+		t.series[metricName] = seen
+	}
+	if _, exists := seen[id]; exists {
+		return
+	}
+	seen[id] = struct{}{}
+
+	if len(seen) == t.threshold+1 {
+		log.Printf("Warning: metric %s produced more than %d series, consider aggregating the query", metricName, t.threshold)
+	}
+}
+
+// highCardinality returns the series count of every metric above the threshold
+func (t *seriesTracker) highCardinality() map[string]int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	counts := make(map[string]int)
+	for name, seen := range t.series {
+		if t.threshold >= 0 && len(seen) > t.threshold {
+			counts[name] = len(seen)
+		}
+	}
+	return counts
+}
@@ -0,0 +1,67 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+func TestSeriesWarning(t *testing.T) {
+	start, end := testTime("2024-01-01T00:00:00Z"), testTime("2024-01-01T03:00:00Z")
+	metrics := []config.MetricConfig{{Name: "qps", Query: "qps"}}
+
+	tests := []struct {
+		name      string
+		threshold int
+		series    int
+		want      map[string]int // Summary().HighSeries
+	}{
+		{"above", 2, 3, map[string]int{"qps": 3}},
+		{"at", 3, 3, map[string]int{}},
+		{"disabled", -1, 3, map[string]int{}},
+		{"default", 0, 3, map[string]int{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			log.SetOutput(&logs)
+			defer log.SetOutput(os.Stderr)
+
+			// The same series come back in each of the 3 batches
+			cfg := config.ProcessorConfig{BatchWindow: "1h", SeriesWarningThreshold: tt.threshold}
+			p := newTestProcessor(newMemorySink(), cfg, wideClient(tt.series))
+			if err := p.ProcessMetrics(context.Background(), metrics, start, end, "5m"); err != nil {
+				t.Fatalf("ProcessMetrics() error = %v", err)
+			}
+
+			got := p.Summary().HighSeries
+			if len(got) != len(tt.want) || got["qps"] != tt.want["qps"] {
+				t.Errorf("HighSeries = %v, want %v", got, tt.want)
+			}
+			warnings := strings.Count(logs.String(), "Warning: metric qps produced more than")
+			if wantWarnings := len(tt.want); warnings != wantWarnings {
+				t.Errorf("logged %d cardinality warnings, want %d", warnings, wantWarnings)
+			}
+		})
+	}
+}
+
+func TestSeriesTrackerCountsInstancesApart(t *testing.T) {
+	tracker := newSeriesTracker(1)
+	labels := map[string]string{"job": "tidb"}
+	tracker.observe("qps", "prom-a", labels)
+	tracker.observe("qps", "prom-a", map[string]string{"job": "tidb"})
+	if got := tracker.highCardinality(); len(got) != 0 {
+		t.Fatalf("highCardinality() = %v after one series seen twice", got)
+	}
+
+	tracker.observe("qps", "prom-b", labels)
+	if got := tracker.highCardinality(); got["qps"] != 2 {
+		t.Errorf("highCardinality() = %v, want qps with the series of both instances", got)
+	}
+}
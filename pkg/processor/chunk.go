@@ -0,0 +1,66 @@
+package processor
+
+import (
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+	"github.com/meiking/tidb-metrics-crawler/pkg/sink"
+)
+
+// defaultWriteChunkSize is the number of rows per sink write when write_chunk_size is unset
+const defaultWriteChunkSize = 5000
+
+// chunkWriter buffers rows and writes them to the sink in fixed-size chunks,
+// bounding memory to one chunk instead of a whole batch
+type chunkWriter struct {
+	sink       sink.Sink
+	metricName string
+	job        string // Provenance stamped on every row
+	runID      string
+	checksum   bool // Stamp rows with common.RowChecksum
+	buf        []common.ProcessedData
+	written    int // Rows written since creation
+}
+
+// newChunkWriter creates a chunk writer for a metric, stamping rows with job
+// and runID, and with their checksum if checksum is set
+func newChunkWriter(s sink.Sink, metricName, job, runID string, checksum bool, size int) *chunkWriter {
+	if size <= 0 {
+		size = defaultWriteChunkSize
+	}
+	return &chunkWriter{
+		sink:       s,
+		metricName: metricName,
+		job:        job,
+		runID:      runID,
+		checksum:   checksum,
+		buf:        make([]common.ProcessedData, 0, size),
+	}
+}
+
+// add appends a row, writing the chunk to the sink once it is full
+func (w *chunkWriter) add(item common.ProcessedData) error {
+	item.Job, item.RunID = w.job, w.runID
+	if w.checksum {
+		item.Checksum = common.RowChecksum(item)
+	}
+	w.buf = append(w.buf, item)
+	if len(w.buf) == cap(w.buf) {
+		return w.flush()
+	}
+	return nil
+}
+
+// flush writes any buffered rows to the sink
+func (w *chunkWriter) flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+
+	if err := w.sink.Write(w.metricName, w.buf); err != nil {
+		return err
+	}
+
+	w.written += len(w.buf)
+	// Sinks may retain the slice, so start a new one rather than reusing it
+	w.buf = make([]common.ProcessedData, 0, cap(w.buf))
+	return nil
+}
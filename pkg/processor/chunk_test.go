@@ -0,0 +1,126 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"github.com/prometheus/common/model"
+)
+
+// chunkSink records the size of every write and the rows written
+type chunkSink struct {
+	sizes []int
+	rows  []common.ProcessedData
+}
+
+func (s *chunkSink) Write(metricName string, data []common.ProcessedData) error {
+	s.sizes = append(s.sizes, len(data))
+	s.rows = append(s.rows, data...)
+	return nil
+}
+
+func (s *chunkSink) Close() error { return nil }
+
+func TestChunkWriter(t *testing.T) {
+	out := &chunkSink{}
+	w := newChunkWriter(out, "qps", "nightly", "run-1", false, 5)
+
+	start := testTime("2024-01-01T00:00:00Z")
+	for i := 0; i < 12; i++ {
+		if err := w.add(common.ProcessedData{Timestamp: start.Add(time.Duration(i) * time.Minute), Value: float64(i)}); err != nil {
+			t.Fatalf("add() error = %v", err)
+		}
+		if len(w.buf) >= 5 {
+			t.Fatalf("after row %d the writer holds %d rows, want fewer than a chunk", i, len(w.buf))
+		}
+	}
+	if err := w.flush(); err != nil {
+		t.Fatalf("flush() error = %v", err)
+	}
+
+	if want := []int{5, 5, 2}; len(out.sizes) != len(want) || out.sizes[0] != 5 || out.sizes[1] != 5 || out.sizes[2] != 2 {
+		t.Errorf("write sizes = %v, want %v", out.sizes, want)
+	}
+	if w.written != 12 {
+		t.Errorf("written = %d, want 12", w.written)
+	}
+	for i, row := range out.rows {
+		if row.Value != float64(i) || row.Job != "nightly" || row.RunID != "run-1" {
+			t.Errorf("row %d = %+v, want value %d stamped with the job and run ID", i, row, i)
+		}
+	}
+
+	// Written chunks are not reused, as sinks may keep them
+	first := out.rows[:5]
+	if err := w.add(common.ProcessedData{Value: 99}); err != nil {
+		t.Fatalf("add() error = %v", err)
+	}
+	if first[0].Value != 0 {
+		t.Errorf("the first chunk changed to %v after a later add", first[0].Value)
+	}
+}
+
+func TestChunkBoundariesKeepEveryRow(t *testing.T) {
+	// Each one-hour batch at a 1s step has 3601 samples, split across chunks
+	metrics := []config.MetricConfig{{Name: "qps", Query: "qps"}}
+	start, end := testTime("2024-01-01T00:00:00Z"), testTime("2024-01-01T03:00:00Z")
+
+	run := func(chunkSize int) *chunkSink {
+		out := &chunkSink{}
+		p := newTestProcessor(out, config.ProcessorConfig{WriteChunkSize: chunkSize}, &fakeClient{name: "prom"})
+		if err := p.ProcessMetrics(context.Background(), metrics, start, end, "1s"); err != nil {
+			t.Fatalf("ProcessMetrics() error = %v", err)
+		}
+		return out
+	}
+
+	whole := run(1 << 20)
+	chunked := run(500)
+	for i, size := range chunked.sizes {
+		if size > 500 {
+			t.Errorf("write %d has %d rows, want at most the chunk size 500", i, size)
+		}
+	}
+	if len(chunked.rows) != 3*3601 || len(chunked.rows) != len(whole.rows) {
+		t.Fatalf("chunked writes have %d rows, want the %d of whole batches", len(chunked.rows), len(whole.rows))
+	}
+	for i := range chunked.rows {
+		if !chunked.rows[i].Timestamp.Equal(whole.rows[i].Timestamp) || chunked.rows[i].Value != whole.rows[i].Value {
+			t.Fatalf("chunked row %d = %+v, want %+v", i, chunked.rows[i], whole.rows[i])
+		}
+	}
+}
+
+// BenchmarkChunkedBatch writes a day of 1s samples in chunks of several
+// sizes. The writer holds at most one chunk; the whole size is the memory
+// a batch took before chunking.
+func BenchmarkChunkedBatch(b *testing.B) {
+	start := testTime("2024-01-01T00:00:00Z")
+	matrix := rangeMatrix(model.Metric{"job": "tidb"}, start, start.Add(24*time.Hour), time.Second)
+	values := matrix[0].Values
+
+	for _, size := range []int{500, defaultWriteChunkSize, len(values)} {
+		b.Run(fmt.Sprintf("chunk=%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				w := newChunkWriter(discardSink{}, "qps", "", "", false, size)
+				for _, v := range values {
+					w.add(common.ProcessedData{Timestamp: v.Timestamp.Time(), Value: float64(v.Value)})
+				}
+				w.flush()
+			}
+			b.ReportMetric(float64(size*int(unsafe.Sizeof(common.ProcessedData{}))), "held-B")
+		})
+	}
+}
+
+// discardSink drops every write
+type discardSink struct{}
+
+func (discardSink) Write(metricName string, data []common.ProcessedData) error { return nil }
+func (discardSink) Close() error                                               { return nil }
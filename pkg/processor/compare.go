@@ -0,0 +1,277 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"github.com/meiking/tidb-metrics-crawler/pkg/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+const (
+	// comparisonLabel tells delta rows from ratio rows of a compared metric
+	comparisonLabel = "comparison"
+
+	// baselineLabel names the instance the candidate was compared against
+	baselineLabel = "baseline"
+
+	comparisonDelta = "delta" // Candidate minus baseline
+	comparisonRatio = "ratio" // Candidate divided by baseline
+
+	compareMissingSkip = "skip" // Points on one side only are dropped
+	compareMissingZero = "zero" // Points on one side only are compared with 0
+)
+
+// compareSeries is one instance's series of a batch
+type compareSeries struct {
+	metric model.Metric // Scraped labels, for the row labels
+	values map[model.Time]model.SampleValue
+}
+
+// alignSeries keys the series of a matrix by the labels labelsOf keeps,
+// which is what identifies a series across the two instances. Series it
+// returns nil for are left out. It reports whether several series ended up
+// with the same key; later ones win.
+func alignSeries(matrix model.Matrix, labelsOf func(model.Metric) map[string]string) (map[string]*compareSeries, bool) {
+	aligned := make(map[string]*compareSeries, len(matrix))
+	collided := false
+	for _, series := range matrix {
+		labels := labelsOf(series.Metric)
+		if labels == nil {
+			continue
+		}
+		key := common.LabelsHash(labels)
+		if _, exists := aligned[key]; exists {
+			collided = true
+		}
+		s := &compareSeries{metric: series.Metric, values: make(map[model.Time]model.SampleValue, len(series.Values))}
+		for _, sample := range series.Values {
+			s.values[sample.Timestamp] = sample.Value
+		}
+		aligned[key] = s
+	}
+	return aligned, collided
+}
+
+// comparedPoint is the difference between the instances at one time
+type comparedPoint struct {
+	metric model.Metric
+	at     model.Time
+	delta  float64
+	ratio  float64
+}
+
+// comparePoints pairs the baseline's and candidate's samples by series key
+// and timestamp. Points on one side only are dropped, or compared with 0
+// when missingZero is set. It also returns the keys of series found on one
+// side only. Points are sorted by series key, then time.
+func comparePoints(baseline, candidate map[string]*compareSeries, missingZero bool) (points []comparedPoint, onlyBaseline, onlyCandidate []string) {
+	keys := make([]string, 0, len(baseline)+len(candidate))
+	for key := range baseline {
+		keys = append(keys, key)
+		if _, ok := candidate[key]; !ok {
+			onlyBaseline = append(onlyBaseline, key)
+		}
+	}
+	for key := range candidate {
+		if _, ok := baseline[key]; !ok {
+			keys = append(keys, key)
+			onlyCandidate = append(onlyCandidate, key)
+		}
+	}
+	sort.Strings(keys)
+
+	empty := &compareSeries{}
+	for _, key := range keys {
+		base, cand := baseline[key], candidate[key]
+		metric := empty.metric
+		switch {
+		case base == nil:
+			base, metric = empty, cand.metric
+		case cand == nil:
+			cand, metric = empty, base.metric
+		default:
+			metric = cand.metric
+		}
+
+		times := make([]model.Time, 0, len(base.values)+len(cand.values))
+		for ts := range base.values {
+			times = append(times, ts)
+		}
+		for ts := range cand.values {
+			if _, ok := base.values[ts]; !ok {
+				times = append(times, ts)
+			}
+		}
+		sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+
+		for _, ts := range times {
+			b, inBase := base.values[ts]
+			c, inCand := cand.values[ts]
+			if (!inBase || !inCand) && !missingZero {
+				continue
+			}
+			points = append(points, comparedPoint{
+				metric: metric,
+				at:     ts,
+				delta:  float64(c - b),
+				ratio:  float64(c / b), // ±Inf or NaN for a zero baseline, handled by the sink's non_finite
+			})
+		}
+	}
+	sort.Strings(onlyBaseline)
+	sort.Strings(onlyCandidate)
+	return points, onlyBaseline, onlyCandidate
+}
+
+// clientNamed returns the client of the instance called name, or nil
+func (p *Processor) clientNamed(name string) prometheus.Client {
+	for _, client := range p.clients {
+		if client.Name() == name {
+			return client
+		}
+	}
+	return nil
+}
+
+// processCompare fetches a metric from its baseline and candidate instances
+// batch by batch and writes the candidate's difference from the baseline,
+// and with ratio its quotient, for every series and timestamp
+func (p *Processor) processCompare(ctx context.Context, metric config.MetricConfig, start, end time.Time, step, window time.Duration) error {
+	cmp := metric.Compare
+	baseline, candidate := p.clientNamed(cmp.Baseline), p.clientNamed(cmp.Candidate)
+	if baseline == nil || candidate == nil {
+		return fmt.Errorf("compare needs the instances %s and %s, but one of them could not be created", cmp.Baseline, cmp.Candidate)
+	}
+	clients := []prometheus.Client{baseline, candidate}
+	for _, client := range clients {
+		if !p.breakers[client.Name()].allow() {
+			return fmt.Errorf("instance %s is unhealthy", client.Name())
+		}
+	}
+	log.Printf("Comparing metric %s on %s against %s", metric.Name, candidate.Name(), baseline.Name())
+
+	totalDuration := end.Sub(start)
+	batches := splitBatches(start, end, window, p.cfg.AlignBatches)
+	fetchers := make([]*batchFetcher, len(clients))
+	for i, client := range clients {
+		client := client
+		fetchers[i] = newBatchFetcher(batches, p.cfg.BatchWorkers, func(batch batchRange) (model.Value, error) {
+			return client.FetchRange(ctx, metric.Query, batch.start, batch.end, step, metricTimeout(metric))
+		})
+	}
+
+	labelsOf := func(scraped model.Metric) map[string]string {
+		return p.keptLabels(metric, scraped)
+	}
+	onlyBaseline, onlyCandidate := make(map[string]bool), make(map[string]bool)
+	for i, batch := range batches {
+		batchNumber := i + 1
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		aligned := make([]map[string]*compareSeries, len(clients))
+		for j, client := range clients {
+			result, err := fetchers[j].result(i)
+			breaker := p.breakers[client.Name()]
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				breaker.recordFetchError(err)
+				return fmt.Errorf("failed to fetch batch %d from %s: %v", batchNumber, client.Name(), err)
+			}
+			breaker.recordSuccess()
+
+			if result, err = p.limitSamples(metric.Name, result); err != nil {
+				return fmt.Errorf("batch %d: %v", batchNumber, err)
+			}
+			matrix, ok := result.(model.Matrix)
+			if !ok {
+				return fmt.Errorf("unsupported result type: %T", result)
+			}
+			var collided bool
+			if aligned[j], collided = alignSeries(matrix, labelsOf); collided {
+				p.collided.warn(metric.Name, client.Name())
+			}
+		}
+
+		points, baseOnly, candOnly := comparePoints(aligned[0], aligned[1], cmp.Missing == compareMissingZero)
+		for _, key := range baseOnly {
+			onlyBaseline[key] = true
+		}
+		for _, key := range candOnly {
+			onlyCandidate[key] = true
+		}
+
+		out := newChunkWriter(p.sink, metric.Name, p.cfg.Job, p.runID, p.cfg.RowChecksum, p.cfg.WriteChunkSize)
+		if err := p.writeCompared(candidate.Name(), baseline.Name(), metric, points, out); err != nil {
+			return fmt.Errorf("failed to process batch %d results: %v", batchNumber, err)
+		}
+		flushErr := out.flush()
+		p.tally.addRows(metric.Name, out.written)
+		if flushErr != nil {
+			return fmt.Errorf("failed to write batch %d to sink: %v", batchNumber, flushErr)
+		}
+		log.Printf("Wrote %d compared records from batch %d to sink", out.written, batchNumber)
+
+		for _, client := range clients {
+			p.progress.advance(metric.Name, client.Name(), batch.end.Sub(start), totalDuration)
+		}
+	}
+
+	if len(onlyBaseline) > 0 || len(onlyCandidate) > 0 {
+		verb := "dropped"
+		if cmp.Missing == compareMissingZero {
+			verb = "compared with 0"
+		}
+		log.Printf("Metric %s: %d series only on %s and %d only on %s, %s",
+			metric.Name, len(onlyBaseline), baseline.Name(), len(onlyCandidate), candidate.Name(), verb)
+	}
+	return nil
+}
+
+// writeCompared writes a delta row, and with ratio a ratio row, per point
+func (p *Processor) writeCompared(candidate, baseline string, metric config.MetricConfig, points []comparedPoint, out *chunkWriter) error {
+	for _, point := range points {
+		labels, err := p.rowLabels(candidate, metric, point.metric)
+		if err != nil {
+			return err
+		}
+		if labels == nil {
+			continue
+		}
+		labels[baselineLabel] = baseline
+		labels[comparisonLabel] = comparisonDelta
+		p.series.observe(metric.Name, candidate, labels)
+
+		row := common.ProcessedData{
+			PrometheusInstance: candidate,
+			MetricName:         metric.Name,
+			Timestamp:          p.sampleTime(point.at),
+			Value:              point.delta,
+			Labels:             labels,
+		}
+		if err := out.add(row); err != nil {
+			return err
+		}
+
+		if metric.Compare.Ratio {
+			ratioLabels := make(map[string]string, len(labels))
+			for k, v := range labels {
+				ratioLabels[k] = v
+			}
+			ratioLabels[comparisonLabel] = comparisonRatio
+			row.Labels, row.Value = ratioLabels, point.ratio
+			if err := out.add(row); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
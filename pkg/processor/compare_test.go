@@ -0,0 +1,115 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"math"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"github.com/prometheus/common/model"
+)
+
+// compareClient answers range queries with one series per instance, valued
+// at the minutes of values that are not NaN. Series carry a replica label
+// that differs between the instances, so only label_keys aligns them.
+func compareClient(name string, series map[string][]float64) *fakeClient {
+	client := &fakeClient{name: name}
+	client.fetchRange = func(ctx context.Context, query string, start, end time.Time, step time.Duration) (model.Value, error) {
+		var matrix model.Matrix
+		for instance, values := range series {
+			s := &model.SampleStream{Metric: model.Metric{"instance": model.LabelValue(instance), "replica": model.LabelValue(name)}}
+			for i, v := range values {
+				if !math.IsNaN(v) {
+					s.Values = append(s.Values, model.SamplePair{Timestamp: model.TimeFromUnix(start.Add(time.Duration(i) * time.Minute).Unix()), Value: model.SampleValue(v)})
+				}
+			}
+			matrix = append(matrix, s)
+		}
+		return matrix, nil
+	}
+	return client
+}
+
+func TestCompareAlignsSeries(t *testing.T) {
+	nan := math.NaN()
+	// tidb-0 misses a point on the canary, tidb-1 is only on the baseline
+	// and tidb-2 only on the canary
+	baseline := compareClient("base", map[string][]float64{"tidb-0": {10, 20, 40}, "tidb-1": {1, 2, 3}})
+	candidate := compareClient("canary", map[string][]float64{"tidb-0": {15, nan, 10}, "tidb-2": {4, 5, 6}})
+	start := testTime("2024-01-01T00:00:00Z")
+
+	// point is a row: instance label, minute, comparison and value
+	type point struct {
+		instance   string
+		minute     int
+		comparison string
+		value      float64
+	}
+	tests := []struct {
+		missing string
+		want    []point
+		logged  string
+	}{
+		{"skip", []point{
+			{"tidb-0", 0, "delta", 5}, {"tidb-0", 0, "ratio", 1.5},
+			{"tidb-0", 2, "delta", -30}, {"tidb-0", 2, "ratio", 0.25},
+		}, "1 series only on base and 1 only on canary, dropped"},
+		{"zero", []point{
+			{"tidb-0", 0, "delta", 5}, {"tidb-0", 0, "ratio", 1.5},
+			{"tidb-0", 1, "delta", -20}, {"tidb-0", 1, "ratio", 0},
+			{"tidb-0", 2, "delta", -30}, {"tidb-0", 2, "ratio", 0.25},
+			{"tidb-1", 0, "delta", -1}, {"tidb-1", 0, "ratio", 0},
+			{"tidb-1", 1, "delta", -2}, {"tidb-1", 1, "ratio", 0},
+			{"tidb-1", 2, "delta", -3}, {"tidb-1", 2, "ratio", 0},
+			{"tidb-2", 0, "delta", 4}, {"tidb-2", 0, "ratio", math.Inf(1)},
+			{"tidb-2", 1, "delta", 5}, {"tidb-2", 1, "ratio", math.Inf(1)},
+			{"tidb-2", 2, "delta", 6}, {"tidb-2", 2, "ratio", math.Inf(1)},
+		}, "1 series only on base and 1 only on canary, compared with 0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.missing, func(t *testing.T) {
+			var logs bytes.Buffer
+			log.SetOutput(&logs)
+			defer log.SetOutput(os.Stderr)
+
+			out := newMemorySink()
+			p := newTestProcessor(out, config.ProcessorConfig{}, baseline, candidate)
+			metrics := []config.MetricConfig{{Name: "qps", Query: "qps", LabelKeys: []string{"instance"},
+				Compare: &config.CompareConfig{Baseline: "base", Candidate: "canary", Ratio: true, Missing: tt.missing}}}
+			if err := p.ProcessMetrics(context.Background(), metrics, start, start.Add(2*time.Minute), "1m"); err != nil {
+				t.Fatalf("ProcessMetrics() error = %v", err)
+			}
+
+			var got []point
+			for _, row := range out.metricRows("qps") {
+				if row.PrometheusInstance != "canary" || row.Labels["baseline"] != "base" || row.Labels["replica"] != "" {
+					t.Errorf("row from %s labelled %v, want rows of canary against base, aligned without replica", row.PrometheusInstance, row.Labels)
+				}
+				got = append(got, point{row.Labels["instance"], int(row.Timestamp.Sub(start) / time.Minute), row.Labels["comparison"], row.Value})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("rows = %v, want %v", got, tt.want)
+			}
+			if !strings.Contains(logs.String(), tt.logged) {
+				t.Errorf("log does not report the one-sided series %q:\n%s", tt.logged, logs.String())
+			}
+		})
+	}
+}
+
+func TestComparePointsZeroBaseline(t *testing.T) {
+	at := model.TimeFromUnix(0)
+	series := func(v model.SampleValue) map[string]*compareSeries {
+		return map[string]*compareSeries{"k": {values: map[model.Time]model.SampleValue{at: v}}}
+	}
+	points, onlyBaseline, onlyCandidate := comparePoints(series(0), series(0), false)
+	if len(points) != 1 || points[0].delta != 0 || !math.IsNaN(points[0].ratio) || onlyBaseline != nil || onlyCandidate != nil {
+		t.Errorf("comparePoints() of two zeros = %+v, %v, %v, want a 0 delta and a NaN ratio", points, onlyBaseline, onlyCandidate)
+	}
+}
@@ -0,0 +1,184 @@
+package processor
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"github.com/prometheus/common/model"
+)
+
+// Aggregations applied to the samples of a downsample bucket
+const (
+	downsampleAvg  = "avg"
+	downsampleMin  = "min"
+	downsampleMax  = "max"
+	downsampleSum  = "sum"
+	downsampleLast = "last"
+)
+
+// bucketState is the open bucket of a series
+type bucketState struct {
+	metric model.Metric
+	start  model.Time // Bucket start, a multiple of the bucket size since the epoch
+	lastTS model.Time // Newest sample added, to skip samples repeated at batch seams
+	count  int
+	sum    float64
+	min    float64
+	max    float64
+	last   float64
+}
+
+// add accumulates a sample into the bucket
+func (b *bucketState) add(v float64) {
+	if b.count == 0 {
+		b.min, b.max = v, v
+	}
+	b.count++
+	b.sum += v
+	b.min = math.Min(b.min, v)
+	b.max = math.Max(b.max, v)
+	b.last = v
+}
+
+// downsampler aggregates the samples of each series into fixed buckets
+// aligned to the epoch, emitting one sample per bucket stamped with the
+// bucket start. A bucket cut by a batch boundary stays open and is completed
+// with the next batch's samples.
+type downsampler struct {
+	bucket   time.Duration
+	function string
+	open     map[model.Fingerprint]*bucketState
+}
+
+// newDownsampler validates a metric's downsample settings and returns nil
+// when downsampling is off
+func newDownsampler(cfg *config.DownsampleConfig) (*downsampler, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	switch cfg.Function {
+	case downsampleAvg, downsampleMin, downsampleMax, downsampleSum, downsampleLast:
+	default:
+		return nil, fmt.Errorf("unsupported downsample function: %q", cfg.Function)
+	}
+
+	bucket, err := common.ParseDuration(cfg.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("invalid downsample bucket: %v", err)
+	}
+	if bucket < time.Second {
+		return nil, fmt.Errorf("downsample bucket must be at least 1s, got %v", bucket)
+	}
+
+	return &downsampler{
+		bucket:   bucket,
+		function: cfg.Function,
+		open:     make(map[model.Fingerprint]*bucketState),
+	}, nil
+}
+
+// apply downsamples a batch ending at end. Buckets ending at or before end are
+// complete, as later batches only hold newer samples, and are returned; the
+// others stay open for the next batch. Buckets without samples produce nothing.
+func (d *downsampler) apply(result model.Value, end time.Time) (model.Value, error) {
+	matrix, ok := result.(model.Matrix)
+	if !ok {
+		return nil, fmt.Errorf("downsample requires a range (matrix) result, got %T", result)
+	}
+
+	size := model.Time(d.bucket.Milliseconds())
+	done := make(map[model.Fingerprint]*model.SampleStream)
+	for _, series := range matrix {
+		fp := series.Metric.Fingerprint()
+		state := d.open[fp]
+
+		for _, sample := range series.Values {
+			// Batches share their boundary timestamp, so skip samples already counted
+			if state != nil && sample.Timestamp <= state.lastTS {
+				continue
+			}
+
+			start := sample.Timestamp - sample.Timestamp%size
+			if state != nil && start != state.start {
+				d.emit(done, fp, state)
+				state = nil
+			}
+			if state == nil {
+				state = &bucketState{metric: series.Metric, start: start}
+			}
+			state.add(float64(sample.Value))
+			state.lastTS = sample.Timestamp
+		}
+		if state != nil {
+			d.open[fp] = state
+		}
+	}
+
+	// Close buckets no later batch can add to, including those of series
+	// absent from this batch
+	cutoff := model.TimeFromUnixNano(end.UnixNano())
+	for fp, state := range d.open {
+		if state.start+size <= cutoff {
+			d.emit(done, fp, state)
+			delete(d.open, fp)
+		}
+	}
+
+	return streams(done), nil
+}
+
+// flush returns the buckets still open after the last batch. The final
+// bucket of each series may cover only part of its span.
+func (d *downsampler) flush() model.Matrix {
+	done := make(map[model.Fingerprint]*model.SampleStream)
+	for fp, state := range d.open {
+		d.emit(done, fp, state)
+	}
+	d.open = make(map[model.Fingerprint]*bucketState)
+	return streams(done)
+}
+
+// emit appends the aggregate of a bucket to its series in done
+func (d *downsampler) emit(done map[model.Fingerprint]*model.SampleStream, fp model.Fingerprint, state *bucketState) {
+	stream, ok := done[fp]
+	if !ok {
+		stream = &model.SampleStream{Metric: state.metric}
+		done[fp] = stream
+	}
+	stream.Values = append(stream.Values, model.SamplePair{
+		Timestamp: state.start,
+		Value:     model.SampleValue(d.aggregate(state)),
+	})
+}
+
+// aggregate applies the downsample function to a bucket
+func (d *downsampler) aggregate(state *bucketState) float64 {
+	switch d.function {
+	case downsampleMin:
+		return state.min
+	case downsampleMax:
+		return state.max
+	case downsampleSum:
+		return state.sum
+	case downsampleLast:
+		return state.last
+	default:
+		return state.sum / float64(state.count)
+	}
+}
+
+// streams returns the series of done as a matrix sorted by labels, so
+// output order does not depend on map iteration
+func streams(done map[model.Fingerprint]*model.SampleStream) model.Matrix {
+	matrix := make(model.Matrix, 0, len(done))
+	for _, stream := range done {
+		matrix = append(matrix, stream)
+	}
+	sort.Sort(matrix)
+	return matrix
+}
@@ -0,0 +1,85 @@
+package processor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"github.com/prometheus/common/model"
+)
+
+func TestDownsampleFunctions(t *testing.T) {
+	// Samples every 15m; the 45m batch window cuts the first 1h bucket at
+	// 00:45, a timestamp both batches return
+	values := map[string]float64{
+		"00:00": 1, "00:15": 5, "00:30": 3, "00:45": 2,
+		"01:00": 4, "01:15": 8, "01:30": 6,
+	}
+	series := func(instance model.LabelValue, scale float64, start, end time.Time) *model.SampleStream {
+		s := &model.SampleStream{Metric: model.Metric{"instance": instance}}
+		for ts := start; !ts.After(end); ts = ts.Add(15 * time.Minute) {
+			s.Values = append(s.Values, model.SamplePair{Timestamp: model.TimeFromUnix(ts.Unix()), Value: model.SampleValue(scale * values[ts.Format("15:04")])})
+		}
+		return s
+	}
+
+	tests := []struct {
+		function string
+		want     [2]float64 // Buckets at 00:00 and 01:00
+	}{
+		{"avg", [2]float64{2.75, 6}},
+		{"min", [2]float64{1, 4}},
+		{"max", [2]float64{5, 8}},
+		{"sum", [2]float64{11, 18}},
+		{"last", [2]float64{2, 6}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.function, func(t *testing.T) {
+			client := &fakeClient{name: "prom"}
+			client.fetchRange = func(ctx context.Context, query string, start, end time.Time, step time.Duration) (model.Value, error) {
+				// A second series ten times the first, aggregated apart
+				return model.Matrix{series("tidb-0", 1, start, end), series("tidb-1", 10, start, end)}, nil
+			}
+			out := newMemorySink()
+			metrics := []config.MetricConfig{{Name: "qps", Query: "qps", Downsample: &config.DownsampleConfig{Function: tt.function, Bucket: "1h"}}}
+			p := newTestProcessor(out, config.ProcessorConfig{BatchWindow: "45m"}, client)
+			if err := p.ProcessMetrics(context.Background(), metrics, testTime("2024-01-01T00:00:00Z"), testTime("2024-01-01T01:30:00Z"), "15m"); err != nil {
+				t.Fatalf("ProcessMetrics() error = %v", err)
+			}
+			if n := len(client.fetched()); n != 2 {
+				t.Fatalf("fetched %d batches, want 2", n)
+			}
+
+			got := make(map[string][]float64)
+			for _, row := range out.metricRows("qps") {
+				instance := row.Labels["instance"]
+				bucket := len(got[instance])
+				wantTS := testTime("2024-01-01T00:00:00Z").Add(time.Duration(bucket) * time.Hour)
+				if !row.Timestamp.Equal(wantTS) {
+					t.Errorf("series %s bucket %d stamped %v, want the bucket start %v", instance, bucket, row.Timestamp, wantTS)
+				}
+				got[instance] = append(got[instance], row.Value)
+			}
+			for instance, scale := range map[string]float64{"tidb-0": 1, "tidb-1": 10} {
+				want := []float64{scale * tt.want[0], scale * tt.want[1]}
+				if len(got[instance]) != 2 || got[instance][0] != want[0] || got[instance][1] != want[1] {
+					t.Errorf("series %s = %v, want %v", instance, got[instance], want)
+				}
+			}
+		})
+	}
+}
+
+func TestDownsampleInvalid(t *testing.T) {
+	tests := []config.DownsampleConfig{
+		{Function: "median", Bucket: "1m"},
+		{Function: "avg", Bucket: "soon"},
+		{Function: "avg", Bucket: "500ms"},
+	}
+	for _, cfg := range tests {
+		if _, err := newDownsampler(&cfg); err == nil {
+			t.Errorf("newDownsampler(%+v) accepted invalid settings", cfg)
+		}
+	}
+}
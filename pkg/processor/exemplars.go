@@ -0,0 +1,118 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"github.com/meiking/tidb-metrics-crawler/pkg/prometheus"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+const (
+	// exemplarRowSuffix names the metric receiving exemplar rows, e.g. request_duration_exemplars
+	exemplarRowSuffix = "_exemplars"
+
+	// exemplarTimeLabel holds an exemplar's own time, as rows are stamped with the nearest sample
+	exemplarTimeLabel = "exemplar_timestamp"
+
+	// exemplarLabelPrefix renames exemplar labels that clash with the series' labels
+	exemplarLabelPrefix = "exemplar_"
+)
+
+// exemplarRow is an exemplar placed on the sample it belongs to
+type exemplarRow struct {
+	series   model.Metric
+	labels   model.LabelSet // The exemplar's own labels, such as trace_id
+	value    model.SampleValue
+	at       model.Time // The exemplar's time
+	sampleAt model.Time // Nearest sample time of the range query
+}
+
+// placeExemplars maps the exemplars of a batch from start to end onto the
+// range query's sample times, start plus whole steps. Each exemplar goes to
+// the nearest sample time, so its row lines up with the sample it explains.
+// Consecutive batches share their boundary, so an exemplar at end is left to
+// the next batch unless last is set. Rows are sorted by sample time, then
+// exemplar time.
+func placeExemplars(results []v1.ExemplarQueryResult, start, end time.Time, step time.Duration, last bool) []exemplarRow {
+	first, final := model.TimeFromUnixNano(start.UnixNano()), model.TimeFromUnixNano(end.UnixNano())
+	stepMs := model.Time(step.Milliseconds())
+
+	var rows []exemplarRow
+	for _, result := range results {
+		series := model.Metric(result.SeriesLabels)
+		for _, e := range result.Exemplars {
+			if e.Timestamp < first || e.Timestamp > final || e.Timestamp == final && !last {
+				continue // Outside the batch; the neighbouring batch has it
+			}
+			sampleAt := e.Timestamp
+			if stepMs > 0 {
+				steps := (e.Timestamp - first + stepMs/2) / stepMs
+				sampleAt = first + steps*stepMs
+				if sampleAt > final {
+					sampleAt -= stepMs
+				}
+			}
+			rows = append(rows, exemplarRow{series: series, labels: e.Labels, value: e.Value, at: e.Timestamp, sampleAt: sampleAt})
+		}
+	}
+
+	sort.SliceStable(rows, func(i, j int) bool {
+		if rows[i].sampleAt != rows[j].sampleAt {
+			return rows[i].sampleAt < rows[j].sampleAt
+		}
+		return rows[i].at < rows[j].at
+	})
+	return rows
+}
+
+// writeExemplars fetches the exemplars of a batch and writes one row per
+// exemplar to the metric's exemplar metric, valued with the exemplar's value
+// and carrying the series' labels plus the exemplar's
+func (p *Processor) writeExemplars(ctx context.Context, client prometheus.Client, metric config.MetricConfig, start, end time.Time, step time.Duration, last bool) (int, error) {
+	results, err := client.FetchExemplars(ctx, metric.Query, start, end, metricTimeout(metric))
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch exemplars: %v", err)
+	}
+
+	instanceName := client.Name()
+
+	name := metric.Name + exemplarRowSuffix
+	out := newChunkWriter(p.sink, name, p.cfg.Job, p.runID, p.cfg.RowChecksum, p.cfg.WriteChunkSize)
+	for _, row := range placeExemplars(results, start, end, step, last) {
+		labels, err := p.rowLabels(instanceName, metric, row.series)
+		if err != nil {
+			return 0, err
+		}
+		if labels == nil {
+			continue
+		}
+		for k, v := range row.labels {
+			key := string(k)
+			if _, exists := labels[key]; exists {
+				key = exemplarLabelPrefix + key
+			}
+			labels[key] = string(v)
+		}
+		labels[exemplarTimeLabel] = p.sampleTime(row.at).Format(time.RFC3339Nano)
+
+		if err := out.add(common.ProcessedData{
+			PrometheusInstance: instanceName,
+			MetricName:         name,
+			Timestamp:          p.sampleTime(row.sampleAt),
+			Value:              float64(row.value),
+			Labels:             labels,
+		}); err != nil {
+			return 0, fmt.Errorf("failed to write exemplars: %v", err)
+		}
+	}
+	if err := out.flush(); err != nil {
+		return 0, fmt.Errorf("failed to write exemplars: %v", err)
+	}
+	return out.written, nil
+}
@@ -0,0 +1,121 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+// exemplarsAt returns one series' exemplars at the given times, each with
+// a trace_id naming its time
+func exemplarsAt(times ...string) []v1.ExemplarQueryResult {
+	result := v1.ExemplarQueryResult{SeriesLabels: model.LabelSet{"job": "tidb", "le": "0.5"}}
+	for _, ts := range times {
+		at := testTime("2024-01-01T" + ts + "Z")
+		result.Exemplars = append(result.Exemplars, v1.Exemplar{
+			Labels:    model.LabelSet{"trace_id": model.LabelValue(ts), "job": "api"},
+			Value:     0.25,
+			Timestamp: model.TimeFromUnixNano(at.UnixNano()),
+		})
+	}
+	return []v1.ExemplarQueryResult{result}
+}
+
+func TestPlaceExemplars(t *testing.T) {
+	start, end := testTime("2024-01-01T00:00:00Z"), testTime("2024-01-01T00:10:00Z")
+	results := exemplarsAt("00:05:40", "00:00:20", "00:00:40", "00:05:10", "00:09:50", "00:10:00", "00:10:20", "23:59:59")
+
+	tests := []struct {
+		name string
+		last bool
+		want map[string]string // Exemplar time to sample time
+	}{
+		{"inner batch", false, map[string]string{
+			"00:00:20": "00:00:00", "00:00:40": "00:01:00", "00:05:10": "00:05:00", "00:05:40": "00:06:00", "00:09:50": "00:10:00",
+		}},
+		{"last batch", true, map[string]string{
+			"00:00:20": "00:00:00", "00:00:40": "00:01:00", "00:05:10": "00:05:00", "00:05:40": "00:06:00", "00:09:50": "00:10:00", "00:10:00": "00:10:00",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows := placeExemplars(results, start, end, time.Minute, tt.last)
+			got := make(map[string]string, len(rows))
+			for i, row := range rows {
+				got[row.at.Time().UTC().Format("15:04:05")] = row.sampleAt.Time().UTC().Format("15:04:05")
+				if i > 0 && (row.sampleAt < rows[i-1].sampleAt || row.sampleAt == rows[i-1].sampleAt && row.at < rows[i-1].at) {
+					t.Errorf("row %d at %v follows %v, want rows sorted by sample time", i, row.at, rows[i-1].at)
+				}
+				if row.series["le"] != "0.5" || row.labels["trace_id"] == "" || row.value != 0.25 {
+					t.Errorf("row %d = %+v, want the series, trace_id and value of its exemplar", i, row)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("exemplar to sample times = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExemplarsWrittenWithSamples(t *testing.T) {
+	var mu sync.Mutex
+	var fetched []string
+	client := &fakeClient{name: "prom"}
+	client.exemplars = func(ctx context.Context, query string, start, end time.Time) ([]v1.ExemplarQueryResult, error) {
+		mu.Lock()
+		fetched = append(fetched, fmt.Sprintf("%s %s-%s", query, start.Format("15:04"), end.Format("15:04")))
+		mu.Unlock()
+		// The exemplar at the 00:30 seam is returned for both batches
+		return exemplarsAt("00:29:50", "00:30:00", "00:59:59"), nil
+	}
+
+	out := newMemorySink()
+	p := newTestProcessor(out, config.ProcessorConfig{BatchWindow: "30m"}, client)
+	metrics := []config.MetricConfig{
+		{Name: "latency", Query: "latency", LabelKeys: []string{"*"}, WithExemplars: true},
+		{Name: "qps", Query: "qps"},
+	}
+	if err := p.ProcessMetrics(context.Background(), metrics, testTime("2024-01-01T00:00:00Z"), testTime("2024-01-01T01:00:00Z"), "1m"); err != nil {
+		t.Fatalf("ProcessMetrics() error = %v", err)
+	}
+
+	// Only the metric that opts in fetches exemplars, once per batch
+	if want := []string{"latency 00:00-00:30", "latency 00:30-01:00"}; !reflect.DeepEqual(fetched, want) {
+		t.Errorf("fetched exemplars %v, want %v", fetched, want)
+	}
+	if rows := out.metricRows("qps_exemplars"); len(rows) != 0 {
+		t.Errorf("wrote %d exemplar rows for qps, which did not opt in", len(rows))
+	}
+
+	rows := out.metricRows("latency_exemplars")
+	want := []struct {
+		trace  string
+		sample string
+	}{
+		{"00:29:50", "2024-01-01T00:30:00Z"},
+		{"00:30:00", "2024-01-01T00:30:00Z"},
+		{"00:59:59", "2024-01-01T01:00:00Z"},
+	}
+	if len(rows) != len(want) {
+		t.Fatalf("wrote %d exemplar rows, want %d: %+v", len(rows), len(want), rows)
+	}
+	for i, row := range rows {
+		if row.Labels["trace_id"] != want[i].trace || !row.Timestamp.Equal(testTime(want[i].sample)) || row.Value != 0.25 {
+			t.Errorf("row %d = %v at %v valued %v, want trace %s at %s valued 0.25", i, row.Labels, row.Timestamp, row.Value, want[i].trace, want[i].sample)
+		}
+		// The series keeps job; the exemplar's own job is renamed
+		if row.Labels["job"] != "tidb" || row.Labels["exemplar_job"] != "api" || row.Labels["le"] != "0.5" {
+			t.Errorf("row %d labels = %v, want the series' job and le with the exemplar's job as exemplar_job", i, row.Labels)
+		}
+		if ts := row.Labels["exemplar_timestamp"]; ts != "2024-01-01T"+want[i].trace+"Z" {
+			t.Errorf("row %d exemplar_timestamp = %s, want the exemplar's own time", i, ts)
+		}
+	}
+}
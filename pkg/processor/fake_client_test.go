@@ -0,0 +1,170 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"github.com/meiking/tidb-metrics-crawler/pkg/prometheus"
+	"github.com/meiking/tidb-metrics-crawler/pkg/sink"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+// fakeClient is a prometheus.Client answering from functions set by each
+// test. Unset range and instant queries return one series with a sample at
+// every step, valued with the sample's Unix time.
+type fakeClient struct {
+	name    string
+	address string
+	labels  map[string]string
+
+	fetchRange   func(ctx context.Context, query string, start, end time.Time, step time.Duration) (model.Value, error)
+	fetchInstant func(ctx context.Context, query string, ts time.Time) (model.Value, error)
+	exemplars    func(ctx context.Context, query string, start, end time.Time) ([]v1.ExemplarQueryResult, error)
+	rules        v1.RulesResult
+	alerts       v1.AlertsResult
+	backend      prometheus.Backend
+	metadata     map[string][]v1.Metadata
+
+	mu     sync.Mutex
+	ranges []batchRange // Range queries seen, in call order
+}
+
+func (c *fakeClient) Name() string              { return c.name }
+func (c *fakeClient) Address() string           { return c.address }
+func (c *fakeClient) Labels() map[string]string { return c.labels }
+func (c *fakeClient) Stats() prometheus.QueryStats {
+	return prometheus.QueryStats{}
+}
+
+func (c *fakeClient) FetchRange(ctx context.Context, query string, start, end time.Time, step, timeout time.Duration) (model.Value, error) {
+	c.mu.Lock()
+	c.ranges = append(c.ranges, batchRange{start: start, end: end})
+	c.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if c.fetchRange != nil {
+		return c.fetchRange(ctx, query, start, end, step)
+	}
+	return rangeMatrix(model.Metric{"job": "tidb"}, start, end, step), nil
+}
+
+func (c *fakeClient) FetchInstant(ctx context.Context, query string, ts time.Time, timeout time.Duration) (model.Value, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if c.fetchInstant != nil {
+		return c.fetchInstant(ctx, query, ts)
+	}
+	return model.Vector{{Metric: model.Metric{"job": "tidb"}, Value: model.SampleValue(ts.Unix()), Timestamp: model.TimeFromUnix(ts.Unix())}}, nil
+}
+
+func (c *fakeClient) FetchExemplars(ctx context.Context, query string, start, end time.Time, timeout time.Duration) ([]v1.ExemplarQueryResult, error) {
+	if c.exemplars != nil {
+		return c.exemplars(ctx, query, start, end)
+	}
+	return nil, nil
+}
+
+func (c *fakeClient) Rules(ctx context.Context) (v1.RulesResult, error)   { return c.rules, ctx.Err() }
+func (c *fakeClient) Alerts(ctx context.Context) (v1.AlertsResult, error) { return c.alerts, ctx.Err() }
+
+func (c *fakeClient) LabelValues(label string) (model.LabelValues, error) {
+	return nil, errors.New("not supported by fakeClient")
+}
+
+func (c *fakeClient) Metadata(metric string) (map[string][]v1.Metadata, error) {
+	if metric == "" {
+		return c.metadata, nil
+	}
+	if md, ok := c.metadata[metric]; ok {
+		return map[string][]v1.Metadata{metric: md}, nil
+	}
+	return map[string][]v1.Metadata{}, nil
+}
+
+func (c *fakeClient) DetectBackend() (prometheus.Backend, error) {
+	return c.backend, nil
+}
+
+// fetched returns the range queries seen so far
+func (c *fakeClient) fetched() []batchRange {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]batchRange(nil), c.ranges...)
+}
+
+// newTestProcessor creates a processor writing to out from clients
+func newTestProcessor(out sink.Sink, cfg config.ProcessorConfig, clients ...*fakeClient) *Processor {
+	promClients := make([]prometheus.Client, len(clients))
+	for i, client := range clients {
+		promClients[i] = client
+	}
+	p := NewProcessor(promClients, out, cfg)
+	p.loc = time.UTC // Set again by ProcessMetrics, for tests calling its parts directly
+	return p
+}
+
+// rangeMatrix returns one series with a sample at every step from start to
+// end inclusive, valued with the sample's Unix time
+func rangeMatrix(labels model.Metric, start, end time.Time, step time.Duration) model.Matrix {
+	series := &model.SampleStream{Metric: labels}
+	for t := start; !t.After(end); t = t.Add(step) {
+		series.Values = append(series.Values, model.SamplePair{Timestamp: model.TimeFromUnix(t.Unix()), Value: model.SampleValue(t.Unix())})
+	}
+	return model.Matrix{series}
+}
+
+// memorySink records every write. failWrites makes the first writes fail.
+type memorySink struct {
+	mu         sync.Mutex
+	rows       map[string][]common.ProcessedData // Keyed by metric name
+	writes     int
+	failWrites int
+	closed     bool
+}
+
+func newMemorySink() *memorySink {
+	return &memorySink{rows: make(map[string][]common.ProcessedData)}
+}
+
+func (s *memorySink) Write(metricName string, data []common.ProcessedData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.writes++
+	if s.writes <= s.failWrites {
+		return errors.New("sink unavailable")
+	}
+	s.rows[metricName] = append(s.rows[metricName], data...)
+	return nil
+}
+
+func (s *memorySink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+// metricRows returns the rows written for metricName
+func (s *memorySink) metricRows(metricName string) []common.ProcessedData {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]common.ProcessedData(nil), s.rows[metricName]...)
+}
+
+// testTime parses an RFC 3339 time, panicking on a typo in a test
+func testTime(s string) time.Time {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
@@ -0,0 +1,37 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"github.com/meiking/tidb-metrics-crawler/pkg/prometheus"
+)
+
+// processSelectors fetches every series matching the match selectors of a
+// federate metric. A selector such as {job="tikv"} is itself a query whose
+// result keeps each series' __name__, so each selector is fetched like the
+// query of a keep_metric_name metric. Unlike /federate, this covers the whole
+// time range rather than the latest samples.
+func (p *Processor) processSelectors(
+	ctx context.Context,
+	client prometheus.Client,
+	metric config.MetricConfig,
+	start, end time.Time,
+	step, window time.Duration,
+) error {
+	for i, selector := range metric.Match {
+		log.Printf("Fetching series matching %s", selector)
+		p.progress.startPart(metric.Name, client.Name(), i, len(metric.Match))
+
+		selected := metric
+		selected.Query = selector
+		selected.KeepMetricName = true
+		if err := p.processQuery(ctx, client, selected, start, end, step, window); err != nil {
+			return fmt.Errorf("selector %s: %v", selector, err)
+		}
+	}
+	return nil
+}
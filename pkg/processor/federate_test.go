@@ -0,0 +1,75 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"github.com/prometheus/common/model"
+)
+
+func TestFederateSelectors(t *testing.T) {
+	// Each selector matches several metric families
+	families := map[string][]model.Metric{
+		`{job="tikv"}`: {
+			{model.MetricNameLabel: "tikv_engine_size_bytes", "job": "tikv", "instance": "tikv-0"},
+			{model.MetricNameLabel: "tikv_engine_size_bytes", "job": "tikv", "instance": "tikv-1"},
+			{model.MetricNameLabel: "tikv_store_size_bytes", "job": "tikv", "instance": "tikv-0"},
+		},
+		`{__name__=~"pd_.+"}`: {
+			{model.MetricNameLabel: "pd_cluster_status", "job": "pd", "type": "leader_count"},
+			{model.MetricNameLabel: "pd_regions_status", "job": "pd", "type": "miss-peer-region-count"},
+		},
+	}
+	var queries []string // Selectors are fetched one after another
+	client := &fakeClient{name: "prom"}
+	client.fetchRange = func(ctx context.Context, query string, start, end time.Time, step time.Duration) (model.Value, error) {
+		queries = append(queries, query)
+		matched, ok := families[query]
+		if !ok {
+			return nil, fmt.Errorf("unexpected query %s", query)
+		}
+		var matrix model.Matrix
+		for _, labels := range matched {
+			matrix = append(matrix, rangeMatrix(labels, start, end, step)...)
+		}
+		return matrix, nil
+	}
+
+	out := newMemorySink()
+	p := newTestProcessor(out, config.ProcessorConfig{}, client)
+	metrics := []config.MetricConfig{{
+		Name:      "cluster",
+		Type:      metricTypeFederate,
+		Match:     []string{`{job="tikv"}`, `{__name__=~"pd_.+"}`},
+		LabelKeys: []string{"*"},
+	}}
+	if err := p.ProcessMetrics(context.Background(), metrics, testTime("2024-01-01T00:00:00Z"), testTime("2024-01-01T01:00:00Z"), "30m"); err != nil {
+		t.Fatalf("ProcessMetrics() error = %v", err)
+	}
+
+	if !slices.Equal(queries, metrics[0].Match) {
+		t.Errorf("queries = %v, want one per selector", queries)
+	}
+
+	// Three points per series, each row tagged with its family
+	rows := make(map[string]int)
+	for _, row := range out.metricRows("cluster") {
+		rows[row.SeriesName]++
+		if row.Labels["job"] == "" {
+			t.Errorf("row %+v lost the series' labels", row)
+		}
+	}
+	want := map[string]int{"tikv_engine_size_bytes": 6, "tikv_store_size_bytes": 3, "pd_cluster_status": 3, "pd_regions_status": 3}
+	if len(rows) != len(want) {
+		t.Errorf("rows per series name = %v, want %v", rows, want)
+	}
+	for name, n := range want {
+		if rows[name] != n {
+			t.Errorf("%s: %d rows, want %d", name, rows[name], n)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package processor
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"github.com/prometheus/common/model"
+)
+
+const (
+	// gapRowSuffix names the metric receiving gap rows, e.g. cpu_usage_gaps
+	gapRowSuffix = "_gaps"
+
+	// maxLoggedGapSeries limits how many series with gaps are logged per metric
+	maxLoggedGapSeries = 10
+)
+
+// SeriesGaps summarizes the gaps found in one series
+type SeriesGaps struct {
+	Instance string
+	Series   string        // Labels of the series, e.g. {instance="tikv-1"}
+	Count    int           // Number of gaps
+	Total    time.Duration // Missing points times the step
+}
+
+// gap is a run of missing points between two samples of a series
+type gap struct {
+	metric model.Metric
+	prev   model.Time // Last sample before the gap
+	next   model.Time // First sample after the gap
+	step   model.Time
+}
+
+// gapTracker finds gaps in the series of one metric and instance. The last
+// timestamp of every series is carried into the next batch, so a gap across
+// a batch boundary is found once.
+type gapTracker struct {
+	instance string
+	step     model.Time
+	last     map[model.Fingerprint]model.Time
+	series   map[model.Fingerprint]*SeriesGaps
+}
+
+// newGapTracker creates a tracker expecting one sample per step
+func newGapTracker(instance string, step time.Duration) *gapTracker {
+	return &gapTracker{
+		instance: instance,
+		step:     model.Time(step.Milliseconds()),
+		last:     make(map[model.Fingerprint]model.Time),
+		series:   make(map[model.Fingerprint]*SeriesGaps),
+	}
+}
+
+// observe scans a batch result and returns the gaps it closes. Two samples
+// further apart than the step have missing points between them; a series
+// starting late or ending early is not a gap.
+func (t *gapTracker) observe(result model.Value) []gap {
+	matrix, ok := result.(model.Matrix)
+	if !ok || t.step <= 0 {
+		return nil
+	}
+
+	var gaps []gap
+	for _, series := range matrix {
+		fp := series.Metric.Fingerprint()
+		prev, hasPrev := t.last[fp]
+		for _, sample := range series.Values {
+			ts := sample.Timestamp
+			if hasPrev && ts <= prev {
+				continue // Repeated at the batch boundary
+			}
+			if hasPrev && ts-prev > t.step {
+				gaps = append(gaps, gap{metric: series.Metric, prev: prev, next: ts, step: t.step})
+				t.record(fp, series.Metric, ts-prev-t.step)
+			}
+			prev, hasPrev = ts, true
+		}
+		if hasPrev {
+			t.last[fp] = prev
+		}
+	}
+	return gaps
+}
+
+// record adds a gap of missing length to the series' summary
+func (t *gapTracker) record(fp model.Fingerprint, metric model.Metric, missing model.Time) {
+	s, ok := t.series[fp]
+	if !ok {
+		s = &SeriesGaps{Instance: t.instance, Series: metric.String()}
+		t.series[fp] = s
+	}
+	s.Count++
+	s.Total += time.Duration(missing) * time.Millisecond
+}
+
+// summary returns the series with gaps, sorted by labels
+func (t *gapTracker) summary() []SeriesGaps {
+	out := make([]SeriesGaps, 0, len(t.series))
+	for _, s := range t.series {
+		out = append(out, *s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Series < out[j].Series })
+	return out
+}
+
+// writeGaps writes one row per gap to the metric's gap metric, stamped with
+// the first missing point and valued with the gap's length in seconds
+func (p *Processor) writeGaps(instanceName string, metric config.MetricConfig, gaps []gap) error {
+	out := newChunkWriter(p.sink, metric.Name+gapRowSuffix, p.cfg.Job, p.runID, p.cfg.RowChecksum, p.cfg.WriteChunkSize)
+	for _, g := range gaps {
+		labels, err := p.rowLabels(instanceName, metric, g.metric)
+		if err != nil {
+			return err
+		}
+		if labels == nil {
+			continue
+		}
+		if err := out.add(common.ProcessedData{
+			PrometheusInstance: instanceName,
+			MetricName:         metric.Name + gapRowSuffix,
+			Timestamp:          p.sampleTime(g.prev + g.step),
+			Value:              float64(g.next-g.prev-g.step) / 1000,
+			Labels:             labels,
+		}); err != nil {
+			return fmt.Errorf("failed to write gaps: %v", err)
+		}
+	}
+	if err := out.flush(); err != nil {
+		return fmt.Errorf("failed to write gaps: %v", err)
+	}
+	return nil
+}
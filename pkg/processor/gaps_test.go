@@ -0,0 +1,56 @@
+package processor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"github.com/prometheus/common/model"
+)
+
+func TestDetectGaps(t *testing.T) {
+	// tidb-0 has no samples from 00:20 to 00:29, across the 00:25 batch
+	// seam; tidb-1 is complete and tidb-2 starts late, which is not a gap
+	missingFrom, missingTo := testTime("2024-01-01T00:20:00Z"), testTime("2024-01-01T00:29:00Z")
+	lateStart := testTime("2024-01-01T00:40:00Z")
+	client := &fakeClient{name: "prom"}
+	client.fetchRange = func(ctx context.Context, query string, start, end time.Time, step time.Duration) (model.Value, error) {
+		gapped := rangeMatrix(model.Metric{"instance": "tidb-0"}, start, end, step)[0]
+		var kept []model.SamplePair
+		for _, sample := range gapped.Values {
+			if ts := sample.Timestamp.Time(); ts.Before(missingFrom) || ts.After(missingTo) {
+				kept = append(kept, sample)
+			}
+		}
+		gapped.Values = kept
+		matrix := model.Matrix{gapped, rangeMatrix(model.Metric{"instance": "tidb-1"}, start, end, step)[0]}
+		if end.After(lateStart) {
+			matrix = append(matrix, rangeMatrix(model.Metric{"instance": "tidb-2"}, lateStart, end, step)[0])
+		}
+		return matrix, nil
+	}
+
+	out := newMemorySink()
+	p := newTestProcessor(out, config.ProcessorConfig{BatchWindow: "25m", DetectGaps: true, GapRows: true}, client)
+	metrics := []config.MetricConfig{{Name: "qps", Query: "qps", LabelKeys: []string{"instance"}}}
+	if err := p.ProcessMetrics(context.Background(), metrics, testTime("2024-01-01T00:00:00Z"), testTime("2024-01-01T01:00:00Z"), "1m"); err != nil {
+		t.Fatalf("ProcessMetrics() error = %v", err)
+	}
+
+	gaps := p.Summary().Gaps["qps"]
+	if len(gaps) != 1 {
+		t.Fatalf("summary gaps = %+v, want only the tidb-0 series", gaps)
+	}
+	if g := gaps[0]; g.Series != `{instance="tidb-0"}` || g.Instance != "prom" || g.Count != 1 || g.Total != 10*time.Minute {
+		t.Errorf("summary gap = %+v, want one 10m gap in tidb-0 on prom", g)
+	}
+
+	rows := out.metricRows("qps" + gapRowSuffix)
+	if len(rows) != 1 {
+		t.Fatalf("gap rows = %+v, want one", rows)
+	}
+	if row := rows[0]; !row.Timestamp.Equal(missingFrom) || row.Value != 600 || row.Labels["instance"] != "tidb-0" {
+		t.Errorf("gap row = %+v, want tidb-0 at %v valued 600 seconds", row, missingFrom)
+	}
+}
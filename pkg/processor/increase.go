@@ -0,0 +1,93 @@
+package processor
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// transformIncrease turns counter series into their increase per batch window
+const transformIncrease = "increase"
+
+// counterSample is the last sample seen of a counter series
+type counterSample struct {
+	ts    model.Time
+	value float64
+}
+
+// increaseTracker replaces each batch of counter series with one sample per
+// series holding its increase over the batch. The last sample of every
+// series is carried into the next batch, so the increase across the seam
+// between two batches is not lost.
+type increaseTracker struct {
+	last map[model.Fingerprint]counterSample
+}
+
+// newIncreaseTracker creates a tracker for the batches of one metric and instance
+func newIncreaseTracker() *increaseTracker {
+	return &increaseTracker{last: make(map[model.Fingerprint]counterSample)}
+}
+
+// apply returns a matrix with a single sample per series, stamped with the
+// batch end, holding the series' reset-aware increase since the previous
+// batch's last sample
+func (t *increaseTracker) apply(result model.Value, end time.Time) (model.Value, error) {
+	matrix, ok := result.(model.Matrix)
+	if !ok {
+		return nil, fmt.Errorf("increase requires a range (matrix) result, got %T", result)
+	}
+
+	out := make(model.Matrix, 0, len(matrix))
+	for _, series := range matrix {
+		fp := series.Metric.Fingerprint()
+		prev, hasPrev := t.last[fp]
+
+		// Batches share their boundary timestamp, so skip samples already counted
+		values := series.Values
+		for hasPrev && len(values) > 0 && values[0].Timestamp <= prev.ts {
+			values = values[1:]
+		}
+		if len(values) == 0 {
+			continue
+		}
+
+		increase, ok := counterIncrease(prev.value, hasPrev, values)
+		last := values[len(values)-1]
+		t.last[fp] = counterSample{ts: last.Timestamp, value: float64(last.Value)}
+		if !ok {
+			continue
+		}
+
+		out = append(out, &model.SampleStream{
+			Metric: series.Metric,
+			Values: []model.SamplePair{{Timestamp: model.TimeFromUnixNano(end.UnixNano()), Value: model.SampleValue(increase)}},
+		})
+	}
+	return out, nil
+}
+
+// counterIncrease sums the increase across values, starting from prev when
+// hasPrev is set. A drop is a counter reset, after which the counter
+// counted up from zero to the current value. It reports false when fewer
+// than two samples are available.
+func counterIncrease(prev float64, hasPrev bool, values []model.SamplePair) (float64, bool) {
+	if !hasPrev {
+		if len(values) < 2 {
+			return 0, false
+		}
+		prev, values = float64(values[0].Value), values[1:]
+	}
+
+	var increase float64
+	for _, v := range values {
+		current := float64(v.Value)
+		if current < prev {
+			increase += current
+		} else {
+			increase += current - prev
+		}
+		prev = current
+	}
+	return increase, true
+}
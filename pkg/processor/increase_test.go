@@ -0,0 +1,93 @@
+package processor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// counterSeries returns a counter series with a sample every minute from
+// start, one per value
+func counterSeries(start time.Time, values ...float64) *model.SampleStream {
+	series := &model.SampleStream{Metric: model.Metric{"job": "tidb"}}
+	for i, v := range values {
+		ts := start.Add(time.Duration(i) * time.Minute)
+		series.Values = append(series.Values, model.SamplePair{Timestamp: model.TimeFromUnix(ts.Unix()), Value: model.SampleValue(v)})
+	}
+	return series
+}
+
+func TestIncreaseTracker(t *testing.T) {
+	start := testTime("2024-01-01T00:00:00Z")
+
+	tests := []struct {
+		name    string
+		batches [][]float64 // Each batch starts where the previous one ended, sharing that sample
+		want    []float64   // Increase per batch
+	}{
+		{"monotonic", [][]float64{{10, 15, 20, 30}}, []float64{20}},
+		{"single reset", [][]float64{{10, 20, 5, 8}}, []float64{10 + 5 + 3}},
+		{"multiple resets", [][]float64{{100, 120, 4, 10, 2, 7}}, []float64{20 + 4 + 6 + 2 + 5}},
+		{"batch seam", [][]float64{{10, 12, 15}, {15, 18, 25}, {25, 25}}, []float64{5, 10, 0}},
+		{"reset at the seam", [][]float64{{10, 12, 15}, {3, 9}}, []float64{5, 3 + 6}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tracker := newIncreaseTracker()
+			batchStart := start
+			for i, values := range tc.batches {
+				series := counterSeries(batchStart, values...)
+				if i > 0 && values[0] != tc.batches[i-1][len(tc.batches[i-1])-1] {
+					// A reset right at the seam has no shared sample
+					series = counterSeries(batchStart.Add(time.Minute), values...)
+				}
+				last := series.Values[len(series.Values)-1].Timestamp.Time()
+
+				result, err := tracker.apply(model.Matrix{series}, last)
+				if err != nil {
+					t.Fatalf("batch %d: apply() error = %v", i, err)
+				}
+				matrix := result.(model.Matrix)
+				if len(matrix) != 1 || len(matrix[0].Values) != 1 {
+					t.Fatalf("batch %d: apply() = %v, want one sample", i, matrix)
+				}
+				got := matrix[0].Values[0]
+				if float64(got.Value) != tc.want[i] {
+					t.Errorf("batch %d: increase = %v, want %v", i, got.Value, tc.want[i])
+				}
+				if !got.Timestamp.Time().Equal(last) {
+					t.Errorf("batch %d: stamped %v, want the batch end %v", i, got.Timestamp.Time(), last)
+				}
+				batchStart = last
+			}
+		})
+	}
+}
+
+func TestIncreaseTrackerSingleSample(t *testing.T) {
+	// A series first seen with one sample has no increase yet, but the
+	// sample is the base of the next batch
+	start := testTime("2024-01-01T00:00:00Z")
+	tracker := newIncreaseTracker()
+
+	result, err := tracker.apply(model.Matrix{counterSeries(start, 10)}, start)
+	if err != nil {
+		t.Fatalf("apply() error = %v", err)
+	}
+	if matrix := result.(model.Matrix); len(matrix) != 0 {
+		t.Errorf("apply() = %v, want no series", matrix)
+	}
+
+	result, err = tracker.apply(model.Matrix{counterSeries(start.Add(time.Minute), 14)}, start.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("apply() error = %v", err)
+	}
+	if matrix := result.(model.Matrix); len(matrix) != 1 || matrix[0].Values[0].Value != 4 {
+		t.Errorf("apply() = %v, want an increase of 4 from the earlier sample", matrix)
+	}
+
+	if _, err := tracker.apply(model.Vector{}, start); err == nil {
+		t.Error("apply() of a vector succeeded, want a matrix required")
+	}
+}
@@ -0,0 +1,160 @@
+package processor
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"github.com/prometheus/common/model"
+)
+
+// Policies for a label set by more than one source. Sources take precedence
+// in the order scraped < instance (labels, instance_label) < metric extra_labels.
+const (
+	labelConflictExported = "exported" // Keep an overridden scraped value as exported_<name>, as Prometheus does (default)
+	labelConflictOverride = "override" // Drop the overridden value
+	labelConflictSuffix   = "suffix"   // Keep the overridden value as <name>_2, <name>_3, ...
+	labelConflictError    = "error"    // Fail the metric on the instance
+)
+
+// Meanings of an empty label_keys, chosen with processor.default_labels
+const (
+	defaultLabelsAll  = "all"  // Keep every label, as ["*"] does (default)
+	defaultLabelsNone = "none" // Keep no scraped labels
+)
+
+// labelKeys returns the metric's label_keys, resolving an empty list with
+// processor.default_labels
+func (p *Processor) labelKeys(metric config.MetricConfig) []string {
+	if len(metric.LabelKeys) == 0 && p.cfg.DefaultLabels != defaultLabelsNone {
+		return []string{allLabelsKey}
+	}
+	return metric.LabelKeys
+}
+
+// rowSet holds the label sets of the series of one query result. The
+// series of a result all differ, so two with the same row labels differed
+// only in labels label_keys dropped, and their rows cannot be told apart.
+type rowSet map[string]struct{}
+
+// add records a series' row labels and reports whether another series of
+// the result already had them
+func (s rowSet) add(seriesName string, labels map[string]string) bool {
+	id := seriesName + "\x00" + common.LabelsHash(labels)
+	if _, exists := s[id]; exists {
+		return true
+	}
+	s[id] = struct{}{}
+	return false
+}
+
+// collisionWarner warns once per metric and instance about series whose
+// rows cannot be told apart
+type collisionWarner struct {
+	mu     sync.Mutex
+	warned map[string]bool
+}
+
+// newCollisionWarner creates a warner that has not warned yet
+func newCollisionWarner() *collisionWarner {
+	return &collisionWarner{warned: make(map[string]bool)}
+}
+
+// warn logs that series of a metric collapsed into identical rows on an instance
+func (w *collisionWarner) warn(metricName, instance string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	key := metricName + "\x00" + instance
+	if w.warned[key] {
+		return
+	}
+	w.warned[key] = true
+	log.Printf("Warning: series of metric %s on %s have identical labels after label_keys, so their rows cannot be told apart; keep the labels that differ", metricName, instance)
+}
+
+// exportedLabelPrefix namespaces scraped labels that collide with injected ones
+const exportedLabelPrefix = "exported_"
+
+// Label sources named in conflict errors
+const (
+	labelSourceScraped  = "scraped"
+	labelSourceInstance = "instance"
+	labelSourceMetric   = "extra_labels"
+)
+
+// keptLabels returns the scraped labels kept by the metric's label_keys and
+// rewritten by its relabel rules, or nil when a rule drops the series
+func (p *Processor) keptLabels(metric config.MetricConfig, scraped model.Metric) map[string]string {
+	labels := extractLabels(scraped, p.labelKeys(metric))
+	if rules := p.relabel[metric.Name]; rules != nil && !rules.apply(labels) {
+		return nil
+	}
+	return labels
+}
+
+// rowLabels returns the labels of a row: the scraped labels kept by the
+// metric's label_keys and relabel rules, then the instance's injected
+// labels, then the metric's extra_labels, resolving names set by several of
+// them with processor.on_label_conflict. Nil labels mean relabeling dropped
+// the series, so it has no rows.
+func (p *Processor) rowLabels(instanceName string, metric config.MetricConfig, scraped model.Metric) (map[string]string, error) {
+	labels := p.keptLabels(metric, scraped)
+	if labels == nil {
+		return nil, nil
+	}
+	var injectedBy map[string]string // Source of labels set after the scraped ones
+	for _, layer := range []struct {
+		source string
+		labels map[string]string
+	}{
+		{labelSourceInstance, p.injected[instanceName]},
+		{labelSourceMetric, metric.ExtraLabels},
+	} {
+		// Sorted, so suffixes do not depend on map order
+		for _, k := range common.SortedLabelKeys(layer.labels) {
+			v := layer.labels[k]
+			if old, exists := labels[k]; exists && old != v {
+				from := labelSourceScraped
+				if source, ok := injectedBy[k]; ok {
+					from = source
+				}
+				if err := p.resolveLabelConflict(labels, k, old, from, v, layer.source); err != nil {
+					return nil, err
+				}
+			}
+			labels[k] = v
+			if injectedBy == nil {
+				injectedBy = make(map[string]string)
+			}
+			injectedBy[k] = layer.source
+		}
+	}
+	return labels, nil
+}
+
+// resolveLabelConflict applies the conflict policy before label name's value
+// old, set by from, is replaced with value from source
+func (p *Processor) resolveLabelConflict(labels map[string]string, name, old, from, value, source string) error {
+	switch p.cfg.OnLabelConflict {
+	case labelConflictOverride:
+	case labelConflictSuffix:
+		for i := 2; ; i++ {
+			renamed := name + "_" + strconv.Itoa(i)
+			if _, taken := labels[renamed]; !taken {
+				labels[renamed] = old
+				break
+			}
+		}
+	case labelConflictError:
+		return fmt.Errorf("label %s is %q from %s and %q from %s (on_label_conflict: error)", name, old, from, value, source)
+	default:
+		if from == labelSourceScraped {
+			labels[exportedLabelPrefix+name] = old
+		}
+	}
+	return nil
+}
@@ -0,0 +1,339 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"github.com/meiking/tidb-metrics-crawler/pkg/sink"
+	"github.com/prometheus/common/model"
+)
+
+func TestExtractLabels(t *testing.T) {
+	series := model.Metric{
+		model.MetricNameLabel: "tidb_server_query_total",
+		"instance":            "tidb-0:10080",
+		"job":                 "tidb",
+		"type":                "Select",
+	}
+	all := map[string]string{"instance": "tidb-0:10080", "job": "tidb", "type": "Select"}
+
+	tests := []struct {
+		name string
+		keys []string
+		want map[string]string
+	}{
+		{"all", []string{"*"}, all},
+		{"all among explicit keys", []string{"type", "*"}, all},
+		{"explicit", []string{"type", "job"}, map[string]string{"job": "tidb", "type": "Select"}},
+		{"explicit missing", []string{"type", "db"}, map[string]string{"type": "Select"}},
+		{"explicit name", []string{"__name__"}, map[string]string{"__name__": "tidb_server_query_total"}},
+		{"none", nil, map[string]string{}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := extractLabels(series, tc.keys); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("extractLabels(%q) = %v, want %v", tc.keys, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRowLabelsConflict(t *testing.T) {
+	// region is set by the scrape and the instance, dc by the instance and
+	// the metric's extra_labels
+	scraped := model.Metric{"job": "tidb", "region": "east"}
+	client := &fakeClient{name: "prom", labels: map[string]string{"region": "west", "dc": "a"}}
+	metric := config.MetricConfig{Name: "qps", LabelKeys: []string{"*"}, ExtraLabels: map[string]string{"dc": "b"}}
+
+	tests := []struct {
+		policy string
+		want   map[string]string
+	}{
+		{"", map[string]string{"job": "tidb", "region": "west", "exported_region": "east", "dc": "b"}},
+		{"exported", map[string]string{"job": "tidb", "region": "west", "exported_region": "east", "dc": "b"}},
+		{"override", map[string]string{"job": "tidb", "region": "west", "dc": "b"}},
+		{"suffix", map[string]string{"job": "tidb", "region": "west", "region_2": "east", "dc": "b", "dc_2": "a"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.policy, func(t *testing.T) {
+			p := newTestProcessor(newMemorySink(), config.ProcessorConfig{OnLabelConflict: tc.policy}, client)
+			p.injected = p.injectedLabels()
+
+			got, err := p.rowLabels("prom", metric, scraped)
+			if err != nil {
+				t.Fatalf("rowLabels() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("rowLabels() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+
+	t.Run("error", func(t *testing.T) {
+		p := newTestProcessor(newMemorySink(), config.ProcessorConfig{OnLabelConflict: "error"}, client)
+		p.injected = p.injectedLabels()
+
+		_, err := p.rowLabels("prom", metric, scraped)
+		if err == nil {
+			t.Fatal("rowLabels() succeeded with conflicting labels")
+		}
+		if msg := err.Error(); !strings.Contains(msg, `region is "east" from scraped and "west" from instance`) {
+			t.Errorf("rowLabels() error = %q, want the label, both values and their sources", msg)
+		}
+	})
+
+	t.Run("same value", func(t *testing.T) {
+		p := newTestProcessor(newMemorySink(), config.ProcessorConfig{OnLabelConflict: "error"}, client)
+		p.injected = p.injectedLabels()
+
+		agreeing := model.Metric{"job": "tidb", "region": "west"}
+		got, err := p.rowLabels("prom", config.MetricConfig{Name: "qps", LabelKeys: []string{"*"}}, agreeing)
+		if err != nil {
+			t.Fatalf("rowLabels() error = %v, want equal values not to conflict", err)
+		}
+		if want := map[string]string{"job": "tidb", "region": "west", "dc": "a"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("rowLabels() = %v, want %v", got, want)
+		}
+	})
+}
+
+func TestKeepMetricName(t *testing.T) {
+	// A regex selector matching two metrics whose series share their labels
+	client := &fakeClient{name: "prom"}
+	client.fetchRange = func(ctx context.Context, query string, start, end time.Time, step time.Duration) (model.Value, error) {
+		reads := rangeMatrix(model.Metric{model.MetricNameLabel: "tikv_reads_total", "job": "tikv"}, start, end, step)
+		writes := rangeMatrix(model.Metric{model.MetricNameLabel: "tikv_writes_total", "job": "tikv"}, start, end, step)
+		return append(reads, writes...), nil
+	}
+	start, end := testTime("2024-01-01T00:00:00Z"), testTime("2024-01-01T01:00:00Z")
+
+	for _, keep := range []bool{true, false} {
+		t.Run(fmt.Sprint(keep), func(t *testing.T) {
+			out := newMemorySink()
+			p := newTestProcessor(out, config.ProcessorConfig{RowChecksum: true}, client)
+			metrics := []config.MetricConfig{{Name: "io", Query: `{__name__=~"tikv_(reads|writes)_total"}`, KeepMetricName: keep}}
+			if err := p.ProcessMetrics(context.Background(), metrics, start, end, "30m"); err != nil {
+				t.Fatalf("ProcessMetrics() error = %v", err)
+			}
+
+			names := make(map[string]int)
+			checksums := make(map[string]bool)
+			rows := out.metricRows("io")
+			for _, row := range rows {
+				names[row.SeriesName]++
+				checksums[row.Checksum] = true
+			}
+			if !keep {
+				if len(names) != 1 || names[""] != len(rows) {
+					t.Errorf("series names = %v, want none without keep_metric_name", names)
+				}
+				return
+			}
+			if len(names) != 2 || names["tikv_reads_total"] != names["tikv_writes_total"] {
+				t.Errorf("series names = %v, want both metrics' rows told apart", names)
+			}
+			if len(checksums) != len(rows) {
+				t.Errorf("%d rows have %d checksums, want the two metrics' points to differ", len(rows), len(checksums))
+			}
+		})
+	}
+}
+
+func TestInstanceLabelInjection(t *testing.T) {
+	// The scrape of b already has a prometheus_instance label, as federated
+	// series do
+	a := &fakeClient{name: "a", labels: map[string]string{"cluster": "prod"}}
+	b := &fakeClient{name: "b", labels: map[string]string{"cluster": "staging"}}
+	b.fetchRange = func(ctx context.Context, query string, start, end time.Time, step time.Duration) (model.Value, error) {
+		return rangeMatrix(model.Metric{"job": "tidb", "prometheus_instance": "upstream"}, start, end, step), nil
+	}
+	metrics := []config.MetricConfig{{Name: "qps", Query: "qps"}}
+	start := testTime("2024-01-01T00:00:00Z")
+
+	tests := []struct {
+		name  string
+		cfg   config.ProcessorConfig
+		wantA map[string]string
+		wantB map[string]string
+	}{
+		{
+			"static labels",
+			config.ProcessorConfig{},
+			map[string]string{"job": "tidb", "cluster": "prod"},
+			map[string]string{"job": "tidb", "prometheus_instance": "upstream", "cluster": "staging"},
+		},
+		{
+			"instance label",
+			config.ProcessorConfig{InstanceLabel: true},
+			map[string]string{"job": "tidb", "cluster": "prod", "prometheus_instance": "a"},
+			map[string]string{"job": "tidb", "cluster": "staging", "prometheus_instance": "b", "exported_prometheus_instance": "upstream"},
+		},
+		{
+			"instance label overriding",
+			config.ProcessorConfig{InstanceLabel: true, OnLabelConflict: "override"},
+			map[string]string{"job": "tidb", "cluster": "prod", "prometheus_instance": "a"},
+			map[string]string{"job": "tidb", "cluster": "staging", "prometheus_instance": "b"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			out := newMemorySink()
+			p := newTestProcessor(out, tc.cfg, a, b)
+			if err := p.ProcessMetrics(context.Background(), metrics, start, start.Add(time.Minute), "1m"); err != nil {
+				t.Fatalf("ProcessMetrics() error = %v", err)
+			}
+			rows := out.metricRows("qps")
+			if len(rows) != 4 {
+				t.Fatalf("got %d rows, want 2 per instance", len(rows))
+			}
+			for _, row := range rows {
+				want := map[string]map[string]string{"a": tc.wantA, "b": tc.wantB}[row.PrometheusInstance]
+				if !reflect.DeepEqual(row.Labels, want) {
+					t.Errorf("row of %s labels = %v, want %v", row.PrometheusInstance, row.Labels, want)
+				}
+			}
+		})
+	}
+
+	t.Run("collision error", func(t *testing.T) {
+		out := newMemorySink()
+		p := newTestProcessor(out, config.ProcessorConfig{InstanceLabel: true, OnLabelConflict: "error"}, a, b)
+		p.ProcessMetrics(context.Background(), metrics, start, start.Add(time.Minute), "1m")
+		for _, row := range out.metricRows("qps") {
+			if row.PrometheusInstance == "b" {
+				t.Fatalf("wrote a row of b, want the conflicting instance to fail")
+			}
+		}
+		if len(out.metricRows("qps")) != 2 {
+			t.Errorf("got %d rows, want a's 2 still written", len(out.metricRows("qps")))
+		}
+		failures := fmt.Sprint(p.Summary().Failures)
+		if !strings.Contains(failures, `prometheus_instance is "upstream" from scraped and "b" from instance`) {
+			t.Errorf("failures = %s, want the collision reported", failures)
+		}
+	})
+}
+
+func TestAddressLabelReachesSink(t *testing.T) {
+	a := &fakeClient{name: "prom", address: "http://prom-a:9090"}
+	b := &fakeClient{name: "prom-b", address: "https://prom-b.example.com/prometheus"}
+	dir := t.TempDir()
+	out, err := sink.NewCSVSink(config.CSVConfig{OutputDir: dir, SingleFile: true})
+	if err != nil {
+		t.Fatalf("NewCSVSink() error = %v", err)
+	}
+	p := newTestProcessor(out, config.ProcessorConfig{AddressLabel: true}, a, b)
+	start := testTime("2024-01-01T00:00:00Z")
+	if err := p.ProcessMetrics(context.Background(), []config.MetricConfig{{Name: "qps", Query: "qps"}}, start, start.Add(time.Minute), "1m"); err != nil {
+		t.Fatalf("ProcessMetrics() error = %v", err)
+	}
+	if err := out.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.csv"))
+	if len(files) != 1 {
+		t.Fatalf("wrote files %v, want one", files)
+	}
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	instance, address := slices.Index(records[0], "prometheus_instance"), slices.Index(records[0], "label_prometheus_address")
+	if address < 0 {
+		t.Fatalf("header = %v, want a label_prometheus_address column", records[0])
+	}
+	got := make(map[string]int)
+	for _, record := range records[1:] {
+		got[record[instance]+" "+record[address]]++
+	}
+	want := map[string]int{"prom http://prom-a:9090": 2, "prom-b https://prom-b.example.com/prometheus": 2}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("rows by instance and address = %v, want %v", got, want)
+	}
+
+	// Without address_label the label is not added
+	memory := newMemorySink()
+	p = newTestProcessor(memory, config.ProcessorConfig{}, a)
+	if err := p.ProcessMetrics(context.Background(), []config.MetricConfig{{Name: "qps", Query: "qps"}}, start, start.Add(time.Minute), "1m"); err != nil {
+		t.Fatalf("ProcessMetrics() error = %v", err)
+	}
+	for _, row := range memory.metricRows("qps") {
+		if _, ok := row.Labels["prometheus_address"]; ok {
+			t.Fatalf("row labels = %v, want no address without address_label", row.Labels)
+		}
+	}
+}
+
+func TestDefaultLabels(t *testing.T) {
+	client := &fakeClient{name: "prom"}
+	client.fetchRange = func(ctx context.Context, query string, start, end time.Time, step time.Duration) (model.Value, error) {
+		return model.Matrix{
+			rangeMatrix(model.Metric{"job": "tidb", "instance": "tidb-0"}, start, end, step)[0],
+			rangeMatrix(model.Metric{"job": "tidb", "instance": "tidb-1"}, start, end, step)[0],
+		}, nil
+	}
+	start := testTime("2024-01-01T00:00:00Z")
+	all := []map[string]string{{"job": "tidb", "instance": "tidb-0"}, {"job": "tidb", "instance": "tidb-1"}}
+
+	tests := []struct {
+		name          string
+		defaultLabels string
+		labelKeys     []string
+		want          []map[string]string // Labels of the first row of each series
+		warnings      int
+	}{
+		{"unset", "", nil, all, 0},
+		{"all", "all", nil, all, 0},
+		{"none", "none", nil, []map[string]string{{}, {}}, 1},
+		{"none with label_keys", "none", []string{"instance"}, []map[string]string{{"instance": "tidb-0"}, {"instance": "tidb-1"}}, 0},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			log.SetOutput(&logs)
+			defer log.SetOutput(os.Stderr)
+
+			out := newMemorySink()
+			p := newTestProcessor(out, config.ProcessorConfig{DefaultLabels: tc.defaultLabels}, client)
+			metrics := []config.MetricConfig{{Name: "qps", Query: "qps", LabelKeys: tc.labelKeys}}
+			if err := p.ProcessMetrics(context.Background(), metrics, start, start.Add(time.Minute), "1m"); err != nil {
+				t.Fatalf("ProcessMetrics() error = %v", err)
+			}
+
+			rows := out.metricRows("qps")
+			if len(rows) != 4 {
+				t.Fatalf("got %d rows, want 2 per series", len(rows))
+			}
+			// Each series writes its two samples in turn
+			got := []map[string]string{rows[0].Labels, rows[2].Labels}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("row labels = %v, want %v", got, tc.want)
+			}
+			if warnings := strings.Count(logs.String(), "cannot be told apart"); warnings != tc.warnings {
+				t.Errorf("logged %d collision warnings, want %d:\n%s", warnings, tc.warnings, logs.String())
+			}
+		})
+	}
+
+	p := newTestProcessor(newMemorySink(), config.ProcessorConfig{DefaultLabels: "some"}, client)
+	if err := p.ProcessMetrics(context.Background(), []config.MetricConfig{{Name: "qps", Query: "qps"}}, start, start.Add(time.Minute), "1m"); err == nil {
+		t.Error("ProcessMetrics() accepted default_labels: some")
+	}
+}
@@ -0,0 +1,50 @@
+package processor
+
+import (
+	"sort"
+
+	"github.com/prometheus/common/model"
+)
+
+// modeLatest keeps only the last sample of each series in the time range
+const modeLatest = "latest"
+
+// latestTracker remembers the newest sample of each series across batches
+type latestTracker struct {
+	series map[model.Fingerprint]*model.SampleStream
+}
+
+// newLatestTracker creates a tracker that has seen no series
+func newLatestTracker() *latestTracker {
+	return &latestTracker{series: make(map[model.Fingerprint]*model.SampleStream)}
+}
+
+// observe keeps the last sample of each series of a matrix result when it
+// is newer than the one kept. Other result types are ignored.
+func (t *latestTracker) observe(result model.Value) {
+	matrix, ok := result.(model.Matrix)
+	if !ok {
+		return
+	}
+	for _, series := range matrix {
+		if len(series.Values) == 0 {
+			continue
+		}
+		last := series.Values[len(series.Values)-1]
+		fp := series.Metric.Fingerprint()
+		if kept, ok := t.series[fp]; ok && kept.Values[0].Timestamp >= last.Timestamp {
+			continue
+		}
+		t.series[fp] = &model.SampleStream{Metric: series.Metric, Values: []model.SamplePair{last}}
+	}
+}
+
+// result returns one single-sample series per series seen, ordered by labels
+func (t *latestTracker) result() model.Matrix {
+	matrix := make(model.Matrix, 0, len(t.series))
+	for _, series := range t.series {
+		matrix = append(matrix, series)
+	}
+	sort.Slice(matrix, func(i, j int) bool { return matrix[i].Metric.Before(matrix[j].Metric) })
+	return matrix
+}
@@ -0,0 +1,96 @@
+package processor
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"github.com/prometheus/common/model"
+)
+
+func TestLatestModeKeepsLastSample(t *testing.T) {
+	// Each series has a sample every 5m, valued with its minute of the hour,
+	// until it stops: tidb-1 in the first batch, tidb-2 begins in the second
+	spans := map[string][2]string{
+		"tidb-0": {"00:00", "01:00"},
+		"tidb-1": {"00:00", "00:20"},
+		"tidb-2": {"00:35", "00:45"},
+	}
+	client := &fakeClient{name: "prom"}
+	client.fetchRange = func(ctx context.Context, query string, start, end time.Time, step time.Duration) (model.Value, error) {
+		var matrix model.Matrix
+		for instance, span := range spans {
+			from, to := testTime("2024-01-01T"+span[0]+":00Z"), testTime("2024-01-01T"+span[1]+":00Z")
+			s := &model.SampleStream{Metric: model.Metric{"instance": model.LabelValue(instance)}}
+			for ts := start; !ts.After(end); ts = ts.Add(step) {
+				if !ts.Before(from) && !ts.After(to) {
+					s.Values = append(s.Values, model.SamplePair{Timestamp: model.TimeFromUnix(ts.Unix()), Value: model.SampleValue(ts.Sub(testTime("2024-01-01T00:00:00Z")).Minutes())})
+				}
+			}
+			matrix = append(matrix, s)
+		}
+		return matrix, nil
+	}
+
+	out := newMemorySink()
+	p := newTestProcessor(out, config.ProcessorConfig{BatchWindow: "30m"}, client)
+	metrics := []config.MetricConfig{{Name: "qps", Query: "qps", LabelKeys: []string{"instance"}, Mode: "latest"}}
+	if err := p.ProcessMetrics(context.Background(), metrics, testTime("2024-01-01T00:00:00Z"), testTime("2024-01-01T01:00:00Z"), "5m"); err != nil {
+		t.Fatalf("ProcessMetrics() error = %v", err)
+	}
+	if n := len(client.fetched()); n != 2 {
+		t.Fatalf("fetched %d batches, want 2", n)
+	}
+
+	// One row per series, at its final timestamp, written once all batches are seen
+	type point struct {
+		at    time.Time
+		value float64
+	}
+	got := make(map[string]point)
+	for _, row := range out.metricRows("qps") {
+		if _, dup := got[row.Labels["instance"]]; dup {
+			t.Errorf("series %s written more than once", row.Labels["instance"])
+		}
+		got[row.Labels["instance"]] = point{row.Timestamp, row.Value}
+	}
+	want := map[string]point{
+		"tidb-0": {testTime("2024-01-01T01:00:00Z"), 60},
+		"tidb-1": {testTime("2024-01-01T00:20:00Z"), 20},
+		"tidb-2": {testTime("2024-01-01T00:45:00Z"), 45},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("latest rows = %v, want %v", got, want)
+	}
+	if writes := out.writes; writes != 1 {
+		t.Errorf("sink got %d writes, want the latest samples in one", writes)
+	}
+}
+
+func TestLatestTrackerKeepsNewest(t *testing.T) {
+	series := func(instance string, times ...int64) *model.SampleStream {
+		s := &model.SampleStream{Metric: model.Metric{"instance": model.LabelValue(instance)}}
+		for _, ts := range times {
+			s.Values = append(s.Values, model.SamplePair{Timestamp: model.TimeFromUnix(ts), Value: model.SampleValue(ts)})
+		}
+		return s
+	}
+
+	tracker := newLatestTracker()
+	tracker.observe(model.Matrix{series("b", 60, 120), series("a", 60)})
+	tracker.observe(model.Matrix{series("b", 30), series("a"), series("c", 90)}) // Older, empty and new series
+	tracker.observe(model.Vector{})                                              // Ignored
+
+	var got []string
+	for _, s := range tracker.result() {
+		if len(s.Values) != 1 {
+			t.Fatalf("series %v has %d samples, want 1", s.Metric, len(s.Values))
+		}
+		got = append(got, string(s.Metric["instance"])+"@"+s.Values[0].Timestamp.Time().UTC().Format("15:04:05"))
+	}
+	if want := []string{"a@00:01:00", "b@00:02:00", "c@00:01:30"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("result() = %v, want %v", got, want)
+	}
+}
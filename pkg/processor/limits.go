@@ -0,0 +1,79 @@
+package processor
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/prometheus/common/model"
+)
+
+// Policies for a batch with more samples than max_samples_per_batch
+const (
+	oversizedError    = "error"    // Fail the batch
+	oversizedTruncate = "truncate" // Keep the first samples and drop the rest
+)
+
+// countSamples returns the number of samples in a query result
+func countSamples(result model.Value) int {
+	switch v := result.(type) {
+	case model.Matrix:
+		n := 0
+		for _, series := range v {
+			n += len(series.Values)
+		}
+		return n
+	case model.Vector:
+		return len(v)
+	default:
+		return 0
+	}
+}
+
+// limitSamples enforces max_samples_per_batch on a query result, either
+// failing or truncating it to the limit according to oversized_batch
+func (p *Processor) limitSamples(metricName string, result model.Value) (model.Value, error) {
+	limit := p.cfg.MaxSamplesPerBatch
+	if limit <= 0 {
+		return result, nil
+	}
+
+	total := countSamples(result)
+	if total <= limit {
+		return result, nil
+	}
+
+	if p.cfg.OversizedBatch != oversizedTruncate {
+		return nil, fmt.Errorf("query returned %d samples, more than max_samples_per_batch (%d); "+
+			"too many series, add aggregation such as sum by (...) or narrow the selector", total, limit)
+	}
+
+	log.Printf("Warning: query of metric %s returned %d samples, truncating to max_samples_per_batch (%d)",
+		metricName, total, limit)
+	p.tally.addTruncated(metricName, total-limit)
+	return truncateSamples(result, limit), nil
+}
+
+// truncateSamples keeps the first limit samples of a result, in series order
+func truncateSamples(result model.Value, limit int) model.Value {
+	switch v := result.(type) {
+	case model.Matrix:
+		kept := make(model.Matrix, 0, len(v))
+		for _, series := range v {
+			if limit == 0 {
+				break
+			}
+			if len(series.Values) > limit {
+				trimmed := *series
+				trimmed.Values = series.Values[:limit]
+				series = &trimmed
+			}
+			kept = append(kept, series)
+			limit -= len(series.Values)
+		}
+		return kept
+	case model.Vector:
+		return v[:limit]
+	default:
+		return result
+	}
+}
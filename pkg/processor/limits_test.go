@@ -0,0 +1,123 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"github.com/prometheus/common/model"
+)
+
+// wideClient returns a client answering every range query with series
+// copies of rangeMatrix, labeled instance="tikv-0", "tikv-1", ...
+func wideClient(series int) *fakeClient {
+	client := &fakeClient{name: "prom"}
+	client.fetchRange = func(ctx context.Context, query string, start, end time.Time, step time.Duration) (model.Value, error) {
+		var matrix model.Matrix
+		for i := 0; i < series; i++ {
+			matrix = append(matrix, rangeMatrix(model.Metric{"instance": model.LabelValue(fmt.Sprintf("tikv-%d", i))}, start, end, step)...)
+		}
+		return matrix, nil
+	}
+	return client
+}
+
+func TestSampleCapPolicies(t *testing.T) {
+	// 3 series of 10 samples against a cap of 25
+	start, end := testTime("2024-01-01T00:00:00Z"), testTime("2024-01-01T00:09:00Z")
+	metrics := []config.MetricConfig{{Name: "qps", Query: "qps"}}
+
+	for _, policy := range []string{"", oversizedError} {
+		t.Run("error "+policy, func(t *testing.T) {
+			out := newMemorySink()
+			cfg := config.ProcessorConfig{MaxSamplesPerBatch: 25, OversizedBatch: policy}
+			p := newTestProcessor(out, cfg, wideClient(3))
+			if err := p.ProcessMetrics(context.Background(), metrics, start, end, "1m"); err != nil {
+				t.Fatalf("ProcessMetrics() error = %v", err)
+			}
+
+			if got := len(out.metricRows("qps")); got != 0 {
+				t.Errorf("wrote %d rows of an oversized batch, want none", got)
+			}
+			failures := p.Summary().Failures
+			if len(failures) != 1 || failures[0].Metric != "qps" {
+				t.Fatalf("failures = %v, want qps", failures)
+			}
+			if !strings.Contains(failures[0].Err, "30 samples, more than max_samples_per_batch (25)") {
+				t.Errorf("failure = %q, want the sample count and the limit", failures[0].Err)
+			}
+		})
+	}
+
+	t.Run("truncate", func(t *testing.T) {
+		var logs bytes.Buffer
+		log.SetOutput(&logs)
+		defer log.SetOutput(os.Stderr)
+
+		out := newMemorySink()
+		cfg := config.ProcessorConfig{MaxSamplesPerBatch: 25, OversizedBatch: oversizedTruncate}
+		p := newTestProcessor(out, cfg, wideClient(3))
+		if err := p.ProcessMetrics(context.Background(), metrics, start, end, "1m"); err != nil {
+			t.Fatalf("ProcessMetrics() error = %v", err)
+		}
+
+		// The first two series whole, then the first 5 samples of the third
+		perSeries := make(map[string]int)
+		for _, row := range out.metricRows("qps") {
+			perSeries[row.Labels["instance"]]++
+		}
+		want := map[string]int{"tikv-0": 10, "tikv-1": 10, "tikv-2": 5}
+		for instance, n := range want {
+			if perSeries[instance] != n {
+				t.Errorf("series %s has %d rows, want %d", instance, perSeries[instance], n)
+			}
+		}
+		if len(perSeries) != len(want) {
+			t.Errorf("rows from series %v, want %v", perSeries, want)
+		}
+
+		summary := p.Summary()
+		if len(summary.Failures) != 0 {
+			t.Errorf("a truncated batch was reported as failed: %v", summary.Failures)
+		}
+		if summary.Truncated["qps"] != 5 {
+			t.Errorf("Truncated[qps] = %d, want 5", summary.Truncated["qps"])
+		}
+		if !strings.Contains(logs.String(), "returned 30 samples, truncating to max_samples_per_batch (25)") {
+			t.Errorf("no truncation warning in %q", logs.String())
+		}
+	})
+
+	t.Run("within the cap", func(t *testing.T) {
+		out := newMemorySink()
+		p := newTestProcessor(out, config.ProcessorConfig{MaxSamplesPerBatch: 30}, wideClient(3))
+		if err := p.ProcessMetrics(context.Background(), metrics, start, end, "1m"); err != nil {
+			t.Fatalf("ProcessMetrics() error = %v", err)
+		}
+		if got := len(out.metricRows("qps")); got != 30 {
+			t.Errorf("wrote %d rows, want all 30", got)
+		}
+	})
+
+	t.Run("unknown policy", func(t *testing.T) {
+		p := newTestProcessor(newMemorySink(), config.ProcessorConfig{MaxSamplesPerBatch: 25, OversizedBatch: "drop"}, wideClient(3))
+		err := p.ProcessMetrics(context.Background(), metrics, start, end, "1m")
+		if err == nil || !strings.Contains(err.Error(), "unsupported oversized_batch policy") {
+			t.Errorf("ProcessMetrics() error = %v, want an unsupported policy", err)
+		}
+	})
+}
+
+func TestTruncateSamplesVector(t *testing.T) {
+	vector := model.Vector{{Value: 1}, {Value: 2}, {Value: 3}}
+	got := truncateSamples(vector, 2).(model.Vector)
+	if len(got) != 2 || got[0].Value != 1 || got[1].Value != 2 {
+		t.Errorf("truncateSamples() = %v, want the first 2 samples", got)
+	}
+}
@@ -0,0 +1,179 @@
+package processor
+
+import (
+	"log"
+	"strings"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"github.com/meiking/tidb-metrics-crawler/pkg/prometheus"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+)
+
+// promqlKeywords are identifiers of PromQL that are not metric names and may
+// not be followed by a parenthesis. Aggregations can be, as in sum by (le) (...).
+var promqlKeywords = map[string]bool{
+	"and": true, "or": true, "unless": true, "bool": true, "offset": true,
+	"inf": true, "nan": true,
+	"sum": true, "min": true, "max": true, "avg": true, "group": true, "count": true,
+	"stddev": true, "stdvar": true, "count_values": true, "topk": true, "bottomk": true,
+	"quantile": true, "limitk": true, "limit_ratio": true,
+}
+
+// groupingKeywords are followed by a parenthesized list of label names
+var groupingKeywords = map[string]bool{
+	"by": true, "without": true, "on": true, "ignoring": true,
+	"group_left": true, "group_right": true,
+}
+
+// queryMetricNames returns the distinct metric names a PromQL query selects,
+// in order of appearance. Like findModifiers it is a lexical scan, so
+// selectors of the form {__name__="..."} are not recognised.
+func queryMetricNames(query string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	runes := []rune(query)
+
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == '"' || r == '\'' || r == '`':
+			for i++; i < len(runes) && runes[i] != r; i++ {
+				if runes[i] == '\\' && r != '`' {
+					i++
+				}
+			}
+		case r == '#':
+			for i < len(runes) && runes[i] != '\n' {
+				i++
+			}
+		case r == '{' || r == '[':
+			// Label matchers and range durations; strings inside cannot hold the closer unescaped
+			closer := '}'
+			if r == '[' {
+				closer = ']'
+			}
+			for i++; i < len(runes) && runes[i] != closer; i++ {
+				if q := runes[i]; q == '"' || q == '\'' || q == '`' {
+					for i++; i < len(runes) && runes[i] != q; i++ {
+						if runes[i] == '\\' && q != '`' {
+							i++
+						}
+					}
+				}
+			}
+		case isIdentStart(r) && (i == 0 || !isIdentPart(runes[i-1])):
+			j := i
+			for j < len(runes) && isIdentPart(runes[j]) {
+				j++
+			}
+			ident := string(runes[i:j])
+			next := j
+			for next < len(runes) && (runes[next] == ' ' || runes[next] == '\t' || runes[next] == '\n' || runes[next] == '\r') {
+				next++
+			}
+			i = j - 1
+
+			lower := strings.ToLower(ident)
+			switch {
+			case groupingKeywords[lower]:
+				if next < len(runes) && runes[next] == '(' {
+					for i = next; i < len(runes) && runes[i] != ')'; i++ {
+					}
+				}
+			case promqlKeywords[lower]:
+			case next < len(runes) && runes[next] == '(':
+				// A function or aggregation
+			case !seen[ident]:
+				seen[ident] = true
+				names = append(names, ident)
+			}
+		}
+	}
+	return names
+}
+
+// metadataSuffixes are stripped from a series name to find its metric
+// family, as histograms, summaries and some counters are described under
+// the family name
+var metadataSuffixes = []string{"_bucket", "_sum", "_count", "_total", "_created"}
+
+// metadataLookup fetches metric metadata from the instances, remembering
+// every answer so each name is asked for at most once per run
+type metadataLookup struct {
+	clients []prometheus.Client
+	cache   map[string]*v1.Metadata // Nil entries for names without metadata
+}
+
+// find returns the metadata of the family of series name, trying the name
+// itself, then the name without a histogram, summary or counter suffix
+func (l *metadataLookup) find(name string) *v1.Metadata {
+	candidates := []string{name}
+	for _, suffix := range metadataSuffixes {
+		if family := strings.TrimSuffix(name, suffix); family != name && family != "" {
+			candidates = append(candidates, family)
+			break
+		}
+	}
+
+	for _, candidate := range candidates {
+		if md := l.fetch(candidate); md != nil {
+			return md
+		}
+	}
+	return nil
+}
+
+// fetch returns the metadata of a metric family from the first instance
+// that has it
+func (l *metadataLookup) fetch(family string) *v1.Metadata {
+	if md, ok := l.cache[family]; ok {
+		return md
+	}
+
+	var found *v1.Metadata
+	for _, client := range l.clients {
+		result, err := client.Metadata(family)
+		if err != nil {
+			log.Printf("Warning: failed to fetch metadata of %s from %s: %v", family, client.Name(), err)
+			continue
+		}
+		// Targets may disagree; the first entry is representative
+		if entries := result[family]; len(entries) > 0 {
+			found = &entries[0]
+			break
+		}
+	}
+	l.cache[family] = found
+	return found
+}
+
+// LookupMetadata fetches the type, help and unit of the metric each range or
+// instant query reads, keyed by configured metric name. Queries reading no
+// metric or several different ones, and metrics the instances have no
+// metadata for, are left out.
+func LookupMetadata(clients []prometheus.Client, metrics []config.MetricConfig) map[string]config.MetricMeta {
+	lookup := &metadataLookup{clients: clients, cache: make(map[string]*v1.Metadata)}
+	meta := make(map[string]config.MetricMeta)
+
+	for _, metric := range metrics {
+		if metric.Type != "" && metric.Type != metricTypeQuery {
+			continue
+		}
+		names := queryMetricNames(metric.Query)
+		if len(names) != 1 {
+			if len(names) > 1 {
+				log.Printf("Metric %s: query reads %d metrics (%s), so no metadata is recorded", metric.Name, len(names), strings.Join(names, ", "))
+			}
+			continue
+		}
+
+		md := lookup.find(names[0])
+		if md == nil {
+			log.Printf("Metric %s: no metadata found for %s", metric.Name, names[0])
+			continue
+		}
+		meta[metric.Name] = config.MetricMeta{Unit: md.Unit, Type: string(md.Type), Help: md.Help}
+	}
+	log.Printf("Found metadata for %d of %d metric(s)", len(meta), len(metrics))
+	return meta
+}
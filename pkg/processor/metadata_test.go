@@ -0,0 +1,89 @@
+package processor
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"github.com/meiking/tidb-metrics-crawler/pkg/prometheus"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+)
+
+// countingClient counts the metadata requests of each metric name
+type countingClient struct {
+	*fakeClient
+
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (c *countingClient) Metadata(metric string) (map[string][]v1.Metadata, error) {
+	c.mu.Lock()
+	c.calls[metric]++
+	c.mu.Unlock()
+	return c.fakeClient.Metadata(metric)
+}
+
+func TestQueryMetricNames(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"up", []string{"up"}},
+		{`sum(rate(tidb_server_query_total{type="Select"}[1m])) by (instance)`, []string{"tidb_server_query_total"}},
+		{`histogram_quantile(0.99, sum by (le) (rate(tidb_server_handle_query_duration_seconds_bucket[5m])))`, []string{"tidb_server_handle_query_duration_seconds_bucket"}},
+		{`a / on (instance) group_left b offset 5m`, []string{"a", "b"}},
+		{`sum(x{job="sum(y)"}) # z`, []string{"x"}},
+		{`vector(1)`, nil},
+	}
+	for _, tt := range tests {
+		if got := queryMetricNames(tt.query); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("queryMetricNames(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestLookupMetadataAttachesToMetric(t *testing.T) {
+	// a has no metadata, so every family is also asked of b
+	a := &countingClient{fakeClient: &fakeClient{name: "a"}, calls: make(map[string]int)}
+	b := &countingClient{fakeClient: &fakeClient{name: "b", metadata: map[string][]v1.Metadata{
+		"tidb_server_query":                         {{Type: v1.MetricTypeCounter, Help: "Counter of queries."}},
+		"tidb_server_handle_query_duration_seconds": {{Type: v1.MetricTypeHistogram, Help: "Query latency.", Unit: "seconds"}},
+		"tikv_engine_size_bytes":                    {{Type: v1.MetricTypeGauge, Help: "Engine size.", Unit: "bytes"}, {Type: v1.MetricTypeGauge, Help: "Other target."}},
+	}}, calls: make(map[string]int)}
+
+	metrics := []config.MetricConfig{
+		{Name: "qps", Query: "sum(rate(tidb_server_query_total[1m]))"},
+		{Name: "latency", Query: "histogram_quantile(0.99, sum by (le) (rate(tidb_server_handle_query_duration_seconds_bucket[1m])))"},
+		{Name: "size", Query: `sum(tikv_engine_size_bytes{db="kv"}) by (instance)`},
+		{Name: "qps_by_type", Query: "sum(rate(tidb_server_query_total[1m])) by (type)"},
+		{Name: "ratio", Query: "tikv_engine_size_bytes / tidb_server_query_total"},
+		{Name: "unknown", Query: "pd_regions"},
+		{Name: "alerts", Type: metricTypeAlerts},
+	}
+	got := LookupMetadata([]prometheus.Client{a, b}, metrics)
+
+	want := map[string]config.MetricMeta{
+		"qps":         {Type: "counter", Help: "Counter of queries."},
+		"latency":     {Type: "histogram", Help: "Query latency.", Unit: "seconds"},
+		"size":        {Type: "gauge", Help: "Engine size.", Unit: "bytes"},
+		"qps_by_type": {Type: "counter", Help: "Counter of queries."},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("LookupMetadata() = %+v, want %+v", got, want)
+	}
+
+	// Each name is asked once per client, however many metrics read it
+	wantCalls := map[string]int{
+		"tidb_server_query_total": 1, "tidb_server_query": 1,
+		"tidb_server_handle_query_duration_seconds_bucket": 1, "tidb_server_handle_query_duration_seconds": 1,
+		"tikv_engine_size_bytes": 1,
+		"pd_regions":             1,
+	}
+	for _, client := range []*countingClient{a, b} {
+		if !reflect.DeepEqual(client.calls, wantCalls) {
+			t.Errorf("metadata requests to %s = %v, want %v", client.name, client.calls, wantCalls)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package processor
+
+import (
+	"log"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+// queryModifiers are the PromQL modifiers of a query that interact with batching
+type queryModifiers struct {
+	at      bool            // An @ modifier pins evaluation to a fixed time
+	offsets []time.Duration // Durations of offset modifiers (negative offsets look ahead)
+}
+
+// findModifiers scans a PromQL query for @ and offset modifiers, ignoring
+// string literals and comments. It is a lexical check, not a full parse.
+func findModifiers(query string) queryModifiers {
+	var mods queryModifiers
+	runes := []rune(query)
+
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == '"' || r == '\'' || r == '`':
+			// Skip the string literal, honouring escapes except in raw strings
+			for i++; i < len(runes) && runes[i] != r; i++ {
+				if runes[i] == '\\' && r != '`' {
+					i++
+				}
+			}
+		case r == '#':
+			for i < len(runes) && runes[i] != '\n' {
+				i++
+			}
+		case r == '@':
+			mods.at = true
+		case isIdentStart(r) && (i == 0 || !isIdentPart(runes[i-1])):
+			j := i
+			for j < len(runes) && isIdentPart(runes[j]) {
+				j++
+			}
+			if strings.EqualFold(string(runes[i:j]), "offset") {
+				if d, ok := parseOffset(runes[j:]); ok {
+					mods.offsets = append(mods.offsets, d)
+				}
+			}
+			i = j - 1
+		}
+	}
+	return mods
+}
+
+// parseOffset parses the duration following an offset keyword
+func parseOffset(rest []rune) (time.Duration, bool) {
+	i := 0
+	for i < len(rest) && unicode.IsSpace(rest[i]) {
+		i++
+	}
+
+	sign := time.Duration(1)
+	if i < len(rest) && rest[i] == '-' {
+		sign = -1
+		i++
+	}
+
+	j := i
+	for j < len(rest) && (unicode.IsDigit(rest[j]) || unicode.IsLetter(rest[j])) {
+		j++
+	}
+	if j == i {
+		return 0, false
+	}
+
+	d, err := common.ParseDuration(string(rest[i:j]))
+	if err != nil {
+		return 0, false
+	}
+	return sign * d, true
+}
+
+func isIdentStart(r rune) bool {
+	return r == '_' || unicode.IsLetter(r)
+}
+
+func isIdentPart(r rune) bool {
+	return r == '_' || r == ':' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// warnModifiers logs when a batched metric's query uses modifiers that
+// interact badly with batching
+func warnModifiers(metric config.MetricConfig, window time.Duration) {
+	if metric.Instant {
+		return
+	}
+
+	mods := findModifiers(metric.Query)
+	if mods.at {
+		log.Printf("Warning: query of metric %s uses the @ modifier, so every batch evaluates at the pinned time and repeats the same values; consider instant: true", metric.Name)
+	}
+	for _, offset := range mods.offsets {
+		if offset >= window || -offset >= window {
+			log.Printf("Warning: query of metric %s uses offset %v, longer than the %v batch window, so each batch reads data from a different window than its timestamps suggest", metric.Name, offset, window)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package processor
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+func TestFindModifiers(t *testing.T) {
+	tests := []struct {
+		query   string
+		at      bool
+		offsets []time.Duration
+	}{
+		{`rate(tidb_server_query_total[5m])`, false, nil},
+		{`rate(tidb_server_query_total[5m] offset 1h)`, false, []time.Duration{time.Hour}},
+		{`rate(x[5m] OFFSET -30m)`, false, []time.Duration{-30 * time.Minute}},
+		{`x offset 1d - x offset 7d`, false, []time.Duration{24 * time.Hour, 7 * 24 * time.Hour}},
+		{`x @ 1700000000`, true, nil},
+		{`x @ end() offset 5m`, true, []time.Duration{5 * time.Minute}},
+		{`x{type="offset 1h @ now"}`, false, nil},       // In a string
+		{"x{type=`offset 1h`}", false, nil},             // In a raw string
+		{`x{type="a\"offset 1h"}`, false, nil},          // After an escaped quote
+		{"x # offset 1h @ 5\n", false, nil},             // In a comment
+		{`sum by (offset) (x{offset="1"})`, false, nil}, // A label named offset
+		{`my_offset 5m + offset_total`, false, nil},     // Part of a metric name
+		{`x offset 5mins`, false, nil},                  // Not a duration
+		{"rate(x[5m]\n  offset\n  2h)", false, []time.Duration{2 * time.Hour}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.query, func(t *testing.T) {
+			got := findModifiers(tc.query)
+			if got.at != tc.at || !slices.Equal(got.offsets, tc.offsets) {
+				t.Errorf("findModifiers() = @%v offsets %v, want @%v offsets %v", got.at, got.offsets, tc.at, tc.offsets)
+			}
+		})
+	}
+}
+
+func TestWarnModifiers(t *testing.T) {
+	tests := []struct {
+		name   string
+		metric config.MetricConfig
+		want   []string // Substrings of the warnings, none if empty
+	}{
+		{"plain", config.MetricConfig{Name: "qps", Query: "rate(x[5m])"}, nil},
+		{"at", config.MetricConfig{Name: "qps", Query: "x @ 1700000000"}, []string{"uses the @ modifier"}},
+		{"short offset", config.MetricConfig{Name: "qps", Query: "x offset 5m"}, nil},
+		{"long offset", config.MetricConfig{Name: "qps", Query: "x offset 1d"}, []string{"uses offset 24h0m0s, longer than the 1h0m0s batch window"}},
+		{"long negative offset", config.MetricConfig{Name: "qps", Query: "x offset -2h"}, []string{"uses offset -2h0m0s"}},
+		{"instant", config.MetricConfig{Name: "qps", Query: "x @ 1700000000 offset 1d", Instant: true}, nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			log.SetOutput(&logs)
+			defer log.SetOutput(os.Stderr)
+
+			warnModifiers(tc.metric, time.Hour)
+			if len(tc.want) == 0 && logs.Len() > 0 {
+				t.Errorf("logged %q, want no warning", logs.String())
+			}
+			for _, want := range tc.want {
+				if !strings.Contains(logs.String(), want) {
+					t.Errorf("logged %q, want %q", logs.String(), want)
+				}
+			}
+		})
+	}
+}
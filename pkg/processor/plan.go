@@ -0,0 +1,94 @@
+package processor
+
+import (
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+// MaxPointsPerSeries is the most points Prometheus returns per series in
+// one range query; larger queries are rejected
+const MaxPointsPerSeries = 11000
+
+// MetricPlan describes what a run would do for one metric on each instance
+type MetricPlan struct {
+	Metric   string
+	Type     string        // "query" for metrics without a type
+	Skipped  string        // Why the metric would be skipped; the rest is unset
+	Instant  bool          // One instant query at the end of the range
+	Step     time.Duration // Zero for instant queries and snapshots
+	Batches  []BatchWindow // Range query windows
+	Queries  int           // Requests per instance
+	Compared int           // Instances queried by a compare metric; zero for every instance
+	Points   int           // Most points per series in one query
+}
+
+// BatchWindow is the time range of one batch
+type BatchWindow struct {
+	Start, End time.Time
+}
+
+// TooManyPoints reports whether a batch exceeds the points Prometheus allows
+// per series, so its queries would fail
+func (m MetricPlan) TooManyPoints() bool {
+	return m.Points > MaxPointsPerSeries
+}
+
+// Plan computes the batches, steps and query counts ProcessMetrics would use
+// for metrics over start to end, without issuing any query. Incremental runs
+// start after the data already stored, so their counts are upper bounds.
+func (p *Processor) Plan(metrics []config.MetricConfig, start, end time.Time, stepStr string) ([]MetricPlan, error) {
+	settings, err := p.parseRunSettings(stepStr)
+	if err != nil {
+		return nil, err
+	}
+
+	plans := make([]MetricPlan, 0, len(metrics))
+	for _, metric := range metrics {
+		plan := MetricPlan{Metric: metric.Name, Type: metric.Type}
+		if plan.Type == "" {
+			plan.Type = metricTypeQuery
+		}
+
+		step, _, err := p.prepareMetric(metric, settings, start, end)
+		switch {
+		case err != nil:
+			plan.Skipped = err.Error()
+		case isSnapshot(metric):
+			plan.Queries = 1
+		case metric.Instant:
+			plan.Instant = true
+			plan.Queries = selectorCount(metric)
+			plan.Points = 1
+		default:
+			plan.Step = step
+			window := metricWindow(metric, step, settings.window)
+			for _, batch := range splitBatches(start, end, window, p.cfg.AlignBatches) {
+				plan.Batches = append(plan.Batches, BatchWindow{Start: batch.start, End: batch.end})
+				if step <= 0 {
+					continue // Rejected by Prometheus
+				}
+				if points := int(batch.end.Sub(batch.start)/step) + 1; points > plan.Points {
+					plan.Points = points
+				}
+			}
+			plan.Queries = len(plan.Batches) * selectorCount(metric)
+			if metric.Compare != nil {
+				plan.Compared = 2
+			}
+			if metric.WithExemplars && metric.Type != metricTypeFederate {
+				plan.Queries += len(plan.Batches)
+			}
+		}
+		plans = append(plans, plan)
+	}
+	return plans, nil
+}
+
+// selectorCount returns the number of queries a metric runs per batch
+func selectorCount(metric config.MetricConfig) int {
+	if metric.Type == metricTypeFederate {
+		return len(metric.Match)
+	}
+	return 1
+}
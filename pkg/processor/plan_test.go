@@ -0,0 +1,99 @@
+package processor
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"github.com/prometheus/common/model"
+)
+
+func TestPlanMatchesExecution(t *testing.T) {
+	start, end := testTime("2024-01-01T00:10:00Z"), testTime("2024-01-02T03:00:00Z")
+	tests := []struct {
+		name   string
+		cfg    config.ProcessorConfig
+		metric config.MetricConfig
+		step   string
+	}{
+		{"default window", config.ProcessorConfig{}, config.MetricConfig{Name: "qps", Query: "qps"}, "1m"},
+		{"batch window", config.ProcessorConfig{BatchWindow: "6h"}, config.MetricConfig{Name: "qps", Query: "qps"}, "1m"},
+		{"aligned batches", config.ProcessorConfig{BatchWindow: "6h", AlignBatches: true}, config.MetricConfig{Name: "qps", Query: "qps"}, "1m"},
+		{"metric step", config.ProcessorConfig{BatchWindow: "6h"}, config.MetricConfig{Name: "qps", Query: "qps", Step: "5m"}, "1m"},
+		// 11000 points of 1s fit in 3h, so the 6h window is narrowed
+		{"window narrowed to the points limit", config.ProcessorConfig{BatchWindow: "6h"}, config.MetricConfig{Name: "qps", Query: "qps"}, "1s"},
+		{"federate", config.ProcessorConfig{BatchWindow: "12h"}, config.MetricConfig{Name: "cluster", Type: metricTypeFederate, Match: []string{`{job="tikv"}`, `{job="pd"}`}}, "1m"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				mu    sync.Mutex
+				steps []time.Duration
+			)
+			client := &fakeClient{name: "prom"}
+			client.fetchRange = func(ctx context.Context, query string, start, end time.Time, step time.Duration) (model.Value, error) {
+				mu.Lock()
+				steps = append(steps, step)
+				mu.Unlock()
+				return model.Matrix{}, nil
+			}
+			p := newTestProcessor(newMemorySink(), tt.cfg, client)
+			metrics := []config.MetricConfig{tt.metric}
+
+			plans, err := p.Plan(metrics, start, end, tt.step)
+			if err != nil {
+				t.Fatalf("Plan() error = %v", err)
+			}
+			if len(client.fetched()) != 0 {
+				t.Fatal("Plan() issued queries")
+			}
+			if err := p.ProcessMetrics(context.Background(), metrics, start, end, tt.step); err != nil {
+				t.Fatalf("ProcessMetrics() error = %v", err)
+			}
+
+			plan := plans[0]
+			fetched := client.fetched()
+			if len(fetched) != plan.Queries {
+				t.Fatalf("ran %d queries, plan has %d", len(fetched), plan.Queries)
+			}
+			// Each selector of a federate metric runs every batch in turn
+			for i, batch := range fetched {
+				want := plan.Batches[i%len(plan.Batches)]
+				if !batch.start.Equal(want.Start) || !batch.end.Equal(want.End) {
+					t.Errorf("query %d covered %v to %v, plan has %v to %v", i, batch.start, batch.end, want.Start, want.End)
+				}
+				if steps[i] != plan.Step {
+					t.Errorf("query %d used step %v, plan has %v", i, steps[i], plan.Step)
+				}
+			}
+			if first, last := plan.Batches[0], plan.Batches[len(plan.Batches)-1]; !first.Start.Equal(start) || !last.End.Equal(end) {
+				t.Errorf("plan covers %v to %v, want %v to %v", first.Start, last.End, start, end)
+			}
+		})
+	}
+}
+
+func TestPlanPoints(t *testing.T) {
+	p := newTestProcessor(newMemorySink(), config.ProcessorConfig{BatchWindow: "1h"}, &fakeClient{name: "prom"})
+	metrics := []config.MetricConfig{
+		{Name: "qps", Query: "qps"},
+		{Name: "up", Query: "up", Instant: true},
+		{Name: "rules", Type: metricTypeRules},
+	}
+	plans, err := p.Plan(metrics, testTime("2024-01-01T00:00:00Z"), testTime("2024-01-01T03:00:00Z"), "15s")
+	if err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+
+	if qps := plans[0]; len(qps.Batches) != 3 || qps.Queries != 3 || qps.Points != 241 || qps.TooManyPoints() {
+		t.Errorf("qps plan = %+v, want 3 batches of 241 points", qps)
+	}
+	if up := plans[1]; !up.Instant || up.Queries != 1 || up.Points != 1 || len(up.Batches) != 0 {
+		t.Errorf("instant plan = %+v, want one query of one point", up)
+	}
+	if rules := plans[2]; rules.Type != metricTypeRules || rules.Queries != 1 || rules.Step != 0 {
+		t.Errorf("rules plan = %+v, want one snapshot request", rules)
+	}
+}
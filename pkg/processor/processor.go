@@ -1,11 +1,14 @@
 package processor
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
+	"slices"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/meiking/tidb-metrics-crawler/pkg/common"
 	"github.com/meiking/tidb-metrics-crawler/pkg/config"
 	"github.com/meiking/tidb-metrics-crawler/pkg/prometheus"
@@ -15,23 +18,181 @@ import (
 
 // Processor handles data processing and coordination
 type Processor struct {
-	clients []prometheus.Client
-	sink    sink.Sink
+	clients  []prometheus.Client
+	sink     sink.Sink
+	cfg      config.ProcessorConfig
+	breakers map[string]*circuitBreaker // Keyed by client name
+	tally    *runTally
+	series   *seriesTracker
+	collided *collisionWarner
+	relabel  map[string]relabeler         // Keyed by metric name
+	injected map[string]map[string]string // Labels added to every row, keyed by client name
+	runID    string                       // Identifies the current run in every row
+	loc      *time.Location               // Time zone of row timestamps
+	progress *progressTracker
+	duration time.Duration
 }
 
 // NewProcessor creates a new data processor
-func NewProcessor(clients []prometheus.Client, outputSink sink.Sink) *Processor {
+func NewProcessor(clients []prometheus.Client, outputSink sink.Sink, cfg config.ProcessorConfig) *Processor {
 	return &Processor{
-		clients: clients,
-		sink:    outputSink,
+		clients:  clients,
+		sink:     outputSink,
+		cfg:      cfg,
+		progress: newProgressTracker(),
 	}
 }
 
-// ProcessMetrics coordinates fetching and processing of all metrics
-func (p *Processor) ProcessMetrics(metrics []config.MetricConfig, start, end time.Time, stepStr string) error {
-	step, err := time.ParseDuration(stepStr)
+// defaultBatchWindow is the length of a query batch when batch_window is unset
+const defaultBatchWindow = time.Hour
+
+// Policies for a metric that fails on an instance
+const (
+	onErrorContinue   = "continue"    // Move on to the next instance
+	onErrorSkipMetric = "skip_metric" // Skip the metric on the remaining instances
+	onErrorFailFast   = "fail_fast"   // Stop the run
+)
+
+// runSettings are the run-wide settings every metric starts from
+type runSettings struct {
+	step    time.Duration // Default step
+	window  time.Duration // Batch window
+	minStep time.Duration // Smallest step chosen by target_points
+}
+
+// parseRunSettings parses the default step and the batching settings
+func (p *Processor) parseRunSettings(stepStr string) (runSettings, error) {
+	s := runSettings{window: defaultBatchWindow, minStep: defaultMinStep}
+
+	var err error
+	if s.step, err = common.ParseDuration(stepStr); err != nil {
+		return s, fmt.Errorf("invalid step duration: %v", err)
+	}
+
+	if p.cfg.BatchWindow != "" {
+		if s.window, err = common.ParseDuration(p.cfg.BatchWindow); err != nil {
+			return s, fmt.Errorf("invalid batch window: %v", err)
+		}
+		if s.window <= 0 {
+			return s, errors.New("batch window must be positive")
+		}
+	}
+
+	if p.cfg.MinStep != "" {
+		if s.minStep, err = common.ParseDuration(p.cfg.MinStep); err != nil {
+			return s, fmt.Errorf("invalid min step: %v", err)
+		}
+	}
+	return s, nil
+}
+
+// prepareMetric validates a metric, logging settings it ignores, and
+// returns the step of its queries and whether target_points chose it. An
+// error means the metric is skipped.
+func (p *Processor) prepareMetric(metric config.MetricConfig, s runSettings, start, end time.Time) (time.Duration, bool, error) {
+	step := s.step
+	if metric.Step != "" {
+		var err error
+		if step, err = common.ParseDuration(metric.Step); err != nil {
+			return 0, false, fmt.Errorf("invalid step duration: %v", err)
+		}
+	}
+	switch metric.Type {
+	case "", metricTypeQuery:
+	case metricTypeFederate:
+		if len(metric.Match) == 0 {
+			return 0, false, fmt.Errorf("type %s requires match selectors", metric.Type)
+		}
+		if metric.Query != "" {
+			log.Printf("Metric %s: query is ignored for type %s", metric.Name, metric.Type)
+		}
+	case metricTypeRules, metricTypeAlerts:
+		if metric.Query != "" || metric.Instant || metric.Transform != "" {
+			log.Printf("Metric %s: query, instant and transform are ignored for type %s", metric.Name, metric.Type)
+		}
+	default:
+		return 0, false, fmt.Errorf("unsupported type: %s", metric.Type)
+	}
+	switch metric.Transform {
+	case "":
+	case transformIncrease:
+		if metric.Instant {
+			log.Printf("Metric %s: transform %s has no effect on instant queries", metric.Name, metric.Transform)
+		}
+	default:
+		return 0, false, fmt.Errorf("unsupported transform: %s", metric.Transform)
+	}
+	if _, err := newDownsampler(metric.Downsample); err != nil {
+		return 0, false, err
+	}
+	if _, err := newRelabeler(metric.Relabel); err != nil {
+		return 0, false, err
+	}
+	switch metric.Mode {
+	case "":
+	case modeLatest:
+		if metric.Instant {
+			log.Printf("Metric %s: mode %s has no effect on instant queries", metric.Name, metric.Mode)
+		}
+	default:
+		return 0, false, fmt.Errorf("unsupported mode: %s", metric.Mode)
+	}
+	if metric.Downsample != nil && metric.Instant {
+		log.Printf("Metric %s: downsample has no effect on instant queries", metric.Name)
+	}
+	if metric.WithExemplars && (metric.Instant || metric.Type != "" && metric.Type != metricTypeQuery) {
+		log.Printf("Metric %s: with_exemplars only applies to range queries", metric.Name)
+	}
+
+	if target := targetPoints(metric, p.cfg); target > 0 && !metric.Instant && !isSnapshot(metric) {
+		span := s.window
+		if d := end.Sub(start); d < span {
+			span = d
+		}
+		return autoStep(span, target, s.minStep), true, nil
+	}
+	return step, false, nil
+}
+
+// ProcessMetrics coordinates fetching and processing of all metrics. When
+// ctx is cancelled the queries in flight are abandoned, no further batch or
+// metric is started, and ctx's error is returned.
+func (p *Processor) ProcessMetrics(ctx context.Context, metrics []config.MetricConfig, start, end time.Time, stepStr string) error {
+	settings, err := p.parseRunSettings(stepStr)
 	if err != nil {
-		return fmt.Errorf("invalid step duration: %v", err)
+		return err
+	}
+	window := settings.window
+
+	if p.loc, err = loadTimezone(p.cfg.Timezone); err != nil {
+		return err
+	}
+
+	policy := p.cfg.OnError
+	switch policy {
+	case "":
+		policy = onErrorContinue
+	case onErrorContinue, onErrorSkipMetric, onErrorFailFast:
+	default:
+		return fmt.Errorf("unsupported on_error policy: %s", p.cfg.OnError)
+	}
+
+	switch p.cfg.DefaultLabels {
+	case "", defaultLabelsAll, defaultLabelsNone:
+	default:
+		return fmt.Errorf("unsupported default_labels: %s", p.cfg.DefaultLabels)
+	}
+
+	switch p.cfg.OnLabelConflict {
+	case "", labelConflictExported, labelConflictOverride, labelConflictSuffix, labelConflictError:
+	default:
+		return fmt.Errorf("unsupported on_label_conflict policy: %s", p.cfg.OnLabelConflict)
+	}
+
+	switch p.cfg.OversizedBatch {
+	case "", oversizedError, oversizedTruncate:
+	default:
+		return fmt.Errorf("unsupported oversized_batch policy: %s", p.cfg.OversizedBatch)
 	}
 
 	// Validate time range
@@ -39,134 +200,587 @@ func (p *Processor) ProcessMetrics(metrics []config.MetricConfig, start, end tim
 		return errors.New("start time must be before end time")
 	}
 
-	// Process each metric for each Prometheus instance
+	if err := p.initBreakers(); err != nil {
+		return err
+	}
+	p.injected = p.injectedLabels()
+	p.tally = newRunTally(metrics)
+	p.series = newSeriesTracker(p.cfg.SeriesWarningThreshold)
+	p.collided = newCollisionWarner()
+	p.relabel = make(map[string]relabeler)
 	for _, metric := range metrics {
+		// Invalid rules are reported when the metric is skipped
+		if rules, err := newRelabeler(metric.Relabel); err == nil && rules != nil {
+			p.relabel[metric.Name] = rules
+		}
+	}
+	p.progress.start(len(metrics), len(p.clients))
+	p.runID = uuid.NewString()
+	log.Printf("Starting run %s", p.runID)
+
+	var watermarks sink.Watermarker
+	if p.cfg.Incremental {
+		var ok bool
+		if watermarks, ok = sink.AsWatermarker(p.sink); !ok {
+			log.Printf("Sink does not support incremental mode, fetching from the configured start")
+		}
+	}
+
+	// Metrics processed in parallel share the sink
+	if p.cfg.MetricWorkers > 1 {
+		shared := &lockedSink{sink: p.sink}
+		if watermarks != nil {
+			watermarks = shared
+		}
+		p.sink = shared
+		defer func() {
+			p.sink = shared.sink
+		}()
+	}
+
+	runStart := time.Now()
+	defer func() {
+		p.duration = time.Since(runStart)
+	}()
+
+	// Process each metric for each Prometheus instance, several at a time with metric_workers
+	return forEachMetric(metrics, p.cfg.MetricWorkers, func(metric config.MetricConfig) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		log.Printf("Processing metric: %s", metric.Name)
+		warnModifiers(metric, window)
+
+		// Skipped and failed instances count as done
+		defer func() {
+			for _, client := range p.clients {
+				p.progress.finish(metric.Name, client.Name())
+			}
+		}()
+
+		step, auto, err := p.prepareMetric(metric, settings, start, end)
+		if err != nil {
+			log.Printf("Skipping metric %s: %v", metric.Name, err)
+			return nil
+		}
+		if auto {
+			log.Printf("Using step %v for metric %s to get about %d points per batch", step, metric.Name, targetPoints(metric, p.cfg))
+			p.tally.setStep(metric.Name, step)
+		}
+		window := metricWindow(metric, step, window)
+		if window != settings.window {
+			log.Printf("Using batches of %v for metric %s to stay within %d points per series at step %v", window, metric.Name, MaxPointsPerSeries, step)
+		}
+
+		if metric.Compare != nil {
+			err := p.processCompare(ctx, metric, start, end, step, window)
+			if err == nil {
+				return nil
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Printf("Error comparing metric %s: %v", metric.Name, err)
+			p.tally.addFailure(metric.Name, metric.Compare.Candidate, err)
+			if policy == onErrorFailFast {
+				return fmt.Errorf("metric %s: %v", metric.Name, err)
+			}
+			return nil
+		}
 
 		for _, client := range p.clients {
+			if !p.breakers[client.Name()].allow() {
+				continue
+			}
+
 			log.Printf("Processing Prometheus instance: %s", client.Name())
 
-			// Fetch data in hourly batches
-			if err := p.processInHourlyBatches(client, metric, start, end, step); err != nil {
-				log.Printf("Error processing metric %s for instance %s: %v",
-					metric.Name, client.Name(), err)
-				// Continue with next client instead of failing entirely
+			err := p.processInstance(ctx, client, metric, start, end, step, window, watermarks)
+			p.progress.finish(metric.Name, client.Name())
+			if err == nil {
 				continue
 			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			log.Printf("Error processing metric %s for instance %s: %v", metric.Name, client.Name(), err)
+			p.tally.addFailure(metric.Name, client.Name(), err)
+
+			if policy == onErrorFailFast {
+				return fmt.Errorf("metric %s for instance %s: %v", metric.Name, client.Name(), err)
+			}
+			if policy == onErrorSkipMetric {
+				log.Printf("Skipping metric %s on the remaining instances", metric.Name)
+				break
+			}
+			// onErrorContinue moves on to the next instance
 		}
+		return nil
+	})
+}
+
+// processInstance fetches and writes one metric from one instance, starting
+// after the sink's watermark when watermarks is set
+func (p *Processor) processInstance(
+	ctx context.Context,
+	client prometheus.Client,
+	metric config.MetricConfig,
+	start, end time.Time,
+	step, window time.Duration,
+	watermarks sink.Watermarker,
+) error {
+	if isSnapshot(metric) {
+		return p.processState(ctx, client, metric)
+	}
+
+	if watermarks != nil {
+		var err error
+		if start, err = incrementalStart(watermarks, client.Name(), metric.Name, start, step); err != nil {
+			return err
+		}
+		if !start.Before(end) {
+			log.Printf("Metric %s for instance %s is up to date", metric.Name, client.Name())
+			return nil
+		}
+	}
+
+	if metric.Type == metricTypeFederate {
+		return p.processSelectors(ctx, client, metric, start, end, step, window)
+	}
+	return p.processQuery(ctx, client, metric, start, end, step, window)
+}
+
+// processQuery fetches the metric's query, once or in batches, and writes the result
+func (p *Processor) processQuery(
+	ctx context.Context,
+	client prometheus.Client,
+	metric config.MetricConfig,
+	start, end time.Time,
+	step, window time.Duration,
+) error {
+	if metric.Instant {
+		return p.processInstant(ctx, client, metric, end)
+	}
+
+	// Fetch data in batches
+	return p.processInBatches(ctx, client, metric, start, end, step, window)
+}
+
+// processInstant evaluates the metric's query once at ts and writes the result
+func (p *Processor) processInstant(ctx context.Context, client prometheus.Client, metric config.MetricConfig, ts time.Time) error {
+	log.Printf("Evaluating instant query at %s", ts.Format(time.RFC3339))
+
+	breaker := p.breakers[client.Name()]
+	result, err := client.FetchInstant(ctx, metric.Query, ts, metricTimeout(metric))
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		breaker.recordFetchError(err)
+		return fmt.Errorf("failed to fetch instant query: %v", err)
+	}
+	breaker.recordSuccess()
+
+	if result, err = p.limitSamples(metric.Name, result); err != nil {
+		return err
 	}
 
+	out := newChunkWriter(p.sink, metric.Name, p.cfg.Job, p.runID, p.cfg.RowChecksum, p.cfg.WriteChunkSize)
+	if err := p.processBatchResult(client.Name(), metric, result, out); err != nil {
+		return fmt.Errorf("failed to process instant query results: %v", err)
+	}
+	flushErr := out.flush()
+	p.tally.addRows(metric.Name, out.written)
+	if flushErr != nil {
+		return fmt.Errorf("failed to write instant query results to sink: %v", flushErr)
+	}
+
+	log.Printf("Wrote %d records from instant query to sink", out.written)
 	return nil
 }
 
-// processInHourlyBatches splits the time range into 1-hour chunks and processes each
-func (p *Processor) processInHourlyBatches(
+// metricTimeout returns the metric's query timeout, or 0 for the instance's.
+// The setting is validated when the config is loaded.
+func metricTimeout(metric config.MetricConfig) time.Duration {
+	if metric.Timeout == "" {
+		return 0
+	}
+	timeout, _ := common.ParseDuration(metric.Timeout)
+	return timeout
+}
+
+// loadTimezone resolves the timezone setting: "UTC" (default), "local" for
+// the host's zone, or an IANA name such as "Asia/Shanghai"
+func loadTimezone(name string) (*time.Location, error) {
+	switch name {
+	case "", "UTC":
+		return time.UTC, nil
+	case "local":
+		return time.Local, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone: %v", err)
+	}
+	return loc, nil
+}
+
+// sampleTime converts a sample timestamp to a row timestamp in the configured zone
+func (p *Processor) sampleTime(t model.Time) time.Time {
+	return time.Unix(t.Unix(), 0).In(p.loc)
+}
+
+// incrementalStart returns where fetching resumes: one step after the newest
+// sample stored in the sink, keeping the sampling grid, or start if that is later
+func incrementalStart(w sink.Watermarker, instance, metricName string, start time.Time, step time.Duration) (time.Time, error) {
+	last, ok, err := w.LastTimestamp(instance, metricName)
+	if err != nil {
+		return start, err
+	}
+	if !ok {
+		return start, nil
+	}
+
+	resume := last.Add(step)
+	if resume.Before(start) {
+		return start, nil
+	}
+	log.Printf("Resuming metric %s for instance %s at %s", metricName, instance, resume.Format(time.RFC3339))
+	return resume, nil
+}
+
+const (
+	// instanceLabelName is the label holding the instance name when instance_label is set
+	instanceLabelName = "prometheus_instance"
+
+	// addressLabelName is the label holding the instance address when address_label is set
+	addressLabelName = "prometheus_address"
+)
+
+// injectedLabels returns the labels added to every row of each client: its
+// static labels plus, with instance_label and address_label, its name and
+// address
+func (p *Processor) injectedLabels() map[string]map[string]string {
+	injected := make(map[string]map[string]string, len(p.clients))
+	for _, client := range p.clients {
+		labels := make(map[string]string, len(client.Labels())+2)
+		for k, v := range client.Labels() {
+			labels[k] = v
+		}
+		if p.cfg.InstanceLabel {
+			labels[instanceLabelName] = client.Name()
+		}
+		if p.cfg.AddressLabel {
+			labels[addressLabelName] = client.Address()
+		}
+		injected[client.Name()] = labels
+	}
+	return injected
+}
+
+// initBreakers creates a fresh circuit breaker for every client
+func (p *Processor) initBreakers() error {
+	threshold := p.cfg.BreakerThreshold
+	if threshold == 0 {
+		threshold = defaultBreakerThreshold
+	}
+
+	var cooldown time.Duration
+	if p.cfg.BreakerCooldown != "" {
+		var err error
+		if cooldown, err = common.ParseDuration(p.cfg.BreakerCooldown); err != nil {
+			return fmt.Errorf("invalid breaker cooldown: %v", err)
+		}
+	}
+
+	p.breakers = make(map[string]*circuitBreaker, len(p.clients))
+	for _, client := range p.clients {
+		p.breakers[client.Name()] = newCircuitBreaker(client.Name(), threshold, cooldown)
+	}
+	return nil
+}
+
+// processInBatches splits the time range into window-sized chunks and processes each
+func (p *Processor) processInBatches(
+	ctx context.Context,
 	client prometheus.Client,
 	metric config.MetricConfig,
 	globalStart, globalEnd time.Time,
-	step time.Duration,
+	step, window time.Duration,
 ) error {
 	// Calculate total duration
 	totalDuration := globalEnd.Sub(globalStart)
-	log.Printf("Total time range: %v. Will split into hourly batches.", totalDuration)
+	log.Printf("Total time range: %v. Will split into batches of %v.", totalDuration, window)
 
-	// Process each hourly batch
-	currentStart := globalStart
-	batchNumber := 1
+	var increase *increaseTracker
+	if metric.Transform == transformIncrease {
+		increase = newIncreaseTracker()
+	}
+	downsample, err := newDownsampler(metric.Downsample)
+	if err != nil {
+		return err
+	}
+	var gaps *gapTracker
+	if p.cfg.DetectGaps {
+		gaps = newGapTracker(client.Name(), step)
+	}
+	var latest *latestTracker
+	if metric.Mode == modeLatest {
+		latest = newLatestTracker()
+	}
+
+	// Queries may run ahead in parallel; results are processed in batch order
+	batches := splitBatches(globalStart, globalEnd, window, p.cfg.AlignBatches)
+	fetcher := newBatchFetcher(batches, p.cfg.BatchWorkers, func(batch batchRange) (model.Value, error) {
+		return client.FetchRange(ctx, metric.Query, batch.start, batch.end, step, metricTimeout(metric))
+	})
+	breaker := p.breakers[client.Name()]
 
-	for currentStart.Before(globalEnd) {
-		// Calculate end of current batch (1 hour later or global end, whichever comes first)
-		currentEnd := currentStart.Add(1 * time.Hour)
-		if currentEnd.After(globalEnd) {
-			currentEnd = globalEnd
+	// Process each batch
+	for i, batch := range batches {
+		batchNumber, currentEnd := i+1, batch.end
+		if err := ctx.Err(); err != nil {
+			log.Printf("Stopping metric %s for instance %s before batch %d: %v", metric.Name, client.Name(), batchNumber, err)
+			return err
 		}
 
 		log.Printf("Processing batch %d: %s to %s",
 			batchNumber,
-			currentStart.Format(time.RFC3339),
+			batch.start.Format(time.RFC3339),
 			currentEnd.Format(time.RFC3339))
 
 		// Fetch data for this batch
-		result, err := client.FetchRange(metric.Query, currentStart, currentEnd, step)
+		result, err := fetcher.result(i)
 		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			breaker.recordFetchError(err)
 			return fmt.Errorf("failed to fetch batch %d: %v", batchNumber, err)
 		}
+		breaker.recordSuccess()
 
-		// Process and write the batch data
-		processedData, err := p.processBatchResult(client.Name(), metric.Name, metric.LabelKeys, result)
-		if err != nil {
-			return fmt.Errorf("failed to process batch %d results: %v", batchNumber, err)
+		// Gaps are looked for in the raw result, before samples are dropped or transformed
+		if gaps != nil {
+			found := gaps.observe(result)
+			if p.cfg.GapRows && len(found) > 0 {
+				if err := p.writeGaps(client.Name(), metric, found); err != nil {
+					return fmt.Errorf("batch %d: %v", batchNumber, err)
+				}
+			}
 		}
 
-		if len(processedData) > 0 {
-			log.Printf("Writing %d records from batch %d to sink", len(processedData), batchNumber)
-			if err := p.sink.Write(metric.Name, processedData); err != nil {
-				return fmt.Errorf("failed to write batch %d to sink: %v", batchNumber, err)
+		if result, err = p.limitSamples(metric.Name, result); err != nil {
+			return fmt.Errorf("batch %d: %v", batchNumber, err)
+		}
+		if increase != nil {
+			if result, err = increase.apply(result, currentEnd); err != nil {
+				return fmt.Errorf("batch %d: %v", batchNumber, err)
+			}
+		}
+		if downsample != nil {
+			if result, err = downsample.apply(result, currentEnd); err != nil {
+				return fmt.Errorf("batch %d: %v", batchNumber, err)
 			}
+		}
+
+		if latest != nil {
+			// The latest samples are written once every batch is seen
+			latest.observe(result)
 		} else {
-			log.Printf("No data found for batch %d", batchNumber)
+			// Process and write the batch data in chunks
+			out := newChunkWriter(p.sink, metric.Name, p.cfg.Job, p.runID, p.cfg.RowChecksum, p.cfg.WriteChunkSize)
+			if err := p.processBatchResult(client.Name(), metric, result, out); err != nil {
+				return fmt.Errorf("failed to process batch %d results: %v", batchNumber, err)
+			}
+			flushErr := out.flush()
+			p.tally.addRows(metric.Name, out.written)
+			if flushErr != nil {
+				return fmt.Errorf("failed to write batch %d to sink: %v", batchNumber, flushErr)
+			}
+
+			if out.written > 0 {
+				log.Printf("Wrote %d records from batch %d to sink", out.written, batchNumber)
+			} else {
+				log.Printf("No data found for batch %d", batchNumber)
+			}
 		}
 
-		// Move to next batch
-		currentStart = currentEnd
-		batchNumber++
+		// Exemplars are optional extra detail, so failing to get them does not fail the metric
+		if metric.WithExemplars {
+			written, err := p.writeExemplars(ctx, client, metric, batch.start, currentEnd, step, i == len(batches)-1)
+			if err != nil {
+				log.Printf("Warning: metric %s batch %d: %v", metric.Name, batchNumber, err)
+			} else if written > 0 {
+				log.Printf("Wrote %d exemplars from batch %d to sink", written, batchNumber)
+			}
+		}
+
+		progress := p.progress.advance(metric.Name, client.Name(), currentEnd.Sub(globalStart), totalDuration)
+		log.Printf("Progress: metric %s on %s %.1f%%, run %.1f%%", metric.Name, client.Name(), progress.Percent, progress.Run)
+	}
+
+	if downsample != nil {
+		last := downsample.flush()
+		if latest != nil {
+			latest.observe(last)
+		} else if err := p.writeResult(client.Name(), metric, last); err != nil {
+			return fmt.Errorf("failed to write last downsample buckets: %v", err)
+		}
+	}
+	if latest != nil {
+		result := latest.result()
+		if err := p.writeResult(client.Name(), metric, result); err != nil {
+			return fmt.Errorf("failed to write latest samples: %v", err)
+		}
+		log.Printf("Wrote the latest sample of %d series", len(result))
+	}
+	if gaps != nil {
+		if found := gaps.summary(); len(found) > 0 {
+			p.tally.addGaps(metric.Name, found)
+		}
 	}
 
-	log.Printf("Completed processing all %d batches for metric %s", batchNumber-1, metric.Name)
+	log.Printf("Completed processing all %d batches for metric %s", len(batches), metric.Name)
 	return nil
 }
 
-// processBatchResult converts Prometheus response to ProcessedData
+// writeResult processes a query result outside the batch loop and writes it to the sink
+func (p *Processor) writeResult(instanceName string, metric config.MetricConfig, result model.Value) error {
+	out := newChunkWriter(p.sink, metric.Name, p.cfg.Job, p.runID, p.cfg.RowChecksum, p.cfg.WriteChunkSize)
+	if err := p.processBatchResult(instanceName, metric, result, out); err != nil {
+		return err
+	}
+	flushErr := out.flush()
+	p.tally.addRows(metric.Name, out.written)
+	return flushErr
+}
+
+// batchEnd returns the end of the batch starting at start. When align is set the
+// batch ends on the next multiple of window (e.g. the next clock hour), so only
+// the first and last batches are partial.
+func batchEnd(start, globalEnd time.Time, window time.Duration, align bool) time.Time {
+	end := start.Add(window)
+	if align {
+		end = start.Truncate(window).Add(window)
+	}
+	if end.After(globalEnd) {
+		end = globalEnd
+	}
+	return end
+}
+
+// processBatchResult converts Prometheus response to ProcessedData, streaming rows to out
 func (p *Processor) processBatchResult(
-	instanceName, metricName string,
-	labelKeys []string,
+	instanceName string,
+	metric config.MetricConfig,
 	result model.Value,
-) ([]common.ProcessedData, error) {
-	var processed []common.ProcessedData
+	out *chunkWriter,
+) error {
+	if len(metric.Quantiles) > 0 {
+		processed, err := p.processQuantiles(instanceName, metric, result)
+		if err != nil {
+			return err
+		}
+		for _, item := range processed {
+			p.series.observe(item.MetricName, instanceName, item.Labels)
+			if err := out.add(item); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	metricName := metric.Name
 
 	// Check result type
 	vector, ok := result.(model.Vector)
 	if !ok {
 		matrix, ok := result.(model.Matrix)
 		if !ok {
-			return nil, fmt.Errorf("unsupported result type: %T", result)
+			return fmt.Errorf("unsupported result type: %T", result)
 		}
 
 		// Process matrix result (time series with multiple samples)
+		rows := make(rowSet, len(matrix))
 		for _, series := range matrix {
-			labels := extractLabels(series.Metric, labelKeys)
+			labels, err := p.rowLabels(instanceName, metric, series.Metric)
+			if err != nil {
+				return err
+			}
+			if labels == nil {
+				continue
+			}
+			p.series.observe(metricName, instanceName, labels)
+			seriesName := seriesNameOf(metric, series.Metric)
+			if rows.add(seriesName, labels) {
+				p.collided.warn(metricName, instanceName)
+			}
 
 			for _, sample := range series.Values {
-				processed = append(processed, common.ProcessedData{
+				if err := out.add(common.ProcessedData{
 					PrometheusInstance: instanceName,
 					MetricName:         metricName,
-					Timestamp:          time.Unix(int64(sample.Timestamp.Unix()), 0),
+					Timestamp:          p.sampleTime(sample.Timestamp),
 					Value:              float64(sample.Value),
 					Labels:             labels,
-				})
+					SeriesName:         seriesName,
+				}); err != nil {
+					return err
+				}
 			}
 		}
-		return processed, nil
+		return nil
 	}
 
 	// Process vector result (single sample per time series)
+	rows := make(rowSet, len(vector))
 	for _, sample := range vector {
-		labels := extractLabels(sample.Metric, labelKeys)
-		processed = append(processed, common.ProcessedData{
+		labels, err := p.rowLabels(instanceName, metric, sample.Metric)
+		if err != nil {
+			return err
+		}
+		if labels == nil {
+			continue
+		}
+		p.series.observe(metricName, instanceName, labels)
+		if rows.add(seriesNameOf(metric, sample.Metric), labels) {
+			p.collided.warn(metricName, instanceName)
+		}
+		if err := out.add(common.ProcessedData{
 			PrometheusInstance: instanceName,
 			MetricName:         metricName,
-			Timestamp:          time.Unix(int64(sample.Timestamp.Unix()), 0),
+			Timestamp:          p.sampleTime(sample.Timestamp),
 			Value:              float64(sample.Value),
 			Labels:             labels,
-		})
+			SeriesName:         seriesNameOf(metric, sample.Metric),
+		}); err != nil {
+			return err
+		}
 	}
 
-	return processed, nil
+	return nil
 }
 
+// allLabelsKey in a metric's label_keys captures every label on the series,
+// whatever other keys are listed
+const allLabelsKey = "*"
+
 // extractLabels extracts specified labels from the metric
 func extractLabels(metric model.Metric, keys []string) map[string]string {
 	labels := make(map[string]string)
+
+	if slices.Contains(keys, allLabelsKey) {
+		for name, val := range metric {
+			if name == model.MetricNameLabel {
+				continue
+			}
+			labels[string(name)] = string(val)
+		}
+		return labels
+	}
+
 	for _, key := range keys {
 		if val, exists := metric[model.LabelName(key)]; exists {
 			labels[key] = string(val)
@@ -174,3 +788,12 @@ func extractLabels(metric model.Metric, keys []string) map[string]string {
 	}
 	return labels
 }
+
+// seriesNameOf returns the series' __name__ for metrics with keep_metric_name.
+// Series computed by functions or operators have none.
+func seriesNameOf(metric config.MetricConfig, labels model.Metric) string {
+	if !metric.KeepMetricName {
+		return ""
+	}
+	return string(labels[model.MetricNameLabel])
+}
@@ -0,0 +1,184 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"github.com/meiking/tidb-metrics-crawler/pkg/sink"
+	"github.com/prometheus/common/model"
+)
+
+func TestProcessMetricsStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := &fakeClient{name: "prom"}
+	client.fetchRange = func(ctx context.Context, query string, start, end time.Time, step time.Duration) (model.Value, error) {
+		if len(client.fetched()) == 2 {
+			// Interrupted while the second batch is in flight
+			cancel()
+			return nil, ctx.Err()
+		}
+		return rangeMatrix(model.Metric{"job": "tidb"}, start, end, step), nil
+	}
+	out := newMemorySink()
+	metrics := []config.MetricConfig{{Name: "qps", Query: "x"}, {Name: "later", Query: "y"}}
+
+	p := newTestProcessor(out, config.ProcessorConfig{BatchWindow: "1h"}, client)
+	err := p.ProcessMetrics(ctx, metrics, testTime("2024-01-01T00:00:00Z"), testTime("2024-01-01T05:00:00Z"), "1h")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("ProcessMetrics() error = %v, want context.Canceled", err)
+	}
+	if got := len(client.fetched()); got != 2 {
+		t.Errorf("fetched %d batches, want 2: no batch may start after the interrupt", got)
+	}
+	if got := len(out.metricRows("qps")); got != 2 {
+		t.Errorf("wrote %d rows of qps, want the 2 of the first batch", got)
+	}
+	if got := len(out.metricRows("later")); got != 0 {
+		t.Errorf("wrote %d rows of a metric started after the interrupt", got)
+	}
+	if p.breakers["prom"].failures != 0 {
+		t.Errorf("an interrupted query counted as a failure of the instance")
+	}
+	if len(p.Summary().Failures) != 0 {
+		t.Errorf("an interrupted query was reported as failed: %v", p.Summary().Failures)
+	}
+}
+
+// watermarkMemorySink is a memorySink that reports stored watermarks and
+// records what it was asked
+type watermarkMemorySink struct {
+	*memorySink
+	last    map[string]time.Time // Keyed by instance/metric
+	queries []string
+}
+
+func (s *watermarkMemorySink) LastTimestamp(instance, metricName string) (time.Time, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := instance + "/" + metricName
+	s.queries = append(s.queries, key)
+	last, ok := s.last[key]
+	return last, ok, nil
+}
+
+func TestIncrementalStart(t *testing.T) {
+	start, end := testTime("2024-01-01T00:00:00Z"), testTime("2024-01-01T06:00:00Z")
+	metrics := []config.MetricConfig{{Name: "qps", Query: "qps"}, {Name: "new", Query: "new"}, {Name: "old", Query: "old"}}
+	watermarks := map[string]time.Time{
+		"prom/qps": testTime("2024-01-01T03:00:00Z"),
+		"prom/old": testTime("2023-12-31T00:00:00Z"), // Before the window
+	}
+
+	// run crawls with the sink decorated as in main, returning the first
+	// range queried per metric
+	run := func(t *testing.T, out sink.Sink) map[string]time.Time {
+		client := &fakeClient{name: "prom"}
+		var mu sync.Mutex
+		first := make(map[string]time.Time)
+		client.fetchRange = func(ctx context.Context, query string, start, end time.Time, step time.Duration) (model.Value, error) {
+			mu.Lock()
+			if _, ok := first[query]; !ok {
+				first[query] = start
+			}
+			mu.Unlock()
+			return rangeMatrix(model.Metric{"job": "tidb"}, start, end, step), nil
+		}
+		p := newTestProcessor(sink.NewSkipNonFiniteSink(out), config.ProcessorConfig{Incremental: true, BatchWindow: "1h"}, client)
+		if err := p.ProcessMetrics(context.Background(), metrics, start, end, "1m"); err != nil {
+			t.Fatalf("ProcessMetrics() error = %v", err)
+		}
+		return first
+	}
+
+	t.Run("watermarker", func(t *testing.T) {
+		out := &watermarkMemorySink{memorySink: newMemorySink(), last: watermarks}
+		first := run(t, out)
+
+		want := map[string]time.Time{
+			"qps": testTime("2024-01-01T03:01:00Z"), // One step after the watermark
+			"new": start,
+			"old": start,
+		}
+		for query, wantStart := range want {
+			if !first[query].Equal(wantStart) {
+				t.Errorf("metric %s starts at %v, want %v", query, first[query], wantStart)
+			}
+		}
+		if len(out.queries) != 3 || !slices.Contains(out.queries, "prom/qps") {
+			t.Errorf("watermarks asked for %v, want every instance/metric", out.queries)
+		}
+	})
+
+	t.Run("decorated plain sink", func(t *testing.T) {
+		// The decorator's LastTimestamp must not make a plain sink look incremental
+		var logs bytes.Buffer
+		log.SetOutput(&logs)
+		defer log.SetOutput(os.Stderr)
+
+		first := run(t, newMemorySink())
+		if !strings.Contains(logs.String(), "Sink does not support incremental mode") {
+			t.Error("no warning that the sink cannot resume")
+		}
+		for _, metric := range metrics {
+			if !first[metric.Query].Equal(start) {
+				t.Errorf("metric %s starts at %v, want the configured start", metric.Name, first[metric.Query])
+			}
+		}
+	})
+}
+
+func TestProvenanceStableWithinRun(t *testing.T) {
+	metrics := []config.MetricConfig{{Name: "qps", Query: "x"}, {Name: "latency", Query: "y"}}
+	start, end := testTime("2024-01-01T00:00:00Z"), testTime("2024-01-01T03:00:00Z")
+
+	out := newMemorySink()
+	p := newTestProcessor(out, config.ProcessorConfig{Job: "nightly", BatchWindow: "1h"}, &fakeClient{name: "a"}, &fakeClient{name: "b"})
+	if err := p.ProcessMetrics(context.Background(), metrics, start, end, "15m"); err != nil {
+		t.Fatalf("ProcessMetrics() error = %v", err)
+	}
+
+	runIDs := make(map[string]bool)
+	for _, metric := range metrics {
+		rows := out.metricRows(metric.Name)
+		if len(rows) == 0 {
+			t.Fatalf("no rows of %s", metric.Name)
+		}
+		for _, row := range rows {
+			if row.Job != "nightly" {
+				t.Fatalf("%s row of %s has job %q, want nightly", metric.Name, row.PrometheusInstance, row.Job)
+			}
+			runIDs[row.RunID] = true
+		}
+	}
+	if len(runIDs) != 1 {
+		t.Fatalf("rows carry %d run IDs, want one across metrics, instances and batches", len(runIDs))
+	}
+	var first string
+	for id := range runIDs {
+		first = id
+	}
+	if len(first) != 36 {
+		t.Errorf("run ID = %q, want a UUID", first)
+	}
+
+	// The next run gets a new ID
+	out = newMemorySink()
+	p = newTestProcessor(out, config.ProcessorConfig{Job: "nightly", BatchWindow: "1h"}, &fakeClient{name: "a"})
+	if err := p.ProcessMetrics(context.Background(), metrics[:1], start, end, "15m"); err != nil {
+		t.Fatalf("ProcessMetrics() error = %v", err)
+	}
+	if second := out.metricRows("qps")[0].RunID; second == first || second == "" {
+		t.Errorf("second run ID = %q, want one different from %q", second, first)
+	}
+}
@@ -0,0 +1,139 @@
+package processor
+
+import (
+	"sync"
+	"time"
+)
+
+// Progress is how far a run has got
+type Progress struct {
+	Metric   string  // Metric of the latest update
+	Instance string  // Instance of the latest update
+	Percent  float64 // Share of the metric's time range done on the instance
+	Run      float64 // Share of all metric and instance pairs done
+}
+
+// progressPercent returns the share of total covered, from 0 to 100. An
+// empty total is complete.
+func progressPercent(covered, total time.Duration) float64 {
+	if total <= 0 || covered >= total {
+		return 100
+	}
+	if covered <= 0 {
+		return 0
+	}
+	return float64(covered) / float64(total) * 100
+}
+
+// progressKey identifies a metric on an instance
+type progressKey struct {
+	metric   string
+	instance string
+}
+
+// pairProgress is the progress of a metric on an instance. Federate metrics
+// fetch one part per selector, each covering the whole time range.
+type pairProgress struct {
+	part    int
+	parts   int
+	percent float64 // Of the current part
+}
+
+// overall returns the pair's progress across its parts
+func (p *pairProgress) overall() float64 {
+	return (float64(p.part)*100 + p.percent) / float64(p.parts)
+}
+
+// progressTracker follows every metric and instance pair of a run. A pair
+// counts as done once it finishes, fails or is skipped, so the run reaches
+// 100% when the last metric is done.
+type progressTracker struct {
+	mu    sync.Mutex
+	total int // Metric and instance pairs in the run
+	pairs map[progressKey]*pairProgress
+	last  Progress
+}
+
+// newProgressTracker creates a tracker with no run started
+func newProgressTracker() *progressTracker {
+	return &progressTracker{pairs: make(map[progressKey]*pairProgress)}
+}
+
+// start begins a run of metrics on instances
+func (t *progressTracker) start(metrics, instances int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.total = metrics * instances
+	t.pairs = make(map[progressKey]*pairProgress)
+	t.last = Progress{}
+}
+
+// pair returns the progress of a pair, creating it at 0%
+func (t *progressTracker) pair(metric, instance string) *pairProgress {
+	key := progressKey{metric: metric, instance: instance}
+	p, ok := t.pairs[key]
+	if !ok {
+		p = &pairProgress{parts: 1}
+		t.pairs[key] = p
+	}
+	return p
+}
+
+// startPart moves a pair on to part of parts
+func (t *progressTracker) startPart(metric, instance string, part, parts int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p := t.pair(metric, instance)
+	p.part, p.parts, p.percent = part, parts, 0
+}
+
+// advance records that covered of the pair's total time range is done and
+// returns the updated progress
+func (t *progressTracker) advance(metric, instance string, covered, total time.Duration) Progress {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p := t.pair(metric, instance)
+	p.percent = progressPercent(covered, total)
+	return t.update(metric, instance, p)
+}
+
+// finish marks a pair as done
+func (t *progressTracker) finish(metric, instance string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p := t.pair(metric, instance)
+	p.part, p.parts, p.percent = 0, 1, 100
+	t.update(metric, instance, p)
+}
+
+// update makes the pair the latest progress
+func (t *progressTracker) update(metric, instance string, p *pairProgress) Progress {
+	done := 0.0
+	for _, pair := range t.pairs {
+		done += pair.overall()
+	}
+	run := 100.0
+	if t.total > 0 {
+		run = done / float64(t.total)
+	}
+
+	t.last = Progress{Metric: metric, Instance: instance, Percent: p.overall(), Run: run}
+	return t.last
+}
+
+// snapshot returns the latest progress
+func (t *progressTracker) snapshot() Progress {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.last
+}
+
+// Progress returns how far the current run has got. It is safe to call
+// while ProcessMetrics runs.
+func (p *Processor) Progress() Progress {
+	return p.progress.snapshot()
+}
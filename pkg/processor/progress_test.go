@@ -0,0 +1,65 @@
+package processor
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProgressPercent(t *testing.T) {
+	tests := []struct {
+		covered, total time.Duration
+		want           float64
+	}{
+		{0, 24 * time.Hour, 0},
+		{6 * time.Hour, 24 * time.Hour, 25},
+		{15 * time.Minute, 2 * time.Hour, 12.5},
+		{24 * time.Hour, 24 * time.Hour, 100},
+		{25 * time.Hour, 24 * time.Hour, 100}, // The last batch runs past the end
+		{-time.Minute, time.Hour, 0},
+		{0, 0, 100}, // An empty range is complete
+	}
+	for _, tt := range tests {
+		if got := progressPercent(tt.covered, tt.total); got != tt.want {
+			t.Errorf("progressPercent(%v, %v) = %v, want %v", tt.covered, tt.total, got, tt.want)
+		}
+	}
+}
+
+func TestProgressTracker(t *testing.T) {
+	tracker := newProgressTracker()
+	tracker.start(2, 2) // Metrics qps and regions on instances a and b
+
+	steps := []struct {
+		name    string
+		update  func() Progress
+		percent float64
+		run     float64
+	}{
+		{"qps half done on a", func() Progress { return tracker.advance("qps", "a", 12*time.Hour, 24*time.Hour) }, 50, 12.5},
+		{"qps done on a", func() Progress { tracker.finish("qps", "a"); return tracker.snapshot() }, 100, 25},
+		// A federate metric with two selectors is half done once the first
+		// selector is
+		{"regions first selector done on b", func() Progress {
+			tracker.startPart("regions", "b", 0, 2)
+			return tracker.advance("regions", "b", 24*time.Hour, 24*time.Hour)
+		}, 50, 37.5},
+		{"regions second selector half done on b", func() Progress {
+			tracker.startPart("regions", "b", 1, 2)
+			return tracker.advance("regions", "b", 12*time.Hour, 24*time.Hour)
+		}, 75, 43.75},
+	}
+	for _, step := range steps {
+		got := step.update()
+		if got.Percent != step.percent || got.Run != step.run {
+			t.Errorf("%s: progress %+v, want %v%% of the pair and %v%% of the run", step.name, got, step.percent, step.run)
+		}
+	}
+
+	// Failed and skipped pairs are finished too
+	for _, pair := range [][2]string{{"qps", "b"}, {"regions", "a"}, {"regions", "b"}} {
+		tracker.finish(pair[0], pair[1])
+	}
+	if got := tracker.snapshot(); got.Run != 100 || got.Metric != "regions" || got.Instance != "b" {
+		t.Errorf("progress after every pair finished = %+v, want 100%% with regions on b last", got)
+	}
+}
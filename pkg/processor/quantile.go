@@ -0,0 +1,364 @@
+package processor
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"github.com/prometheus/common/model"
+)
+
+// quantileLabel tags rows produced from a bucketed histogram with their quantile
+const quantileLabel = "quantile"
+
+// bucket is a single cumulative histogram bucket
+type bucket struct {
+	upperBound float64
+	count      float64
+}
+
+// histogramSeries holds the buckets of one histogram, keyed by timestamp.
+// A classic histogram has a series per bucket; a native histogram carries
+// all its buckets in each sample.
+type histogramSeries struct {
+	metric  model.Metric // Series labels without "le"
+	buckets map[model.Time][]bucket
+	native  map[model.Time]*model.SampleHistogram
+}
+
+// timestamps returns the histogram's sample times in order
+func (h *histogramSeries) timestamps() []model.Time {
+	timestamps := make([]model.Time, 0, len(h.buckets)+len(h.native))
+	for ts := range h.buckets {
+		timestamps = append(timestamps, ts)
+	}
+	for ts := range h.native {
+		if _, ok := h.buckets[ts]; !ok {
+			timestamps = append(timestamps, ts)
+		}
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	return timestamps
+}
+
+// quantile returns quantile q at ts, from the native histogram if the
+// series has one
+func (h *histogramSeries) quantile(q float64, ts model.Time) float64 {
+	if native, ok := h.native[ts]; ok {
+		return nativeQuantile(q, native)
+	}
+	return bucketQuantile(q, h.buckets[ts])
+}
+
+// processQuantiles computes the configured quantiles from a bucketed matrix,
+// emitting one row per quantile, histogram and timestamp
+func (p *Processor) processQuantiles(
+	instanceName string,
+	metric config.MetricConfig,
+	result model.Value,
+) ([]common.ProcessedData, error) {
+	matrix, ok := result.(model.Matrix)
+	if !ok {
+		return nil, fmt.Errorf("quantiles require a range (matrix) result, got %T", result)
+	}
+
+	histograms := groupHistogramBuckets(matrix)
+
+	// Process histograms in a stable order
+	fingerprints := make([]model.Fingerprint, 0, len(histograms))
+	for fp := range histograms {
+		fingerprints = append(fingerprints, fp)
+	}
+	sort.Slice(fingerprints, func(i, j int) bool { return fingerprints[i] < fingerprints[j] })
+
+	var processed []common.ProcessedData
+	for _, fp := range fingerprints {
+		histogram := histograms[fp]
+		timestamps := histogram.timestamps()
+
+		for _, q := range metric.Quantiles {
+			quantile := strconv.FormatFloat(q, 'f', -1, 64)
+
+			for _, ts := range timestamps {
+				value := histogram.quantile(q, ts)
+				if math.IsNaN(value) {
+					// Not enough usable buckets at this timestamp
+					continue
+				}
+
+				labels, err := p.rowLabels(instanceName, metric, histogram.metric)
+				if err != nil {
+					return nil, err
+				}
+				if labels == nil {
+					continue
+				}
+				labels[quantileLabel] = quantile
+
+				processed = append(processed, common.ProcessedData{
+					PrometheusInstance: instanceName,
+					MetricName:         metric.Name,
+					Timestamp:          p.sampleTime(ts),
+					Value:              value,
+					Labels:             labels,
+				})
+			}
+		}
+	}
+
+	return processed, nil
+}
+
+// groupHistogramBuckets groups bucket series by their labels without "le",
+// and takes native histogram series as they are
+func groupHistogramBuckets(matrix model.Matrix) map[model.Fingerprint]*histogramSeries {
+	histograms := make(map[model.Fingerprint]*histogramSeries)
+	histogramOf := func(metric model.Metric) *histogramSeries {
+		fp := metric.Fingerprint()
+		histogram, exists := histograms[fp]
+		if !exists {
+			histogram = &histogramSeries{
+				metric:  metric,
+				buckets: make(map[model.Time][]bucket),
+				native:  make(map[model.Time]*model.SampleHistogram),
+			}
+			histograms[fp] = histogram
+		}
+		return histogram
+	}
+
+	for _, series := range matrix {
+		if len(series.Histograms) > 0 {
+			metric := series.Metric.Clone()
+			delete(metric, model.MetricNameLabel)
+			histogram := histogramOf(metric)
+			for _, sample := range series.Histograms {
+				histogram.native[sample.Timestamp] = sample.Histogram
+			}
+		}
+
+		le, ok := series.Metric[model.BucketLabel]
+		if !ok {
+			continue
+		}
+		upperBound, err := strconv.ParseFloat(string(le), 64)
+		if err != nil {
+			continue
+		}
+
+		metric := series.Metric.Clone()
+		delete(metric, model.BucketLabel)
+		delete(metric, model.MetricNameLabel)
+		histogram := histogramOf(metric)
+
+		for _, sample := range series.Values {
+			histogram.buckets[sample.Timestamp] = append(histogram.buckets[sample.Timestamp], bucket{
+				upperBound: upperBound,
+				count:      float64(sample.Value),
+			})
+		}
+	}
+
+	return histograms
+}
+
+// bucketQuantile calculates quantile q from cumulative buckets using the same
+// algorithm as PromQL's histogram_quantile. It returns NaN when the buckets
+// are unusable, e.g. when the +Inf bucket is missing.
+func bucketQuantile(q float64, buckets []bucket) float64 {
+	if math.IsNaN(q) {
+		return math.NaN()
+	}
+	if q < 0 {
+		return math.Inf(-1)
+	}
+	if q > 1 {
+		return math.Inf(+1)
+	}
+
+	buckets = append([]bucket(nil), buckets...)
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].upperBound < buckets[j].upperBound })
+
+	if len(buckets) < 2 || !math.IsInf(buckets[len(buckets)-1].upperBound, +1) {
+		return math.NaN()
+	}
+
+	buckets = coalesceBuckets(buckets)
+	ensureMonotonic(buckets)
+
+	if len(buckets) < 2 {
+		return math.NaN()
+	}
+
+	observations := buckets[len(buckets)-1].count
+	if observations == 0 {
+		return math.NaN()
+	}
+
+	rank := q * observations
+	b := sort.Search(len(buckets)-1, func(i int) bool { return buckets[i].count >= rank })
+
+	if b == len(buckets)-1 {
+		return buckets[len(buckets)-2].upperBound
+	}
+	if b == 0 && buckets[0].upperBound <= 0 {
+		return buckets[0].upperBound
+	}
+
+	var (
+		bucketStart float64
+		bucketEnd   = buckets[b].upperBound
+		count       = buckets[b].count
+	)
+	if b > 0 {
+		bucketStart = buckets[b-1].upperBound
+		count -= buckets[b-1].count
+		rank -= buckets[b-1].count
+	}
+
+	return bucketStart + (bucketEnd-bucketStart)*(rank/count)
+}
+
+// nativeQuantile calculates quantile q from a native histogram, as PromQL's
+// histogram_quantile does: it finds the bucket holding the rank and
+// interpolates within it, on a logarithmic scale for the buckets of a
+// standard exponential schema and linearly for the zero bucket and custom
+// buckets. The zero bucket is taken to start at zero when the histogram has
+// no negative observations. It returns NaN for an empty histogram.
+func nativeQuantile(q float64, h *model.SampleHistogram) float64 {
+	if math.IsNaN(q) {
+		return math.NaN()
+	}
+	if q < 0 {
+		return math.Inf(-1)
+	}
+	if q > 1 {
+		return math.Inf(+1)
+	}
+
+	observations := float64(h.Count)
+	if observations == 0 || len(h.Buckets) == 0 {
+		return math.NaN()
+	}
+
+	buckets := append(model.HistogramBuckets(nil), h.Buckets...)
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Lower < buckets[j].Lower })
+
+	rank := q * observations
+	var (
+		b     *model.HistogramBucket
+		count float64
+	)
+	for _, bucket := range buckets {
+		if bucket.Count <= 0 {
+			continue
+		}
+		b = bucket
+		count += float64(b.Count)
+		if count >= rank {
+			break
+		}
+	}
+	if b == nil {
+		return math.NaN()
+	}
+	lower, upper := float64(b.Lower), float64(b.Upper)
+
+	// The zero bucket straddles zero; narrow it to the side holding observations
+	if lower < 0 && upper > 0 {
+		negative, positive := false, false
+		for _, other := range buckets {
+			negative = negative || (other.Upper <= 0 && other.Count > 0)
+			positive = positive || (other.Lower >= 0 && other.Count > 0)
+		}
+		switch {
+		case positive && !negative:
+			lower = 0
+		case negative && !positive:
+			upper = 0
+		}
+	}
+
+	// Rounding can leave the running count above the total
+	count = min(count, observations)
+	fraction := 1 - (count-rank)/float64(b.Count)
+	if (lower <= 0 && upper >= 0) || !exponentialBuckets(buckets) {
+		return lower + (upper-lower)*fraction
+	}
+
+	logLower, logUpper := math.Log2(math.Abs(lower)), math.Log2(math.Abs(upper))
+	if lower > 0 {
+		return math.Exp2(logLower + (logUpper-logLower)*fraction)
+	}
+	// Negative buckets grow towards their lower bound
+	return -math.Exp2(logUpper + (logLower-logUpper)*(1-fraction))
+}
+
+// exponentialBuckets reports whether the buckets outside the zero bucket
+// follow one standard exponential schema, i.e. whether their bounds are
+// consecutive powers of 2^(2^-schema) for a schema in [-4, 8]. The API does
+// not return the schema, so custom buckets are told apart by their bounds.
+func exponentialBuckets(buckets model.HistogramBuckets) bool {
+	const tolerance = 1e-9
+	var schema float64
+	found := false
+	for _, b := range buckets {
+		if b.Lower <= 0 && b.Upper >= 0 {
+			continue
+		}
+		lower, upper := math.Abs(float64(b.Lower)), math.Abs(float64(b.Upper))
+		if lower > upper {
+			lower, upper = upper, lower
+		}
+
+		s := math.Round(-math.Log2(math.Log2(upper / lower)))
+		if s < -4 || s > 8 || math.Abs(math.Log2(upper/lower)-math.Exp2(-s)) > tolerance {
+			return false
+		}
+		if found && s != schema {
+			return false
+		}
+		schema, found = s, true
+
+		index := math.Log2(upper) * math.Exp2(schema)
+		if math.Abs(index-math.Round(index)) > tolerance {
+			return false
+		}
+	}
+	return found
+}
+
+// coalesceBuckets merges buckets with the same upper bound, which can
+// happen when the same histogram is exposed by several series
+func coalesceBuckets(buckets []bucket) []bucket {
+	last := buckets[0]
+	i := 0
+	for _, b := range buckets[1:] {
+		if b.upperBound == last.upperBound {
+			last.count += b.count
+		} else {
+			buckets[i] = last
+			last = b
+			i++
+		}
+	}
+	buckets[i] = last
+	return buckets[:i+1]
+}
+
+// ensureMonotonic raises bucket counts that are lower than a preceding bucket.
+// Non-monotonic buckets come from scrape races and would otherwise yield
+// nonsensical quantiles.
+func ensureMonotonic(buckets []bucket) {
+	highest := math.Inf(-1)
+	for i := range buckets {
+		if buckets[i].count > highest {
+			highest = buckets[i].count
+		} else {
+			buckets[i].count = highest
+		}
+	}
+}
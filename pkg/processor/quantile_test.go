@@ -0,0 +1,180 @@
+package processor
+
+import (
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"github.com/prometheus/common/model"
+)
+
+// uniformBuckets are the cumulative buckets of 100 observations spread
+// evenly over [0, 1], whose quantile q is q itself
+func uniformBuckets() []bucket {
+	var buckets []bucket
+	for i := 1; i <= 10; i++ {
+		buckets = append(buckets, bucket{upperBound: float64(i) / 10, count: float64(i * 10)})
+	}
+	return append(buckets, bucket{upperBound: math.Inf(1), count: 100})
+}
+
+// uniformNative is the native histogram of 100 observations spread evenly
+// over [0, 1]
+func uniformNative() *model.SampleHistogram {
+	h := &model.SampleHistogram{Count: 100, Sum: 50}
+	for i := 0; i < 4; i++ {
+		h.Buckets = append(h.Buckets, &model.HistogramBucket{
+			Lower: model.FloatString(float64(i) / 4),
+			Upper: model.FloatString(float64(i+1) / 4),
+			Count: 25,
+		})
+	}
+	return h
+}
+
+func TestBucketQuantile(t *testing.T) {
+	for _, q := range []float64{0.25, 0.5, 0.95, 0.99} {
+		if got := bucketQuantile(q, uniformBuckets()); math.Abs(got-q) > 1e-9 {
+			t.Errorf("bucketQuantile(%v) = %v, want %v", q, got, q)
+		}
+	}
+
+	// Beyond the last finite bucket, the quantile is its upper bound
+	skewed := []bucket{{0.1, 10}, {0.5, 50}, {1, 90}, {math.Inf(1), 100}}
+	if got := bucketQuantile(0.95, skewed); got != 1 {
+		t.Errorf("bucketQuantile(0.95) in the +Inf bucket = %v, want 1", got)
+	}
+	if got := bucketQuantile(-1, skewed); !math.IsInf(got, -1) {
+		t.Errorf("bucketQuantile(-1) = %v, want -Inf", got)
+	}
+	if got := bucketQuantile(2, skewed); !math.IsInf(got, 1) {
+		t.Errorf("bucketQuantile(2) = %v, want +Inf", got)
+	}
+}
+
+func TestBucketQuantileUnusable(t *testing.T) {
+	tests := []struct {
+		name    string
+		buckets []bucket
+	}{
+		{"no +Inf bucket", []bucket{{0.1, 10}, {1, 100}}},
+		{"single bucket", []bucket{{math.Inf(1), 100}}},
+		{"no observations", []bucket{{0.1, 0}, {math.Inf(1), 0}}},
+	}
+	for _, tc := range tests {
+		if got := bucketQuantile(0.5, tc.buckets); !math.IsNaN(got) {
+			t.Errorf("%s: bucketQuantile() = %v, want NaN", tc.name, got)
+		}
+	}
+}
+
+func TestBucketQuantileNonMonotonic(t *testing.T) {
+	// The 0.5 bucket was scraped before an observation the 0.2 bucket saw
+	buckets := []bucket{{0.2, 60}, {0.5, 50}, {1, 100}, {math.Inf(1), 100}}
+	got := bucketQuantile(0.5, buckets)
+	if math.IsNaN(got) || got < 0 || got > 0.2 {
+		t.Errorf("bucketQuantile(0.5) = %v, want a value within the first bucket", got)
+	}
+}
+
+func TestNativeQuantile(t *testing.T) {
+	for _, q := range []float64{0.1, 0.5, 0.95, 0.99} {
+		if got := nativeQuantile(q, uniformNative()); math.Abs(got-q) > 1e-9 {
+			t.Errorf("nativeQuantile(%v) = %v, want %v", q, got, q)
+		}
+	}
+	if got := nativeQuantile(0.5, &model.SampleHistogram{}); !math.IsNaN(got) {
+		t.Errorf("nativeQuantile() of an empty histogram = %v, want NaN", got)
+	}
+}
+
+func TestNativeQuantileZeroBucket(t *testing.T) {
+	// 10 observations in the zero bucket [-0.001, 0.001], 10 in (1, 2]
+	h := &model.SampleHistogram{Count: 20, Buckets: model.HistogramBuckets{
+		{Boundaries: 3, Lower: -0.001, Upper: 0.001, Count: 10},
+		{Boundaries: 0, Lower: 1, Upper: 2, Count: 10},
+	}}
+	// Without negative observations the zero bucket starts at zero
+	if got := nativeQuantile(0.25, h); math.Abs(got-0.0005) > 1e-12 {
+		t.Errorf("nativeQuantile(0.25) = %v, want 0.0005", got)
+	}
+	if got := nativeQuantile(0.75, h); math.Abs(got-math.Sqrt2) > 1e-12 {
+		t.Errorf("nativeQuantile(0.75) = %v, want %v", got, math.Sqrt2)
+	}
+}
+
+func TestNativeQuantileExponential(t *testing.T) {
+	// A schema 0 histogram, whose buckets double: 10 observations in
+	// [-4, -2), 10 in (1, 2] and 20 in (2, 4]
+	h := &model.SampleHistogram{Count: 40, Buckets: model.HistogramBuckets{
+		{Boundaries: 1, Lower: -4, Upper: -2, Count: 10},
+		{Boundaries: 0, Lower: 1, Upper: 2, Count: 10},
+		{Boundaries: 0, Lower: 2, Upper: 4, Count: 20},
+	}}
+	tests := []struct {
+		q    float64
+		want float64
+	}{
+		{0.125, -math.Exp2(1.5)},
+		{0.25, -2},
+		{0.375, math.Sqrt2},
+		{0.5, 2},
+		{0.75, math.Exp2(1.5)},
+		{1, 4},
+	}
+	for _, tc := range tests {
+		if got := nativeQuantile(tc.q, h); math.Abs(got-tc.want) > 1e-12 {
+			t.Errorf("nativeQuantile(%v) = %v, want %v", tc.q, got, tc.want)
+		}
+	}
+
+	// Schema 2 splits each power of two into 4 buckets
+	h = &model.SampleHistogram{Count: 10, Buckets: model.HistogramBuckets{
+		{Boundaries: 0, Lower: 1, Upper: model.FloatString(math.Pow(2, 0.25)), Count: 10},
+	}}
+	if got, want := nativeQuantile(0.5, h), math.Pow(2, 0.125); math.Abs(got-want) > 1e-12 {
+		t.Errorf("nativeQuantile(0.5) with schema 2 = %v, want %v", got, want)
+	}
+}
+
+func TestProcessQuantiles(t *testing.T) {
+	ts := model.TimeFromUnix(testTime("2024-01-01T00:00:00Z").Unix())
+
+	// A classic histogram of type=get and a native one of type=put, both uniform
+	var matrix model.Matrix
+	for _, b := range uniformBuckets() {
+		matrix = append(matrix, &model.SampleStream{
+			Metric: model.Metric{"type": "get", "le": model.LabelValue(strconv.FormatFloat(b.upperBound, 'g', -1, 64))},
+			Values: []model.SamplePair{{Timestamp: ts, Value: model.SampleValue(b.count)}},
+		})
+	}
+	matrix = append(matrix, &model.SampleStream{
+		Metric:     model.Metric{"type": "put"},
+		Histograms: []model.SampleHistogramPair{{Timestamp: ts, Histogram: uniformNative()}},
+	})
+
+	p := newTestProcessor(newMemorySink(), config.ProcessorConfig{})
+	metric := config.MetricConfig{Name: "latency", LabelKeys: []string{"*"}, Quantiles: []float64{0.5, 0.99}}
+	rows, err := p.processQuantiles("prom", metric, matrix)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]float64)
+	for _, row := range rows {
+		got[row.Labels["type"]+"/"+row.Labels[quantileLabel]] = row.Value
+		if _, ok := row.Labels["le"]; ok {
+			t.Errorf("row kept the le label: %v", row.Labels)
+		}
+	}
+	want := map[string]float64{"get/0.5": 0.5, "get/0.99": 0.99, "put/0.5": 0.5, "put/0.99": 0.99}
+	if len(got) != len(want) {
+		t.Fatalf("rows = %v, want %v", got, want)
+	}
+	for key, v := range want {
+		if math.Abs(got[key]-v) > 1e-9 {
+			t.Errorf("%s = %v, want %v", key, got[key], v)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package processor
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+// Relabel actions, named as in Prometheus relabel_configs
+const (
+	relabelReplace   = "replace"   // Set target_label to replacement when regex matches the source value
+	relabelKeep      = "keep"      // Drop rows whose source value does not match regex
+	relabelDrop      = "drop"      // Drop rows whose source value matches regex
+	relabelLabelMap  = "labelmap"  // Copy labels whose name matches regex to the name replacement makes of it
+	relabelLabelDrop = "labeldrop" // Remove labels whose name matches regex
+	relabelLabelKeep = "labelkeep" // Remove labels whose name does not match regex
+	relabelLowercase = "lowercase" // Set target_label to the source value in lower case
+	relabelUppercase = "uppercase" // Set target_label to the source value in upper case
+)
+
+// Relabel defaults, as in Prometheus
+const (
+	defaultRelabelRegex       = "(.*)"
+	defaultRelabelSeparator   = ";"
+	defaultRelabelReplacement = "$1"
+)
+
+// relabelRule is a relabel config with its regex compiled and defaults applied
+type relabelRule struct {
+	action       string
+	sourceLabels []string
+	separator    string
+	regex        *regexp.Regexp // Anchored at both ends
+	targetLabel  string
+	replacement  string
+}
+
+// relabeler applies a metric's relabel rules in order
+type relabeler []relabelRule
+
+// newRelabeler compiles relabel configs, returning nil for none
+func newRelabeler(cfgs []config.RelabelConfig) (relabeler, error) {
+	if len(cfgs) == 0 {
+		return nil, nil
+	}
+
+	rules := make(relabeler, 0, len(cfgs))
+	for i, cfg := range cfgs {
+		rule := relabelRule{
+			action:       cfg.Action,
+			sourceLabels: cfg.SourceLabels,
+			separator:    cfg.Separator,
+			targetLabel:  cfg.TargetLabel,
+			replacement:  defaultRelabelReplacement,
+		}
+		if rule.action == "" {
+			rule.action = relabelReplace
+		}
+		if rule.separator == "" {
+			rule.separator = defaultRelabelSeparator
+		}
+		if cfg.Replacement != nil {
+			rule.replacement = *cfg.Replacement
+		}
+		expr := cfg.Regex
+		if expr == "" {
+			expr = defaultRelabelRegex
+		}
+		var err error
+		if rule.regex, err = regexp.Compile("^(?:" + expr + ")$"); err != nil {
+			return nil, fmt.Errorf("relabel rule %d: invalid regex: %v", i+1, err)
+		}
+
+		switch rule.action {
+		case relabelReplace, relabelLowercase, relabelUppercase:
+			if rule.targetLabel == "" {
+				return nil, fmt.Errorf("relabel rule %d: action %s requires target_label", i+1, rule.action)
+			}
+		case relabelKeep, relabelDrop:
+			if len(rule.sourceLabels) == 0 {
+				return nil, fmt.Errorf("relabel rule %d: action %s requires source_labels", i+1, rule.action)
+			}
+		case relabelLabelMap, relabelLabelDrop, relabelLabelKeep:
+		default:
+			return nil, fmt.Errorf("relabel rule %d: unsupported action: %s", i+1, rule.action)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// apply rewrites labels in place and reports whether the row is kept
+func (r relabeler) apply(labels map[string]string) bool {
+	for _, rule := range r {
+		if !rule.apply(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// apply runs one rule on labels and reports whether the row is kept
+func (rule relabelRule) apply(labels map[string]string) bool {
+	values := make([]string, len(rule.sourceLabels))
+	for i, name := range rule.sourceLabels {
+		values[i] = labels[name] // Missing labels count as empty, as in Prometheus
+	}
+	value := strings.Join(values, rule.separator)
+
+	switch rule.action {
+	case relabelKeep:
+		return rule.regex.MatchString(value)
+	case relabelDrop:
+		return !rule.regex.MatchString(value)
+	case relabelReplace:
+		match := rule.regex.FindStringSubmatchIndex(value)
+		if match == nil {
+			break
+		}
+		target := string(rule.regex.ExpandString(nil, rule.targetLabel, value, match))
+		if target == "" {
+			break
+		}
+		if result := rule.regex.ExpandString(nil, rule.replacement, value, match); len(result) > 0 {
+			labels[target] = string(result)
+		} else {
+			delete(labels, target)
+		}
+	case relabelLowercase:
+		labels[rule.targetLabel] = strings.ToLower(value)
+	case relabelUppercase:
+		labels[rule.targetLabel] = strings.ToUpper(value)
+	case relabelLabelMap:
+		// Sorted, so clashing names resolve the same way every time
+		for _, name := range common.SortedLabelKeys(labels) {
+			if rule.regex.MatchString(name) {
+				labels[rule.regex.ReplaceAllString(name, rule.replacement)] = labels[name]
+			}
+		}
+	case relabelLabelDrop, relabelLabelKeep:
+		for name := range labels {
+			if rule.regex.MatchString(name) == (rule.action == relabelLabelDrop) {
+				delete(labels, name)
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,176 @@
+package processor
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"github.com/prometheus/common/model"
+)
+
+// strPtr returns a pointer to s, for optional settings
+func strPtr(s string) *string {
+	return &s
+}
+
+func TestRelabelRules(t *testing.T) {
+	sample := func() map[string]string {
+		return map[string]string{"instance": "tidb-0.tidb-peer:10080", "job": "tidb", "type": "Select", "__meta_zone": "us-east-1a"}
+	}
+
+	tests := []struct {
+		name  string
+		rules []config.RelabelConfig
+		want  map[string]string // Nil when the row is dropped
+	}{
+		{
+			"replace with capture",
+			[]config.RelabelConfig{{SourceLabels: []string{"instance"}, Regex: `([^.]+)\..*:(\d+)`, TargetLabel: "pod", Replacement: strPtr("$1/$2")}},
+			map[string]string{"instance": "tidb-0.tidb-peer:10080", "job": "tidb", "type": "Select", "__meta_zone": "us-east-1a", "pod": "tidb-0/10080"},
+		},
+		{
+			"replace with default replacement",
+			[]config.RelabelConfig{{SourceLabels: []string{"instance"}, Regex: `([^.]+)\..*`, TargetLabel: "instance"}},
+			map[string]string{"instance": "tidb-0", "job": "tidb", "type": "Select", "__meta_zone": "us-east-1a"},
+		},
+		{
+			"replace joining sources",
+			[]config.RelabelConfig{{SourceLabels: []string{"job", "type"}, Separator: "/", Regex: `tidb/(.*)`, TargetLabel: "kind", Replacement: strPtr("sql_$1")}},
+			map[string]string{"instance": "tidb-0.tidb-peer:10080", "job": "tidb", "type": "Select", "__meta_zone": "us-east-1a", "kind": "sql_Select"},
+		},
+		{
+			"replace without a match",
+			[]config.RelabelConfig{{SourceLabels: []string{"job"}, Regex: "tikv", TargetLabel: "job", Replacement: strPtr("storage")}},
+			sample(),
+		},
+		{
+			"replace removing the target",
+			[]config.RelabelConfig{{SourceLabels: []string{"type"}, Regex: "Select", TargetLabel: "type", Replacement: strPtr("")}},
+			map[string]string{"instance": "tidb-0.tidb-peer:10080", "job": "tidb", "__meta_zone": "us-east-1a"},
+		},
+		{
+			"keep matching",
+			[]config.RelabelConfig{{Action: "keep", SourceLabels: []string{"type"}, Regex: "Select|Insert"}},
+			sample(),
+		},
+		{
+			"keep not matching",
+			[]config.RelabelConfig{{Action: "keep", SourceLabels: []string{"type"}, Regex: "Insert"}},
+			nil,
+		},
+		{
+			"keep a missing label as empty",
+			[]config.RelabelConfig{{Action: "keep", SourceLabels: []string{"db"}, Regex: ""}},
+			sample(),
+		},
+		{
+			"drop matching",
+			[]config.RelabelConfig{{Action: "drop", SourceLabels: []string{"job", "type"}, Regex: "tidb;Sel.*"}},
+			nil,
+		},
+		{
+			"drop not matching",
+			[]config.RelabelConfig{{Action: "drop", SourceLabels: []string{"type"}, Regex: "Sel"}},
+			sample(),
+		},
+		{
+			"labelmap",
+			[]config.RelabelConfig{{Action: "labelmap", Regex: "__meta_(.+)"}},
+			map[string]string{"instance": "tidb-0.tidb-peer:10080", "job": "tidb", "type": "Select", "__meta_zone": "us-east-1a", "zone": "us-east-1a"},
+		},
+		{
+			"labeldrop",
+			[]config.RelabelConfig{{Action: "labeldrop", Regex: "__.*|type"}},
+			map[string]string{"instance": "tidb-0.tidb-peer:10080", "job": "tidb"},
+		},
+		{
+			"labelkeep",
+			[]config.RelabelConfig{{Action: "labelkeep", Regex: "instance|job"}},
+			map[string]string{"instance": "tidb-0.tidb-peer:10080", "job": "tidb"},
+		},
+		{
+			"lowercase and uppercase",
+			[]config.RelabelConfig{
+				{Action: "lowercase", SourceLabels: []string{"type"}, TargetLabel: "type"},
+				{Action: "uppercase", SourceLabels: []string{"job"}, TargetLabel: "component"},
+			},
+			map[string]string{"instance": "tidb-0.tidb-peer:10080", "job": "tidb", "type": "select", "__meta_zone": "us-east-1a", "component": "TIDB"},
+		},
+		{
+			"rules in order",
+			[]config.RelabelConfig{
+				{SourceLabels: []string{"type"}, Regex: "(.*)", TargetLabel: "statement"},
+				{Action: "labeldrop", Regex: "type|__meta_zone"},
+				{Action: "keep", SourceLabels: []string{"statement"}, Regex: "Select"},
+			},
+			map[string]string{"instance": "tidb-0.tidb-peer:10080", "job": "tidb", "statement": "Select"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := newRelabeler(tt.rules)
+			if err != nil {
+				t.Fatalf("newRelabeler() error = %v", err)
+			}
+			labels := sample()
+			kept := r.apply(labels)
+			if tt.want == nil {
+				if kept {
+					t.Errorf("apply() kept %v, want the row dropped", labels)
+				}
+				return
+			}
+			if !kept || !reflect.DeepEqual(labels, tt.want) {
+				t.Errorf("apply() = %v, %v, want %v kept", labels, kept, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewRelabelerInvalid(t *testing.T) {
+	tests := []config.RelabelConfig{
+		{Regex: "(", TargetLabel: "x"},
+		{SourceLabels: []string{"job"}},
+		{Action: "uppercase", SourceLabels: []string{"job"}},
+		{Action: "keep", Regex: "tidb"},
+		{Action: "drop"},
+		{Action: "hashmod", SourceLabels: []string{"job"}},
+	}
+	for _, cfg := range tests {
+		if _, err := newRelabeler([]config.RelabelConfig{cfg}); err == nil {
+			t.Errorf("newRelabeler(%+v) accepted an invalid rule", cfg)
+		}
+	}
+}
+
+func TestRelabelAppliedToRows(t *testing.T) {
+	client := &fakeClient{name: "prom"}
+	client.fetchRange = func(ctx context.Context, query string, start, end time.Time, step time.Duration) (model.Value, error) {
+		return model.Matrix{
+			rangeMatrix(model.Metric{"instance": "tidb-0:10080", "type": "Select"}, start, end, step)[0],
+			rangeMatrix(model.Metric{"instance": "tidb-1:10080", "type": "internal"}, start, end, step)[0],
+		}, nil
+	}
+	out := newMemorySink()
+	p := newTestProcessor(out, config.ProcessorConfig{}, client)
+	metrics := []config.MetricConfig{{Name: "qps", Query: "qps", LabelKeys: []string{"instance", "type"}, Relabel: []config.RelabelConfig{
+		{Action: "drop", SourceLabels: []string{"type"}, Regex: "internal"},
+		{SourceLabels: []string{"instance"}, Regex: `(.+):\d+`, TargetLabel: "instance"},
+	}}}
+	start := testTime("2024-01-01T00:00:00Z")
+	if err := p.ProcessMetrics(context.Background(), metrics, start, start.Add(time.Minute), "1m"); err != nil {
+		t.Fatalf("ProcessMetrics() error = %v", err)
+	}
+
+	rows := out.metricRows("qps")
+	if len(rows) != 2 {
+		t.Fatalf("got %d rows, want the 2 of the series not dropped", len(rows))
+	}
+	for _, row := range rows {
+		if want := map[string]string{"instance": "tidb-0", "type": "Select"}; !reflect.DeepEqual(row.Labels, want) {
+			t.Errorf("row labels = %v, want %v", row.Labels, want)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package processor
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"github.com/prometheus/common/model"
+)
+
+const stepsConfig = `
+prometheus_instances:
+  - name: prom
+    address: http://prom:9090
+metrics:
+  - name: qps
+    query: sum(rate(tidb_server_query_total[1m]))
+    steps: [15s, 5m]
+processor:
+  batch_window: 72h
+`
+
+func TestMetricStepsLabelledResultSets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(stepsConfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	var mu sync.Mutex
+	batches := make(map[time.Duration]int)
+	client := &fakeClient{name: "prom"}
+	client.fetchRange = func(ctx context.Context, query string, start, end time.Time, step time.Duration) (model.Value, error) {
+		mu.Lock()
+		batches[step]++
+		mu.Unlock()
+		return rangeMatrix(model.Metric{"job": "tidb"}, start, end, step), nil
+	}
+	out := newMemorySink()
+	p := newTestProcessor(out, cfg.Processor, client)
+	start, end := testTime("2024-01-01T00:00:00Z"), testTime("2024-01-04T00:00:00Z")
+	if err := p.ProcessMetrics(context.Background(), cfg.Metrics, start, end, "1m"); err != nil {
+		t.Fatalf("ProcessMetrics() error = %v", err)
+	}
+
+	tests := []struct {
+		metric  string
+		step    time.Duration
+		points  int
+		batches int // The 15s step holds 11000 points in 45h, so 72h splits in two
+	}{
+		{"qps_15s", 15 * time.Second, 3*24*240 + 1, 2},
+		{"qps_5m", 5 * time.Minute, 3*24*12 + 1, 1},
+	}
+	for _, tt := range tests {
+		resolution := tt.metric[len("qps_"):]
+		points := make(map[time.Time]bool)
+		for _, row := range out.metricRows(tt.metric) {
+			if row.Labels["resolution"] != resolution {
+				t.Fatalf("%s: row labels = %v, want resolution=%s", tt.metric, row.Labels, resolution)
+			}
+			if row.Timestamp.Before(start) || row.Timestamp.After(end) || row.Timestamp.Sub(start)%tt.step != 0 {
+				t.Errorf("%s: row at %v, want one every %v from %v to %v", tt.metric, row.Timestamp, tt.step, start, end)
+			}
+			points[row.Timestamp] = true
+		}
+		// The seam of two batches is returned by both
+		if len(points) != tt.points {
+			t.Errorf("%s: rows at %d timestamps, want %d", tt.metric, len(points), tt.points)
+		}
+		if batches[tt.step] != tt.batches {
+			t.Errorf("%s: queried in %d batches, want %d", tt.metric, batches[tt.step], tt.batches)
+		}
+	}
+	if rows := out.metricRows("qps"); len(rows) != 0 {
+		t.Errorf("wrote %d rows under the unexpanded name qps", len(rows))
+	}
+}
@@ -0,0 +1,153 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"github.com/meiking/tidb-metrics-crawler/pkg/prometheus"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+// Metric types: a PromQL query, the series matching selectors, or a
+// snapshot of rule or alert state
+const (
+	metricTypeQuery    = "query"
+	metricTypeFederate = "federate"
+	metricTypeRules    = "rules"
+	metricTypeAlerts   = "alerts"
+)
+
+// isSnapshot reports whether the metric snapshots rules or alerts rather
+// than running a query
+func isSnapshot(metric config.MetricConfig) bool {
+	return metric.Type == metricTypeRules || metric.Type == metricTypeAlerts
+}
+
+// stateSample is one row of a rules or alerts snapshot before labels are
+// filtered and injected
+type stateSample struct {
+	labels    model.Metric
+	timestamp time.Time
+	value     float64
+}
+
+// ruleSamples maps a rules response to one sample per rule. The value is the
+// rule's last evaluation time in seconds, stamped at its last evaluation; the
+// rule's identity, health and state are labels alongside the rule's own labels.
+func ruleSamples(result v1.RulesResult) []stateSample {
+	var samples []stateSample
+	for _, group := range result.Groups {
+		for _, rule := range group.Rules {
+			var s stateSample
+			switch r := rule.(type) {
+			case v1.AlertingRule:
+				s = stateSample{labels: ruleLabels(r.Labels), timestamp: r.LastEvaluation, value: r.EvaluationTime}
+				s.labels["rule"] = model.LabelValue(r.Name)
+				s.labels["rule_type"] = "alerting"
+				s.labels["health"] = model.LabelValue(r.Health)
+				s.labels["state"] = model.LabelValue(r.State)
+				s.labels["active_alerts"] = model.LabelValue(strconv.Itoa(len(r.Alerts)))
+			case v1.RecordingRule:
+				s = stateSample{labels: ruleLabels(r.Labels), timestamp: r.LastEvaluation, value: r.EvaluationTime}
+				s.labels["rule"] = model.LabelValue(r.Name)
+				s.labels["rule_type"] = "recording"
+				s.labels["health"] = model.LabelValue(r.Health)
+			default:
+				continue
+			}
+			s.labels["rule_group"] = model.LabelValue(group.Name)
+			s.labels["rule_file"] = model.LabelValue(group.File)
+			samples = append(samples, s)
+		}
+	}
+	return samples
+}
+
+// alertSamples maps an alerts response to one sample per active alert, like
+// the ALERTS series: the alert's labels plus alertstate, stamped when the
+// alert became active, with the value of its expression at the last evaluation
+func alertSamples(result v1.AlertsResult) []stateSample {
+	samples := make([]stateSample, 0, len(result.Alerts))
+	for _, alert := range result.Alerts {
+		value, err := strconv.ParseFloat(alert.Value, 64)
+		if err != nil {
+			log.Printf("Alert %s has non-numeric value %q, recording NaN", alert.Labels[model.AlertNameLabel], alert.Value)
+			value = math.NaN()
+		}
+
+		labels := ruleLabels(alert.Labels)
+		labels["alertstate"] = model.LabelValue(alert.State)
+		samples = append(samples, stateSample{labels: labels, timestamp: alert.ActiveAt, value: value})
+	}
+	return samples
+}
+
+// ruleLabels copies a label set so identity labels can be added to it
+func ruleLabels(set model.LabelSet) model.Metric {
+	labels := make(model.Metric, len(set)+6)
+	for k, v := range set {
+		labels[k] = v
+	}
+	return labels
+}
+
+// processState fetches the current rules or alerts of the instance and writes
+// them as rows of the metric. Snapshots reflect the moment of the request, so
+// the time range does not apply.
+func (p *Processor) processState(ctx context.Context, client prometheus.Client, metric config.MetricConfig) error {
+	breaker := p.breakers[client.Name()]
+
+	var samples []stateSample
+	if metric.Type == metricTypeRules {
+		result, err := client.Rules(ctx)
+		if err != nil {
+			breaker.recordFetchError(err)
+			return fmt.Errorf("failed to fetch rules: %v", err)
+		}
+		samples = ruleSamples(result)
+	} else {
+		result, err := client.Alerts(ctx)
+		if err != nil {
+			breaker.recordFetchError(err)
+			return fmt.Errorf("failed to fetch alerts: %v", err)
+		}
+		samples = alertSamples(result)
+	}
+	breaker.recordSuccess()
+
+	out := newChunkWriter(p.sink, metric.Name, p.cfg.Job, p.runID, p.cfg.RowChecksum, p.cfg.WriteChunkSize)
+	for _, s := range samples {
+		labels, err := p.rowLabels(client.Name(), metric, s.labels)
+		if err != nil {
+			return err
+		}
+		if labels == nil {
+			continue
+		}
+		p.series.observe(metric.Name, client.Name(), labels)
+		if err := out.add(common.ProcessedData{
+			PrometheusInstance: client.Name(),
+			MetricName:         metric.Name,
+			Timestamp:          s.timestamp.In(p.loc),
+			Value:              s.value,
+			Labels:             labels,
+		}); err != nil {
+			return fmt.Errorf("failed to write %s: %v", metric.Type, err)
+		}
+	}
+	flushErr := out.flush()
+	p.tally.addRows(metric.Name, out.written)
+	if flushErr != nil {
+		return fmt.Errorf("failed to write %s to sink: %v", metric.Type, flushErr)
+	}
+
+	log.Printf("Wrote %d %s records to sink", out.written, metric.Type)
+	return nil
+}
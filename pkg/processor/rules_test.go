@@ -0,0 +1,119 @@
+package processor
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+// rowsByLabel indexes rows by the value of one label
+func rowsByLabel(rows []common.ProcessedData, label string) map[string]common.ProcessedData {
+	byLabel := make(map[string]common.ProcessedData, len(rows))
+	for _, row := range rows {
+		byLabel[row.Labels[label]] = row
+	}
+	return byLabel
+}
+
+func TestRulesMappedToRows(t *testing.T) {
+	evaluated := testTime("2024-01-01T00:00:30Z")
+	client := &fakeClient{name: "prom", rules: v1.RulesResult{Groups: []v1.RuleGroup{{
+		Name: "tidb",
+		File: "/etc/prometheus/tidb.rules.yml",
+		Rules: v1.Rules{
+			v1.AlertingRule{
+				Name:           "TiDBDown",
+				Labels:         model.LabelSet{"severity": "critical"},
+				Alerts:         []*v1.Alert{{}, {}},
+				Health:         v1.RuleHealthGood,
+				State:          "firing",
+				LastEvaluation: evaluated,
+				EvaluationTime: 0.002,
+			},
+			v1.RecordingRule{
+				Name:           "tidb:qps:rate1m",
+				Health:         v1.RuleHealthBad,
+				LastEvaluation: evaluated.Add(time.Second),
+				EvaluationTime: 0.5,
+			},
+		},
+	}}}}
+
+	out := newMemorySink()
+	p := newTestProcessor(out, config.ProcessorConfig{}, client)
+	metrics := []config.MetricConfig{{Name: "rules", Type: metricTypeRules}}
+	if err := p.ProcessMetrics(context.Background(), metrics, testTime("2024-01-01T00:00:00Z"), testTime("2024-01-01T01:00:00Z"), "1m"); err != nil {
+		t.Fatalf("ProcessMetrics() error = %v", err)
+	}
+
+	rows := rowsByLabel(out.metricRows("rules"), "rule")
+	if len(rows) != 2 {
+		t.Fatalf("wrote rows for rules %v, want one per rule", rows)
+	}
+
+	tests := []struct {
+		rule      string
+		timestamp time.Time
+		value     float64
+		labels    map[string]string
+	}{
+		{"TiDBDown", evaluated, 0.002, map[string]string{
+			"rule_type": "alerting", "health": "ok", "state": "firing", "active_alerts": "2", "severity": "critical",
+			"rule_group": "tidb", "rule_file": "/etc/prometheus/tidb.rules.yml",
+		}},
+		{"tidb:qps:rate1m", evaluated.Add(time.Second), 0.5, map[string]string{
+			"rule_type": "recording", "health": "err", "rule_group": "tidb", "rule_file": "/etc/prometheus/tidb.rules.yml",
+		}},
+	}
+	for _, tt := range tests {
+		row, ok := rows[tt.rule]
+		if !ok {
+			t.Errorf("no row for rule %s", tt.rule)
+			continue
+		}
+		if !row.Timestamp.Equal(tt.timestamp) || row.Value != tt.value || row.PrometheusInstance != "prom" {
+			t.Errorf("rule %s: row at %v valued %v from %s, want %v, %v from prom", tt.rule, row.Timestamp, row.Value, row.PrometheusInstance, tt.timestamp, tt.value)
+		}
+		for k, v := range tt.labels {
+			if row.Labels[k] != v {
+				t.Errorf("rule %s: label %s = %q, want %q", tt.rule, k, row.Labels[k], v)
+			}
+		}
+	}
+	if _, ok := rows["tidb:qps:rate1m"].Labels["state"]; ok {
+		t.Error("recording rule has a state label")
+	}
+	if got := len(client.fetched()); got != 0 {
+		t.Errorf("ran %d range queries for a rules snapshot", got)
+	}
+}
+
+func TestAlertsMappedToRows(t *testing.T) {
+	activeAt := testTime("2024-01-01T00:10:00Z")
+	client := &fakeClient{name: "prom", alerts: v1.AlertsResult{Alerts: []v1.Alert{
+		{Labels: model.LabelSet{"alertname": "TiDBDown", "instance": "tidb-0"}, State: v1.AlertStateFiring, ActiveAt: activeAt, Value: "1e+00"},
+		{Labels: model.LabelSet{"alertname": "TiKVSlow", "instance": "tikv-0"}, State: v1.AlertStatePending, ActiveAt: activeAt.Add(time.Minute), Value: "not a number"},
+	}}}
+
+	out := newMemorySink()
+	p := newTestProcessor(out, config.ProcessorConfig{}, client)
+	metrics := []config.MetricConfig{{Name: "alerts", Type: metricTypeAlerts}}
+	if err := p.ProcessMetrics(context.Background(), metrics, testTime("2024-01-01T00:00:00Z"), testTime("2024-01-01T01:00:00Z"), "1m"); err != nil {
+		t.Fatalf("ProcessMetrics() error = %v", err)
+	}
+
+	rows := rowsByLabel(out.metricRows("alerts"), "alertname")
+	down, slow := rows["TiDBDown"], rows["TiKVSlow"]
+	if down.Value != 1 || !down.Timestamp.Equal(activeAt) || down.Labels["alertstate"] != "firing" || down.Labels["instance"] != "tidb-0" {
+		t.Errorf("TiDBDown row = %+v, want 1 at %v, firing on tidb-0", down, activeAt)
+	}
+	if !math.IsNaN(slow.Value) || slow.Labels["alertstate"] != "pending" {
+		t.Errorf("TiKVSlow row = %+v, want NaN for the non-numeric value, pending", slow)
+	}
+}
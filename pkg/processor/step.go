@@ -0,0 +1,56 @@
+package processor
+
+import (
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+// defaultMinStep is the smallest step chosen by target_points, about one
+// scrape interval
+const defaultMinStep = 15 * time.Second
+
+// targetPoints returns the metric's target_points, falling back to the
+// processor-wide setting; zero disables automatic steps
+func targetPoints(metric config.MetricConfig, cfg config.ProcessorConfig) int {
+	if metric.TargetPoints > 0 {
+		return metric.TargetPoints
+	}
+	return cfg.TargetPoints
+}
+
+// autoStep returns the step that yields about target points over span,
+// rounded to whole seconds and never below minStep
+func autoStep(span time.Duration, target int, minStep time.Duration) time.Duration {
+	if target <= 0 {
+		return minStep
+	}
+	step := (span / time.Duration(target)).Round(time.Second)
+	if step < minStep {
+		step = minStep
+	}
+	return step
+}
+
+// metricWindow returns the batch window of metric at step. A window that
+// would return more than MaxPointsPerSeries points per series is shortened,
+// to whole hours or minutes so aligned batches stay on clock boundaries, and
+// fine steps are fetched in more, shorter batches. Increase keeps the
+// window, which is its reporting period.
+func metricWindow(metric config.MetricConfig, step, window time.Duration) time.Duration {
+	if step <= 0 || metric.Transform == transformIncrease {
+		return window
+	}
+	limit := step * (MaxPointsPerSeries - 1)
+	if window <= limit {
+		return window
+	}
+	switch {
+	case limit >= time.Hour:
+		return limit.Truncate(time.Hour)
+	case limit >= time.Minute:
+		return limit.Truncate(time.Minute)
+	default:
+		return limit
+	}
+}
@@ -0,0 +1,108 @@
+package processor
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"github.com/prometheus/common/model"
+)
+
+func TestAutoStep(t *testing.T) {
+	tests := []struct {
+		span    time.Duration
+		target  int
+		minStep time.Duration
+		want    time.Duration
+	}{
+		{time.Hour, 240, defaultMinStep, 15 * time.Second},
+		{time.Hour, 60, defaultMinStep, time.Minute},
+		{24 * time.Hour, 1000, defaultMinStep, 86 * time.Second},      // 86.4s rounded to whole seconds
+		{7 * 24 * time.Hour, 500, defaultMinStep, 1210 * time.Second}, // 1209.6s
+		{time.Hour, 1000, defaultMinStep, defaultMinStep},             // 3.6s clamped
+		{time.Hour, 1000, time.Minute, time.Minute},                   // Clamped to min_step
+		{time.Hour, 1000, time.Second, 4 * time.Second},               // 3.6s rounded, above min_step
+		{time.Hour, 0, time.Minute, time.Minute},
+	}
+	for _, tt := range tests {
+		if got := autoStep(tt.span, tt.target, tt.minStep); got != tt.want {
+			t.Errorf("autoStep(%v, %d, %v) = %v, want %v", tt.span, tt.target, tt.minStep, got, tt.want)
+		}
+	}
+}
+
+func TestMetricWindow(t *testing.T) {
+	tests := []struct {
+		name   string
+		metric config.MetricConfig
+		step   time.Duration
+		window time.Duration
+		want   time.Duration
+	}{
+		{"fits", config.MetricConfig{}, time.Minute, 24 * time.Hour, 24 * time.Hour},
+		{"hours", config.MetricConfig{}, 15 * time.Second, 7 * 24 * time.Hour, 45 * time.Hour},  // 45h49m45s
+		{"minutes", config.MetricConfig{}, 100 * time.Millisecond, time.Hour, 18 * time.Minute}, // 18m19.9s
+		{"seconds", config.MetricConfig{}, time.Millisecond, time.Hour, 10999 * time.Millisecond},
+		{"increase", config.MetricConfig{Transform: transformIncrease}, time.Second, 7 * 24 * time.Hour, 7 * 24 * time.Hour},
+	}
+	for _, tt := range tests {
+		if got := metricWindow(tt.metric, tt.step, tt.window); got != tt.want {
+			t.Errorf("%s: metricWindow(%v, %v) = %v, want %v", tt.name, tt.step, tt.window, got, tt.want)
+		}
+	}
+}
+
+func TestTargetPointsChoosesStep(t *testing.T) {
+	start := testTime("2024-01-01T00:00:00Z")
+	tests := []struct {
+		name   string
+		cfg    config.ProcessorConfig
+		metric config.MetricConfig
+		end    time.Time
+		want   time.Duration
+		chosen bool // Reported in Summary().Steps
+	}{
+		// The span is the batch window, or the whole range when shorter
+		{"batch window", config.ProcessorConfig{BatchWindow: "6h", TargetPoints: 360}, config.MetricConfig{}, start.Add(24 * time.Hour), time.Minute, true},
+		{"short range", config.ProcessorConfig{BatchWindow: "6h", TargetPoints: 120}, config.MetricConfig{}, start.Add(time.Hour), 30 * time.Second, true},
+		{"default min step", config.ProcessorConfig{BatchWindow: "6h", TargetPoints: 360}, config.MetricConfig{}, start.Add(time.Hour), defaultMinStep, true}, // 10s clamped
+		{"min step clamp", config.ProcessorConfig{BatchWindow: "6h", TargetPoints: 120, MinStep: "1m"}, config.MetricConfig{}, start.Add(time.Hour), time.Minute, true},
+		{"metric override", config.ProcessorConfig{BatchWindow: "6h", TargetPoints: 360}, config.MetricConfig{TargetPoints: 72}, start.Add(24 * time.Hour), 5 * time.Minute, true},
+		{"disabled", config.ProcessorConfig{BatchWindow: "6h"}, config.MetricConfig{Step: "30s"}, start.Add(time.Hour), 30 * time.Second, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var steps []time.Duration
+			client := &fakeClient{name: "prom"}
+			client.fetchRange = func(ctx context.Context, query string, start, end time.Time, step time.Duration) (model.Value, error) {
+				mu.Lock()
+				steps = append(steps, step)
+				mu.Unlock()
+				return rangeMatrix(model.Metric{"job": "tidb"}, start, end, step), nil
+			}
+			metric := tt.metric
+			metric.Name, metric.Query = "qps", "qps"
+
+			p := newTestProcessor(newMemorySink(), tt.cfg, client)
+			if err := p.ProcessMetrics(context.Background(), []config.MetricConfig{metric}, start, tt.end, "1m"); err != nil {
+				t.Fatalf("ProcessMetrics() error = %v", err)
+			}
+
+			if len(steps) == 0 {
+				t.Fatal("no range queries")
+			}
+			for _, step := range steps {
+				if step != tt.want {
+					t.Fatalf("queried at step %v, want %v", step, tt.want)
+				}
+			}
+			got, ok := p.Summary().Steps["qps"]
+			if ok != tt.chosen || ok && got != tt.want {
+				t.Errorf("Summary().Steps[qps] = %v, %v, want %v, %v", got, ok, tt.want, tt.chosen)
+			}
+		})
+	}
+}
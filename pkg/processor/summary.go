@@ -0,0 +1,235 @@
+package processor
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"github.com/meiking/tidb-metrics-crawler/pkg/prometheus"
+	"github.com/meiking/tidb-metrics-crawler/pkg/sink"
+)
+
+// Summary collects statistics about a processing run
+type Summary struct {
+	RunID        string                           // ID stamped on every row of the run
+	Duration     time.Duration                    // Wall time spent in ProcessMetrics
+	Instances    map[string]prometheus.QueryStats // Query stats keyed by Prometheus instance name
+	Skipped      map[string]int                   // Metrics skipped per unhealthy instance
+	Rows         map[string]int                   // Rows written per metric
+	EmptyMetrics []string                         // Metrics that produced no rows across all instances and batches
+	Failures     []Failure                        // Metric/instance pairs that failed, in order
+	Truncated    map[string]int                   // Samples dropped per metric by max_samples_per_batch
+	HighSeries   map[string]int                   // Distinct series of metrics above series_warning_threshold
+	Steps        map[string]time.Duration         // Steps chosen by target_points per metric
+	Gaps         map[string][]SeriesGaps          // Series with missing points per metric, with detect_gaps
+}
+
+// Failure records a metric that failed on an instance
+type Failure struct {
+	Metric   string
+	Instance string
+	Err      string
+}
+
+// runTally accumulates per-metric results during a run
+type runTally struct {
+	mu        sync.Mutex
+	metrics   []string // Metric names in config order
+	rows      map[string]int
+	failures  []Failure
+	truncated map[string]int
+	steps     map[string]time.Duration
+	gaps      map[string][]SeriesGaps
+}
+
+// newRunTally creates a tally for the given metrics
+func newRunTally(metrics []config.MetricConfig) *runTally {
+	t := &runTally{
+		rows:      make(map[string]int, len(metrics)),
+		truncated: make(map[string]int),
+		steps:     make(map[string]time.Duration),
+		gaps:      make(map[string][]SeriesGaps),
+	}
+	for _, metric := range metrics {
+		t.metrics = append(t.metrics, metric.Name)
+		t.rows[metric.Name] = 0
+	}
+	return t
+}
+
+// addRows records rows written for a metric
+func (t *runTally) addRows(metricName string, n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rows[metricName] += n
+}
+
+// addFailure records a metric that failed on an instance
+func (t *runTally) addFailure(metricName, instance string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.failures = append(t.failures, Failure{Metric: metricName, Instance: instance, Err: err.Error()})
+}
+
+// addTruncated records samples of a metric dropped by truncation
+func (t *runTally) addTruncated(metricName string, n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.truncated[metricName] += n
+}
+
+// setStep records the step chosen for a metric by target_points
+func (t *runTally) setStep(metricName string, step time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.steps[metricName] = step
+}
+
+// addGaps records the series of a metric with gaps on one instance
+func (t *runTally) addGaps(metricName string, gaps []SeriesGaps) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.gaps[metricName] = append(t.gaps[metricName], gaps...)
+}
+
+// Summary returns statistics about the most recent run
+func (p *Processor) Summary() Summary {
+	summary := Summary{
+		RunID:     p.runID,
+		Duration:  p.duration,
+		Instances: make(map[string]prometheus.QueryStats, len(p.clients)),
+		Skipped:   make(map[string]int),
+		Rows:      make(map[string]int),
+		Truncated: make(map[string]int),
+		Steps:     make(map[string]time.Duration),
+		Gaps:      make(map[string][]SeriesGaps),
+	}
+	if p.series != nil {
+		summary.HighSeries = p.series.highCardinality()
+	}
+
+	if p.tally != nil {
+		p.tally.mu.Lock()
+		for _, name := range p.tally.metrics {
+			summary.Rows[name] = p.tally.rows[name]
+			if p.tally.rows[name] == 0 {
+				summary.EmptyMetrics = append(summary.EmptyMetrics, name)
+			}
+		}
+		summary.Failures = append([]Failure(nil), p.tally.failures...)
+		for name, n := range p.tally.truncated {
+			summary.Truncated[name] = n
+		}
+		for name, step := range p.tally.steps {
+			summary.Steps[name] = step
+		}
+		for name, gaps := range p.tally.gaps {
+			summary.Gaps[name] = append([]SeriesGaps(nil), gaps...)
+		}
+		p.tally.mu.Unlock()
+	}
+
+	for _, client := range p.clients {
+		summary.Instances[client.Name()] = client.Stats()
+		if breaker, ok := p.breakers[client.Name()]; ok && breaker.skips() > 0 {
+			summary.Skipped[client.Name()] = breaker.skips()
+		}
+	}
+	return summary
+}
+
+// Report converts the summary into the run report recorded by sinks
+func (s Summary) Report() sink.RunReport {
+	report := sink.RunReport{
+		RunID:        s.RunID,
+		Duration:     s.Duration.Round(time.Millisecond).String(),
+		Rows:         s.Rows,
+		EmptyMetrics: s.EmptyMetrics,
+		Truncated:    s.Truncated,
+	}
+	for _, f := range s.Failures {
+		report.Failures = append(report.Failures, sink.RunFailure{Metric: f.Metric, Instance: f.Instance, Error: f.Err})
+	}
+	return report
+}
+
+// Log writes the summary to the standard logger
+func (s Summary) Log() {
+	log.Printf("Run summary: run %s completed in %v", s.RunID, s.Duration.Round(time.Millisecond))
+
+	names := make([]string, 0, len(s.Instances))
+	for name := range s.Instances {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		stats := s.Instances[name]
+		log.Printf("  instance %s: queries=%d retries=%d failures=%d avg_latency=%v max_latency=%v received=%dB decoded=%dB",
+			name,
+			stats.Queries,
+			stats.Retries,
+			stats.Failures,
+			stats.AvgLatency().Round(time.Millisecond),
+			stats.MaxLatency.Round(time.Millisecond),
+			stats.BytesWire,
+			stats.BytesDecoded)
+		if skipped := s.Skipped[name]; skipped > 0 {
+			log.Printf("  instance %s: unhealthy, skipped %d metric(s)", name, skipped)
+		}
+	}
+
+	stepped := make([]string, 0, len(s.Steps))
+	for name := range s.Steps {
+		stepped = append(stepped, name)
+	}
+	sort.Strings(stepped)
+	for _, name := range stepped {
+		log.Printf("  metric %s: step %v chosen by target_points", name, s.Steps[name])
+	}
+
+	truncated := make([]string, 0, len(s.Truncated))
+	for name := range s.Truncated {
+		truncated = append(truncated, name)
+	}
+	sort.Strings(truncated)
+	for _, name := range truncated {
+		log.Printf("  metric %s: %d samples dropped by max_samples_per_batch", name, s.Truncated[name])
+	}
+
+	highSeries := make([]string, 0, len(s.HighSeries))
+	for name := range s.HighSeries {
+		highSeries = append(highSeries, name)
+	}
+	sort.Strings(highSeries)
+	for _, name := range highSeries {
+		log.Printf("  metric %s: %d series, consider aggregating", name, s.HighSeries[name])
+	}
+
+	gapped := make([]string, 0, len(s.Gaps))
+	for name := range s.Gaps {
+		gapped = append(gapped, name)
+	}
+	sort.Strings(gapped)
+	for _, name := range gapped {
+		series := s.Gaps[name]
+		for i, g := range series {
+			if i == maxLoggedGapSeries {
+				log.Printf("  metric %s: ... and %d more series with gaps", name, len(series)-i)
+				break
+			}
+			log.Printf("  metric %s: %d gap(s) totalling %v in series %s on instance %s",
+				name, g.Count, g.Total, g.Series, g.Instance)
+		}
+	}
+
+	for _, f := range s.Failures {
+		log.Printf("  metric %s failed on instance %s: %s", f.Metric, f.Instance, f.Err)
+	}
+
+	if len(s.EmptyMetrics) > 0 {
+		log.Printf("  metrics with no data: %v", s.EmptyMetrics)
+	}
+}
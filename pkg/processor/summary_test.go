@@ -0,0 +1,47 @@
+package processor
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"github.com/prometheus/common/model"
+)
+
+func TestSummaryEmptyMetrics(t *testing.T) {
+	// "typo" matches nothing anywhere; "qps" has data on one instance only
+	fetchRange := func(ctx context.Context, query string, start, end time.Time, step time.Duration) (model.Value, error) {
+		return model.Matrix{}, nil
+	}
+	empty := &fakeClient{name: "empty", fetchRange: fetchRange}
+	partial := &fakeClient{name: "partial"}
+	partial.fetchRange = func(ctx context.Context, query string, start, end time.Time, step time.Duration) (model.Value, error) {
+		if query == "typo" {
+			return model.Matrix{}, nil
+		}
+		return rangeMatrix(model.Metric{"job": "tidb"}, start, end, step), nil
+	}
+	out := newMemorySink()
+	metrics := []config.MetricConfig{{Name: "qps", Query: "qps"}, {Name: "typo", Query: "typo"}}
+
+	p := newTestProcessor(out, config.ProcessorConfig{}, empty, partial)
+	if err := p.ProcessMetrics(context.Background(), metrics, testTime("2024-01-01T00:00:00Z"), testTime("2024-01-01T03:00:00Z"), "1h"); err != nil {
+		t.Fatalf("ProcessMetrics() error = %v", err)
+	}
+
+	summary := p.Summary()
+	if !slices.Equal(summary.EmptyMetrics, []string{"typo"}) {
+		t.Errorf("EmptyMetrics = %v, want [typo]", summary.EmptyMetrics)
+	}
+	if summary.Rows["qps"] == 0 || summary.Rows["typo"] != 0 {
+		t.Errorf("Rows = %v, want rows of qps only", summary.Rows)
+	}
+	if len(summary.Failures) != 0 {
+		t.Errorf("an empty result was reported as a failure: %v", summary.Failures)
+	}
+	if report := summary.Report(); !slices.Equal(report.EmptyMetrics, []string{"typo"}) {
+		t.Errorf("report EmptyMetrics = %v, want [typo]", report.EmptyMetrics)
+	}
+}
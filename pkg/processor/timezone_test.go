@@ -0,0 +1,96 @@
+package processor
+
+import (
+	"context"
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"github.com/meiking/tidb-metrics-crawler/pkg/sink"
+)
+
+// crawlCSVTimestamps crawls two hours of qps in one batch into a CSV sink as
+// a host whose local zone is hostZone would, returning the timestamp column
+func crawlCSVTimestamps(t *testing.T, hostZone *time.Location, timezone string) []string {
+	t.Helper()
+	local := time.Local
+	time.Local = hostZone
+	defer func() { time.Local = local }()
+
+	dir := t.TempDir()
+	out, err := sink.NewCSVSink(config.CSVConfig{OutputDir: dir})
+	if err != nil {
+		t.Fatalf("NewCSVSink() error = %v", err)
+	}
+	metrics := []config.MetricConfig{{Name: "qps", Query: "qps"}}
+	p := newTestProcessor(out, config.ProcessorConfig{Timezone: timezone, BatchWindow: "3h"}, &fakeClient{name: "prom"})
+	if err := p.ProcessMetrics(context.Background(), metrics, testTime("2024-01-01T00:00:00Z"), testTime("2024-01-01T02:00:00Z"), "30m"); err != nil {
+		t.Fatalf("ProcessMetrics() error = %v", err)
+	}
+	if err := out.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.csv"))
+	if len(files) != 1 {
+		t.Fatalf("wrote files %v, want one", files)
+	}
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	column := slices.Index(records[0], "timestamp")
+	var timestamps []string
+	for _, record := range records[1:] {
+		timestamps = append(timestamps, record[column])
+	}
+	return timestamps
+}
+
+func TestTimezoneIndependentOfHost(t *testing.T) {
+	hosts := []*time.Location{time.UTC, time.FixedZone("CST", 8*3600), time.FixedZone("PDT", -7*3600)}
+	want := []string{"2024-01-01T00:00:00Z", "2024-01-01T00:30:00Z", "2024-01-01T01:00:00Z", "2024-01-01T01:30:00Z", "2024-01-01T02:00:00Z"}
+
+	// UTC, by default or by name, gives the same file on every host
+	for _, timezone := range []string{"", "UTC"} {
+		for _, host := range hosts {
+			if got := crawlCSVTimestamps(t, host, timezone); !slices.Equal(got, want) {
+				t.Errorf("timezone %q on a %s host: timestamps = %v, want %v", timezone, host, got, want)
+			}
+		}
+	}
+
+	// A named zone does not depend on the host either
+	shanghai, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Skipf("time zone unavailable: %v", err)
+	}
+	for _, host := range hosts {
+		got := crawlCSVTimestamps(t, host, "Asia/Shanghai")
+		if len(got) == 0 || got[0] != "2024-01-01T08:00:00+08:00" {
+			t.Errorf("timezone Asia/Shanghai on a %s host: timestamps = %v, want them from 2024-01-01T08:00:00+08:00", host, got)
+		}
+	}
+
+	// local follows the host
+	if got := crawlCSVTimestamps(t, shanghai, "local"); len(got) == 0 || got[0] != "2024-01-01T08:00:00+08:00" {
+		t.Errorf("timezone local on a Shanghai host: timestamps = %v, want them in +08:00", got)
+	}
+}
+
+func TestLoadTimezoneInvalid(t *testing.T) {
+	p := newTestProcessor(newMemorySink(), config.ProcessorConfig{Timezone: "Mars/Olympus_Mons"}, &fakeClient{name: "prom"})
+	err := p.ProcessMetrics(context.Background(), []config.MetricConfig{{Name: "qps", Query: "qps"}}, testTime("2024-01-01T00:00:00Z"), testTime("2024-01-01T01:00:00Z"), "1m")
+	if err == nil {
+		t.Error("ProcessMetrics() accepted an unknown time zone")
+	}
+}
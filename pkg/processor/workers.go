@@ -0,0 +1,86 @@
+package processor
+
+import (
+	"sync"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"github.com/meiking/tidb-metrics-crawler/pkg/sink"
+)
+
+// lockedSink serializes access to a sink shared by metrics processed in
+// parallel, as sinks are not safe for concurrent use. Each Write is whole,
+// so a chunk of one metric is never interleaved with another's.
+type lockedSink struct {
+	mu   sync.Mutex
+	sink sink.Sink
+}
+
+// Write passes data to the sink while holding the lock
+func (s *lockedSink) Write(metricName string, data []common.ProcessedData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sink.Write(metricName, data)
+}
+
+// Close closes the sink while holding the lock
+func (s *lockedSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sink.Close()
+}
+
+// LastTimestamp asks the sink for its watermark while holding the lock. It
+// is only called when the sink is a Watermarker.
+func (s *lockedSink) LastTimestamp(instance, metricName string) (time.Time, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sink.(sink.Watermarker).LastTimestamp(instance, metricName)
+}
+
+// forEachMetric calls process for every metric, running up to workers at a
+// time. After the first error no further metrics are started; the error is
+// returned once the running ones finish.
+func forEachMetric(metrics []config.MetricConfig, workers int, process func(config.MetricConfig) error) error {
+	if workers <= 1 {
+		for _, metric := range metrics {
+			if err := process(metric); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	slots := make(chan struct{}, workers)
+	for _, metric := range metrics {
+		slots <- struct{}{}
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			<-slots
+			break
+		}
+
+		wg.Add(1)
+		go func(metric config.MetricConfig) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if err := process(metric); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}(metric)
+	}
+	wg.Wait()
+	return firstErr
+}
@@ -0,0 +1,150 @@
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+// overlapSink counts calls that overlap, which sinks do not allow
+type overlapSink struct {
+	active   atomic.Int32
+	overlaps atomic.Int32
+	rows     atomic.Int64
+}
+
+func (s *overlapSink) enter() func() {
+	if s.active.Add(1) > 1 {
+		s.overlaps.Add(1)
+	}
+	return func() { s.active.Add(-1) }
+}
+
+func (s *overlapSink) Write(metricName string, data []common.ProcessedData) error {
+	defer s.enter()()
+	time.Sleep(100 * time.Microsecond) // Long enough for writes to overlap
+	s.rows.Add(int64(len(data)))
+	return nil
+}
+
+func (s *overlapSink) Close() error { return nil }
+
+func (s *overlapSink) LastTimestamp(instance, metricName string) (time.Time, bool, error) {
+	defer s.enter()()
+	time.Sleep(100 * time.Microsecond)
+	return time.Time{}, false, nil
+}
+
+// testMetrics returns n metrics named m0, m1, ...
+func testMetrics(n int) []config.MetricConfig {
+	metrics := make([]config.MetricConfig, n)
+	for i := range metrics {
+		metrics[i] = config.MetricConfig{Name: fmt.Sprintf("m%d", i), Query: fmt.Sprintf("m%d", i)}
+	}
+	return metrics
+}
+
+func TestLockedSinkSerializesCalls(t *testing.T) {
+	inner := &overlapSink{}
+	s := &lockedSink{sink: inner}
+	rows := make([]common.ProcessedData, 3)
+
+	err := forEachMetric(testMetrics(16), 8, func(metric config.MetricConfig) error {
+		for i := 0; i < 5; i++ {
+			if err := s.Write(metric.Name, rows); err != nil {
+				return err
+			}
+			if _, _, err := s.LastTimestamp("prom", metric.Name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("forEachMetric() error = %v", err)
+	}
+	if n := inner.overlaps.Load(); n > 0 {
+		t.Errorf("%d sink calls overlapped", n)
+	}
+	if n := inner.rows.Load(); n != 16*5*3 {
+		t.Errorf("sink got %d rows, want %d", n, 16*5*3)
+	}
+}
+
+func TestForEachMetricLimitsWorkers(t *testing.T) {
+	for _, workers := range []int{0, 1, 3} {
+		t.Run(fmt.Sprint(workers), func(t *testing.T) {
+			var (
+				mu              sync.Mutex
+				running, peak   int
+				processed       []string
+				wantConcurrency = max(workers, 1)
+			)
+			err := forEachMetric(testMetrics(10), workers, func(metric config.MetricConfig) error {
+				mu.Lock()
+				running++
+				peak = max(peak, running)
+				mu.Unlock()
+
+				time.Sleep(2 * time.Millisecond)
+
+				mu.Lock()
+				running--
+				processed = append(processed, metric.Name)
+				mu.Unlock()
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("forEachMetric() error = %v", err)
+			}
+			if peak != wantConcurrency {
+				t.Errorf("%d metrics ran at once, want %d", peak, wantConcurrency)
+			}
+			if len(processed) != 10 {
+				t.Errorf("processed %d metrics, want 10", len(processed))
+			}
+		})
+	}
+}
+
+func TestForEachMetricStopsAfterError(t *testing.T) {
+	var started atomic.Int32
+	failure := errors.New("fail_fast")
+	err := forEachMetric(testMetrics(20), 2, func(metric config.MetricConfig) error {
+		started.Add(1)
+		time.Sleep(time.Millisecond)
+		if metric.Name == "m1" {
+			return failure
+		}
+		return nil
+	})
+	if !errors.Is(err, failure) {
+		t.Fatalf("forEachMetric() error = %v, want the metric's", err)
+	}
+	if n := started.Load(); n >= 20 {
+		t.Errorf("%d metrics started, want none after the failure is seen", n)
+	}
+}
+
+// BenchmarkForEachMetric compares processing metrics with a query latency
+// serially and with workers sharing a locked sink
+func BenchmarkForEachMetric(b *testing.B) {
+	rows := make([]common.ProcessedData, 100)
+	for _, workers := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			s := &lockedSink{sink: &overlapSink{}}
+			for i := 0; i < b.N; i++ {
+				forEachMetric(testMetrics(32), workers, func(metric config.MetricConfig) error {
+					time.Sleep(time.Millisecond) // The query
+					return s.Write(metric.Name, rows)
+				})
+			}
+		})
+	}
+}
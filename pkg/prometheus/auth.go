@@ -1,7 +1,13 @@
 package prometheus
 
 import (
+	"context"
+	"errors"
 	"net/http"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
 )
 
 // createAuthTransport creates an HTTP transport with basic authentication if credentials are provided
@@ -48,3 +54,27 @@ func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 
 	return t.transport.RoundTrip(reqCopy)
 }
+
+// newOAuth2RoundTripper creates a transport that obtains tokens via the OAuth2
+// client-credentials grant and attaches them as bearer tokens. Tokens are
+// cached and refreshed automatically shortly before they expire.
+func newOAuth2RoundTripper(cfg *config.OAuth2Config, rt http.RoundTripper) (http.RoundTripper, error) {
+	if cfg.TokenURL == "" || cfg.ClientID == "" {
+		return nil, errors.New("oauth2 requires token_url and client_id")
+	}
+
+	ccCfg := clientcredentials.Config{
+		ClientID:     cfg.ClientID,
+		ClientSecret: cfg.ClientSecret,
+		TokenURL:     cfg.TokenURL,
+		Scopes:       cfg.Scopes,
+	}
+
+	// Token requests use the same underlying transport as queries
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: rt})
+
+	return &oauth2.Transport{
+		Source: ccCfg.TokenSource(ctx),
+		Base:   rt,
+	}, nil
+}
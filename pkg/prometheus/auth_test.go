@@ -0,0 +1,102 @@
+package prometheus
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+func TestOAuth2AttachesToken(t *testing.T) {
+	var (
+		mu            sync.Mutex
+		tokenRequests int
+		authorization []string
+	)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		if r.Method != http.MethodPost || r.FormValue("grant_type") != "client_credentials" ||
+			id != "crawler" || secret != "s3cret" || r.FormValue("scope") != "metrics.read" {
+			http.Error(w, "bad token request", http.StatusUnauthorized)
+			return
+		}
+		mu.Lock()
+		tokenRequests++
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"access_token": "tok-1", "token_type": "Bearer", "expires_in": 3600})
+	})
+	mux.HandleFunc("/api/v1/query_range", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		authorization = append(authorization, r.Header.Get("Authorization"))
+		mu.Unlock()
+		w.Write([]byte(emptyMatrix))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	client := newTestClient(t, server.URL, config.PrometheusConfig{OAuth2: &config.OAuth2Config{
+		TokenURL:     server.URL + "/token",
+		ClientID:     "crawler",
+		ClientSecret: "s3cret",
+		Scopes:       []string{"metrics.read"},
+	}})
+	end := time.Now()
+	for i := 0; i < 2; i++ {
+		if _, err := client.FetchRange(context.Background(), "up", end.Add(-time.Hour), end, time.Minute, 0); err != nil {
+			t.Fatalf("FetchRange() error = %v", err)
+		}
+	}
+
+	if len(authorization) != 2 || authorization[0] != "Bearer tok-1" || authorization[1] != "Bearer tok-1" {
+		t.Errorf("Authorization headers = %q, want the token on both queries", authorization)
+	}
+	if tokenRequests != 1 {
+		t.Errorf("token requested %d times, want 1 with the token cached", tokenRequests)
+	}
+}
+
+func TestOAuth2TokenFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+			return
+		}
+		t.Errorf("queried %s without a token", r.URL.Path)
+	}))
+	defer server.Close()
+
+	client := newTestClient(t, server.URL, config.PrometheusConfig{OAuth2: &config.OAuth2Config{
+		TokenURL: server.URL + "/token",
+		ClientID: "crawler",
+	}})
+	end := time.Now()
+	if _, err := client.FetchRange(context.Background(), "up", end.Add(-time.Hour), end, time.Minute, 0); err == nil {
+		t.Fatal("FetchRange() succeeded, want the token error")
+	}
+}
+
+func TestOAuth2Config(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.PrometheusConfig
+	}{
+		{"missing token_url", config.PrometheusConfig{OAuth2: &config.OAuth2Config{ClientID: "crawler"}}},
+		{"missing client_id", config.PrometheusConfig{OAuth2: &config.OAuth2Config{TokenURL: "http://idp/token"}}},
+		{"with basic auth", config.PrometheusConfig{Username: "u", Password: "p", OAuth2: &config.OAuth2Config{TokenURL: "http://idp/token", ClientID: "crawler"}}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.cfg.Address = "http://prometheus:9090"
+			if _, err := NewClient(tc.cfg); err == nil {
+				t.Error("NewClient() succeeded, want a configuration error")
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package prometheus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Backend flavors told apart by DetectBackend
+const (
+	FlavorPrometheus      = "prometheus"
+	FlavorThanos          = "thanos"
+	FlavorMimir           = "mimir"
+	FlavorCortex          = "cortex"
+	FlavorVictoriaMetrics = "victoriametrics"
+	FlavorUnknown         = "unknown"
+)
+
+// buildinfoPath is the Prometheus endpoint describing the server build
+const buildinfoPath = "/api/v1/status/buildinfo"
+
+// maxProbeTimeout caps the backend probe, so a slow server does not hold up
+// the start of a run
+const maxProbeTimeout = 10 * time.Second
+
+// Backend describes the server behind an instance
+type Backend struct {
+	Flavor  string // One of the Flavor constants
+	Version string // Empty when the server does not say
+}
+
+// buildinfo is the data of a buildinfo response. Prometheus and Thanos fill
+// in the build fields; Mimir and Cortex add application; VictoriaMetrics
+// answers with a fixed version only.
+type buildinfo struct {
+	Application string `json:"application"`
+	Version     string `json:"version"`
+	Revision    string `json:"revision"`
+	Branch      string `json:"branch"`
+	GoVersion   string `json:"goVersion"`
+}
+
+// DetectBackend probes the instance's buildinfo endpoint once, without
+// retries, and works out which server answers. A failed probe still returns
+// a guess from the address, with the error.
+func (c *promClient) DetectBackend() (Backend, error) {
+	timeout := min(c.timeout, maxProbeTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := c.limiter.Wait(ctx); err != nil {
+		return detectBackend(c.address, 0, nil), fmt.Errorf("rate limiter: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.http.URL(buildinfoPath, nil).String(), nil)
+	if err != nil {
+		return detectBackend(c.address, 0, nil), err
+	}
+	resp, body, err := c.http.Do(ctx, req)
+	if err != nil {
+		return detectBackend(c.address, 0, nil), fmt.Errorf("buildinfo probe: %v", err)
+	}
+	return detectBackend(c.address, resp.StatusCode, body), nil
+}
+
+// detectBackend tells the flavor from a buildinfo response, falling back to
+// the conventional API paths in address when the response does not say.
+// A status of 0 means no response arrived.
+func detectBackend(address string, status int, body []byte) Backend {
+	if status == http.StatusOK {
+		var resp struct {
+			Status string    `json:"status"`
+			Data   buildinfo `json:"data"`
+		}
+		if err := json.Unmarshal(body, &resp); err == nil && resp.Status == "success" {
+			switch flavor := buildinfoFlavor(resp.Data); flavor {
+			case FlavorUnknown:
+			case FlavorVictoriaMetrics:
+				return Backend{Flavor: flavor} // Its version is not its own
+			default:
+				return Backend{Flavor: flavor, Version: resp.Data.Version}
+			}
+		}
+	}
+	return Backend{Flavor: addressFlavor(address)}
+}
+
+// buildinfoFlavor tells the flavor from buildinfo data
+func buildinfoFlavor(info buildinfo) string {
+	application := strings.ToLower(info.Application)
+	switch {
+	case strings.Contains(application, "mimir"):
+		return FlavorMimir
+	case strings.Contains(application, "cortex"):
+		return FlavorCortex
+	case strings.Contains(application, "thanos"):
+		return FlavorThanos
+	case info.Version == "":
+		return FlavorUnknown
+	case info.Revision == "" && info.GoVersion == "":
+		// VictoriaMetrics claims a Prometheus version to keep Grafana happy
+		// but has no build details to report
+		return FlavorVictoriaMetrics
+	case strings.HasPrefix(info.Version, "0."):
+		// Thanos is still at major version 0; Prometheus has been at 2 or
+		// later for years
+		return FlavorThanos
+	}
+	return FlavorPrometheus
+}
+
+// addressFlavor guesses the flavor from the API path prefix in address:
+// /prometheus for Mimir and Cortex and /select/<tenant>/prometheus for a
+// VictoriaMetrics cluster. Mimir and Cortex share the prefix, and the more
+// common Mimir is assumed.
+func addressFlavor(address string) string {
+	u, err := url.Parse(address)
+	if err != nil {
+		return FlavorUnknown
+	}
+	path := strings.TrimSuffix(u.Path, "/")
+	switch {
+	case strings.Contains(path, "/select/"):
+		return FlavorVictoriaMetrics
+	case strings.HasSuffix(path, "/prometheus"):
+		return FlavorMimir
+	}
+	return FlavorUnknown
+}
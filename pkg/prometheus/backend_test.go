@@ -0,0 +1,104 @@
+package prometheus
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+func TestDetectBackendFromBuildinfo(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string // API path prefix of the instance address
+		status int
+		body   string
+		want   Backend
+	}{
+		{
+			"prometheus", "", http.StatusOK,
+			`{"status":"success","data":{"version":"2.53.1","revision":"14cfec3f","branch":"HEAD","buildUser":"root@buildkitsandbox","goVersion":"go1.22.5"}}`,
+			Backend{Flavor: FlavorPrometheus, Version: "2.53.1"},
+		},
+		{
+			"thanos", "", http.StatusOK,
+			`{"status":"success","data":{"version":"0.35.1","revision":"086a698b","branch":"HEAD","goVersion":"go1.21.10"}}`,
+			Backend{Flavor: FlavorThanos, Version: "0.35.1"},
+		},
+		{
+			"mimir", "/prometheus", http.StatusOK,
+			`{"status":"success","data":{"application":"Grafana Mimir","version":"2.12.0","revision":"a8ef0ba","branch":"release-2.12","goVersion":"go1.21.9","features":{"ruler_config_api":"true"}}}`,
+			Backend{Flavor: FlavorMimir, Version: "2.12.0"},
+		},
+		{
+			"cortex", "/prometheus", http.StatusOK,
+			`{"status":"success","data":{"application":"Cortex","version":"1.16.0","revision":"f6d8b7d","goVersion":"go1.21.3"}}`,
+			Backend{Flavor: FlavorCortex, Version: "1.16.0"},
+		},
+		{
+			"victoriametrics", "", http.StatusOK,
+			`{"status":"success","data":{"version":"2.24.0"}}`,
+			Backend{Flavor: FlavorVictoriaMetrics},
+		},
+		{
+			"victoriametrics cluster without buildinfo", "/select/0/prometheus", http.StatusNotFound,
+			`unsupported path requested: "/select/0/prometheus/api/v1/status/buildinfo"`,
+			Backend{Flavor: FlavorVictoriaMetrics},
+		},
+		{
+			"prefix without buildinfo", "/prometheus", http.StatusNotFound,
+			`404 page not found`,
+			Backend{Flavor: FlavorMimir},
+		},
+		{
+			"error status", "", http.StatusOK,
+			`{"status":"error","errorType":"internal","error":"not ready"}`,
+			Backend{Flavor: FlavorUnknown},
+		},
+		{
+			"not JSON", "", http.StatusOK,
+			`<html>Sign in</html>`,
+			Backend{Flavor: FlavorUnknown},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var path string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				path = r.URL.Path
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			client := newTestClient(t, server.URL+tt.prefix, config.PrometheusConfig{})
+			got, err := client.DetectBackend()
+			if err != nil {
+				t.Fatalf("DetectBackend() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("DetectBackend() = %+v, want %+v", got, tt.want)
+			}
+			if want := tt.prefix + buildinfoPath; path != want {
+				t.Errorf("probed %s, want %s", path, want)
+			}
+		})
+	}
+}
+
+func TestDetectBackendUnreachable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	address := server.URL + "/prometheus"
+	server.Close()
+
+	// The probe fails, but the address still gives a guess
+	client := newTestClient(t, address, config.PrometheusConfig{})
+	got, err := client.DetectBackend()
+	if err == nil {
+		t.Error("DetectBackend() of a closed server succeeded")
+	}
+	if got.Flavor != FlavorMimir {
+		t.Errorf("DetectBackend() = %+v, want the mimir guess from the address", got)
+	}
+}
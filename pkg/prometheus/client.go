@@ -5,47 +5,139 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
+	"github.com/meiking/tidb-metrics-crawler/pkg/backoff"
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
 	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"github.com/meiking/tidb-metrics-crawler/pkg/version"
 	"github.com/prometheus/client_golang/api"
 	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
 	"github.com/prometheus/common/model"
+	"golang.org/x/time/rate"
 )
 
 // Client defines the interface for Prometheus clients
 type Client interface {
 	Name() string
-	FetchRange(query string, start, end time.Time, step time.Duration) (model.Value, error)
+	Address() string
+	Labels() map[string]string
+	FetchRange(ctx context.Context, query string, start, end time.Time, step, timeout time.Duration) (model.Value, error)
+	FetchInstant(ctx context.Context, query string, ts time.Time, timeout time.Duration) (model.Value, error)
+	FetchExemplars(ctx context.Context, query string, start, end time.Time, timeout time.Duration) ([]v1.ExemplarQueryResult, error)
+	Rules(ctx context.Context) (v1.RulesResult, error)
+	Alerts(ctx context.Context) (v1.AlertsResult, error)
+	LabelValues(label string) (model.LabelValues, error)
+	Metadata(metric string) (map[string][]v1.Metadata, error)
+	DetectBackend() (Backend, error)
+	Stats() QueryStats
 }
 
 // promClient implements the Client interface
 type promClient struct {
 	name    string
+	address string // Without credentials
+	http    api.Client
 	api     v1.API
 	timeout time.Duration
+	labels  map[string]string // Static labels for rows from this instance
+	limiter queryLimiter      // Paces queries to the instance
+	slots   chan struct{}     // Caps in-flight queries; nil for unlimited
+	stats   statsRecorder
+
+	attempts int              // Tries per query
+	backoff  *backoff.Backoff // Delay between tries
+}
+
+// queryLimiter paces queries. It is a *rate.Limiter, replaced in tests to
+// control the clock.
+type queryLimiter interface {
+	Wait(ctx context.Context) error
+}
+
+const defaultQueryAttempts = 5
+
+// defaultQueryBackoff is the backoff of queries unless the instance's retry sets it
+var defaultQueryBackoff = backoff.Backoff{
+	Base:       2 * time.Second,
+	Max:        30 * time.Second,
+	Multiplier: 2,
 }
 
 // NewClient creates a new Prometheus client
 func NewClient(cfg config.PrometheusConfig) (Client, error) {
+	if err := validateAddress(cfg.Address); err != nil {
+		return nil, err
+	}
+
+	userAgent := cfg.UserAgent
+	if userAgent == "" {
+		userAgent = version.UserAgent()
+	}
+
+	// Build the transport chain: User-Agent -> compression -> authentication -> network
+	var transport http.RoundTripper
+	if cfg.OAuth2 != nil {
+		if cfg.Username != "" || cfg.Password != "" {
+			return nil, errors.New("oauth2 and basic auth (username/password) are mutually exclusive")
+		}
+		var err error
+		if transport, err = newOAuth2RoundTripper(cfg.OAuth2, http.DefaultTransport); err != nil {
+			return nil, err
+		}
+	} else {
+		transport = newAuthRoundTripper(cfg.Username, cfg.Password, http.DefaultTransport)
+	}
+
+	c := &promClient{
+		name:    cfg.Name,
+		address: stripUserinfo(cfg.Address),
+		labels:  cfg.Labels,
+	}
+
 	client, err := api.NewClient(api.Config{
 		Address:      cfg.Address,
-		RoundTripper: newAuthRoundTripper(cfg.Username, cfg.Password, http.DefaultTransport),
+		RoundTripper: newUserAgentRoundTripper(userAgent, newGzipRoundTripper(&c.stats, transport)),
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to create Prometheus client: %v", err)
 	}
+	c.http = client
+	c.api = v1.NewAPI(client)
+
+	if cfg.RateLimit < 0 {
+		return nil, fmt.Errorf("invalid rate_limit: %v", cfg.RateLimit)
+	}
+	limit := rate.Inf
+	if cfg.RateLimit > 0 {
+		limit = rate.Limit(cfg.RateLimit)
+	}
 
-	timeout, err := time.ParseDuration(cfg.Timeout)
+	timeout, err := common.ParseDuration(cfg.Timeout)
 	if err != nil || timeout == 0 {
 		timeout = 30 * time.Second // Default timeout
 	}
 
-	return &promClient{
-		name:    cfg.Name,
-		api:     v1.NewAPI(client),
-		timeout: timeout,
-	}, nil
+	c.attempts = defaultQueryAttempts
+	var retry config.RetryConfig
+	if cfg.Retry != nil {
+		retry = *cfg.Retry
+		if retry.Attempts > 0 {
+			c.attempts = retry.Attempts
+		}
+	}
+	if c.backoff, err = backoff.FromConfig(retry, defaultQueryBackoff); err != nil {
+		return nil, fmt.Errorf("instance %s: %v", cfg.Name, err)
+	}
+
+	c.timeout = timeout
+	c.limiter = rate.NewLimiter(limit, 1)
+	if cfg.MaxConcurrency > 0 {
+		c.slots = make(chan struct{}, cfg.MaxConcurrency)
+	}
+	return c, nil
 }
 
 // Name returns the client name
@@ -53,21 +145,129 @@ func (c *promClient) Name() string {
 	return c.name
 }
 
-// FetchRange fetches metrics for a time range with retries
-func (c *promClient) FetchRange(query string, start, end time.Time, step time.Duration) (model.Value, error) {
-	// Maximum retry attempts
-	maxRetries := 5
-	retryDelay := 2 * time.Second // Initial delay between retries
+// Address returns the URL queries are sent to, without any credentials
+func (c *promClient) Address() string {
+	return c.address
+}
 
-	for attempt := 1; attempt <= maxRetries; attempt++ {
-		ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
-		defer cancel()
+// Labels returns the static labels configured for the instance
+func (c *promClient) Labels() map[string]string {
+	return c.labels
+}
 
-		result, warnings, err := c.api.QueryRange(ctx, query, v1.Range{
+// Stats returns the query latency and retry counters collected so far
+func (c *promClient) Stats() QueryStats {
+	return c.stats.snapshot()
+}
+
+// FetchRange fetches metrics for a time range with retries. A non-zero
+// timeout replaces the instance's timeout for this query. Cancelling ctx
+// abandons the query and any retries still to come.
+func (c *promClient) FetchRange(ctx context.Context, query string, start, end time.Time, step, timeout time.Duration) (model.Value, error) {
+	return withRetries(ctx, c, c.queryTimeout(timeout), func(ctx context.Context) (model.Value, v1.Warnings, error) {
+		return c.api.QueryRange(ctx, query, v1.Range{
 			Start: start,
 			End:   end,
 			Step:  step,
-		})
+		}, queryOptions(timeout)...)
+	})
+}
+
+// FetchInstant evaluates query at a single point in time with retries. A
+// non-zero timeout replaces the instance's timeout for this query.
+func (c *promClient) FetchInstant(ctx context.Context, query string, ts time.Time, timeout time.Duration) (model.Value, error) {
+	return withRetries(ctx, c, c.queryTimeout(timeout), func(ctx context.Context) (model.Value, v1.Warnings, error) {
+		return c.api.Query(ctx, query, ts, queryOptions(timeout)...)
+	})
+}
+
+// FetchExemplars fetches the exemplars of the series query selects between
+// start and end with retries
+func (c *promClient) FetchExemplars(ctx context.Context, query string, start, end time.Time, timeout time.Duration) ([]v1.ExemplarQueryResult, error) {
+	return withRetries(ctx, c, c.queryTimeout(timeout), func(ctx context.Context) ([]v1.ExemplarQueryResult, v1.Warnings, error) {
+		result, err := c.api.QueryExemplars(ctx, query, start, end)
+		return result, nil, err
+	})
+}
+
+// queryTimeout returns the timeout of one query attempt: the query's own
+// timeout if set, otherwise the instance's
+func (c *promClient) queryTimeout(timeout time.Duration) time.Duration {
+	if timeout > 0 {
+		return timeout
+	}
+	return c.timeout
+}
+
+// queryOptions passes a query's own timeout to Prometheus, so the server
+// stops evaluating when the client gives up
+func queryOptions(timeout time.Duration) []v1.Option {
+	if timeout <= 0 {
+		return nil
+	}
+	return []v1.Option{v1.WithTimeout(timeout)}
+}
+
+// Rules fetches the current state of recording and alerting rules with retries
+func (c *promClient) Rules(ctx context.Context) (v1.RulesResult, error) {
+	return withRetries(ctx, c, c.timeout, func(ctx context.Context) (v1.RulesResult, v1.Warnings, error) {
+		result, err := c.api.Rules(ctx)
+		return result, nil, err
+	})
+}
+
+// Alerts fetches the active alerts with retries
+func (c *promClient) Alerts(ctx context.Context) (v1.AlertsResult, error) {
+	return withRetries(ctx, c, c.timeout, func(ctx context.Context) (v1.AlertsResult, v1.Warnings, error) {
+		result, err := c.api.Alerts(ctx)
+		return result, nil, err
+	})
+}
+
+// LabelValues fetches every value of label across the instance's series
+// with retries, e.g. all metric names for __name__
+func (c *promClient) LabelValues(label string) (model.LabelValues, error) {
+	return withRetries(context.Background(), c, c.timeout, func(ctx context.Context) (model.LabelValues, v1.Warnings, error) {
+		return c.api.LabelValues(ctx, label, nil, time.Time{}, time.Time{})
+	})
+}
+
+// Metadata fetches the type, help and unit of scraped metrics, keyed by
+// metric name, with retries. An empty metric returns every metric.
+func (c *promClient) Metadata(metric string) (map[string][]v1.Metadata, error) {
+	return withRetries(context.Background(), c, c.timeout, func(ctx context.Context) (map[string][]v1.Metadata, v1.Warnings, error) {
+		result, err := c.api.Metadata(ctx, metric, "")
+		return result, nil, err
+	})
+}
+
+// withRetries runs query with rate limiting, timeout per attempt, and
+// jittered exponential backoff between failed attempts. It gives up as soon
+// as parent is cancelled, whether waiting, querying or backing off.
+func withRetries[T any](parent context.Context, c *promClient, timeout time.Duration, query func(ctx context.Context) (T, v1.Warnings, error)) (T, error) {
+	var zero T
+	maxRetries := c.attempts
+
+	for attempt := 1; attempt <= maxRetries; attempt++ {
+		// Wait for a slot and the rate limiter outside the query timeout;
+		// the slot is not held while backing off
+		if err := c.acquire(parent); err != nil {
+			return zero, err
+		}
+		if err := c.limiter.Wait(parent); err != nil {
+			c.release()
+			if parent.Err() != nil {
+				return zero, parent.Err()
+			}
+			return zero, fmt.Errorf("rate limiter: %v", err)
+		}
+
+		ctx, cancel := context.WithTimeout(parent, timeout)
+		queryStart := time.Now()
+		result, warnings, err := query(ctx)
+		c.stats.observe(time.Since(queryStart))
+		cancel()
+		c.release()
 
 		// Log warnings but don't treat them as errors
 		for _, w := range warnings {
@@ -79,21 +279,131 @@ func (c *promClient) FetchRange(query string, start, end time.Time, step time.Du
 			return result, nil
 		}
 
+		// An interrupted run is not a failure of the instance
+		if parent.Err() != nil {
+			return zero, parent.Err()
+		}
+
+		// Retrying cannot shorten the URL
+		if isURITooLong(err) {
+			c.stats.failure()
+			return zero, fmt.Errorf("query too long for a GET URL (HTTP 414): the server refused the query as a POST body, so allow POST to /api/v1/query and /api/v1/query_range in any proxy in front of it")
+		}
+
+		// A rejected query fails the same way every time
+		if isPermanent(err) {
+			c.stats.failure()
+			return zero, fmt.Errorf("%w, not retrying: %s", ErrQueryRejected, describeError(err))
+		}
+
 		// Check if we should retry
 		if attempt == maxRetries {
-			return nil, fmt.Errorf("failed after %d retries: %v", maxRetries, err)
+			c.stats.failure()
+			return zero, fmt.Errorf("failed after %d retries: %s", maxRetries, describeError(err))
 		}
 
 		// Log retry attempt
-		fmt.Printf("Retry %d/%d for Prometheus instance %s (error: %v). Waiting %v...\n",
-			attempt, maxRetries, c.name, err, retryDelay)
+		retryDelay := c.backoff.NextDelay(attempt)
+		fmt.Printf("Retry %d/%d for Prometheus instance %s (error: %s). Waiting %v...\n",
+			attempt, maxRetries, c.name, describeError(err), retryDelay)
 
-		// Wait before next retry (exponential backoff)
-		time.Sleep(retryDelay)
-		retryDelay *= 2 // Double the delay for next attempt
+		// Wait before next retry
+		c.stats.retry()
+		timer := time.NewTimer(retryDelay)
+		select {
+		case <-timer.C:
+		case <-parent.Done():
+			timer.Stop()
+			return zero, parent.Err()
+		}
 	}
 
-	return nil, errors.New("maximum retry attempts exceeded")
+	return zero, errors.New("maximum retry attempts exceeded")
+}
+
+// ErrQueryRejected wraps errors that retrying cannot fix, such as a query
+// Prometheus cannot parse
+var ErrQueryRejected = errors.New("query rejected")
+
+// retryableClientErrors are the HTTP 4xx statuses worth retrying
+var retryableClientErrors = map[string]bool{
+	fmt.Sprintf("client error: %d", http.StatusRequestTimeout):  true,
+	fmt.Sprintf("client error: %d", http.StatusTooManyRequests): true,
+}
+
+// isPermanent reports whether retrying err cannot help. Prometheus reports
+// an invalid query as bad_data, with HTTP 400 or 422 or, behind some
+// proxies, a 200 whose body has "status":"error"; either way the API
+// returns the body's errorType and error. Other 4xx responses are refusals
+// of the request itself, except timeouts and rate limiting. Server, timeout
+// and execution errors and unparsable responses may pass, so they are
+// retried.
+func isPermanent(err error) bool {
+	var apiErr *v1.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.Type {
+	case v1.ErrBadData:
+		return true
+	case v1.ErrClient:
+		return !retryableClientErrors[apiErr.Msg]
+	}
+	return false
+}
+
+// maxErrorDetail is the most of a response body quoted in an error
+const maxErrorDetail = 200
+
+// describeError returns err's message, "<errorType>: <error>" for API
+// errors, plus the start of the response body of HTTP errors, which often
+// names the proxy or gateway that answered
+func describeError(err error) string {
+	var apiErr *v1.Error
+	if !errors.As(err, &apiErr) {
+		return err.Error()
+	}
+	detail := strings.Join(strings.Fields(apiErr.Detail), " ")
+	if detail == "" {
+		return err.Error()
+	}
+	if len(detail) > maxErrorDetail {
+		detail = strings.ToValidUTF8(detail[:maxErrorDetail], "") + "..."
+	}
+	return fmt.Sprintf("%v (response: %s)", err, detail)
+}
+
+// uriTooLongMsg is the message of the error the API returns for HTTP 414
+var uriTooLongMsg = fmt.Sprintf("client error: %d", http.StatusRequestURITooLong)
+
+// isURITooLong reports whether err is an HTTP 414. Queries are sent as POST
+// form bodies, so their length is not limited by the URL; only when the
+// server answers POST with 405 or 501 does the API retry with a GET, which
+// fails this way for long queries.
+func isURITooLong(err error) bool {
+	var apiErr *v1.Error
+	return errors.As(err, &apiErr) && apiErr.Type == v1.ErrClient && apiErr.Msg == uriTooLongMsg
+}
+
+// acquire blocks until fewer than max_concurrency queries are in flight, or
+// ctx is cancelled
+func (c *promClient) acquire(ctx context.Context) error {
+	if c.slots == nil {
+		return ctx.Err()
+	}
+	select {
+	case c.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release frees the slot taken by acquire
+func (c *promClient) release() {
+	if c.slots != nil {
+		<-c.slots
+	}
 }
 
 // authRoundTripper handles basic authentication
@@ -113,7 +423,38 @@ func newAuthRoundTripper(username, password string, rt http.RoundTripper) http.R
 
 func (a *authRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
 	if a.username != "" && a.password != "" {
+		// Clone the request since a RoundTripper must not modify its input;
+		// the URL (including any path prefix) is left untouched
+		req = req.Clone(req.Context())
 		req.SetBasicAuth(a.username, a.password)
 	}
 	return a.rt.RoundTrip(req)
 }
+
+// validateAddress checks that a Prometheus address is an absolute http(s) URL.
+// A path prefix is allowed for deployments behind a reverse proxy, e.g.
+// https://host/prometheus queries https://host/prometheus/api/v1/query_range.
+func validateAddress(address string) error {
+	u, err := url.Parse(address)
+	if err != nil {
+		return fmt.Errorf("invalid Prometheus address %q: %v", address, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid Prometheus address %q: expected http(s)://host[:port][/path-prefix]", address)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("invalid Prometheus address %q: query strings and fragments are not supported", address)
+	}
+	return nil
+}
+
+// stripUserinfo removes user:password@ from a validated address, so it can
+// be recorded with the data
+func stripUserinfo(address string) string {
+	u, err := url.Parse(address)
+	if err != nil || u.User == nil {
+		return address
+	}
+	u.User = nil
+	return u.String()
+}
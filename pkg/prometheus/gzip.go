@@ -0,0 +1,100 @@
+package prometheus
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// gzipRoundTripper asks for gzip-compressed responses and decompresses them,
+// recording the bytes received and decoded. net/http does the same
+// transparently, but hides the compressed size.
+type gzipRoundTripper struct {
+	stats *statsRecorder
+	rt    http.RoundTripper
+}
+
+func newGzipRoundTripper(stats *statsRecorder, rt http.RoundTripper) http.RoundTripper {
+	return &gzipRoundTripper{
+		stats: stats,
+		rt:    rt,
+	}
+}
+
+func (g *gzipRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Leave requests that negotiate their own encoding alone
+	if req.Header.Get("Accept-Encoding") != "" {
+		return g.rt.RoundTrip(req)
+	}
+
+	// Clone the request since a RoundTripper must not modify its input
+	req = req.Clone(req.Context())
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	resp, err := g.rt.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	body := &countingBody{body: resp.Body, stats: g.stats}
+	body.wire = &countingReader{r: resp.Body}
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		body.gzipped = true
+		resp.Header.Del("Content-Encoding")
+		resp.Header.Del("Content-Length")
+		resp.ContentLength = -1
+		resp.Uncompressed = true
+	}
+	resp.Body = body
+	return resp, nil
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// countingBody decodes a possibly gzipped response body and records the
+// received and decoded sizes when closed
+type countingBody struct {
+	body    io.ReadCloser
+	wire    *countingReader
+	gzipped bool
+	reader  io.Reader // Created lazily, since gzip.NewReader reads the header
+	decoded int64
+	stats   *statsRecorder
+	once    sync.Once
+}
+
+func (c *countingBody) Read(p []byte) (int, error) {
+	if c.reader == nil {
+		c.reader = c.wire
+		if c.gzipped {
+			zr, err := gzip.NewReader(c.wire)
+			if err != nil {
+				return 0, err
+			}
+			c.reader = zr
+		}
+	}
+
+	n, err := c.reader.Read(p)
+	c.decoded += int64(n)
+	return n, err
+}
+
+func (c *countingBody) Close() error {
+	c.once.Do(func() {
+		c.stats.transfer(c.wire.n, c.decoded)
+	})
+	return c.body.Close()
+}
@@ -0,0 +1,131 @@
+package prometheus
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"github.com/prometheus/common/model"
+)
+
+// syntheticMatrix returns a range query response of series × points
+// samples with seeded random values, which compress worse than real data
+func syntheticMatrix(series, points int) []byte {
+	rng := rand.New(rand.NewSource(1))
+	var b strings.Builder
+	b.WriteString(`{"status":"success","data":{"resultType":"matrix","result":[`)
+	for i := 0; i < series; i++ {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `{"metric":{"__name__":"tidb_server_query_total","instance":"tidb-%d:10080","job":"tidb","type":"Select"},"values":[`, i)
+		for j := 0; j < points; j++ {
+			if j > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(&b, `[%d,"%v"]`, 1700000000+j*15, rng.Float64()*1000)
+		}
+		b.WriteString("]}")
+	}
+	b.WriteString("]}}")
+	return []byte(b.String())
+}
+
+// newMatrixServer serves body to every query, gzipped when the client asks
+// for it and gzipped is set, and records the Accept-Encoding of the last
+// request
+func newMatrixServer(t *testing.T, body []byte, gzipped bool, acceptEncoding *string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*acceptEncoding = r.Header.Get("Accept-Encoding")
+		w.Header().Set("Content-Type", "application/json")
+		if !gzipped || !strings.Contains(*acceptEncoding, "gzip") {
+			w.Write(body)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		zw.Write(body)
+		zw.Close()
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestGzipResponses(t *testing.T) {
+	body := syntheticMatrix(3, 10)
+	for _, gzipped := range []bool{true, false} {
+		t.Run(map[bool]string{true: "gzipped", false: "plain"}[gzipped], func(t *testing.T) {
+			var acceptEncoding string
+			server := newMatrixServer(t, body, gzipped, &acceptEncoding)
+			client := newTestClient(t, server.URL, config.PrometheusConfig{})
+
+			end := time.Now()
+			result, err := client.FetchRange(context.Background(), "tidb_server_query_total", end.Add(-time.Hour), end, 15*time.Second, 0)
+			if err != nil {
+				t.Fatalf("FetchRange() error = %v", err)
+			}
+			if acceptEncoding != "gzip" {
+				t.Errorf("Accept-Encoding = %q, want gzip", acceptEncoding)
+			}
+			matrix := result.(model.Matrix)
+			if len(matrix) != 3 || len(matrix[0].Values) != 10 {
+				t.Fatalf("decoded %d series, want 3 of 10 samples", len(matrix))
+			}
+
+			stats := client.Stats()
+			if stats.BytesDecoded != int64(len(body)) {
+				t.Errorf("decoded %d bytes, want the response's %d", stats.BytesDecoded, len(body))
+			}
+			if gzipped && stats.BytesWire >= stats.BytesDecoded {
+				t.Errorf("received %d bytes, want fewer than the %d decoded", stats.BytesWire, stats.BytesDecoded)
+			}
+			if !gzipped && stats.BytesWire != stats.BytesDecoded {
+				t.Errorf("received %d bytes of a plain response, want the %d decoded", stats.BytesWire, stats.BytesDecoded)
+			}
+		})
+	}
+}
+
+func TestGzipLeavesNegotiatedEncoding(t *testing.T) {
+	var acceptEncoding string
+	server := newMatrixServer(t, []byte(emptyMatrix), false, &acceptEncoding)
+
+	rt := newGzipRoundTripper(&statsRecorder{}, http.DefaultTransport)
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	req.Header.Set("Accept-Encoding", "identity")
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip() error = %v", err)
+	}
+	resp.Body.Close()
+	if acceptEncoding != "identity" {
+		t.Errorf("Accept-Encoding = %q, want the request's own", acceptEncoding)
+	}
+}
+
+// TestGzipPayloadReduction measures the transfer saved on the synthetic
+// 200-series × 240-point matrix quoted in the README
+func TestGzipPayloadReduction(t *testing.T) {
+	body := syntheticMatrix(200, 240)
+	var acceptEncoding string
+	server := newMatrixServer(t, body, true, &acceptEncoding)
+	client := newTestClient(t, server.URL, config.PrometheusConfig{})
+
+	end := time.Now()
+	if _, err := client.FetchRange(context.Background(), "tidb_server_query_total", end.Add(-time.Hour), end, 15*time.Second, 0); err != nil {
+		t.Fatalf("FetchRange() error = %v", err)
+	}
+	stats := client.Stats()
+	ratio := float64(stats.BytesWire) / float64(stats.BytesDecoded)
+	t.Logf("received %d bytes for %d decoded (%.0f%%)", stats.BytesWire, stats.BytesDecoded, ratio*100)
+	if ratio > 0.4 {
+		t.Errorf("gzip kept %.0f%% of the response, want at most 40%%", ratio*100)
+	}
+}
@@ -0,0 +1,72 @@
+package prometheus
+
+import (
+	"sync"
+	"time"
+)
+
+// QueryStats holds query latency and retry counters for a Prometheus instance
+type QueryStats struct {
+	Queries      int           // Number of queries issued (including retries)
+	Retries      int           // Number of retried attempts
+	Failures     int           // Number of fetches that gave up after all retries
+	TotalLatency time.Duration // Sum of query latencies
+	MaxLatency   time.Duration // Slowest single query
+	BytesWire    int64         // Response bytes received, compressed if the server used gzip
+	BytesDecoded int64         // Response bytes after decompression
+}
+
+// AvgLatency returns the mean latency of a single query
+func (s QueryStats) AvgLatency() time.Duration {
+	if s.Queries == 0 {
+		return 0
+	}
+	return s.TotalLatency / time.Duration(s.Queries)
+}
+
+// statsRecorder accumulates QueryStats safely across goroutines
+type statsRecorder struct {
+	mu    sync.Mutex
+	stats QueryStats
+}
+
+// observe records the latency of a single query
+func (r *statsRecorder) observe(latency time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.stats.Queries++
+	r.stats.TotalLatency += latency
+	if latency > r.stats.MaxLatency {
+		r.stats.MaxLatency = latency
+	}
+}
+
+// retry records a retried attempt
+func (r *statsRecorder) retry() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats.Retries++
+}
+
+// failure records a fetch that exhausted its retries
+func (r *statsRecorder) failure() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats.Failures++
+}
+
+// transfer records the received and decoded size of a response body
+func (r *statsRecorder) transfer(wire, decoded int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats.BytesWire += wire
+	r.stats.BytesDecoded += decoded
+}
+
+// snapshot returns a copy of the current stats
+func (r *statsRecorder) snapshot() QueryStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stats
+}
@@ -0,0 +1,23 @@
+package prometheus
+
+import "net/http"
+
+// userAgentRoundTripper sets the User-Agent header on every request
+type userAgentRoundTripper struct {
+	userAgent string
+	rt        http.RoundTripper
+}
+
+func newUserAgentRoundTripper(userAgent string, rt http.RoundTripper) http.RoundTripper {
+	return &userAgentRoundTripper{
+		userAgent: userAgent,
+		rt:        rt,
+	}
+}
+
+func (u *userAgentRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Clone the request since a RoundTripper must not modify its input
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", u.userAgent)
+	return u.rt.RoundTrip(req)
+}
@@ -0,0 +1,42 @@
+package prometheus
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"github.com/meiking/tidb-metrics-crawler/pkg/version"
+)
+
+func TestUserAgent(t *testing.T) {
+	tests := []struct {
+		name      string
+		userAgent string
+		want      string
+	}{
+		{"default", "", "tidb-metrics-crawler/" + version.Version},
+		{"configured", "capacity-report/2.0", "capacity-report/2.0"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			agents := make(chan string, 10)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				agents <- r.Header.Get("User-Agent")
+				w.Write([]byte(emptyMatrix))
+			}))
+			defer server.Close()
+
+			client := newTestClient(t, server.URL, config.PrometheusConfig{UserAgent: tc.userAgent})
+			end := time.Now()
+			if _, err := client.FetchRange(context.Background(), "up", end.Add(-time.Hour), end, time.Minute, 0); err != nil {
+				t.Fatalf("FetchRange() error = %v", err)
+			}
+			if got := <-agents; got != tc.want {
+				t.Errorf("User-Agent = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
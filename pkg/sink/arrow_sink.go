@@ -0,0 +1,183 @@
+package sink
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+// defaultArrowBatchSize is the number of rows per record batch
+const defaultArrowBatchSize = 65536
+
+// ArrowSink writes processed data to one Arrow IPC file (Feather v2) per
+// metric, readable without parsing by pandas.read_feather or polars.read_ipc.
+// Label columns are the union of the labels in the metric's first write, like
+// the Parquet sink; each is a nullable string column.
+type ArrowSink struct {
+	outputDir string
+	batchSize int
+	mem       memory.Allocator
+	files     map[string]*arrowFile
+}
+
+// arrowFile is an open Arrow file and its pending record batch
+type arrowFile struct {
+	file      *os.File
+	writer    *ipc.FileWriter
+	builder   *array.RecordBuilder
+	labelKeys []string
+	rows      int // Rows in the pending batch
+}
+
+// NewArrowSink creates a new Arrow sink
+func NewArrowSink(cfg config.ArrowConfig) (*ArrowSink, error) {
+	batchSize := cfg.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultArrowBatchSize
+	}
+
+	// Create output directory if it doesn't exist
+	if err := os.MkdirAll(cfg.OutputDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create output directory: %v", err)
+	}
+
+	return &ArrowSink{
+		outputDir: cfg.OutputDir,
+		batchSize: batchSize,
+		mem:       memory.NewGoAllocator(),
+		files:     make(map[string]*arrowFile),
+	}, nil
+}
+
+// Write appends rows to the metric's pending batch, writing it whenever it is full
+func (s *ArrowSink) Write(metricName string, data []common.ProcessedData) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	af, exists := s.files[metricName]
+	if !exists {
+		var err error
+		if af, err = s.createFile(metricName, unionLabelKeys(data)); err != nil {
+			return err
+		}
+		s.files[metricName] = af
+	}
+
+	warnUnknownLabels(metricName, af.labelKeys, data)
+	for _, item := range data {
+		af.builder.Field(0).(*array.StringBuilder).Append(item.PrometheusInstance)
+		af.builder.Field(1).(*array.StringBuilder).Append(item.MetricName)
+		af.builder.Field(2).(*array.TimestampBuilder).Append(arrow.Timestamp(item.Timestamp.UnixMicro()))
+		af.builder.Field(3).(*array.Float64Builder).Append(item.Value)
+		af.builder.Field(4).(*array.StringBuilder).Append(item.Job)
+		af.builder.Field(5).(*array.StringBuilder).Append(item.RunID)
+		for i, key := range af.labelKeys {
+			column := af.builder.Field(arrowBaseColumns + i).(*array.StringBuilder)
+			if value, ok := item.Labels[key]; ok {
+				column.Append(value)
+			} else {
+				column.AppendNull()
+			}
+		}
+		af.rows++
+
+		if af.rows >= s.batchSize {
+			if err := af.flush(); err != nil {
+				return fmt.Errorf("failed to write record batch: %v", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Close writes the remaining rows and footers and closes all files
+func (s *ArrowSink) Close() error {
+	var lastErr error
+
+	for name, af := range s.files {
+		err := af.flush()
+		if closeErr := af.writer.Close(); err == nil {
+			err = closeErr
+		}
+		af.builder.Release()
+		if closeErr := af.file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			lastErr = fmt.Errorf("error closing file %s: %v", name, err)
+		}
+		delete(s.files, name)
+	}
+
+	return lastErr
+}
+
+// arrowBaseColumns is the number of columns before the label columns
+const arrowBaseColumns = 6
+
+// arrowSchema returns the schema of a metric's file: the same columns as the
+// Parquet sink, with timestamps in UTC microseconds
+func arrowSchema(labelKeys []string) *arrow.Schema {
+	fields := []arrow.Field{
+		{Name: "prometheus_instance", Type: arrow.BinaryTypes.String},
+		{Name: "metric_name", Type: arrow.BinaryTypes.String},
+		{Name: "timestamp", Type: arrow.FixedWidthTypes.Timestamp_us},
+		{Name: "value", Type: arrow.PrimitiveTypes.Float64},
+		{Name: "job", Type: arrow.BinaryTypes.String},
+		{Name: "run_id", Type: arrow.BinaryTypes.String},
+	}
+	for _, key := range labelKeys {
+		fields = append(fields, arrow.Field{Name: "label_" + key, Type: arrow.BinaryTypes.String, Nullable: true})
+	}
+	return arrow.NewSchema(fields, nil)
+}
+
+// createFile opens a new Arrow file for a metric
+func (s *ArrowSink) createFile(metricName string, labelKeys []string) (*arrowFile, error) {
+	timestamp := time.Now().Format("20060102150405")
+	path := filepath.Join(s.outputDir, fmt.Sprintf("%s_%s.arrow", metricName, timestamp))
+
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Arrow file: %v", err)
+	}
+
+	schema := arrowSchema(labelKeys)
+	writer, err := ipc.NewFileWriter(file, ipc.WithSchema(schema), ipc.WithAllocator(s.mem))
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to create Arrow writer: %v", err)
+	}
+
+	return &arrowFile{
+		file:      file,
+		writer:    writer,
+		builder:   array.NewRecordBuilder(s.mem, schema),
+		labelKeys: labelKeys,
+	}, nil
+}
+
+// flush writes the pending rows as a record batch
+func (af *arrowFile) flush() error {
+	if af.rows == 0 {
+		return nil
+	}
+
+	record := af.builder.NewRecord()
+	defer record.Release()
+	if err := af.writer.Write(record); err != nil {
+		return err
+	}
+	af.rows = 0
+	return nil
+}
@@ -0,0 +1,104 @@
+package sink
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+func TestArrowSinkReadBack(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewArrowSink(config.ArrowConfig{OutputDir: dir, BatchSize: 2})
+	if err != nil {
+		t.Fatalf("NewArrowSink() error = %v", err)
+	}
+
+	rows := valueRows(1.5, math.NaN(), 3, 4.25, 5)
+	for i := range rows {
+		rows[i].Job, rows[i].RunID = "nightly", "run-1"
+		rows[i].Labels = map[string]string{"job": "tidb", "instance": "tidb-0"}
+	}
+	delete(rows[3].Labels, "instance") // Null in its label column
+	if err := s.Write("qps", rows[:3]); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := s.Write("qps", rows[3:]); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	paths, _ := filepath.Glob(filepath.Join(dir, "qps_*.arrow"))
+	if len(paths) != 1 {
+		t.Fatalf("got files %v, want one qps file", paths)
+	}
+	f, err := os.Open(paths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := ipc.NewFileReader(f, ipc.WithAllocator(memory.NewGoAllocator()))
+	if err != nil {
+		t.Fatalf("NewFileReader() error = %v", err)
+	}
+	defer r.Close()
+
+	schema := r.Schema()
+	if n := r.NumRecords(); n != 3 {
+		t.Errorf("file has %d record batches, want 3 of at most 2 rows", n)
+	}
+	if ts, ok := schema.Field(2).Type.(*arrow.TimestampType); !ok || ts.Unit != arrow.Microsecond {
+		t.Errorf("timestamp column type = %v, want timestamp[us]", schema.Field(2).Type)
+	}
+
+	i := 0
+	for batch := 0; batch < r.NumRecords(); batch++ {
+		record, err := r.Record(batch)
+		if err != nil {
+			t.Fatalf("Record(%d) error = %v", batch, err)
+		}
+		columns := make(map[string]arrow.Array)
+		for c, field := range schema.Fields() {
+			columns[field.Name] = record.Column(c)
+		}
+		for j := 0; j < int(record.NumRows()); j, i = j+1, i+1 {
+			want := rows[i]
+			if got := columns["metric_name"].(*array.String).Value(j); got != want.MetricName {
+				t.Errorf("row %d metric_name = %q, want %q", i, got, want.MetricName)
+			}
+			if got := columns["run_id"].(*array.String).Value(j); got != want.RunID {
+				t.Errorf("row %d run_id = %q, want %q", i, got, want.RunID)
+			}
+			ts := columns["timestamp"].(*array.Timestamp).Value(j)
+			if got := time.UnixMicro(int64(ts)); !got.Equal(want.Timestamp) {
+				t.Errorf("row %d timestamp = %v, want %v", i, got, want.Timestamp)
+			}
+			got := columns["value"].(*array.Float64).Value(j)
+			if got != want.Value && !(math.IsNaN(got) && math.IsNaN(want.Value)) {
+				t.Errorf("row %d value = %v, want %v", i, got, want.Value)
+			}
+			for _, name := range []string{"job", "instance"} {
+				column := columns["label_"+name].(*array.String)
+				wantValue, ok := want.Labels[name]
+				switch {
+				case !ok && !column.IsNull(j):
+					t.Errorf("row %d label %s = %q, want null", i, name, column.Value(j))
+				case ok && (column.IsNull(j) || column.Value(j) != wantValue):
+					t.Errorf("row %d label %s = %q (null %v), want %q", i, name, column.Value(j), column.IsNull(j), wantValue)
+				}
+			}
+		}
+	}
+	if i != len(rows) {
+		t.Errorf("read %d rows, want %d", i, len(rows))
+	}
+}
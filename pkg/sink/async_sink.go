@@ -0,0 +1,147 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+)
+
+// defaultAsyncBuffer is the number of writes queued when async_buffer is unset
+const defaultAsyncBuffer = 16
+
+// AsyncSink queues writes and performs them in a background goroutine, so
+// fetching the next batch overlaps with writing the previous one. A single
+// writer keeps writes ordered, as sinks are not safe for concurrent use.
+type AsyncSink struct {
+	ctx     context.Context
+	sink    Sink
+	queue   chan asyncWrite
+	done    chan struct{} // Closed when the writer has drained the queue
+	closeMu sync.Mutex    // Guards closed against concurrent Write and Close
+	closed  bool
+	sinkMu  sync.Mutex // Serializes calls into the wrapped sink
+	mu      sync.Mutex // Guards err and failed
+	err     error      // First write error
+	failed  int        // Number of failed writes
+}
+
+// asyncWrite is one queued Write call
+type asyncWrite struct {
+	metricName string
+	data       []common.ProcessedData
+}
+
+// NewAsyncSink wraps s with a queue of buffer writes. Write blocks while
+// the queue is full and gives up when ctx is done.
+func NewAsyncSink(ctx context.Context, s Sink, buffer int) *AsyncSink {
+	if buffer <= 0 {
+		buffer = defaultAsyncBuffer
+	}
+
+	a := &AsyncSink{
+		ctx:   ctx,
+		sink:  s,
+		queue: make(chan asyncWrite, buffer),
+		done:  make(chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+// Write queues data for the background writer. Write errors are logged as
+// they happen and the first one is returned by Close.
+func (a *AsyncSink) Write(metricName string, data []common.ProcessedData) error {
+	a.closeMu.Lock()
+	defer a.closeMu.Unlock()
+	if a.closed {
+		return errors.New("write to closed async sink")
+	}
+
+	select {
+	case a.queue <- asyncWrite{metricName: metricName, data: data}:
+		return nil
+	case <-a.ctx.Done():
+		return fmt.Errorf("async write cancelled: %v", a.ctx.Err())
+	}
+}
+
+// Close waits for queued writes to finish, closes the wrapped sink, and
+// returns the first write error together with any close error. Later calls
+// do nothing.
+func (a *AsyncSink) Close() error {
+	a.closeMu.Lock()
+	if a.closed {
+		a.closeMu.Unlock()
+		return nil
+	}
+	a.closed = true
+	close(a.queue)
+	a.closeMu.Unlock()
+
+	<-a.done
+
+	var errs []error
+	a.mu.Lock()
+	if a.err != nil {
+		errs = append(errs, fmt.Errorf("%d async write(s) failed, first error: %v", a.failed, a.err))
+	}
+	a.mu.Unlock()
+	if err := a.sink.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// Ping checks the wrapped sink
+func (a *AsyncSink) Ping(ctx context.Context) error {
+	return Ping(ctx, a.sink)
+}
+
+// RecordRun forwards the run report to the wrapped sink. Only the report is
+// stored, so this does not race with queued writes.
+func (a *AsyncSink) RecordRun(report RunReport) {
+	RecordRun(a.sink, report)
+}
+
+// canWatermark reports whether the wrapped sink is a Watermarker
+func (a *AsyncSink) canWatermark() bool {
+	_, ok := AsWatermarker(a.sink)
+	return ok
+}
+
+// LastTimestamp forwards to the wrapped sink when it is a Watermarker,
+// waiting for a write in progress to finish
+func (a *AsyncSink) LastTimestamp(instance, metricName string) (time.Time, bool, error) {
+	w, ok := AsWatermarker(a.sink)
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	a.sinkMu.Lock()
+	defer a.sinkMu.Unlock()
+	return w.LastTimestamp(instance, metricName)
+}
+
+// run writes queued data until the queue is closed and drained
+func (a *AsyncSink) run() {
+	defer close(a.done)
+
+	for w := range a.queue {
+		a.sinkMu.Lock()
+		err := a.sink.Write(w.metricName, w.data)
+		a.sinkMu.Unlock()
+		if err != nil {
+			log.Printf("Async write of %d records of metric %s failed: %v", len(w.data), w.metricName, err)
+			a.mu.Lock()
+			if a.err == nil {
+				a.err = err
+			}
+			a.failed++
+			a.mu.Unlock()
+		}
+	}
+}
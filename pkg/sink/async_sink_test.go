@@ -0,0 +1,194 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+)
+
+func TestAsyncSinkCloseDrainsQueue(t *testing.T) {
+	inner := newFakeSink()
+	inner.write = func(call int, metricName string, data []common.ProcessedData) error {
+		time.Sleep(time.Millisecond) // Slower than the writes are queued
+		return nil
+	}
+	s := NewAsyncSink(context.Background(), inner, 4)
+
+	for i := 0; i < 10; i++ {
+		if err := s.Write("qps", testRows(3)); err != nil {
+			t.Fatalf("Write() %d error = %v", i, err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if got := len(inner.metricRows("qps")); got != 30 {
+		t.Errorf("wrapped sink got %d rows, want all 30 queued before Close", got)
+	}
+	if inner.closed != 1 {
+		t.Errorf("wrapped sink closed %d times, want 1", inner.closed)
+	}
+
+	if err := s.Close(); err != nil || inner.closed != 1 {
+		t.Errorf("second Close() = %v and closed the wrapped sink %d times, want nil and 1", err, inner.closed)
+	}
+	if err := s.Write("qps", testRows(1)); err == nil {
+		t.Error("Write() after Close succeeded")
+	}
+}
+
+func TestAsyncSinkCloseReturnsFirstWriteError(t *testing.T) {
+	inner := newFakeSink()
+	inner.write = func(call int, metricName string, data []common.ProcessedData) error {
+		switch call {
+		case 2:
+			return errors.New("disk full")
+		case 3:
+			return errors.New("still full")
+		}
+		return nil
+	}
+	s := NewAsyncSink(context.Background(), inner, 0)
+
+	for i := 0; i < 4; i++ {
+		// Errors come later, from Close
+		if err := s.Write("qps", testRows(1)); err != nil {
+			t.Fatalf("Write() %d error = %v", i, err)
+		}
+	}
+	err := s.Close()
+	if err == nil {
+		t.Fatal("Close() succeeded after failed writes")
+	}
+	if msg := err.Error(); !strings.Contains(msg, "2 async write(s) failed") || !strings.Contains(msg, "disk full") {
+		t.Errorf("Close() error = %q, want the count of failures and the first error", msg)
+	}
+	if got := len(inner.metricRows("qps")); got != 2 {
+		t.Errorf("wrapped sink got %d rows, want those of the 2 writes that succeeded", got)
+	}
+}
+
+func TestAsyncSinkBackpressure(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	inner := newFakeSink()
+	inner.write = func(call int, metricName string, data []common.ProcessedData) error {
+		if call == 1 {
+			started <- struct{}{}
+			<-release
+		}
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := NewAsyncSink(ctx, inner, 2)
+
+	// The writer holds the first write while two more fill the queue
+	s.Write("qps", testRows(1))
+	<-started
+	s.Write("qps", testRows(1))
+	s.Write("qps", testRows(1))
+
+	blocked := make(chan error, 1)
+	go func() {
+		blocked <- s.Write("qps", testRows(1))
+	}()
+	select {
+	case err := <-blocked:
+		t.Fatalf("Write() to a full queue returned %v, want it to block", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case err := <-blocked:
+		if err != nil {
+			t.Fatalf("blocked Write() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Write() still blocked after the queue drained")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if got := len(inner.metricRows("qps")); got != 4 {
+		t.Errorf("wrapped sink got %d rows, want 4", got)
+	}
+}
+
+func TestAsyncSinkBackpressureCancelled(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	inner := newFakeSink()
+	inner.write = func(call int, metricName string, data []common.ProcessedData) error {
+		if call == 1 {
+			started <- struct{}{}
+			<-release
+		}
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := NewAsyncSink(ctx, inner, 1)
+
+	s.Write("qps", testRows(1))
+	<-started
+	s.Write("qps", testRows(1))
+
+	blocked := make(chan error, 1)
+	go func() {
+		blocked <- s.Write("qps", testRows(1))
+	}()
+	cancel() // Interrupted while waiting for room in the queue
+	select {
+	case err := <-blocked:
+		if err == nil || !strings.Contains(err.Error(), "cancelled") {
+			t.Errorf("Write() error = %v, want it cancelled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Write() still blocked after the cancel")
+	}
+
+	close(release)
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if got := len(inner.metricRows("qps")); got != 2 {
+		t.Errorf("wrapped sink got %d rows, want the 2 queued before the cancel", got)
+	}
+}
+
+func TestAsyncSinkLastTimestampWaitsForWrite(t *testing.T) {
+	inner := &watermarkSink{fakeSink: newFakeSink(), last: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	inner.write = func(call int, metricName string, data []common.ProcessedData) error {
+		time.Sleep(time.Millisecond)
+		return nil
+	}
+	s := NewAsyncSink(context.Background(), inner, 0)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			s.Write("qps", testRows(1))
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		if last, ok, err := s.LastTimestamp("prom", "qps"); err != nil || !ok || !last.Equal(inner.last) {
+			t.Fatalf("LastTimestamp() = %v, %v, %v, want the wrapped sink's", last, ok, err)
+		}
+	}
+	wg.Wait()
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	if n := inner.overlaps.Load(); n > 0 {
+		t.Errorf("LastTimestamp overlapped a background write %d times", n)
+	}
+}
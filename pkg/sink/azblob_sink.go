@@ -0,0 +1,47 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+// azblobUploader uploads objects as block blobs
+type azblobUploader struct {
+	client    *azblob.Client
+	container string
+}
+
+// NewAzBlobSink creates a sink uploading CSV objects to an Azure Blob Storage container
+func NewAzBlobSink(ctx context.Context, cfg config.AzBlobConfig) (*ObjectSink, error) {
+	if cfg.AccountURL == "" || cfg.Container == "" {
+		return nil, fmt.Errorf("azblob account_url and container are required")
+	}
+
+	cred, err := azidentity.NewDefaultAzureCredential(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find Azure credentials: %v", err)
+	}
+
+	client, err := azblob.NewClient(cfg.AccountURL, cred, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Azure Blob client: %v", err)
+	}
+
+	return newObjectSink(ctx, &azblobUploader{client: client, container: cfg.Container}, cfg.ObjectStoreConfig)
+}
+
+// upload stores body as a block blob, replacing any existing blob
+func (u *azblobUploader) upload(ctx context.Context, key, contentType string, body []byte) error {
+	_, err := u.client.UploadBuffer(ctx, u.container, key, body, &azblob.UploadBufferOptions{
+		HTTPHeaders: &blob.HTTPHeaders{BlobContentType: &contentType},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload to %s/%s: %v", u.container, key, err)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package sink
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+// linesOnDisk returns how many complete lines of the metric's CSV file have
+// reached the disk
+func linesOnDisk(t *testing.T, dir, metric string) int {
+	t.Helper()
+	paths, _ := filepath.Glob(filepath.Join(dir, metric+"_*.csv"))
+	if len(paths) != 1 {
+		t.Fatalf("files of %s: %v, want one", metric, paths)
+	}
+	data, err := os.ReadFile(paths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Count(string(data), "\n")
+}
+
+func TestCSVSinkFlushRows(t *testing.T) {
+	tests := []struct {
+		flushRows int
+		want      []int // Lines on disk, header included, after each write of three rows
+	}{
+		{0, []int{4, 7, 10}},
+		{5, []int{0, 7, 7}}, // The threshold is checked after each write
+		{100, []int{0, 0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.flushRows), func(t *testing.T) {
+			dir := t.TempDir()
+			s, err := NewCSVSink(config.CSVConfig{OutputDir: dir, FlushRows: tt.flushRows})
+			if err != nil {
+				t.Fatalf("NewCSVSink() error = %v", err)
+			}
+			for i, want := range tt.want {
+				if err := s.Write("qps", valueRows(1, 2, 3)); err != nil {
+					t.Fatalf("Write() error = %v", err)
+				}
+				if got := linesOnDisk(t, dir, "qps"); got != want {
+					t.Errorf("after write %d: %d lines on disk, want %d", i+1, got, want)
+				}
+			}
+
+			// Close writes out whatever is still buffered
+			if err := s.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+			if got := linesOnDisk(t, dir, "qps"); got != 10 {
+				t.Errorf("after Close: %d lines on disk, want the header and 9 rows", got)
+			}
+		})
+	}
+}
+
+func TestCSVSinkFlushRowsPerMetric(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewCSVSink(config.CSVConfig{OutputDir: dir, FlushRows: 4})
+	if err != nil {
+		t.Fatalf("NewCSVSink() error = %v", err)
+	}
+	defer s.Close()
+
+	// Rows of another metric do not count towards qps' threshold
+	for _, metric := range []string{"qps", "tps", "tps"} {
+		if err := s.Write(metric, valueRows(1, 2)); err != nil {
+			t.Fatalf("Write(%s) error = %v", metric, err)
+		}
+	}
+	if qps, tps := linesOnDisk(t, dir, "qps"), linesOnDisk(t, dir, "tps"); qps != 0 || tps != 5 {
+		t.Errorf("lines on disk: qps %d, tps %d, want qps still buffered and tps flushed with 5", qps, tps)
+	}
+}
+
+func TestNewCSVSinkNegativeFlushRows(t *testing.T) {
+	if _, err := NewCSVSink(config.CSVConfig{OutputDir: t.TempDir(), FlushRows: -1}); err == nil {
+		t.Error("NewCSVSink() accepted flush_rows -1")
+	}
+}
+
+// writeSyscalls returns the write system calls the process has made, from
+// /proc/self/io, or false where that is not available
+func writeSyscalls() (int, bool) {
+	data, err := os.ReadFile("/proc/self/io")
+	if err != nil {
+		return 0, false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if value, ok := strings.CutPrefix(line, "syscw: "); ok {
+			n, err := strconv.Atoi(value)
+			return n, err == nil
+		}
+	}
+	return 0, false
+}
+
+// BenchmarkCSVSinkFlushRows writes small batches, as the chunked path does,
+// flushing after every batch or after thousands of rows, and reports the
+// write system calls per batch where the platform counts them
+func BenchmarkCSVSinkFlushRows(b *testing.B) {
+	batch := valueRows(1, 2, 3, 4, 5, 6, 7, 8, 9, 10)
+	for _, flushRows := range []int{0, 10000} {
+		b.Run(fmt.Sprintf("flush_rows=%d", flushRows), func(b *testing.B) {
+			s, err := NewCSVSink(config.CSVConfig{OutputDir: b.TempDir(), FlushRows: flushRows})
+			if err != nil {
+				b.Fatal(err)
+			}
+			before, counted := writeSyscalls()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := s.Write("qps", batch); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			if after, ok := writeSyscalls(); counted && ok {
+				b.ReportMetric(float64(after-before)/float64(b.N), "writes/op")
+			}
+			if err := s.Close(); err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
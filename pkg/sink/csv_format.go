@@ -0,0 +1,65 @@
+package sink
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// defaultFloatFormat is used when no float_format is configured
+const defaultFloatFormat = "%g"
+
+// utf8BOM is written at the start of CSV files when bom is enabled
+const utf8BOM = "\xEF\xBB\xBF"
+
+// valueFormatter formats a metric value for CSV output
+type valueFormatter func(float64) string
+
+// newValueFormatter builds a valueFormatter from a float_format setting:
+// either a fmt verb such as "%g" or "%.3f", or "full" for the shortest
+// representation that round-trips exactly without an exponent. NaN and ±Inf
+// follow the non_finite policy: an empty cell for "empty", or NaN, +Inf and
+// -Inf for "string" whatever the format; otherwise the format decides.
+func newValueFormatter(format, nonFinite string) (valueFormatter, error) {
+	formatValue, err := newFloatFormatter(format)
+	if err != nil || (nonFinite != nonFiniteEmpty && nonFinite != nonFiniteString) {
+		return formatValue, err
+	}
+
+	return func(v float64) string {
+		if isFinite(v) {
+			return formatValue(v)
+		}
+		if nonFinite == nonFiniteEmpty {
+			return ""
+		}
+		if math.IsNaN(v) {
+			return "NaN"
+		}
+		if v > 0 {
+			return "+Inf"
+		}
+		return "-Inf"
+	}, nil
+}
+
+// newFloatFormatter builds a valueFormatter from a float_format setting
+func newFloatFormatter(format string) (valueFormatter, error) {
+	switch {
+	case format == "":
+		format = defaultFloatFormat
+	case format == "full":
+		return func(v float64) string {
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		}, nil
+	}
+
+	if !strings.HasPrefix(format, "%") || strings.Contains(fmt.Sprintf(format, 1.0), "%!") {
+		return nil, fmt.Errorf("invalid float_format %q", format)
+	}
+
+	return func(v float64) string {
+		return fmt.Sprintf(format, v)
+	}, nil
+}
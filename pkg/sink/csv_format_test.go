@@ -0,0 +1,198 @@
+package sink
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+// floatFormatCases are the renderings of a large counter and a small rate
+// under each float_format
+var floatFormatCases = []struct {
+	format      string
+	large, rate string
+}{
+	{"", "1.2345678905e+09", "0.000123"},
+	{"%g", "1.2345678905e+09", "0.000123"},
+	{"%.3f", "1234567890.500", "0.000"},
+	{"full", "1234567890.5", "0.000123"},
+}
+
+func TestValueFormatter(t *testing.T) {
+	for _, tc := range floatFormatCases {
+		t.Run(tc.format, func(t *testing.T) {
+			formatValue, err := newValueFormatter(tc.format, "")
+			if err != nil {
+				t.Fatalf("newValueFormatter(%q) error = %v", tc.format, err)
+			}
+			if got := formatValue(1234567890.5); got != tc.large {
+				t.Errorf("1234567890.5 = %q, want %q", got, tc.large)
+			}
+			if got := formatValue(0.000123); got != tc.rate {
+				t.Errorf("0.000123 = %q, want %q", got, tc.rate)
+			}
+		})
+	}
+}
+
+func TestValueFormatterInvalid(t *testing.T) {
+	for _, format := range []string{"g", "%d", "%s %s", "%"} {
+		if _, err := newValueFormatter(format, ""); err == nil {
+			t.Errorf("newValueFormatter(%q) accepted an invalid format", format)
+		}
+	}
+}
+
+func TestValueFormatterNonFinite(t *testing.T) {
+	tests := []struct {
+		nonFinite string
+		want      []string // NaN, +Inf, -Inf
+	}{
+		{nonFiniteEmpty, []string{"", "", ""}},
+		{nonFiniteString, []string{"NaN", "+Inf", "-Inf"}},
+	}
+	for _, tc := range tests {
+		formatValue, err := newValueFormatter("%.3f", tc.nonFinite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, v := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+			if got := formatValue(v); got != tc.want[i] {
+				t.Errorf("non_finite %s: %v = %q, want %q", tc.nonFinite, v, got, tc.want[i])
+			}
+		}
+		if got := formatValue(0.5); got != "0.500" {
+			t.Errorf("non_finite %s changed a finite value: %q", tc.nonFinite, got)
+		}
+	}
+}
+
+func TestCSVSinkFloatFormat(t *testing.T) {
+	for _, tc := range floatFormatCases {
+		t.Run(tc.format, func(t *testing.T) {
+			s, err := NewCSVSink(config.CSVConfig{OutputDir: t.TempDir(), FloatFormat: tc.format})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Write("qps", valueRows(1234567890.5, 0.000123)); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			records := readCSV(t, csvFiles(t, s.outputDir)[0])
+			if got := column(records, "value"); got[0] != tc.large || got[1] != tc.rate {
+				t.Errorf("values = %q, want [%s %s]", got, tc.large, tc.rate)
+			}
+		})
+	}
+}
+
+func TestFeishuCSVFloatFormat(t *testing.T) {
+	for _, tc := range floatFormatCases {
+		t.Run(tc.format, func(t *testing.T) {
+			formatValue, err := newValueFormatter(tc.format, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, err := createCSVContent(valueRows(1234567890.5, 0.000123), formatValue, false, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			records, err := csv.NewReader(strings.NewReader(string(content))).ReadAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := column(records, "value"); got[0] != tc.large || got[1] != tc.rate {
+				t.Errorf("values = %q, want [%s %s]", got, tc.large, tc.rate)
+			}
+		})
+	}
+}
+
+// valueRows returns one qps row per value, a minute apart
+func valueRows(values ...float64) []common.ProcessedData {
+	rows := make([]common.ProcessedData, len(values))
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, v := range values {
+		rows[i] = common.ProcessedData{
+			PrometheusInstance: "prom",
+			MetricName:         "qps",
+			Timestamp:          start.Add(time.Duration(i) * time.Minute),
+			Value:              v,
+			Labels:             map[string]string{"job": "tidb"},
+		}
+	}
+	return rows
+}
+
+// csvFiles returns the CSV files under dir, sorted by path
+func csvFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && (strings.HasSuffix(path, ".csv") || strings.HasSuffix(path, ".csv.gz")) {
+			files = append(files, path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatalf("no CSV files in %s", dir)
+	}
+	return files
+}
+
+// readCSV reads every record of a CSV file, decompressing *.gz and skipping
+// a BOM and metadata lines
+func readCSV(t *testing.T, path string) [][]string {
+	t.Helper()
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(bytes.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if content, err = io.ReadAll(gz); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reader := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(content, []byte(utf8BOM))))
+	reader.Comment = '#'
+	records, err := reader.ReadAll()
+	if err != nil {
+		t.Fatalf("failed to parse %s: %v", path, err)
+	}
+	return records
+}
+
+// column returns the values of the named column, given a header record first
+func column(records [][]string, name string) []string {
+	var values []string
+	for i, field := range records[0] {
+		if field != name {
+			continue
+		}
+		for _, record := range records[1:] {
+			values = append(values, record[i])
+		}
+	}
+	return values
+}
@@ -0,0 +1,160 @@
+package sink
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+// runStampLayout is the run time in the names of the crawler's files
+const runStampLayout = "20060102150405"
+
+// runFilePattern matches the names the crawler gives its files: a metric
+// file or single file <name>_<stamp>.csv, optionally gzipped, and a manifest
+// manifest_<stamp>.json
+var runFilePattern = regexp.MustCompile(`^(?:.+_(\d{14})\.csv(?:\.gz)?|manifest_(\d{14})\.json)$`)
+
+// csvRetention prunes the files of earlier runs from an output directory
+type csvRetention struct {
+	maxAge   time.Duration
+	maxRuns  int
+	maxBytes int64
+	dryRun   bool
+}
+
+// newCSVRetention validates retention settings and returns nil when none are set
+func newCSVRetention(cfg *config.CSVRetentionConfig) (*csvRetention, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	r := &csvRetention{maxRuns: cfg.MaxRuns, maxBytes: cfg.MaxBytes, dryRun: cfg.DryRun}
+	if cfg.MaxAge != "" {
+		var err error
+		if r.maxAge, err = common.ParseDuration(cfg.MaxAge); err != nil {
+			return nil, fmt.Errorf("invalid csv retention max_age: %v", err)
+		}
+		if r.maxAge <= 0 {
+			return nil, fmt.Errorf("csv retention max_age must be positive")
+		}
+	}
+	if r.maxRuns < 0 || r.maxBytes < 0 {
+		return nil, fmt.Errorf("csv retention max_runs and max_bytes must not be negative")
+	}
+	if r.maxAge == 0 && r.maxRuns == 0 && r.maxBytes == 0 {
+		return nil, fmt.Errorf("csv retention needs max_age, max_runs or max_bytes")
+	}
+	return r, nil
+}
+
+// runFiles are the files one run left in the output directory
+type runFiles struct {
+	stamp string    // Run time as written in the file names
+	time  time.Time // Parsed stamp
+	paths []string
+	bytes int64
+}
+
+// collectRuns groups the crawler's files under dir by run, oldest first.
+// Stamps are in the local zone, as the sink writes them.
+func collectRuns(dir string) ([]*runFiles, error) {
+	runs := make(map[string]*runFiles)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		m := runFilePattern.FindStringSubmatch(d.Name())
+		if m == nil {
+			return nil
+		}
+		stamp := m[1] + m[2] // Only one group matches
+		t, err := time.ParseInLocation(runStampLayout, stamp, time.Local)
+		if err != nil {
+			return nil // Digits that are not a time, so not ours
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		run, ok := runs[stamp]
+		if !ok {
+			run = &runFiles{stamp: stamp, time: t}
+			runs[stamp] = run
+		}
+		run.paths = append(run.paths, path)
+		run.bytes += info.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sorted := make([]*runFiles, 0, len(runs))
+	for _, run := range runs {
+		sorted = append(sorted, run)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].stamp < sorted[j].stamp })
+	return sorted, nil
+}
+
+// expired returns the runs to delete from runs, sorted oldest first: those
+// older than max_age, those beyond the newest max_runs, and the oldest ones
+// while all runs exceed max_bytes. The current run is always kept.
+func (r *csvRetention) expired(runs []*runFiles, current string, now time.Time) []*runFiles {
+	var total int64
+	for _, run := range runs {
+		total += run.bytes
+	}
+
+	var expired []*runFiles
+	for i, run := range runs {
+		if run.stamp == current {
+			continue
+		}
+		newer := len(runs) - i - 1
+		switch {
+		case r.maxAge > 0 && now.Sub(run.time) > r.maxAge:
+		case r.maxRuns > 0 && newer >= r.maxRuns:
+		case r.maxBytes > 0 && total > r.maxBytes:
+		default:
+			continue
+		}
+		expired = append(expired, run)
+		total -= run.bytes
+	}
+	return expired
+}
+
+// prune deletes the expired runs under dir, or only logs them with dry_run
+func (r *csvRetention) prune(dir string, current time.Time) error {
+	runs, err := collectRuns(dir)
+	if err != nil {
+		return fmt.Errorf("failed to list output files: %v", err)
+	}
+
+	for _, run := range r.expired(runs, current.Format(runStampLayout), time.Now()) {
+		for _, path := range run.paths {
+			if r.dryRun {
+				log.Printf("Retention would delete %s", path)
+				continue
+			}
+			if err := os.Remove(path); err != nil {
+				return fmt.Errorf("failed to delete %s: %v", path, err)
+			}
+			log.Printf("Retention deleted %s", path)
+		}
+	}
+	return nil
+}
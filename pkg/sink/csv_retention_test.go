@@ -0,0 +1,143 @@
+package sink
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+// testRuns returns runs a day apart ending at now, oldest first, each of size bytes
+func testRuns(now time.Time, days int, size int64) []*runFiles {
+	runs := make([]*runFiles, days)
+	for i := range runs {
+		t := now.AddDate(0, 0, i-days+1)
+		runs[i] = &runFiles{stamp: t.Format(runStampLayout), time: t, bytes: size}
+	}
+	return runs
+}
+
+func TestCSVRetentionExpired(t *testing.T) {
+	now := time.Date(2024, 1, 10, 3, 0, 0, 0, time.Local)
+	runs := testRuns(now, 5, 100) // Jan 6 to Jan 10
+	current := runs[4].stamp
+
+	tests := []struct {
+		name      string
+		retention csvRetention
+		current   string
+		want      []string // Days of the month of the expired runs
+	}{
+		{"age", csvRetention{maxAge: 48 * time.Hour}, current, []string{"06", "07"}},
+		{"age exactly at the limit is kept", csvRetention{maxAge: 72 * time.Hour}, current, []string{"06"}},
+		{"count", csvRetention{maxRuns: 2}, current, []string{"06", "07", "08"}},
+		{"bytes", csvRetention{maxBytes: 250}, current, []string{"06", "07", "08"}},
+		{"age or count", csvRetention{maxAge: 48 * time.Hour, maxRuns: 4}, current, []string{"06", "07"}},
+		{"within every limit", csvRetention{maxAge: 30 * 24 * time.Hour, maxRuns: 5}, current, nil},
+		// An old current run, e.g. with a clock gone backwards, is never deleted
+		{"current run kept", csvRetention{maxRuns: 1}, runs[0].stamp, []string{"07", "08", "09"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, run := range tt.retention.expired(runs, tt.current, now) {
+			got = append(got, run.time.Format("02"))
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: expired runs of days %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCSVRetentionPrune(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	stamp := func(days int) string { return now.AddDate(0, 0, -days).Format(runStampLayout) }
+
+	// Three runs of the crawler, with metric files in a subdirectory, and
+	// files of others that must survive
+	crawler := map[string]int{ // Path to the run's age in days
+		"qps_" + stamp(0) + ".csv":               0,
+		"manifest_" + stamp(0) + ".json":         0,
+		"tidb/tps_" + stamp(1) + ".csv.gz":       1,
+		"manifest_" + stamp(1) + ".json":         1,
+		"metrics_" + stamp(10) + ".csv":          10,
+		"manifest_" + stamp(10) + ".json":        10,
+		"tidb/latency_p99_" + stamp(10) + ".csv": 10,
+	}
+	others := []string{
+		"notes.csv",
+		"qps_latest.csv",
+		"export_20200101.csv",              // Not a full stamp
+		"qps_20200101000000.txt",           // Not a CSV
+		"manifest_20200101000000.json.bak", // Not a manifest
+		"qps_" + stamp(10) + ".csv.orig",   // Renamed by someone
+		"tidb/readme_" + stamp(10) + ".md", // Not a CSV
+		"archive/qps_20209999999999.csv",   // Digits that are not a time
+	}
+	setup := func(t *testing.T) string {
+		dir := t.TempDir()
+		paths := slices.Collect(maps.Keys(crawler))
+		for _, path := range append(paths, others...) {
+			if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(path)), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			writeTestFile(t, dir, filepath.FromSlash(path), []byte("x"))
+		}
+		return dir
+	}
+	exists := func(dir, path string) bool {
+		_, err := os.Stat(filepath.Join(dir, filepath.FromSlash(path)))
+		return err == nil
+	}
+
+	tests := []struct {
+		name      string
+		cfg       config.CSVRetentionConfig
+		deleteAge int // Runs at least this many days old are deleted; 0 for none
+	}{
+		{"max_age", config.CSVRetentionConfig{MaxAge: "7d"}, 10},
+		{"max_runs", config.CSVRetentionConfig{MaxRuns: 1}, 1},
+		{"dry_run", config.CSVRetentionConfig{MaxRuns: 1, DryRun: true}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := setup(t)
+			retention, err := newCSVRetention(&tt.cfg)
+			if err != nil {
+				t.Fatalf("newCSVRetention() error = %v", err)
+			}
+			if err := retention.prune(dir, now); err != nil {
+				t.Fatalf("prune() error = %v", err)
+			}
+
+			for path, age := range crawler {
+				deleted := tt.deleteAge > 0 && age >= tt.deleteAge
+				if exists(dir, path) == deleted {
+					t.Errorf("%s of a run %d day(s) old: exists %v, want deleted %v", path, age, !deleted, deleted)
+				}
+			}
+			for _, path := range others {
+				if !exists(dir, path) {
+					t.Errorf("%s was deleted, but the crawler did not write it", path)
+				}
+			}
+		})
+	}
+}
+
+func TestNewCSVRetentionInvalid(t *testing.T) {
+	for _, cfg := range []config.CSVRetentionConfig{
+		{},
+		{MaxAge: "soon"},
+		{MaxAge: "0s"},
+		{MaxRuns: -1},
+		{MaxBytes: -1},
+	} {
+		if _, err := newCSVRetention(&cfg); err == nil {
+			t.Errorf("newCSVRetention(%+v) accepted invalid settings", cfg)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package sink
+
+import (
+	"encoding/csv"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+)
+
+// csvSingleFile collects every metric of a run into one CSV file. Its header
+// needs the label keys of all metrics, which are known only once the last
+// metric is written, so rows are spooled to a temporary file and the CSV is
+// written when the sink is closed.
+type csvSingleFile struct {
+	path      string
+	spool     *os.File // Nil until the first row
+	encoder   *gob.Encoder
+	labelKeys map[string]string // Union of label keys, values unused
+	optional  csvOptionalColumns
+	rows      int
+}
+
+// newCSVSingleFile prepares the run's file, named metrics_<timestamp>.csv
+func (s *CSVSink) newCSVSingleFile() *csvSingleFile {
+	return &csvSingleFile{
+		path:      filepath.Join(s.outputDir, fmt.Sprintf("metrics_%s.csv", s.runTime.Format("20060102150405"))),
+		labelKeys: make(map[string]string),
+	}
+}
+
+// writeSingle spools data and widens the header to cover it
+func (s *CSVSink) writeSingle(metricName string, data []common.ProcessedData) error {
+	f := s.single
+	if f.spool == nil {
+		// Next to the output so the spool shares its file system
+		spool, err := os.CreateTemp(s.outputDir, ".metrics-*.spool")
+		if err != nil {
+			return fmt.Errorf("failed to create spool file: %v", err)
+		}
+		f.spool = spool
+		f.encoder = gob.NewEncoder(spool)
+	}
+
+	for _, item := range data {
+		if err := f.encoder.Encode(&item); err != nil {
+			return fmt.Errorf("failed to spool CSV row: %v", err)
+		}
+		for k := range item.Labels {
+			f.labelKeys[k] = ""
+		}
+	}
+	optional := optionalColumns(data)
+	f.optional.checksum = f.optional.checksum || optional.checksum
+	f.optional.seriesName = f.optional.seriesName || optional.seriesName
+	f.rows += len(data)
+
+	if _, ok := s.manifest[metricName]; !ok {
+		rel, err := filepath.Rel(s.outputDir, f.path)
+		if err != nil {
+			return err
+		}
+		s.manifest[metricName] = newManifestFile(metricName, filepath.ToSlash(rel))
+	}
+	s.manifest[metricName].add(data)
+	return nil
+}
+
+// closeSingle writes the spooled rows under the union header and removes the
+// spool. Nothing is written when no rows arrived.
+func (s *CSVSink) closeSingle() error {
+	f := s.single
+	if f.spool == nil {
+		return nil
+	}
+	defer func() {
+		f.spool.Close()
+		os.Remove(f.spool.Name())
+		f.spool = nil
+	}()
+
+	if _, err := f.spool.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to rewind spool file: %v", err)
+	}
+
+	file, err := os.Create(f.path)
+	if err != nil {
+		return fmt.Errorf("failed to create CSV file: %v", err)
+	}
+	defer file.Close()
+
+	if s.bom {
+		if _, err := file.WriteString(utf8BOM); err != nil {
+			return fmt.Errorf("failed to write BOM: %v", err)
+		}
+	}
+
+	labelKeys := common.SortedLabelKeys(f.labelKeys)
+	header, err := s.createHeaderRow(labelKeys, f.optional)
+	if err != nil {
+		return err
+	}
+	writer := csv.NewWriter(file)
+	if err := writer.Write(header); err != nil {
+		return fmt.Errorf("failed to write CSV header: %v", err)
+	}
+
+	decoder := gob.NewDecoder(f.spool)
+	for {
+		var item common.ProcessedData
+		if err := decoder.Decode(&item); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return fmt.Errorf("failed to read spool file: %v", err)
+		}
+
+		row, err := s.createDataRow(item, labelKeys, f.optional)
+		if err != nil {
+			return err
+		}
+		if err := writer.Write(row); err != nil {
+			return fmt.Errorf("failed to write CSV row: %v", err)
+		}
+	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("error closing file %s: %v", f.path, err)
+	}
+	log.Printf("Wrote %d rows of %d metric(s) to %s", f.rows, len(s.manifest), f.path)
+	return nil
+}
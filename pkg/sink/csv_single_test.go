@@ -0,0 +1,73 @@
+package sink
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+func TestCSVSingleFileCombinesMetrics(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewCSVSink(config.CSVConfig{OutputDir: dir, SingleFile: true})
+	if err != nil {
+		t.Fatalf("NewCSVSink() error = %v", err)
+	}
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	qps := []common.ProcessedData{
+		{PrometheusInstance: "prom", MetricName: "qps", Timestamp: start, Value: 1, Labels: map[string]string{"instance": "tidb-0", "sql_type": "Select"}},
+		{PrometheusInstance: "prom", MetricName: "qps", Timestamp: start.Add(time.Minute), Value: 2, Labels: map[string]string{"instance": "tidb-0", "sql_type": "Insert"}},
+	}
+	disk := []common.ProcessedData{
+		{PrometheusInstance: "prom", MetricName: "disk_usage", Timestamp: start, Value: 0.5, Labels: map[string]string{"instance": "tikv-0", "device": "nvme0n1"}},
+	}
+	// Written in several batches, interleaved
+	for _, write := range []struct {
+		metric string
+		rows   []common.ProcessedData
+	}{{"qps", qps[:1]}, {"disk_usage", disk}, {"qps", qps[1:]}} {
+		if err := s.Write(write.metric, write.rows); err != nil {
+			t.Fatalf("Write(%s) error = %v", write.metric, err)
+		}
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.csv")); len(files) != 0 {
+		t.Errorf("files %v written before Close, want the CSV written once its header is known", files)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	if spools, _ := filepath.Glob(filepath.Join(dir, ".metrics-*.spool")); len(spools) != 0 {
+		t.Errorf("spool files %v left behind", spools)
+	}
+	files := csvFiles(t, dir)
+	if len(files) != 1 || !strings.HasPrefix(filepath.Base(files[0]), "metrics_") {
+		t.Fatalf("CSV files %v, want only the combined file", files)
+	}
+	records := readCSV(t, files[0])
+
+	// The header covers the label keys of both metrics
+	for _, key := range []string{"label_device", "label_instance", "label_sql_type"} {
+		if !slices.Contains(records[0], key) {
+			t.Errorf("header %v has no %s column", records[0], key)
+		}
+	}
+	// Rows keep their write order, each metric leaving the other's labels empty
+	want := map[string][]string{
+		"metric_name":    {"qps", "disk_usage", "qps"},
+		"label_instance": {"tidb-0", "tikv-0", "tidb-0"},
+		"label_sql_type": {"Select", "", "Insert"},
+		"label_device":   {"", "nvme0n1", ""},
+		"value":          {"1", "0.5", "2"},
+	}
+	for name, values := range want {
+		if got := column(records, name); !slices.Equal(got, values) {
+			t.Errorf("column %s = %v, want %v", name, got, values)
+		}
+	}
+}
@@ -1,11 +1,17 @@
 package sink
 
 import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
 	"encoding/csv"
 	"fmt"
+	"io"
+	"log"
 	"os"
 	"path/filepath"
-	"sort"
+	"strings"
+	"text/template"
 	"time"
 
 	"github.com/meiking/tidb-metrics-crawler/pkg/common"
@@ -14,23 +20,131 @@ import (
 
 // CSVSink writes processed data to CSV files
 type CSVSink struct {
-	outputDir string
-	files     map[string]*os.File
-	writers   map[string]*csv.Writer
+	outputDir   string
+	formatValue valueFormatter
+	bom         bool
+	provenance  bool                         // Write job and run_id columns
+	meta        map[string]config.MetricMeta // Written before the header with metadata_header; nil otherwise
+	files       map[string]*os.File
+	gzips       map[string]*gzip.Writer // Compressors of files named *.gz
+	writers     map[string]*csv.Writer
+	pending     map[string]int      // Rows written to each writer since its last flush
+	flushRows   int                 // Rows buffered before a flush; 0 flushes after every Write
+	labelKeys   map[string][]string // Label columns of each file's header
+	optional    map[string]csvOptionalColumns
+	outputs     map[string]csvOutput
+	paths       map[string]string        // Metric writing each open file, keyed by path
+	manifest    map[string]*manifestFile // Manifest entries keyed by metric name
+	report      *RunReport
+	runTime     time.Time
+	single      *csvSingleFile // Set with single_file; every metric goes to one file
+	retention   *csvRetention  // Prunes earlier runs on Close; nil to keep everything
+}
+
+// csvFlushBufferSize is the write buffer of each file with flush_rows;
+// csv.NewWriter uses a bufio.Writer this large as is
+const csvFlushBufferSize = 64 << 10
+
+// csvOptionalColumns are the columns a file has only when its first rows carry them
+type csvOptionalColumns struct {
+	checksum   bool // Rows stamped by processor.row_checksum
+	seriesName bool // Rows of a metric with keep_metric_name
+}
+
+// optionalColumns returns the optional columns carried by data
+func optionalColumns(data []common.ProcessedData) csvOptionalColumns {
+	var columns csvOptionalColumns
+	for _, item := range data {
+		columns.checksum = columns.checksum || item.Checksum != ""
+		columns.seriesName = columns.seriesName || item.SeriesName != ""
+	}
+	return columns
+}
+
+// csvOutput is a metric's file location override
+type csvOutput struct {
+	subdir   string
+	filename *template.Template // Nil for the default name
+}
+
+// csvFilenameData is the data available to filename templates
+type csvFilenameData struct {
+	MetricName string
+	Time       time.Time
 }
 
 // NewCSVSink creates a new CSV sink
 func NewCSVSink(cfg config.CSVConfig) (*CSVSink, error) {
+	formatValue, err := newValueFormatter(cfg.FloatFormat, cfg.NonFinite)
+	if err != nil {
+		return nil, err
+	}
+
 	// Create output directory if it doesn't exist
 	if err := os.MkdirAll(cfg.OutputDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create output directory: %v", err)
 	}
 
-	return &CSVSink{
-		outputDir: cfg.OutputDir,
-		files:     make(map[string]*os.File),
-		writers:   make(map[string]*csv.Writer),
-	}, nil
+	outputs := make(map[string]csvOutput, len(cfg.Metrics))
+	for name, m := range cfg.Metrics {
+		out := csvOutput{subdir: filepath.Clean(m.Subdir)}
+		if m.Subdir != "" && !filepath.IsLocal(m.Subdir) {
+			return nil, fmt.Errorf("output_subdir of metric %s must be a relative path inside output_dir: %s", name, m.Subdir)
+		}
+		if m.Filename != "" {
+			if out.filename, err = template.New("filename").Option("missingkey=error").Parse(m.Filename); err != nil {
+				return nil, fmt.Errorf("invalid filename of metric %s: %v", name, err)
+			}
+		}
+		outputs[name] = out
+	}
+
+	var meta map[string]config.MetricMeta
+	if cfg.MetadataHeader {
+		meta = cfg.Meta
+		if meta == nil {
+			meta = make(map[string]config.MetricMeta)
+		}
+	}
+
+	retention, err := newCSVRetention(cfg.Retention)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.FlushRows < 0 {
+		return nil, fmt.Errorf("csv flush_rows must not be negative: %d", cfg.FlushRows)
+	}
+	if cfg.SingleFile && cfg.MetadataHeader {
+		return nil, fmt.Errorf("csv metadata_header is not supported with single_file")
+	}
+	if cfg.SingleFile && len(cfg.Metrics) > 0 {
+		log.Printf("Ignoring per-metric output_subdir and filename with csv single_file")
+	}
+
+	s := &CSVSink{
+		outputDir:   cfg.OutputDir,
+		formatValue: formatValue,
+		bom:         cfg.BOM,
+		provenance:  cfg.Provenance,
+		meta:        meta,
+		files:       make(map[string]*os.File),
+		gzips:       make(map[string]*gzip.Writer),
+		writers:     make(map[string]*csv.Writer),
+		pending:     make(map[string]int),
+		flushRows:   cfg.FlushRows,
+		labelKeys:   make(map[string][]string),
+		optional:    make(map[string]csvOptionalColumns),
+		outputs:     outputs,
+		paths:       make(map[string]string),
+		manifest:    make(map[string]*manifestFile),
+		runTime:     time.Now(),
+		retention:   retention,
+	}
+	if cfg.SingleFile {
+		s.single = s.newCSVSingleFile()
+	}
+	return s, nil
 }
 
 // Write writes processed data to a CSV file
@@ -38,18 +152,30 @@ func (s *CSVSink) Write(metricName string, data []common.ProcessedData) error {
 	if len(data) == 0 {
 		return nil // Nothing to write
 	}
+	if s.single != nil {
+		return s.writeSingle(metricName, data)
+	}
 
 	// Create writer if it doesn't exist
 	if _, exists := s.writers[metricName]; !exists {
-		if err := s.createWriter(metricName, data[0]); err != nil {
+		if err := s.createWriter(metricName, unionLabelKeys(data), optionalColumns(data)); err != nil {
+			return err
+		}
+	}
+
+	// A batch with labels or optional columns the header lacks widens the file first
+	if labelKeys, optional, grown := widenColumns(s.labelKeys[metricName], s.optional[metricName], data); grown {
+		if err := s.widenFile(metricName, labelKeys, optional); err != nil {
 			return err
 		}
 	}
 
 	// Write data rows
 	writer := s.writers[metricName]
+	labelKeys := s.labelKeys[metricName]
+	optional := s.optional[metricName]
 	for _, item := range data {
-		row, err := s.createDataRow(item)
+		row, err := s.createDataRow(item, labelKeys, optional)
 		if err != nil {
 			return err
 		}
@@ -59,34 +185,123 @@ func (s *CSVSink) Write(metricName string, data []common.ProcessedData) error {
 		}
 	}
 
-	// Flush after writing batch
-	writer.Flush()
+	// Flush after every write, or once flush_rows rows are buffered
+	s.pending[metricName] += len(data)
+	if s.pending[metricName] >= s.flushRows {
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			return err
+		}
+		s.pending[metricName] = 0
+	}
+
+	s.manifest[metricName].add(data)
+	return nil
+}
 
-	return writer.Error()
+// RecordRun keeps the run report for the manifest
+func (s *CSVSink) RecordRun(report RunReport) {
+	s.report = &report
 }
 
-// Close cleans up resources
+// Close closes every file and writes the manifest listing them
 func (s *CSVSink) Close() error {
 	var lastErr error
 
-	// Close all files
-	for name, file := range s.files {
-		if err := file.Close(); err != nil {
-			lastErr = fmt.Errorf("error closing file %s: %v", name, err)
+	// Close all files, flushing buffered rows and finishing the gzip stream first
+	for name := range s.files {
+		if err := s.closeFile(name); err != nil {
+			lastErr = err
+		}
+	}
+	s.paths = make(map[string]string)
+
+	if s.single != nil {
+		if err := s.closeSingle(); err != nil {
+			lastErr = err
+		}
+	}
+
+	if err := s.writeManifest(); err != nil {
+		lastErr = err
+	}
+
+	if s.retention != nil {
+		if err := s.retention.prune(s.outputDir, s.runTime); err != nil {
+			lastErr = fmt.Errorf("csv retention: %v", err)
 		}
-		delete(s.files, name)
-		delete(s.writers, name)
 	}
+	return lastErr
+}
 
+// closeFile flushes and closes a metric's file
+func (s *CSVSink) closeFile(metricName string) error {
+	var lastErr error
+	if writer, ok := s.writers[metricName]; ok {
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			lastErr = fmt.Errorf("error flushing file %s: %v", metricName, err)
+		}
+	}
+	if gz, ok := s.gzips[metricName]; ok {
+		if err := gz.Close(); err != nil {
+			lastErr = fmt.Errorf("error compressing file %s: %v", metricName, err)
+		}
+		delete(s.gzips, metricName)
+	}
+	if err := s.files[metricName].Close(); err != nil {
+		lastErr = fmt.Errorf("error closing file %s: %v", metricName, err)
+	}
+	delete(s.files, metricName)
+	delete(s.writers, metricName)
+	delete(s.pending, metricName)
+	delete(s.labelKeys, metricName)
+	delete(s.optional, metricName)
 	return lastErr
 }
 
+// writeManifest writes the index of the run's files to output_dir
+func (s *CSVSink) writeManifest() error {
+	if len(s.manifest) == 0 && s.report == nil {
+		return nil
+	}
+
+	for _, f := range s.manifest {
+		size, sum, err := fileChecksum(filepath.Join(s.outputDir, f.Path))
+		if err != nil {
+			return fmt.Errorf("failed to checksum %s: %v", f.Path, err)
+		}
+		f.setContent(size, sum)
+	}
+
+	data, err := encodeManifest(s.manifest, s.report)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.outputDir, manifestName(s.runTime))
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write manifest: %v", err)
+	}
+	log.Printf("Wrote manifest of %d file(s) to %s", len(s.manifest), path)
+
+	s.manifest = make(map[string]*manifestFile)
+	s.report = nil
+	return nil
+}
+
 // createWriter initializes a new CSV writer for a metric
-func (s *CSVSink) createWriter(metricName string, sampleData common.ProcessedData) error {
-	// Create filename with timestamp
-	timestamp := time.Now().Format("20060102150405")
-	filename := fmt.Sprintf("%s_%s.csv", metricName, timestamp)
-	path := filepath.Join(s.outputDir, filename)
+func (s *CSVSink) createWriter(metricName string, labelKeys []string, optional csvOptionalColumns) error {
+	path, err := s.filePath(metricName)
+	if err != nil {
+		return err
+	}
+	if other, taken := s.paths[path]; taken {
+		return fmt.Errorf("metrics %s and %s would both write %s", other, metricName, path)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %v", err)
+	}
 
 	// Create file
 	file, err := os.Create(path)
@@ -94,9 +309,35 @@ func (s *CSVSink) createWriter(metricName string, sampleData common.ProcessedDat
 		return fmt.Errorf("failed to create CSV file: %v", err)
 	}
 
-	// Create writer and write header
-	writer := csv.NewWriter(file)
-	header, err := s.createHeaderRow(sampleData)
+	// A file named *.gz, e.g. by a filename template, is compressed
+	var out io.Writer = file
+	var gz *gzip.Writer
+	if strings.HasSuffix(path, ".gz") {
+		gz = gzip.NewWriter(file)
+		out = gz
+	}
+
+	// The BOM goes only at the start of a newly created file
+	if s.bom {
+		if _, err := io.WriteString(out, utf8BOM); err != nil {
+			file.Close()
+			return fmt.Errorf("failed to write BOM: %v", err)
+		}
+	}
+	if s.meta != nil {
+		if _, err := io.WriteString(out, metadataLines(s.meta[metricName])); err != nil {
+			file.Close()
+			return fmt.Errorf("failed to write metadata: %v", err)
+		}
+	}
+
+	// Create writer and write header. With flush_rows, a larger buffer than
+	// csv.Writer's own 4 KiB saves write calls between flushes.
+	if s.flushRows > 0 {
+		out = bufio.NewWriterSize(out, csvFlushBufferSize)
+	}
+	writer := csv.NewWriter(out)
+	header, err := s.createHeaderRow(labelKeys, optional)
 	if err != nil {
 		file.Close()
 		return err
@@ -107,15 +348,73 @@ func (s *CSVSink) createWriter(metricName string, sampleData common.ProcessedDat
 		return fmt.Errorf("failed to write CSV header: %v", err)
 	}
 
+	rel, err := filepath.Rel(s.outputDir, path)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
 	// Store writer and file
+	s.paths[path] = metricName
+	s.manifest[metricName] = newManifestFile(metricName, filepath.ToSlash(rel))
 	s.files[metricName] = file
+	if gz != nil {
+		s.gzips[metricName] = gz
+	}
 	s.writers[metricName] = writer
+	s.labelKeys[metricName] = labelKeys
+	s.optional[metricName] = optional
 
 	return nil
 }
 
+// metadataLines renders a metric's query, unit, type and help as comment
+// lines. Queries spanning several lines are joined onto one.
+func metadataLines(meta config.MetricMeta) string {
+	var b strings.Builder
+	if meta.Query != "" {
+		lines := strings.Split(strings.TrimSpace(meta.Query), "\n")
+		for i, line := range lines {
+			lines[i] = strings.TrimSpace(line)
+		}
+		fmt.Fprintf(&b, "# query: %s\n", strings.Join(lines, " "))
+	}
+	if meta.Unit != "" {
+		fmt.Fprintf(&b, "# unit: %s\n", meta.Unit)
+	}
+	if meta.Type != "" {
+		fmt.Fprintf(&b, "# type: %s\n", meta.Type)
+	}
+	if meta.Help != "" {
+		fmt.Fprintf(&b, "# help: %s\n", strings.Join(strings.Fields(meta.Help), " "))
+	}
+	return b.String()
+}
+
+// filePath returns the metric's file path: output_dir, the metric's
+// subdirectory, then its file name, by default <metric>_<timestamp>.csv.
+// The result never escapes output_dir.
+func (s *CSVSink) filePath(metricName string) (string, error) {
+	out := s.outputs[metricName]
+
+	filename := fmt.Sprintf("%s_%s.csv", metricName, s.runTime.Format("20060102150405"))
+	if out.filename != nil {
+		var b strings.Builder
+		if err := out.filename.Execute(&b, csvFilenameData{MetricName: metricName, Time: s.runTime}); err != nil {
+			return "", fmt.Errorf("failed to render filename of metric %s: %v", metricName, err)
+		}
+		filename = b.String()
+	}
+
+	rel := filepath.Join(out.subdir, filename)
+	if !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("file of metric %s must stay inside output_dir: %s", metricName, rel)
+	}
+	return filepath.Join(s.outputDir, rel), nil
+}
+
 // createHeaderRow creates the CSV header row
-func (s *CSVSink) createHeaderRow(sample common.ProcessedData) ([]string, error) {
+func (s *CSVSink) createHeaderRow(labelKeys []string, optional csvOptionalColumns) ([]string, error) {
 	// Base columns
 	header := []string{
 		"prometheus_instance",
@@ -123,9 +422,18 @@ func (s *CSVSink) createHeaderRow(sample common.ProcessedData) ([]string, error)
 		"timestamp",
 		"value",
 	}
+	if s.provenance {
+		header = append(header, "job", "run_id")
+	}
+	if optional.checksum {
+		header = append(header, "checksum")
+	}
+	if optional.seriesName {
+		header = append(header, "series_name")
+	}
 
 	// Add label columns
-	for key := range sample.Labels {
+	for _, key := range labelKeys {
 		header = append(header, fmt.Sprintf("label_%s", key))
 	}
 
@@ -133,29 +441,75 @@ func (s *CSVSink) createHeaderRow(sample common.ProcessedData) ([]string, error)
 }
 
 // createDataRow creates a CSV row from processed data
-func (s *CSVSink) createDataRow(data common.ProcessedData) ([]string, error) {
+func (s *CSVSink) createDataRow(data common.ProcessedData, labelKeys []string, optional csvOptionalColumns) ([]string, error) {
 	// Base data
 	row := []string{
 		data.PrometheusInstance,
 		data.MetricName,
 		data.Timestamp.Format(time.RFC3339),
-		fmt.Sprintf("%f", data.Value),
+		s.formatValue(data.Value),
+	}
+	if s.provenance {
+		row = append(row, data.Job, data.RunID)
+	}
+	if optional.checksum {
+		row = append(row, data.Checksum)
+	}
+	if optional.seriesName {
+		row = append(row, data.SeriesName)
 	}
 
-	// Add label values in consistent order
-	for _, key := range getSortedLabelKeys(data.Labels) {
+	// Add label values in header order, leaving missing labels empty
+	for _, key := range labelKeys {
 		row = append(row, data.Labels[key])
 	}
 
 	return row, nil
 }
 
-// getSortedLabelKeys returns sorted label keys for consistent CSV output
-func getSortedLabelKeys(labels map[string]string) []string {
-	keys := make([]string, 0, len(labels))
-	for k := range labels {
-		keys = append(keys, k)
+// fileChecksum returns the size and SHA-256 digest of the file at path
+func fileChecksum(path string) (int64, []byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, file)
+	if err != nil {
+		return 0, nil, err
+	}
+	return size, h.Sum(nil), nil
+}
+
+// unionLabelKeys returns the sorted union of label keys across all data
+func unionLabelKeys(data []common.ProcessedData) []string {
+	seen := make(map[string]string)
+	for _, item := range data {
+		for k := range item.Labels {
+			seen[k] = ""
+		}
+	}
+	return common.SortedLabelKeys(seen)
+}
+
+// warnUnknownLabels logs label keys that are missing from an already written header.
+// Their values cannot be represented in the file and are dropped.
+func warnUnknownLabels(metricName string, labelKeys []string, data []common.ProcessedData) {
+	known := make(map[string]struct{}, len(labelKeys))
+	for _, k := range labelKeys {
+		known[k] = struct{}{}
+	}
+
+	var unknown []string
+	for _, k := range unionLabelKeys(data) {
+		if _, ok := known[k]; !ok {
+			unknown = append(unknown, k)
+		}
+	}
+
+	if len(unknown) > 0 {
+		log.Printf("Warning: labels %v of metric %s are not in the CSV header and will be dropped", unknown, metricName)
 	}
-	sort.Strings(keys)
-	return keys
 }
@@ -0,0 +1,387 @@
+package sink
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+func TestCSVSinkBOM(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cfg  config.CSVConfig
+	}{
+		{"enabled", config.CSVConfig{BOM: true}},
+		{"disabled", config.CSVConfig{}},
+		{"single file enabled", config.CSVConfig{BOM: true, SingleFile: true}},
+		{"single file disabled", config.CSVConfig{SingleFile: true}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.cfg.OutputDir = t.TempDir()
+			s, err := NewCSVSink(tc.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Several writes append to the same file
+			for i := 0; i < 3; i++ {
+				if err := s.Write("qps", valueRows(1, 2)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			content, err := os.ReadFile(csvFiles(t, tc.cfg.OutputDir)[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkBOM(t, content, tc.cfg.BOM)
+		})
+	}
+}
+
+func TestFeishuCSVBOM(t *testing.T) {
+	formatValue, err := newValueFormatter("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bom := range []bool{true, false} {
+		content, err := createCSVContent(valueRows(1, 2), formatValue, bom, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkBOM(t, content, bom)
+
+		// Every part of a split upload is a file of its own
+		parts, err := splitCSVContent(valueRows(1, 2, 3, 4), formatValue, bom, false, 150)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(parts) < 2 {
+			t.Fatalf("got %d part(s), want the rows split", len(parts))
+		}
+		for _, part := range parts {
+			checkBOM(t, part, bom)
+		}
+	}
+}
+
+// checkBOM checks that content starts with exactly one BOM when want is set
+// and has none otherwise
+func checkBOM(t *testing.T, content []byte, want bool) {
+	t.Helper()
+	if got := bytes.HasPrefix(content, []byte{0xEF, 0xBB, 0xBF}); got != want {
+		t.Errorf("content starts with a BOM: %v, want %v", got, want)
+	}
+	if n := bytes.Count(content, []byte(utf8BOM)); n > 1 {
+		t.Errorf("content holds %d BOMs, want at most one", n)
+	}
+}
+
+func TestCSVSinkWidensHeader(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cfg  config.CSVConfig
+	}{
+		{"plain", config.CSVConfig{}},
+		{"gzip", config.CSVConfig{Metrics: map[string]config.CSVMetricOutput{"qps": {Filename: "{{.MetricName}}.csv.gz"}}}},
+		{"bom and metadata", config.CSVConfig{BOM: true, MetadataHeader: true, Meta: map[string]config.MetricMeta{"qps": {Query: "sum(rate(x[1m]))"}}}},
+		{"flush rows", config.CSVConfig{FlushRows: 100}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.cfg.OutputDir = t.TempDir()
+			s, err := NewCSVSink(tc.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The second batch brings a label and the checksum column the header lacks
+			first, second, third := valueRows(1, 2), valueRows(3, 4), valueRows(5, 6)
+			for i := range second {
+				second[i].Labels = map[string]string{"job": "tidb", "type": "Select"}
+				second[i].Checksum = "c"
+			}
+			for _, batch := range [][]common.ProcessedData{first, second, third} {
+				if err := s.Write("qps", batch); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			files := csvFiles(t, tc.cfg.OutputDir)
+			if len(files) != 1 {
+				t.Fatalf("got files %v, want one", files)
+			}
+			records := readCSV(t, files[0])
+			if got := column(records, "value"); !reflect.DeepEqual(got, []string{"1", "2", "3", "4", "5", "6"}) {
+				t.Errorf("values = %q, want every row in order", got)
+			}
+			if got := column(records, "label_type"); !reflect.DeepEqual(got, []string{"", "", "Select", "Select", "", ""}) {
+				t.Errorf("label_type = %q, want the values of the second batch", got)
+			}
+			if got := column(records, "label_job"); !reflect.DeepEqual(got, []string{"tidb", "tidb", "tidb", "tidb", "tidb", "tidb"}) {
+				t.Errorf("label_job = %q, want it kept through the rewrite", got)
+			}
+			if got := column(records, "checksum"); !reflect.DeepEqual(got, []string{"", "", "c", "c", "", ""}) {
+				t.Errorf("checksum = %q, want the values of the second batch", got)
+			}
+			if tc.cfg.BOM {
+				content, err := os.ReadFile(files[0])
+				if err != nil {
+					t.Fatal(err)
+				}
+				checkBOM(t, content, true)
+				if !bytes.Contains(content, []byte("# query: sum(rate(x[1m]))\n")) || bytes.Count(content, []byte("# query:")) != 1 {
+					t.Errorf("metadata lines not kept once through the rewrite:\n%s", content)
+				}
+			}
+		})
+	}
+}
+
+func TestCSVSinkMetricPaths(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewCSVSink(config.CSVConfig{
+		OutputDir: dir,
+		Metrics: map[string]config.CSVMetricOutput{
+			"tikv_qps":   {Subdir: "tikv/store"},                                      // Nested, default name
+			"tidb_qps":   {Subdir: "tidb", Filename: "{{.MetricName}}.csv"},           // Both
+			"pd_leaders": {Filename: "{{.MetricName}}-{{.Time.Format \"2006\"}}.csv"}, // Name only
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewCSVSink() error = %v", err)
+	}
+	for _, metric := range []string{"tikv_qps", "tidb_qps", "pd_leaders", "up"} {
+		if err := s.Write(metric, valueRows(1)); err != nil {
+			t.Fatalf("Write(%s) error = %v", metric, err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	stamp := s.runTime.Format("20060102150405")
+	for _, want := range []string{
+		"tikv/store/tikv_qps_" + stamp + ".csv",
+		"tidb/tidb_qps.csv",
+		"pd_leaders-" + s.runTime.Format("2006") + ".csv",
+		"up_" + stamp + ".csv", // No override
+	} {
+		if _, err := os.Stat(filepath.Join(dir, want)); err != nil {
+			t.Errorf("missing %s: %v", want, err)
+		}
+	}
+	if files := csvFiles(t, dir); len(files) != 4 {
+		t.Errorf("wrote %v, want 4 files", files)
+	}
+}
+
+func TestCSVSinkRejectsPathsOutsideOutputDir(t *testing.T) {
+	for _, subdir := range []string{"../elsewhere", "/tmp/abs", "a/../../b"} {
+		_, err := NewCSVSink(config.CSVConfig{OutputDir: t.TempDir(), Metrics: map[string]config.CSVMetricOutput{"qps": {Subdir: subdir}}})
+		if err == nil {
+			t.Errorf("NewCSVSink() accepted output_subdir %q", subdir)
+		}
+	}
+
+	parent := t.TempDir()
+	dir := filepath.Join(parent, "out")
+	for _, filename := range []string{"../{{.MetricName}}.csv", "{{.MetricName}}/../../x.csv"} {
+		s, err := NewCSVSink(config.CSVConfig{OutputDir: dir, Metrics: map[string]config.CSVMetricOutput{"qps": {Filename: filename}}})
+		if err != nil {
+			t.Fatalf("NewCSVSink() error = %v", err)
+		}
+		if err := s.Write("qps", valueRows(1)); err == nil || !strings.Contains(err.Error(), "must stay inside output_dir") {
+			t.Errorf("Write() with filename %q error = %v, want it rejected", filename, err)
+		}
+		s.Close()
+	}
+	if entries, _ := os.ReadDir(parent); len(entries) != 1 {
+		t.Errorf("%s has %d entries, want only the output directory", parent, len(entries))
+	}
+}
+
+func TestCSVSinkPathCollision(t *testing.T) {
+	s, err := NewCSVSink(config.CSVConfig{
+		OutputDir: t.TempDir(),
+		Metrics: map[string]config.CSVMetricOutput{
+			"a": {Filename: "same.csv"},
+			"b": {Filename: "same.csv"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewCSVSink() error = %v", err)
+	}
+	defer s.Close()
+	if err := s.Write("a", valueRows(1)); err != nil {
+		t.Fatalf("Write(a) error = %v", err)
+	}
+	if err := s.Write("b", valueRows(1)); err == nil || !strings.Contains(err.Error(), "would both write") {
+		t.Errorf("Write(b) error = %v, want the collision reported", err)
+	}
+}
+
+func TestCSVMetadataHeader(t *testing.T) {
+	meta := map[string]config.MetricMeta{
+		"qps": {Query: "sum(rate(\n  tidb_server_query_total[1m]\n))", Unit: "ops"},
+		"tps": {Query: "tidb_tps"},
+	}
+	tests := []struct {
+		name   string
+		header bool
+		want   map[string]string // Lines before the CSV header, per metric
+	}{
+		{"off by default", false, map[string]string{"qps": "", "tps": ""}},
+		{"enabled", true, map[string]string{
+			"qps": "# query: sum(rate( tidb_server_query_total[1m] ))\n# unit: ops\n",
+			"tps": "# query: tidb_tps\n",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s, err := NewCSVSink(config.CSVConfig{OutputDir: dir, MetadataHeader: tt.header, Meta: meta})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, metric := range []string{"qps", "tps"} {
+				if err := s.Write(metric, valueRows(1)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, path := range csvFiles(t, dir) {
+				content, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				metric := strings.SplitN(filepath.Base(path), "_", 2)[0]
+				header := strings.Index(string(content), "prometheus_instance,")
+				if header < 0 {
+					t.Fatalf("%s has no CSV header:\n%s", path, content)
+				}
+				if got := string(content[:header]); got != tt.want[metric] {
+					t.Errorf("%s: lines before the header = %q, want %q", metric, got, tt.want[metric])
+				}
+			}
+		})
+	}
+}
+
+func TestCSVSinkGzipByExtension(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewCSVSink(config.CSVConfig{OutputDir: dir, Metrics: map[string]config.CSVMetricOutput{
+		"qps": {Filename: `{{.MetricName}}-{{.Time.Format "20060102"}}.csv.gz`},
+		"tps": {Filename: "{{.MetricName}}.csv"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Several writes go into one gzip stream
+	for i := 0; i < 2; i++ {
+		for _, metric := range []string{"qps", "tps"} {
+			if err := s.Write(metric, valueRows(1, 2)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files := csvFiles(t, dir)
+	if len(files) != 2 {
+		t.Fatalf("files = %v, want one per metric", files)
+	}
+	for _, path := range files {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compressed := strings.HasSuffix(path, ".gz")
+		if compressed != strings.HasPrefix(filepath.Base(path), "qps-") {
+			t.Errorf("%s: compressed %v, want only the .gz template compressed", path, compressed)
+		}
+
+		if !compressed {
+			if !bytes.HasPrefix(content, []byte("prometheus_instance,")) {
+				t.Errorf("%s starts with %q, want the plain CSV header", path, content[:min(len(content), 20)])
+			}
+		} else {
+			// Reading to the end checks the trailer written by Close
+			gz, err := gzip.NewReader(bytes.NewReader(content))
+			if err != nil {
+				t.Fatalf("%s is not gzip: %v", path, err)
+			}
+			if _, err := io.ReadAll(gz); err != nil {
+				t.Fatalf("%s is not a complete gzip stream: %v", path, err)
+			}
+		}
+		if records := readCSV(t, path); len(records) != 5 {
+			t.Errorf("%s has %d records, want the header and 4 rows", path, len(records))
+		}
+	}
+}
+
+func TestCSVProvenanceColumns(t *testing.T) {
+	formatValue, err := newValueFormatter("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := valueRows(1, 2)
+	for i := range rows {
+		rows[i].Job, rows[i].RunID = "nightly", "run-1"
+	}
+
+	for _, tc := range []struct {
+		provenance bool
+		file       string // Header of the CSV sink's file
+		attachment string // Header of a CSV attachment
+	}{
+		// Without provenance the layout is the one consumers had before
+		{false, "prometheus_instance,metric_name,timestamp,value,label_job", "prometheus_instance,metric_name,timestamp,value,job"},
+		{true, "prometheus_instance,metric_name,timestamp,value,job,run_id,label_job", "prometheus_instance,metric_name,timestamp,value,job,run_id,job"},
+	} {
+		dir := t.TempDir()
+		s, err := NewCSVSink(config.CSVConfig{OutputDir: dir, Provenance: tc.provenance})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Write("qps", rows); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+		records := readCSV(t, csvFiles(t, dir)[0])
+		if got := strings.Join(records[0], ","); got != tc.file {
+			t.Errorf("provenance %v: file header = %s, want %s", tc.provenance, got, tc.file)
+		}
+		if tc.provenance && (!reflect.DeepEqual(column(records, "job"), []string{"nightly", "nightly"}) || !reflect.DeepEqual(column(records, "run_id"), []string{"run-1", "run-1"})) {
+			t.Errorf("provenance columns = %q and %q, want the rows' job and run ID", column(records, "job"), column(records, "run_id"))
+		}
+
+		content, err := createCSVContent(rows, formatValue, false, tc.provenance)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _, _ := strings.Cut(string(content), "\n"); got != tc.attachment {
+			t.Errorf("provenance %v: attachment header = %s, want %s", tc.provenance, got, tc.attachment)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package sink
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+)
+
+// widenColumns returns the columns a file with labelKeys and optional needs
+// to hold data as well, and whether that is more than it has
+func widenColumns(labelKeys []string, optional csvOptionalColumns, data []common.ProcessedData) ([]string, csvOptionalColumns, bool) {
+	keys, grown := widenLabelKeys(labelKeys, data)
+
+	extra := optionalColumns(data)
+	wider := csvOptionalColumns{
+		checksum:   optional.checksum || extra.checksum,
+		seriesName: optional.seriesName || extra.seriesName,
+	}
+	if !grown && wider == optional {
+		return labelKeys, optional, false
+	}
+	return keys, wider, true
+}
+
+// widenLabelKeys returns the sorted union of labelKeys and the labels in
+// data, and whether it has keys labelKeys lacks
+func widenLabelKeys(labelKeys []string, data []common.ProcessedData) ([]string, bool) {
+	keys := make(map[string]string, len(labelKeys))
+	for _, k := range labelKeys {
+		keys[k] = ""
+	}
+	for _, item := range data {
+		for k := range item.Labels {
+			keys[k] = ""
+		}
+	}
+
+	if len(keys) == len(labelKeys) {
+		return labelKeys, false
+	}
+	return common.SortedLabelKeys(keys), true
+}
+
+// widenFile rewrites a metric's file under a header with labelKeys and
+// optional, for labels first seen after the file was created. Rows already
+// written are copied over with the new columns empty, so the header ends up
+// the union of every batch.
+func (s *CSVSink) widenFile(metricName string, labelKeys []string, optional csvOptionalColumns) error {
+	path := s.files[metricName].Name()
+	manifest := s.manifest[metricName]
+	if err := s.closeFile(metricName); err != nil {
+		return err
+	}
+
+	old := path + ".widen"
+	if err := os.Rename(path, old); err != nil {
+		return fmt.Errorf("failed to widen CSV file: %v", err)
+	}
+
+	// Keep the earlier rows in the old file until they are copied
+	delete(s.paths, path)
+	if err := s.createWriter(metricName, labelKeys, optional); err != nil {
+		os.Rename(old, path)
+		return err
+	}
+	s.manifest[metricName] = manifest
+
+	if err := s.copyRows(metricName, old, strings.HasSuffix(path, ".gz")); err != nil {
+		return fmt.Errorf("failed to widen CSV file %s, earlier rows are kept in %s: %v", path, old, err)
+	}
+	os.Remove(old)
+	log.Printf("Widened the header of %s to the labels %v", path, labelKeys)
+	return nil
+}
+
+// copyRows writes the rows of the metric's earlier file at path to its
+// current writer, matching columns by name
+func (s *CSVSink) copyRows(metricName, path string, compressed bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var in io.Reader = bufio.NewReader(file)
+	if compressed {
+		gz, err := gzip.NewReader(in)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		in = gz
+	}
+
+	// Skip what createWriter wrote before the header
+	var preamble string
+	if s.bom {
+		preamble = utf8BOM
+	}
+	if s.meta != nil {
+		preamble += metadataLines(s.meta[metricName])
+	}
+	if _, err := io.CopyN(io.Discard, in, int64(len(preamble))); err != nil {
+		return err
+	}
+
+	reader := csv.NewReader(in)
+	reader.ReuseRecord = true
+	oldHeader, err := reader.Read()
+	if err != nil {
+		return err
+	}
+	columns := make(map[string]int, len(oldHeader))
+	for i, name := range oldHeader {
+		columns[name] = i
+	}
+
+	// Position of each current column in the old file, or -1 for a new one
+	header, err := s.createHeaderRow(s.labelKeys[metricName], s.optional[metricName])
+	if err != nil {
+		return err
+	}
+	from := make([]int, len(header))
+	for i, name := range header {
+		from[i] = -1
+		if j, ok := columns[name]; ok {
+			from[i] = j
+		}
+	}
+
+	writer := s.writers[metricName]
+	row := make([]string, len(header))
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for i, j := range from {
+			row[i] = ""
+			if j >= 0 {
+				row[i] = record[j]
+			}
+		}
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package sink
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+// DingTalkSink posts a summary of each metric to a DingTalk robot.
+// Robot webhooks cannot send files, so no CSV is attached.
+type DingTalkSink struct {
+	webhook      string
+	secret       string
+	messageTitle string
+	httpClient   *http.Client
+}
+
+// NewDingTalkSink creates a new DingTalk sink
+func NewDingTalkSink(cfg config.DingTalkConfig) (*DingTalkSink, error) {
+	if cfg.Webhook == "" {
+		return nil, fmt.Errorf("dingtalk webhook is required")
+	}
+
+	return &DingTalkSink{
+		webhook:      cfg.Webhook,
+		secret:       cfg.Secret,
+		messageTitle: cfg.MessageTitle,
+		httpClient: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+	}, nil
+}
+
+// Write sends a markdown summary of the data
+func (s *DingTalkSink) Write(metricName string, data []common.ProcessedData) error {
+	if len(data) == 0 {
+		return nil // Nothing to send
+	}
+
+	webhook, err := s.signedWebhook(time.Now())
+	if err != nil {
+		return err
+	}
+
+	payload := map[string]interface{}{
+		"msgtype": "markdown",
+		"markdown": map[string]string{
+			"title": fmt.Sprintf("%s - %s", s.messageTitle, metricName),
+			"text":  summarizeData(s.messageTitle, metricName, data),
+		},
+	}
+	if err := postRobotMessage(s.httpClient, webhook, payload); err != nil {
+		return &WriteError{Err: fmt.Errorf("failed to send message: %w", err)}
+	}
+
+	return nil
+}
+
+// Close cleans up resources
+func (s *DingTalkSink) Close() error {
+	return nil
+}
+
+// signedWebhook adds the timestamp and HMAC signature required by robots
+// in signed security mode. The webhook is returned unchanged without a secret.
+func (s *DingTalkSink) signedWebhook(now time.Time) (string, error) {
+	if s.secret == "" {
+		return s.webhook, nil
+	}
+
+	u, err := url.Parse(s.webhook)
+	if err != nil {
+		return "", fmt.Errorf("invalid webhook: %v", err)
+	}
+
+	timestamp := strconv.FormatInt(now.UnixMilli(), 10)
+	mac := hmac.New(sha256.New, []byte(s.secret))
+	mac.Write([]byte(timestamp + "\n" + s.secret))
+
+	query := u.Query()
+	query.Set("timestamp", timestamp)
+	query.Set("sign", base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
@@ -0,0 +1,85 @@
+package sink
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+func TestDingTalkSinkPostsMarkdown(t *testing.T) {
+	server := newRobotServer(t)
+	s, err := NewDingTalkSink(config.DingTalkConfig{Webhook: server.URL + "/robot/send?access_token=abc", MessageTitle: "Daily"})
+	if err != nil {
+		t.Fatalf("NewDingTalkSink() error = %v", err)
+	}
+
+	if err := s.Write("qps", valueRows(1, 2, 3)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := s.Write("qps", nil); err != nil {
+		t.Fatalf("Write() of no rows error = %v", err)
+	}
+
+	requests := server.received()
+	if len(requests) != 1 {
+		t.Fatalf("got %d requests, want one message and none for an empty batch", len(requests))
+	}
+	req := requests[0]
+	if req.path != "/robot/send" || req.query.Get("access_token") != "abc" || req.contentType != "application/json" {
+		t.Errorf("request = %s %v %s, want a JSON post to the webhook", req.path, req.query, req.contentType)
+	}
+	if req.query.Has("sign") {
+		t.Error("request is signed without a secret")
+	}
+
+	var payload struct {
+		MsgType  string `json:"msgtype"`
+		Markdown struct {
+			Title string `json:"title"`
+			Text  string `json:"text"`
+		} `json:"markdown"`
+	}
+	if err := json.Unmarshal(req.body, &payload); err != nil {
+		t.Fatalf("body %s is not JSON: %v", req.body, err)
+	}
+	if payload.MsgType != "markdown" || payload.Markdown.Title != "Daily - qps" {
+		t.Errorf("payload = %+v, want a markdown message titled Daily - qps", payload)
+	}
+	if !strings.HasPrefix(payload.Markdown.Text, "### Daily - qps\n") || !strings.Contains(payload.Markdown.Text, "- Rows: 3\n") {
+		t.Errorf("text = %q, want the summary of 3 rows", payload.Markdown.Text)
+	}
+}
+
+func TestDingTalkSinkSignsWebhook(t *testing.T) {
+	server := newRobotServer(t)
+	s, err := NewDingTalkSink(config.DingTalkConfig{Webhook: server.URL + "/robot/send?access_token=abc", Secret: "SECabc"})
+	if err != nil {
+		t.Fatalf("NewDingTalkSink() error = %v", err)
+	}
+
+	before := time.Now().UnixMilli()
+	if err := s.Write("qps", valueRows(1)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	query := server.received()[0].query
+	timestamp, err := strconv.ParseInt(query.Get("timestamp"), 10, 64)
+	if err != nil || timestamp < before || timestamp > time.Now().UnixMilli() {
+		t.Fatalf("timestamp = %q, want the send time in milliseconds", query.Get("timestamp"))
+	}
+	mac := hmac.New(sha256.New, []byte("SECabc"))
+	mac.Write([]byte(query.Get("timestamp") + "\nSECabc"))
+	if want := base64.StdEncoding.EncodeToString(mac.Sum(nil)); query.Get("sign") != want {
+		t.Errorf("sign = %q, want %q", query.Get("sign"), want)
+	}
+	if query.Get("access_token") != "abc" {
+		t.Errorf("access_token = %q, want the webhook's kept", query.Get("access_token"))
+	}
+}
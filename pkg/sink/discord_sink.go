@@ -0,0 +1,303 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+const (
+	// maxDiscordAttempts is how many times a request is tried when rate limited
+	maxDiscordAttempts = 5
+
+	// maxDiscordAttachmentBytes is the largest file a webhook may attach
+	// without a boosted server
+	maxDiscordAttachmentBytes = 10 << 20
+)
+
+// DiscordSink posts a summary embed of each metric to a Discord channel
+// webhook, optionally with the metric's CSV attached
+type DiscordSink struct {
+	webhook      string
+	username     string
+	messageTitle string
+	attachCSV    bool
+	formatValue  valueFormatter
+	bom          bool
+	provenance   bool
+	httpClient   *http.Client
+}
+
+// discordMessage is the body of a webhook execution
+type discordMessage struct {
+	Username    string              `json:"username,omitempty"`
+	Embeds      []discordEmbed      `json:"embeds"`
+	Attachments []discordAttachment `json:"attachments,omitempty"`
+}
+
+// discordEmbed is a rich message card
+type discordEmbed struct {
+	Title     string              `json:"title"`
+	Timestamp string              `json:"timestamp,omitempty"`
+	Fields    []discordEmbedField `json:"fields"`
+}
+
+type discordEmbedField struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Inline bool   `json:"inline,omitempty"`
+}
+
+// discordAttachment describes the file sent in multipart part files[ID]
+type discordAttachment struct {
+	ID       int    `json:"id"`
+	Filename string `json:"filename"`
+}
+
+// NewDiscordSink creates a new Discord sink. CSV attachments are formatted
+// according to csvCfg.
+func NewDiscordSink(cfg config.DiscordConfig, csvCfg config.CSVConfig) (*DiscordSink, error) {
+	if cfg.Webhook == "" {
+		return nil, fmt.Errorf("discord webhook is required")
+	}
+	if u, err := url.Parse(cfg.Webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("discord webhook must be an http(s) URL")
+	}
+
+	formatValue, err := newValueFormatter(csvCfg.FloatFormat, csvCfg.NonFinite)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DiscordSink{
+		webhook:      cfg.Webhook,
+		username:     cfg.Username,
+		messageTitle: cfg.MessageTitle,
+		attachCSV:    cfg.AttachCSV,
+		formatValue:  formatValue,
+		bom:          csvCfg.BOM,
+		provenance:   csvCfg.Provenance,
+		httpClient: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+	}, nil
+}
+
+// Write posts a summary embed of the data and, if enabled, the CSV file
+func (s *DiscordSink) Write(metricName string, data []common.ProcessedData) error {
+	if len(data) == 0 {
+		return nil // Nothing to send
+	}
+
+	msg := discordMessage{
+		Username: s.username,
+		Embeds:   []discordEmbed{s.summaryEmbed(metricName, data)},
+	}
+	if !s.attachCSV {
+		if err := s.post(msg, "", nil); err != nil {
+			return &WriteError{Err: fmt.Errorf("failed to send message: %w", err)}
+		}
+		return nil
+	}
+
+	csvContent, err := createCSVContent(data, s.formatValue, s.bom, s.provenance)
+	if err != nil {
+		return fmt.Errorf("failed to create CSV content: %v", err)
+	}
+	if len(csvContent) > maxDiscordAttachmentBytes {
+		log.Printf("CSV of metric %s is %d bytes, above Discord's %d byte limit; sending the summary only",
+			metricName, len(csvContent), maxDiscordAttachmentBytes)
+		if err := s.post(msg, "", nil); err != nil {
+			return &WriteError{Err: fmt.Errorf("failed to send message: %w", err)}
+		}
+		return nil
+	}
+
+	filename := fmt.Sprintf("%s_%s.csv", metricName, time.Now().Format("20060102150405"))
+	msg.Attachments = []discordAttachment{{ID: 0, Filename: filename}}
+	if err := s.post(msg, filename, csvContent); err != nil {
+		return &WriteError{Err: fmt.Errorf("failed to send message with file: %w", err)}
+	}
+	return nil
+}
+
+// Close cleans up resources
+func (s *DiscordSink) Close() error {
+	return nil
+}
+
+// Ping checks the webhook by fetching it, which fails for a wrong token
+func (s *DiscordSink) Ping(ctx context.Context) error {
+	resp, err := s.doWithRetry(func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodGet, s.webhook, nil)
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkDiscordResponse(resp)
+}
+
+// summaryEmbed describes data as an embed with rows, series and time range
+func (s *DiscordSink) summaryEmbed(metricName string, data []common.ProcessedData) discordEmbed {
+	summary := summarize(data)
+	title := metricName
+	if s.messageTitle != "" {
+		title = s.messageTitle + " - " + metricName
+	}
+	return discordEmbed{
+		Title:     title,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Fields: []discordEmbedField{
+			{Name: "Rows", Value: strconv.Itoa(summary.Rows), Inline: true},
+			{Name: "Series", Value: strconv.Itoa(summary.Series), Inline: true},
+			{Name: "Time range", Value: summary.First.Format(time.RFC3339) + " ~ " + summary.Last.Format(time.RFC3339)},
+		},
+	}
+}
+
+// post executes the webhook with msg as JSON, or as the payload_json part
+// of a multipart body carrying content as files[0] when filename is set
+func (s *DiscordSink) post(msg discordMessage, filename string, content []byte) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	body, contentType := payload, "application/json"
+	if filename != "" {
+		if body, contentType, err = discordMultipart(payload, filename, content); err != nil {
+			return err
+		}
+	}
+
+	resp, err := s.doWithRetry(func() (*http.Request, error) {
+		// wait=true makes Discord report errors instead of answering 204 early
+		req, err := http.NewRequest(http.MethodPost, s.webhook, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		q := req.URL.Query()
+		q.Set("wait", "true")
+		req.URL.RawQuery = q.Encode()
+		req.Header.Set("Content-Type", contentType)
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkDiscordResponse(resp)
+}
+
+// discordMultipart builds a multipart/form-data body with the JSON payload
+// and one CSV file, returning the body and its content type
+func discordMultipart(payload []byte, filename string, content []byte) ([]byte, string, error) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", `form-data; name="payload_json"`)
+	header.Set("Content-Type", "application/json")
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := part.Write(payload); err != nil {
+		return nil, "", err
+	}
+
+	header = make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="files[0]"; filename=%q`, filename))
+	header.Set("Content-Type", "text/csv")
+	if part, err = writer.CreatePart(header); err != nil {
+		return nil, "", err
+	}
+	if _, err := part.Write(content); err != nil {
+		return nil, "", err
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, "", err
+	}
+	return body.Bytes(), writer.FormDataContentType(), nil
+}
+
+// checkDiscordResponse fails on a non-2xx reply, keeping Discord's message
+func checkDiscordResponse(resp *http.Response) error {
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return fmt.Errorf("webhook request failed: %w", &StatusError{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(body))})
+}
+
+// doWithRetry sends the request built by newRequest, waiting and retrying
+// while Discord answers 429 Too Many Requests. When a reply says the rate
+// limit bucket is empty, it also waits for the bucket to reset, so the next
+// request is not rejected.
+func (s *DiscordSink) doWithRetry(newRequest func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := s.httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusTooManyRequests || attempt == maxDiscordAttempts {
+			if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+				if wait, ok := discordSeconds(resp.Header.Get("X-RateLimit-Reset-After")); ok {
+					time.Sleep(wait)
+				}
+			}
+			return resp, nil
+		}
+
+		wait := discordRetryAfter(resp, attempt)
+		resp.Body.Close()
+		log.Printf("Discord rate limited, retry %d/%d in %v", attempt, maxDiscordAttempts-1, wait)
+		time.Sleep(wait)
+	}
+}
+
+// discordRetryAfter returns how long a 429 reply asks to wait: retry_after
+// in the JSON body, then the Retry-After header, both in seconds, then an
+// exponential backoff when neither is present
+func discordRetryAfter(resp *http.Response, attempt int) time.Duration {
+	var body struct {
+		RetryAfter float64 `json:"retry_after"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if json.Unmarshal(data, &body) == nil && body.RetryAfter > 0 {
+		return time.Duration(body.RetryAfter * float64(time.Second))
+	}
+	if wait, ok := discordSeconds(resp.Header.Get("Retry-After")); ok {
+		return wait
+	}
+	return time.Duration(1<<(attempt-1)) * time.Second
+}
+
+// discordSeconds parses a header holding seconds, possibly fractional
+func discordSeconds(value string) (time.Duration, bool) {
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds * float64(time.Second)), true
+}
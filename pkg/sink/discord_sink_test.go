@@ -0,0 +1,193 @@
+package sink
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+// discordCall is a webhook execution received by the fake Discord
+type discordCall struct {
+	query       string
+	contentType string
+	payload     discordMessage
+	parts       []string          // Form names of the parts, in order
+	files       map[string]string // Part name to filename
+	fileTypes   map[string]string // Part name to content type
+	content     map[string]string // Part name to content
+}
+
+// fakeDiscord records webhook executions, answering the first rateLimited
+// requests with 429 and a retry_after body
+type fakeDiscord struct {
+	*httptest.Server
+	rateLimited int
+
+	mu    sync.Mutex
+	calls []discordCall
+}
+
+func newFakeDiscord(t *testing.T) *fakeDiscord {
+	f := &fakeDiscord{}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeDiscord) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.rateLimited > 0 {
+		f.rateLimited--
+		w.WriteHeader(http.StatusTooManyRequests)
+		io.WriteString(w, `{"message": "You are being rate limited.", "retry_after": 0.01, "global": false}`)
+		return
+	}
+
+	call := discordCall{query: r.URL.RawQuery, contentType: r.Header.Get("Content-Type"), files: map[string]string{}, fileTypes: map[string]string{}, content: map[string]string{}}
+	mediaType, params, _ := mime.ParseMediaType(call.contentType)
+	if mediaType == "multipart/form-data" {
+		reader := multipart.NewReader(r.Body, params["boundary"])
+		for {
+			part, err := reader.NextPart()
+			if err != nil {
+				break
+			}
+			data, _ := io.ReadAll(part)
+			call.parts = append(call.parts, part.FormName())
+			call.files[part.FormName()] = part.FileName()
+			call.fileTypes[part.FormName()] = part.Header.Get("Content-Type")
+			call.content[part.FormName()] = string(data)
+		}
+		json.Unmarshal([]byte(call.content["payload_json"]), &call.payload)
+	} else {
+		json.NewDecoder(r.Body).Decode(&call.payload)
+	}
+	f.calls = append(f.calls, call)
+	w.Write([]byte(`{"id": "1"}`))
+}
+
+// received returns the calls so far
+func (f *fakeDiscord) received() []discordCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]discordCall(nil), f.calls...)
+}
+
+func newTestDiscordSink(t *testing.T, server *fakeDiscord, cfg config.DiscordConfig) *DiscordSink {
+	t.Helper()
+	cfg.Webhook = server.URL + "/api/webhooks/1/token"
+	s, err := NewDiscordSink(cfg, config.CSVConfig{})
+	if err != nil {
+		t.Fatalf("NewDiscordSink() error = %v", err)
+	}
+	s.httpClient = server.Client()
+	return s
+}
+
+func TestDiscordSinkMultipartShape(t *testing.T) {
+	server := newFakeDiscord(t)
+	s := newTestDiscordSink(t, server, config.DiscordConfig{Username: "crawler", MessageTitle: "Daily", AttachCSV: true})
+
+	if err := s.Write("qps", valueRows(1, 2)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	calls := server.received()
+	if len(calls) != 1 {
+		t.Fatalf("webhook executed %d times, want once", len(calls))
+	}
+	call := calls[0]
+	if call.query != "wait=true" || !strings.HasPrefix(call.contentType, "multipart/form-data; boundary=") {
+		t.Errorf("request ?%s with Content-Type %q, want ?wait=true and multipart/form-data", call.query, call.contentType)
+	}
+	if strings.Join(call.parts, ",") != "payload_json,files[0]" {
+		t.Fatalf("parts = %v, want payload_json then files[0]", call.parts)
+	}
+	if call.files["payload_json"] != "" || call.fileTypes["payload_json"] != "application/json" {
+		t.Errorf("payload_json part is file %q of type %q, want a plain JSON field", call.files["payload_json"], call.fileTypes["payload_json"])
+	}
+
+	filename := call.files["files[0]"]
+	if !strings.HasPrefix(filename, "qps_") || !strings.HasSuffix(filename, ".csv") || call.fileTypes["files[0]"] != "text/csv" {
+		t.Errorf("files[0] is %q of type %q, want the metric's CSV", filename, call.fileTypes["files[0]"])
+	}
+	if csv := call.content["files[0]"]; !strings.HasPrefix(csv, "prometheus_instance,metric_name,timestamp,value,") || strings.Count(csv, "\n") != 3 {
+		t.Errorf("files[0] content = %q, want a header and two rows", csv)
+	}
+
+	payload := call.payload
+	if payload.Username != "crawler" || len(payload.Attachments) != 1 || payload.Attachments[0].ID != 0 || payload.Attachments[0].Filename != filename {
+		t.Errorf("payload = %+v, want the username and attachment 0 naming %s", payload, filename)
+	}
+	if len(payload.Embeds) != 1 || payload.Embeds[0].Title != "Daily - qps" {
+		t.Fatalf("embeds = %+v, want one titled Daily - qps", payload.Embeds)
+	}
+	fields := make(map[string]string)
+	for _, field := range payload.Embeds[0].Fields {
+		fields[field.Name] = field.Value
+	}
+	if fields["Rows"] != "2" || fields["Series"] != "1" || fields["Time range"] != "2024-01-01T00:00:00Z ~ 2024-01-01T00:01:00Z" {
+		t.Errorf("embed fields = %v, want 2 rows of 1 series over the two minutes", fields)
+	}
+}
+
+func TestDiscordSinkSummaryOnly(t *testing.T) {
+	server := newFakeDiscord(t)
+	s := newTestDiscordSink(t, server, config.DiscordConfig{})
+
+	if err := s.Write("qps", valueRows(1)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := s.Write("idle", nil); err != nil {
+		t.Fatalf("Write() without rows error = %v", err)
+	}
+
+	calls := server.received()
+	if len(calls) != 1 {
+		t.Fatalf("webhook executed %d times, want once for the metric with rows", len(calls))
+	}
+	call := calls[0]
+	if call.contentType != "application/json" || len(call.parts) != 0 || len(call.payload.Attachments) != 0 {
+		t.Errorf("request of type %q with parts %v and attachments %v, want a plain JSON summary", call.contentType, call.parts, call.payload.Attachments)
+	}
+	if call.payload.Username != "" || len(call.payload.Embeds) != 1 || call.payload.Embeds[0].Title != "qps" {
+		t.Errorf("payload = %+v, want one embed titled qps without a username", call.payload)
+	}
+}
+
+func TestDiscordSinkRetriesRateLimit(t *testing.T) {
+	server := newFakeDiscord(t)
+	server.rateLimited = 2
+	s := newTestDiscordSink(t, server, config.DiscordConfig{AttachCSV: true})
+
+	if err := s.Write("qps", valueRows(1)); err != nil {
+		t.Fatalf("Write() error = %v, want the rate limit retried", err)
+	}
+	// The retried request carries the whole multipart body again
+	if calls := server.received(); len(calls) != 1 || calls[0].content["files[0]"] == "" {
+		t.Errorf("calls = %+v, want one served with the file", calls)
+	}
+
+	server.rateLimited = maxDiscordAttempts
+	err := s.Write("qps", valueRows(1))
+	if err == nil || !strings.Contains(err.Error(), "429") {
+		t.Errorf("Write() error = %v, want the 429 once retries run out", err)
+	}
+}
+
+func TestNewDiscordSinkInvalid(t *testing.T) {
+	for _, webhook := range []string{"", "discord.com/api/webhooks/1/token", "ftp://discord.com/api/webhooks/1/token"} {
+		if _, err := NewDiscordSink(config.DiscordConfig{Webhook: webhook}, config.CSVConfig{}); err == nil {
+			t.Errorf("NewDiscordSink(%q) accepted an invalid webhook", webhook)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+const (
+	// defaultESBatchSize is the number of documents per bulk request
+	defaultESBatchSize = 1000
+
+	// maxLoggedBulkErrors limits how many failed items of one bulk request are logged
+	maxLoggedBulkErrors = 10
+)
+
+// ElasticsearchSink indexes processed data into Elasticsearch or OpenSearch
+// through the _bulk API
+type ElasticsearchSink struct {
+	ctx        context.Context
+	addresses  []string
+	index      string
+	opType     string // "index", or "create" for data streams
+	username   string
+	password   string
+	apiKey     string
+	batchSize  int
+	nullValues bool // Index NaN and ±Inf as null instead of skipping them
+	httpClient *http.Client
+	buf        bytes.Buffer // Pending bulk body
+	pending    int          // Documents in buf
+}
+
+// esDocument is the indexed form of a sample
+type esDocument struct {
+	Timestamp          string            `json:"@timestamp"`
+	Value              *float64          `json:"value"` // nil for non-finite values with non_finite: null
+	MetricName         string            `json:"metric_name"`
+	PrometheusInstance string            `json:"prometheus_instance"`
+	Labels             map[string]string `json:"labels,omitempty"`
+	Job                string            `json:"job,omitempty"`
+	RunID              string            `json:"run_id,omitempty"`
+	Checksum           string            `json:"checksum,omitempty"`
+	SeriesName         string            `json:"series_name,omitempty"`
+}
+
+// esBulkResponse holds the fields of a _bulk reply used to report failures
+type esBulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int `json:"status"`
+		Error  *struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	} `json:"items"`
+}
+
+// NewElasticsearchSink creates a new Elasticsearch sink. Requests are bound to ctx.
+func NewElasticsearchSink(ctx context.Context, cfg config.ElasticsearchConfig) (*ElasticsearchSink, error) {
+	if len(cfg.Addresses) == 0 || cfg.Index == "" {
+		return nil, fmt.Errorf("elasticsearch addresses and index are required")
+	}
+
+	batchSize := cfg.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultESBatchSize
+	}
+
+	opType := "index"
+	if cfg.DataStream {
+		opType = "create"
+	}
+
+	addresses := make([]string, len(cfg.Addresses))
+	for i, addr := range cfg.Addresses {
+		addresses[i] = strings.TrimSuffix(addr, "/")
+	}
+
+	s := &ElasticsearchSink{
+		ctx:        ctx,
+		addresses:  addresses,
+		index:      cfg.Index,
+		opType:     opType,
+		username:   cfg.Username,
+		password:   cfg.Password,
+		apiKey:     cfg.APIKey,
+		batchSize:  batchSize,
+		nullValues: cfg.NonFinite == nonFiniteNull,
+		httpClient: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+	}
+
+	if cfg.CreateTemplate {
+		log.Printf("Installing index template for %s", cfg.Index)
+		if err := s.putIndexTemplate(cfg.DataStream); err != nil {
+			return nil, fmt.Errorf("failed to create index template: %v", err)
+		}
+	}
+
+	return s, nil
+}
+
+// Write buffers documents and sends a bulk request whenever a batch is full
+func (s *ElasticsearchSink) Write(metricName string, data []common.ProcessedData) error {
+	action, err := json.Marshal(map[string]map[string]string{s.opType: {"_index": s.index}})
+	if err != nil {
+		return err
+	}
+
+	skipped := 0
+	for _, item := range data {
+		// JSON has no representation for NaN and ±Inf
+		value := &item.Value
+		if !isFinite(item.Value) {
+			if !s.nullValues {
+				skipped++
+				continue
+			}
+			value = nil
+		}
+
+		doc, err := json.Marshal(esDocument{
+			Timestamp:          item.Timestamp.UTC().Format(time.RFC3339Nano),
+			Value:              value,
+			MetricName:         metricName,
+			PrometheusInstance: item.PrometheusInstance,
+			Labels:             item.Labels,
+			Job:                item.Job,
+			RunID:              item.RunID,
+			Checksum:           item.Checksum,
+			SeriesName:         item.SeriesName,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to encode document: %v", err)
+		}
+
+		s.buf.Write(action)
+		s.buf.WriteByte('\n')
+		s.buf.Write(doc)
+		s.buf.WriteByte('\n')
+		s.pending++
+
+		if s.pending >= s.batchSize {
+			if err := s.flush(s.ctx); err != nil {
+				return err
+			}
+		}
+	}
+
+	if skipped > 0 {
+		log.Printf("Skipped %d non-finite values of metric %s", skipped, metricName)
+	}
+	return nil
+}
+
+// Close sends any remaining documents. The final bulk request outlives the
+// run context, so the documents of an interrupted run are still indexed.
+func (s *ElasticsearchSink) Close() error {
+	if err := s.flush(context.WithoutCancel(s.ctx)); err != nil {
+		return fmt.Errorf("failed to flush final batch: %v", err)
+	}
+	return nil
+}
+
+// Ping checks that a node is reachable and accepts the credentials
+func (s *ElasticsearchSink) Ping(ctx context.Context) error {
+	if _, err := s.do(ctx, http.MethodGet, "/", "application/json", nil); err != nil {
+		return fmt.Errorf("failed to reach Elasticsearch: %v", err)
+	}
+	return nil
+}
+
+// flush sends the pending documents as one bulk request. Items rejected by
+// the cluster are logged and reported together; the others stay indexed.
+func (s *ElasticsearchSink) flush(ctx context.Context) error {
+	if s.pending == 0 {
+		return nil
+	}
+
+	log.Printf("Sending bulk request with %d documents to Elasticsearch", s.pending)
+	total := s.pending
+	body := append([]byte(nil), s.buf.Bytes()...)
+	s.buf.Reset()
+	s.pending = 0
+
+	respBody, err := s.do(ctx, http.MethodPost, "/_bulk", "application/x-ndjson", body)
+	if err != nil {
+		return fmt.Errorf("bulk request failed: %v", err)
+	}
+
+	var bulkResp esBulkResponse
+	if err := json.Unmarshal(respBody, &bulkResp); err != nil {
+		return fmt.Errorf("invalid bulk response: %v", err)
+	}
+	if !bulkResp.Errors {
+		return nil
+	}
+
+	return bulkItemsError(bulkResp, total)
+}
+
+// bulkItemsError logs the failed items of a bulk response and returns an
+// error summarizing them
+func bulkItemsError(resp esBulkResponse, total int) error {
+	failed := 0
+	var first error
+	for i, item := range resp.Items {
+		for _, result := range item {
+			if result.Error == nil {
+				continue
+			}
+			failed++
+			itemErr := fmt.Errorf("%s: %s (status %d)", result.Error.Type, result.Error.Reason, result.Status)
+			if first == nil {
+				first = itemErr
+			}
+			if failed <= maxLoggedBulkErrors {
+				log.Printf("Bulk item %d failed: %v", i, itemErr)
+			}
+		}
+	}
+
+	if failed == 0 {
+		return errors.New("bulk request reported errors without failed items")
+	}
+	if failed > maxLoggedBulkErrors {
+		log.Printf("... and %d more failed bulk items", failed-maxLoggedBulkErrors)
+	}
+	return fmt.Errorf("%d of %d documents failed, first error: %v", failed, total, first)
+}
+
+// putIndexTemplate installs an index template mapping labels as keywords
+func (s *ElasticsearchSink) putIndexTemplate(dataStream bool) error {
+	template := map[string]interface{}{
+		"index_patterns": []string{s.index},
+		"priority":       200,
+		"template": map[string]interface{}{
+			"mappings": map[string]interface{}{
+				"dynamic_templates": []map[string]interface{}{
+					{
+						"labels_as_keywords": map[string]interface{}{
+							"path_match": "labels.*",
+							"mapping":    map[string]string{"type": "keyword"},
+						},
+					},
+				},
+				"properties": map[string]interface{}{
+					"@timestamp":          map[string]string{"type": "date"},
+					"value":               map[string]string{"type": "double"},
+					"metric_name":         map[string]string{"type": "keyword"},
+					"prometheus_instance": map[string]string{"type": "keyword"},
+					"job":                 map[string]string{"type": "keyword"},
+					"run_id":              map[string]string{"type": "keyword"},
+				},
+			},
+		},
+	}
+	if dataStream {
+		template["data_stream"] = map[string]interface{}{}
+	}
+
+	body, err := json.Marshal(template)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.do(s.ctx, http.MethodPut, "/_index_template/"+s.index, "application/json", body)
+	return err
+}
+
+// do sends a request to the first address that responds and returns the
+// response body, failing on non-2xx status codes
+func (s *ElasticsearchSink) do(ctx context.Context, method, path, contentType string, body []byte) ([]byte, error) {
+	var lastErr error
+	for _, addr := range s.addresses {
+		req, err := http.NewRequestWithContext(ctx, method, addr+path, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", contentType)
+		if s.apiKey != "" {
+			req.Header.Set("Authorization", "ApiKey "+s.apiKey)
+		} else if s.username != "" {
+			req.SetBasicAuth(s.username, s.password)
+		}
+
+		resp, err := s.httpClient.Do(req)
+		if err != nil {
+			// Try the next node
+			lastErr = err
+			continue
+		}
+
+		respBody, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return nil, fmt.Errorf("%s %s: %s (status: %d)", method, path, string(respBody), resp.StatusCode)
+		}
+		return respBody, nil
+	}
+	return nil, lastErr
+}
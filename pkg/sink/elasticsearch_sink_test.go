@@ -0,0 +1,224 @@
+package sink
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+// fakeBulk serves _bulk requests, keeping each request's ndjson lines.
+// reply, when set, returns the response body of a request.
+type fakeBulk struct {
+	*httptest.Server
+	reply func(lines []string) string
+
+	mu       sync.Mutex
+	requests [][]string
+}
+
+func newFakeBulk(t *testing.T) *fakeBulk {
+	f := &fakeBulk{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/_bulk" || r.Header.Get("Content-Type") != "application/x-ndjson" {
+			http.Error(w, "unexpected request "+r.Method+" "+r.URL.Path, http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if !bytes.HasSuffix(body, []byte("\n")) {
+			http.Error(w, "the bulk request must be terminated by a newline", http.StatusBadRequest)
+			return
+		}
+		var lines []string
+		scanner := bufio.NewScanner(bytes.NewReader(body))
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+
+		f.mu.Lock()
+		f.requests = append(f.requests, lines)
+		f.mu.Unlock()
+		if f.reply != nil {
+			w.Write([]byte(f.reply(lines)))
+			return
+		}
+		w.Write([]byte(`{"errors":false,"items":[]}`))
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func TestElasticsearchBulkBody(t *testing.T) {
+	server := newFakeBulk(t)
+	s, err := NewElasticsearchSink(context.Background(), config.ElasticsearchConfig{
+		Addresses: []string{server.URL + "/"},
+		Index:     "metrics",
+		BatchSize: 2,
+	})
+	if err != nil {
+		t.Fatalf("NewElasticsearchSink() error = %v", err)
+	}
+
+	rows := valueRows(1, 2, 3)
+	rows[0].RunID = "run-1"
+	if err := s.Write("qps", rows); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	// Full batches are sent as they fill; the rest on Close
+	if len(server.requests) != 2 || len(server.requests[0]) != 4 || len(server.requests[1]) != 2 {
+		t.Fatalf("bulk requests = %v, want 2 documents then 1", server.requests)
+	}
+	var docs []map[string]any
+	for _, lines := range server.requests {
+		for i := 0; i < len(lines); i += 2 {
+			if lines[i] != `{"index":{"_index":"metrics"}}` {
+				t.Errorf("action line = %s, want an index action", lines[i])
+			}
+			var doc map[string]any
+			if err := json.Unmarshal([]byte(lines[i+1]), &doc); err != nil {
+				t.Fatalf("document %s is not JSON: %v", lines[i+1], err)
+			}
+			docs = append(docs, doc)
+		}
+	}
+	first := docs[0]
+	if first["@timestamp"] != "2024-01-01T00:00:00Z" || first["value"] != 1.0 || first["metric_name"] != "qps" ||
+		first["prometheus_instance"] != "prom" || first["run_id"] != "run-1" {
+		t.Errorf("first document = %v", first)
+	}
+	if labels, ok := first["labels"].(map[string]any); !ok || labels["job"] != "tidb" {
+		t.Errorf("first document labels = %v, want job tidb", first["labels"])
+	}
+	if _, ok := docs[1]["run_id"]; ok {
+		t.Errorf("second document = %v, want empty fields omitted", docs[1])
+	}
+	if docs[2]["value"] != 3.0 {
+		t.Errorf("last document value = %v, want 3", docs[2]["value"])
+	}
+}
+
+func TestElasticsearchDataStreamCreates(t *testing.T) {
+	server := newFakeBulk(t)
+	s, err := NewElasticsearchSink(context.Background(), config.ElasticsearchConfig{
+		Addresses:  []string{server.URL},
+		Index:      "metrics-tidb",
+		DataStream: true,
+	})
+	if err != nil {
+		t.Fatalf("NewElasticsearchSink() error = %v", err)
+	}
+	s.Write("qps", valueRows(1))
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if got := server.requests[0][0]; got != `{"create":{"_index":"metrics-tidb"}}` {
+		t.Errorf("action line = %s, want create for a data stream", got)
+	}
+}
+
+func TestElasticsearchCloseFlushesAfterCancel(t *testing.T) {
+	server := newFakeBulk(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	s, err := NewElasticsearchSink(ctx, config.ElasticsearchConfig{Addresses: []string{server.URL}, Index: "metrics"})
+	if err != nil {
+		t.Fatalf("NewElasticsearchSink() error = %v", err)
+	}
+	if err := s.Write("qps", valueRows(1, 2)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	cancel() // Interrupted before the sink is closed
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v, want the last batch indexed", err)
+	}
+	if len(server.requests) != 1 || len(server.requests[0]) != 4 {
+		t.Errorf("bulk requests = %v, want the 2 pending documents", server.requests)
+	}
+}
+
+func TestElasticsearchBulkPartialFailure(t *testing.T) {
+	server := newFakeBulk(t)
+	server.reply = func(lines []string) string {
+		return `{"errors":true,"items":[` +
+			`{"index":{"status":201}},` +
+			`{"index":{"status":400,"error":{"type":"mapper_parsing_exception","reason":"failed to parse field [value]"}}},` +
+			`{"index":{"status":201}}]}`
+	}
+	s, err := NewElasticsearchSink(context.Background(), config.ElasticsearchConfig{Addresses: []string{server.URL}, Index: "metrics"})
+	if err != nil {
+		t.Fatalf("NewElasticsearchSink() error = %v", err)
+	}
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	s.Write("qps", valueRows(1, 2, 3))
+	err = s.Close()
+	if err == nil || !strings.Contains(err.Error(), "1 of 3 documents failed") || !strings.Contains(err.Error(), "mapper_parsing_exception") {
+		t.Fatalf("Close() error = %v, want the failed item reported", err)
+	}
+	if !strings.Contains(logs.String(), "Bulk item 1 failed: mapper_parsing_exception: failed to parse field [value] (status 400)") {
+		t.Errorf("log = %q, want the failed item logged", logs.String())
+	}
+
+	// The batch is not sent again
+	if err := s.Close(); err != nil || len(server.requests) != 1 {
+		t.Errorf("second Close() = %v after %d requests, want nothing left to send", err, len(server.requests))
+	}
+}
+
+func TestElasticsearchNonFinite(t *testing.T) {
+	tests := []struct {
+		nonFinite string
+		want      []string // Indexed values
+	}{
+		{"", []string{"1.5"}},
+		{nonFiniteNull, []string{"1.5", "null", "null", "null"}},
+	}
+	for _, tt := range tests {
+		server := newFakeBulk(t)
+		s, err := NewElasticsearchSink(context.Background(), config.ElasticsearchConfig{
+			Addresses: []string{server.URL},
+			Index:     "metrics",
+			NonFinite: tt.nonFinite,
+		})
+		if err != nil {
+			t.Fatalf("NewElasticsearchSink() error = %v", err)
+		}
+		if err := s.Write("qps", valueRows(1.5, math.NaN(), math.Inf(1), math.Inf(-1))); err != nil {
+			t.Fatalf("non_finite %q: Write() error = %v", tt.nonFinite, err)
+		}
+		if err := s.Close(); err != nil {
+			t.Fatalf("non_finite %q: Close() error = %v", tt.nonFinite, err)
+		}
+
+		var got []string
+		for _, lines := range server.requests {
+			for i := 1; i < len(lines); i += 2 {
+				var doc map[string]json.RawMessage
+				if err := json.Unmarshal([]byte(lines[i]), &doc); err != nil {
+					t.Fatalf("non_finite %q: document %s is not JSON: %v", tt.nonFinite, lines[i], err)
+				}
+				got = append(got, string(doc["value"]))
+			}
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("non_finite %q: indexed values %v, want %v", tt.nonFinite, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+const (
+	// defaultEmailSubject is used when no subject template is configured
+	defaultEmailSubject = `TiDB Metrics Report {{.Time.Format "2006-01-02 15:04"}}`
+
+	emailTLSStartTLS = "starttls"
+	emailTLSImplicit = "tls"
+	emailTLSNone     = "none"
+)
+
+// EmailSink collects each metric's data during the run and, on Close,
+// mails every metric as a CSV attachment with an HTML summary table
+type EmailSink struct {
+	addr        string
+	host        string
+	tlsMode     string
+	auth        smtp.Auth
+	from        string
+	to          []string
+	subject     *template.Template
+	formatValue valueFormatter
+	bom         bool
+	provenance  bool
+	runTime     time.Time
+	data        map[string][]common.ProcessedData // Buffered rows keyed by metric name
+}
+
+// emailSubjectData is the data available to the subject template
+type emailSubjectData struct {
+	Time    time.Time
+	Metrics []string
+}
+
+// NewEmailSink creates a new email sink. CSV attachments are formatted
+// according to csvCfg.
+func NewEmailSink(cfg config.EmailConfig, csvCfg config.CSVConfig) (*EmailSink, error) {
+	if cfg.Host == "" || cfg.From == "" || len(cfg.To) == 0 {
+		return nil, fmt.Errorf("email host, from and to are required")
+	}
+
+	tlsMode := cfg.TLS
+	port := cfg.Port
+	switch tlsMode {
+	case "", emailTLSStartTLS:
+		tlsMode = emailTLSStartTLS
+		if port == 0 {
+			port = 587
+		}
+	case emailTLSImplicit:
+		if port == 0 {
+			port = 465
+		}
+	case emailTLSNone:
+		if port == 0 {
+			port = 25
+		}
+	default:
+		return nil, fmt.Errorf("unsupported email tls mode: %s", cfg.TLS)
+	}
+
+	subjectStr := cfg.Subject
+	if subjectStr == "" {
+		subjectStr = defaultEmailSubject
+	}
+	subject, err := template.New("subject").Option("missingkey=error").Parse(subjectStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subject: %v", err)
+	}
+
+	formatValue, err := newValueFormatter(csvCfg.FloatFormat, csvCfg.NonFinite)
+	if err != nil {
+		return nil, err
+	}
+
+	var auth smtp.Auth
+	if cfg.Username != "" {
+		auth = smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)
+	}
+
+	return &EmailSink{
+		addr:        net.JoinHostPort(cfg.Host, strconv.Itoa(port)),
+		host:        cfg.Host,
+		tlsMode:     tlsMode,
+		auth:        auth,
+		from:        cfg.From,
+		to:          cfg.To,
+		subject:     subject,
+		formatValue: formatValue,
+		bom:         csvCfg.BOM,
+		provenance:  csvCfg.Provenance,
+		runTime:     time.Now(),
+		data:        make(map[string][]common.ProcessedData),
+	}, nil
+}
+
+// Write buffers data until the sink is closed
+func (s *EmailSink) Write(metricName string, data []common.ProcessedData) error {
+	s.data[metricName] = append(s.data[metricName], data...)
+	return nil
+}
+
+// Close sends the email with all buffered metrics
+func (s *EmailSink) Close() error {
+	if len(s.data) == 0 {
+		log.Printf("No data collected, skipping email")
+		return nil
+	}
+
+	msg, err := s.buildMessage()
+	if err != nil {
+		return fmt.Errorf("failed to build email: %v", err)
+	}
+
+	log.Printf("Sending email with %d attachment(s) to %v", len(s.data), s.to)
+	if err := s.send(msg); err != nil {
+		return fmt.Errorf("failed to send email: %v", err)
+	}
+
+	s.data = make(map[string][]common.ProcessedData)
+	return nil
+}
+
+// buildMessage renders a multipart/mixed message: an HTML summary followed
+// by one CSV attachment per metric
+func (s *EmailSink) buildMessage() ([]byte, error) {
+	metrics := make([]string, 0, len(s.data))
+	for name := range s.data {
+		metrics = append(metrics, name)
+	}
+	sort.Strings(metrics)
+
+	var subject strings.Builder
+	if err := s.subject.Execute(&subject, emailSubjectData{Time: s.runTime, Metrics: metrics}); err != nil {
+		return nil, fmt.Errorf("failed to render subject: %v", err)
+	}
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	msg := &bytes.Buffer{}
+	fmt.Fprintf(msg, "From: %s\r\n", s.from)
+	fmt.Fprintf(msg, "To: %s\r\n", strings.Join(s.to, ", "))
+	fmt.Fprintf(msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject.String()))
+	fmt.Fprintf(msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(msg, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", writer.Boundary())
+
+	// HTML summary table
+	htmlPart, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/html; charset=utf-8"},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := writeBase64Lines(htmlPart, []byte(s.summaryHTML(metrics))); err != nil {
+		return nil, err
+	}
+
+	// One attachment per metric
+	for _, name := range metrics {
+		content, err := createCSVContent(s.data[name], s.formatValue, s.bom, s.provenance)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create CSV content for %s: %v", name, err)
+		}
+
+		filename := fmt.Sprintf("%s_%s.csv", name, s.runTime.Format("20060102150405"))
+		part, err := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {fmt.Sprintf("text/csv; charset=utf-8; name=%q", filename)},
+			"Content-Disposition":       {fmt.Sprintf("attachment; filename=%q", filename)},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeBase64Lines(part, content); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
+
+// summaryHTML renders a table with one row per metric
+func (s *EmailSink) summaryHTML(metrics []string) string {
+	var b strings.Builder
+	b.WriteString("<html><body>\n<table border=\"1\" cellpadding=\"4\" cellspacing=\"0\">\n")
+	b.WriteString("<tr><th>Metric</th><th>Rows</th><th>Series</th><th>Start</th><th>End</th></tr>\n")
+	for _, name := range metrics {
+		summary := summarize(s.data[name])
+		fmt.Fprintf(&b, "<tr><td>%s</td><td>%d</td><td>%d</td><td>%s</td><td>%s</td></tr>\n",
+			html.EscapeString(name),
+			summary.Rows,
+			summary.Series,
+			summary.First.Format(time.RFC3339),
+			summary.Last.Format(time.RFC3339))
+	}
+	b.WriteString("</table>\n</body></html>\n")
+	return b.String()
+}
+
+// Ping connects and authenticates to the SMTP server without sending mail
+func (s *EmailSink) Ping(ctx context.Context) error {
+	client, err := s.dial()
+	if err != nil {
+		return fmt.Errorf("failed to connect to SMTP server: %v", err)
+	}
+	defer client.Close()
+	return client.Quit()
+}
+
+// dial connects to the SMTP server using the configured TLS mode and authenticates
+func (s *EmailSink) dial() (*smtp.Client, error) {
+	var client *smtp.Client
+	var err error
+	if s.tlsMode == emailTLSImplicit {
+		var conn *tls.Conn
+		conn, err = tls.Dial("tcp", s.addr, &tls.Config{ServerName: s.host})
+		if err != nil {
+			return nil, err
+		}
+		client, err = smtp.NewClient(conn, s.host)
+	} else {
+		client, err = smtp.Dial(s.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if s.tlsMode == emailTLSStartTLS {
+		if err := client.StartTLS(&tls.Config{ServerName: s.host}); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("STARTTLS failed: %v", err)
+		}
+	}
+
+	if s.auth != nil {
+		if err := client.Auth(s.auth); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("authentication failed: %v", err)
+		}
+	}
+	return client, nil
+}
+
+// send delivers msg over SMTP
+func (s *EmailSink) send(msg []byte) error {
+	client, err := s.dial()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if err := client.Mail(s.from); err != nil {
+		return err
+	}
+	for _, rcpt := range s.to {
+		if err := client.Rcpt(rcpt); err != nil {
+			return fmt.Errorf("recipient %s rejected: %v", rcpt, err)
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+// writeBase64Lines writes data base64-encoded in 76-character lines as required by MIME
+func writeBase64Lines(w io.Writer, data []byte) error {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 0 {
+		n := 76
+		if len(encoded) < n {
+			n = len(encoded)
+		}
+		if _, err := fmt.Fprintf(w, "%s\r\n", encoded[:n]); err != nil {
+			return err
+		}
+		encoded = encoded[n:]
+	}
+	return nil
+}
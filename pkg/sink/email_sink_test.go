@@ -0,0 +1,220 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+// fakeSMTP is a plaintext SMTP server accepting PLAIN auth and keeping the
+// last message and its envelope
+type fakeSMTP struct {
+	listener net.Listener
+
+	mu   sync.Mutex
+	auth string // Decoded PLAIN credentials
+	from string
+	rcpt []string
+	data []byte
+}
+
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeSMTP{listener: listener}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+// port returns the port the server listens on
+func (f *fakeSMTP) port() int {
+	return f.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (f *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 fake ESMTP")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		f.mu.Lock()
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			tp.PrintfLine("250-fake")
+			tp.PrintfLine("250 AUTH PLAIN")
+		case "AUTH":
+			_, encoded, _ := strings.Cut(arg, " ")
+			decoded, _ := base64.StdEncoding.DecodeString(encoded)
+			f.auth = string(decoded)
+			tp.PrintfLine("235 authenticated")
+		case "MAIL":
+			f.from = arg
+			tp.PrintfLine("250 ok")
+		case "RCPT":
+			f.rcpt = append(f.rcpt, arg)
+			tp.PrintfLine("250 ok")
+		case "DATA":
+			tp.PrintfLine("354 go ahead")
+			f.mu.Unlock()
+			data, err := tp.ReadDotBytes()
+			f.mu.Lock()
+			if err != nil {
+				f.mu.Unlock()
+				return
+			}
+			f.data = data
+			tp.PrintfLine("250 queued")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			f.mu.Unlock()
+			return
+		default:
+			tp.PrintfLine("502 unsupported")
+		}
+		f.mu.Unlock()
+	}
+}
+
+func TestEmailSinkMessageStructure(t *testing.T) {
+	server := newFakeSMTP(t)
+	s, err := NewEmailSink(config.EmailConfig{
+		Host:     "127.0.0.1",
+		Port:     server.port(),
+		TLS:      "none",
+		Username: "crawler",
+		Password: "s3cret",
+		From:     "crawler@example.com",
+		To:       []string{"dba@example.com", "ops@example.com"},
+		Subject:  "Report {{len .Metrics}} metrics",
+	}, config.CSVConfig{})
+	if err != nil {
+		t.Fatalf("NewEmailSink() error = %v", err)
+	}
+
+	s.Write("qps", valueRows(1, 2))
+	s.Write("latency", valueRows(0.5))
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	if server.auth != "\x00crawler\x00s3cret" {
+		t.Errorf("auth = %q, want PLAIN credentials", server.auth)
+	}
+	if server.from != "FROM:<crawler@example.com>" || !slices.Equal(server.rcpt, []string{"TO:<dba@example.com>", "TO:<ops@example.com>"}) {
+		t.Errorf("envelope = %s %v, want the sender and both recipients", server.from, server.rcpt)
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(server.data))
+	if err != nil {
+		t.Fatalf("message is not RFC 5322: %v", err)
+	}
+	if got := msg.Header.Get("To"); got != "dba@example.com, ops@example.com" {
+		t.Errorf("To = %q", got)
+	}
+	if subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject")); subject != "Report 2 metrics" {
+		t.Errorf("Subject = %q, want the rendered template", subject)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("Content-Type = %q, want multipart/mixed", msg.Header.Get("Content-Type"))
+	}
+
+	// An HTML summary, then one attachment per metric in name order
+	parts := multipart.NewReader(msg.Body, params["boundary"])
+	var (
+		html        string
+		attachments []string
+		values      = make(map[string][]string)
+	)
+	for {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("NextPart() error = %v", err)
+		}
+		if enc := part.Header.Get("Content-Transfer-Encoding"); enc != "base64" {
+			t.Errorf("part encoding = %q, want base64", enc)
+		}
+		content, err := io.ReadAll(base64.NewDecoder(base64.StdEncoding, part))
+		if err != nil {
+			t.Fatalf("part is not base64: %v", err)
+		}
+
+		if html == "" && len(attachments) == 0 {
+			if ct := part.Header.Get("Content-Type"); ct != "text/html; charset=utf-8" {
+				t.Errorf("first part is %q, want the HTML summary", ct)
+			}
+			html = string(content)
+			continue
+		}
+		disposition, dparams, _ := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+		if disposition != "attachment" || !strings.HasPrefix(part.Header.Get("Content-Type"), "text/csv") {
+			t.Errorf("part %s %s, want a CSV attachment", part.Header.Get("Content-Type"), disposition)
+		}
+		filename := dparams["filename"]
+		attachments = append(attachments, filename)
+		records, err := csv.NewReader(bytes.NewReader(content)).ReadAll()
+		if err != nil {
+			t.Fatalf("attachment %s is not CSV: %v", filename, err)
+		}
+		metric, _, _ := strings.Cut(filename, "_")
+		values[metric] = column(records, "value")
+	}
+
+	if len(attachments) != 2 || !strings.HasPrefix(attachments[0], "latency_") || !strings.HasPrefix(attachments[1], "qps_") {
+		t.Errorf("attachments = %v, want latency then qps", attachments)
+	}
+	if !slices.Equal(values["qps"], []string{"1", "2"}) || !slices.Equal(values["latency"], []string{"0.5"}) {
+		t.Errorf("attachment values = %v", values)
+	}
+	for _, row := range []string{"<td>latency</td><td>1</td>", "<td>qps</td><td>2</td>"} {
+		if !strings.Contains(html, row) {
+			t.Errorf("summary %q lacks %q", html, row)
+		}
+	}
+}
+
+func TestEmailSinkSkipsEmptyRun(t *testing.T) {
+	server := newFakeSMTP(t)
+	s, err := NewEmailSink(config.EmailConfig{
+		Host: "127.0.0.1", Port: server.port(), TLS: "none", From: "a@example.com", To: []string{"b@example.com"},
+	}, config.CSVConfig{})
+	if err != nil {
+		t.Fatalf("NewEmailSink() error = %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if server.data != nil {
+		t.Errorf("sent %d bytes, want no email without data", len(server.data))
+	}
+}
@@ -1,21 +1,84 @@
 package sink
 
 import (
+	"context"
 	"fmt"
+	"strings"
 
 	"github.com/meiking/tidb-metrics-crawler/pkg/config"
 )
 
-// NewSink creates the appropriate sink based on configuration
-func NewSink(cfg config.SinkConfig) (Sink, error) {
-	switch cfg.Type {
-	case "csv":
-		return NewCSVSink(cfg.CSV)
-	case "feishu":
-		return NewFeishuSink(cfg.Feishu)
-	case "mysql":
-		return NewMySQLSink(cfg.MySQL)
+// NewSink creates the appropriate sink based on configuration, wrapped in a
+// SkipNonFiniteSink for non_finite: skip, in a RetryingSink when retries are
+// configured and then in an AsyncSink when async is set. ctx bounds any
+// network I/O the sink performs.
+func NewSink(ctx context.Context, cfg config.SinkConfig) (Sink, error) {
+	constructor, name, ok := lookup(cfg.Type)
+	if !ok {
+		return nil, unknownTypeError(cfg.Type)
+	}
+	cfg.Type = name
+
+	if err := checkNonFinite(cfg.Type, cfg.NonFinite); err != nil {
+		return nil, err
+	}
+
+	s, err := constructor(ctx, withNonFinite(cfg))
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.NonFinite == nonFiniteSkip {
+		s = NewSkipNonFiniteSink(s)
+	}
+
+	if cfg.Retry != nil {
+		retrying, err := NewRetryingSink(ctx, s, *cfg.Retry)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s = retrying
+	}
+
+	if cfg.Async {
+		s = NewAsyncSink(ctx, s, cfg.AsyncBuffer)
+	}
+	return s, nil
+}
+
+// unknownTypeError describes a sink type that is not registered, suggesting
+// the type it most likely meant
+func unknownTypeError(sinkType string) error {
+	available := strings.Join(Types(), ", ")
+	if suggestion := suggestType(sinkType); suggestion != "" {
+		return fmt.Errorf("unsupported sink type: %q, did you mean %q? (available: %s)", sinkType, suggestion, available)
+	}
+	return fmt.Errorf("unsupported sink type: %q (available: %s)", sinkType, available)
+}
+
+// NewFanoutSink creates a MultiSink from several sink configurations.
+// fanout is "serial" (the default) or "parallel".
+func NewFanoutSink(ctx context.Context, cfgs []config.SinkConfig, fanout string) (Sink, error) {
+	var parallel bool
+	switch fanout {
+	case "", "serial":
+	case "parallel":
+		parallel = true
 	default:
-		return nil, fmt.Errorf("unsupported sink type: %s", cfg.Type)
+		return nil, fmt.Errorf("unsupported sink fanout: %s", fanout)
+	}
+
+	sinks := make([]Sink, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		child, err := NewSink(ctx, cfg)
+		if err != nil {
+			// Release the sinks created so far
+			NewMultiSink(sinks, false).Close()
+			return nil, fmt.Errorf("failed to create %s sink: %v", cfg.Type, err)
+		}
+		sinks = append(sinks, child)
 	}
+
+	return NewMultiSink(sinks, parallel), nil
 }
@@ -0,0 +1,205 @@
+package sink
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+// MySQL protocol constants used by fakeMySQL
+const (
+	mysqlClientProtocol41  = 0x00000200
+	mysqlClientSSL         = 0x00000800
+	mysqlClientSecureConn  = 0x00008000
+	mysqlClientPluginAuth  = 0x00080000
+	mysqlClientTransaction = 0x00002000
+
+	mysqlComQuit  = 0x01
+	mysqlComQuery = 0x03
+
+	// mysqlSSLRequestSize is the size of the handshake response a client
+	// sends before switching to TLS
+	mysqlSSLRequestSize = 32
+)
+
+// fakeMySQL speaks enough of the MySQL protocol for the driver to connect
+// and run statements. It accepts any user, answers every query with OK and
+// records the statements of each connection in order. With tlsConfig set it
+// offers TLS and records whether each connection switched to it.
+type fakeMySQL struct {
+	listener  net.Listener
+	tlsConfig *tls.Config
+
+	mu    sync.Mutex
+	conns []*fakeMySQLConn
+}
+
+// fakeMySQLConn is what a fakeMySQL saw of one client connection
+type fakeMySQLConn struct {
+	tls     bool
+	queries []string
+}
+
+// newFakeMySQL starts a fake server, stopped when the test ends
+func newFakeMySQL(t *testing.T, tlsConfig *tls.Config) *fakeMySQL {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeMySQL{listener: listener, tlsConfig: tlsConfig}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+// addr returns the host:port the server listens on
+func (s *fakeMySQL) addr() string {
+	return s.listener.Addr().String()
+}
+
+// connections returns a copy of what each connection saw so far
+func (s *fakeMySQL) connections() []fakeMySQLConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conns := make([]fakeMySQLConn, len(s.conns))
+	for i, c := range s.conns {
+		conns[i] = fakeMySQLConn{tls: c.tls, queries: append([]string(nil), c.queries...)}
+	}
+	return conns
+}
+
+func (s *fakeMySQL) serve(netConn net.Conn) {
+	defer netConn.Close()
+	conn := &fakeMySQLConn{}
+	s.mu.Lock()
+	s.conns = append(s.conns, conn)
+	s.mu.Unlock()
+
+	reader := bufio.NewReader(netConn)
+	p := &mysqlPackets{rw: bufio.NewReadWriter(reader, bufio.NewWriter(netConn))}
+	if err := p.write(s.handshake()); err != nil {
+		return
+	}
+	response, err := p.read()
+	if err != nil {
+		return
+	}
+	if len(response) == mysqlSSLRequestSize && s.tlsConfig != nil {
+		// The client's hello may already be buffered behind the SSL request
+		tlsConn := tls.Server(&bufferedConn{Conn: netConn, reader: reader}, s.tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			return
+		}
+		s.mu.Lock()
+		conn.tls = true
+		s.mu.Unlock()
+		p.rw = bufio.NewReadWriter(bufio.NewReader(tlsConn), bufio.NewWriter(tlsConn))
+		if _, err := p.read(); err != nil {
+			return
+		}
+	}
+	if err := p.write(mysqlOK()); err != nil {
+		return
+	}
+
+	for {
+		p.seq = 0
+		command, err := p.read()
+		if err != nil || len(command) == 0 || command[0] == mysqlComQuit {
+			return
+		}
+		if command[0] == mysqlComQuery {
+			s.mu.Lock()
+			conn.queries = append(conn.queries, string(command[1:]))
+			s.mu.Unlock()
+		}
+		if err := p.write(mysqlOK()); err != nil {
+			return
+		}
+	}
+}
+
+// bufferedConn reads a connection through the reader already buffering it
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// handshake returns the server's initial handshake packet
+func (s *fakeMySQL) handshake() []byte {
+	caps := uint32(mysqlClientProtocol41 | mysqlClientSecureConn | mysqlClientPluginAuth | mysqlClientTransaction)
+	if s.tlsConfig != nil {
+		caps |= mysqlClientSSL
+	}
+	scramble := []byte("0123456789abcdefghij")
+
+	b := []byte{10}                 // Protocol version
+	b = append(b, "8.0.11-fake"...) // Server version
+	b = append(b, 0, 1, 0, 0, 0)    // Connection ID
+	b = append(b, scramble[:8]...)  // Auth data, part 1
+	b = append(b, 0)                // Filler
+	b = binary.LittleEndian.AppendUint16(b, uint16(caps))
+	b = append(b, 45)   // utf8mb4_general_ci
+	b = append(b, 2, 0) // Autocommit
+	b = binary.LittleEndian.AppendUint16(b, uint16(caps>>16))
+	b = append(b, 21)                  // Auth data length
+	b = append(b, make([]byte, 10)...) // Reserved
+	b = append(b, scramble[8:]...)     // Auth data, part 2
+	b = append(b, 0)
+	b = append(b, "mysql_native_password"...)
+	return append(b, 0)
+}
+
+// mysqlOK returns an OK packet with no affected rows
+func mysqlOK() []byte {
+	return []byte{0, 0, 0, 2, 0, 0, 0}
+}
+
+// mysqlPackets reads and writes MySQL packets, tracking the sequence number
+type mysqlPackets struct {
+	rw  *bufio.ReadWriter
+	seq byte
+}
+
+func (p *mysqlPackets) read() ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(p.rw, header[:]); err != nil {
+		return nil, err
+	}
+	size := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+	if size == 0xffffff {
+		return nil, errors.New("fakeMySQL does not support split packets")
+	}
+	p.seq = header[3] + 1
+	payload := make([]byte, size)
+	_, err := io.ReadFull(p.rw, payload)
+	return payload, err
+}
+
+func (p *mysqlPackets) write(payload []byte) error {
+	header := []byte{byte(len(payload)), byte(len(payload) >> 8), byte(len(payload) >> 16), p.seq}
+	p.seq++
+	if _, err := p.rw.Write(append(header, payload...)); err != nil {
+		return err
+	}
+	return p.rw.Flush()
+}
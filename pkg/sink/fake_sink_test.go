@@ -0,0 +1,90 @@
+package sink
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+)
+
+// fakeSink records what is written to it. write, when set, is called with
+// the 1-based number of each Write and may fail it or hold it up. Calls that
+// overlap, which sinks do not allow, are counted.
+type fakeSink struct {
+	write func(call int, metricName string, data []common.ProcessedData) error
+
+	mu     sync.Mutex
+	rows   map[string][]common.ProcessedData // Keyed by metric name
+	calls  int
+	closed int
+
+	active   atomic.Int32
+	overlaps atomic.Int32
+}
+
+func newFakeSink() *fakeSink {
+	return &fakeSink{rows: make(map[string][]common.ProcessedData)}
+}
+
+func (s *fakeSink) Write(metricName string, data []common.ProcessedData) error {
+	defer s.enter()()
+
+	s.mu.Lock()
+	s.calls++
+	call := s.calls
+	s.mu.Unlock()
+
+	if s.write != nil {
+		if err := s.write(call, metricName, data); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rows[metricName] = append(s.rows[metricName], data...)
+	return nil
+}
+
+func (s *fakeSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed++
+	return nil
+}
+
+// enter marks a call into the sink until the returned function is called
+func (s *fakeSink) enter() func() {
+	if s.active.Add(1) > 1 {
+		s.overlaps.Add(1)
+	}
+	return func() { s.active.Add(-1) }
+}
+
+// metricRows returns the rows written for metricName
+func (s *fakeSink) metricRows(metricName string) []common.ProcessedData {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]common.ProcessedData(nil), s.rows[metricName]...)
+}
+
+// writeCalls returns the number of Write calls so far
+func (s *fakeSink) writeCalls() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls
+}
+
+// watermarkSink is a fakeSink that is also a Watermarker, reporting last
+// for every instance and metric unless it is zero
+type watermarkSink struct {
+	*fakeSink
+	last time.Time
+}
+
+func (s *watermarkSink) LastTimestamp(instance, metricName string) (time.Time, bool, error) {
+	defer s.enter()()
+	time.Sleep(time.Millisecond) // Long enough to overlap with a write in progress
+	return s.last, !s.last.IsZero(), nil
+}
@@ -2,19 +2,29 @@ package sink
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log"
 	"mime/multipart"
 	"net/http"
-	"sort"
 	"time"
 
 	"github.com/meiking/tidb-metrics-crawler/pkg/common"
 	"github.com/meiking/tidb-metrics-crawler/pkg/config"
 )
 
+const (
+	// defaultFeishuMaxUpload is the size limit of Feishu's upload_all API
+	defaultFeishuMaxUpload = 20 << 20
+
+	feishuOversizedSplit = "split"
+	feishuOversizedGzip  = "gzip"
+)
+
 // FeishuSink sends processed data as CSV attachments via Feishu
 type FeishuSink struct {
 	appID         string
@@ -22,8 +32,13 @@ type FeishuSink struct {
 	receiveID     string
 	receiveIDType string
 	messageTitle  string
+	maxUpload     int
+	oversized     string
 	accessToken   string
 	tokenExpiry   time.Time
+	formatValue   valueFormatter
+	bom           bool
+	provenance    bool
 	httpClient    *http.Client
 }
 
@@ -36,6 +51,13 @@ type feishuTokenResponse struct {
 	TenantAccessToken string `json:"tenant_access_token"`
 }
 
+// feishuFile is one attachment of a metric
+type feishuFile struct {
+	name     string
+	fileType string
+	content  []byte
+}
+
 // Feishu upload response structure
 type feishuUploadResponse struct {
 	Code int `json:"code"`
@@ -44,14 +66,39 @@ type feishuUploadResponse struct {
 	} `json:"data"`
 }
 
-// NewFeishuSink creates a new Feishu sink
-func NewFeishuSink(cfg config.FeishuConfig) (*FeishuSink, error) {
+// NewFeishuSink creates a new Feishu sink. CSV attachments are formatted
+// according to csvCfg.
+func NewFeishuSink(cfg config.FeishuConfig, csvCfg config.CSVConfig) (*FeishuSink, error) {
+	formatValue, err := newValueFormatter(csvCfg.FloatFormat, csvCfg.NonFinite)
+	if err != nil {
+		return nil, err
+	}
+
+	maxUpload := cfg.MaxUploadBytes
+	if maxUpload <= 0 {
+		maxUpload = defaultFeishuMaxUpload
+	}
+
+	oversized := cfg.Oversized
+	switch oversized {
+	case "":
+		oversized = feishuOversizedSplit
+	case feishuOversizedSplit, feishuOversizedGzip:
+	default:
+		return nil, fmt.Errorf("unsupported feishu oversized mode: %s", cfg.Oversized)
+	}
+
 	return &FeishuSink{
 		appID:         cfg.AppID,
 		appSecret:     cfg.AppSecret,
 		receiveID:     cfg.ReceiveID,
 		receiveIDType: cfg.ReceiveIDType,
 		messageTitle:  cfg.MessageTitle,
+		maxUpload:     maxUpload,
+		oversized:     oversized,
+		formatValue:   formatValue,
+		bom:           csvCfg.BOM,
+		provenance:    csvCfg.Provenance,
 		httpClient: &http.Client{
 			Timeout: 30 * time.Second,
 		},
@@ -66,35 +113,98 @@ func (s *FeishuSink) Write(metricName string, data []common.ProcessedData) error
 
 	// Ensure we have a valid access token
 	if err := s.ensureAccessToken(); err != nil {
-		return fmt.Errorf("failed to get access token: %v", err)
+		return &WriteError{Err: fmt.Errorf("failed to get access token: %w", err)}
 	}
 
 	// Create CSV content in memory
-	csvContent, err := s.createCSVContent(metricName, data)
+	csvContent, err := createCSVContent(data, s.formatValue, s.bom, s.provenance)
 	if err != nil {
 		return fmt.Errorf("failed to create CSV content: %v", err)
 	}
 
-	// Upload file to Feishu
-	fileKey, err := s.uploadFile(metricName, csvContent)
+	files, err := s.prepareFiles(metricName, data, csvContent)
 	if err != nil {
-		return fmt.Errorf("failed to upload file: %v", err)
+		return err
 	}
 
-	// Send message with attachment
-	if err := s.sendMessage(metricName, fileKey); err != nil {
-		return fmt.Errorf("failed to send message: %v", err)
+	for i, file := range files {
+		// Upload file to Feishu
+		fileKey, err := s.uploadFile(file)
+		if err != nil {
+			return retryBeforeFirst(i, fmt.Errorf("failed to upload file %s: %w", file.name, err))
+		}
+
+		// Send message with attachment
+		title := fmt.Sprintf("%s - %s", s.messageTitle, metricName)
+		if len(files) > 1 {
+			title = fmt.Sprintf("%s (part %d/%d)", title, i+1, len(files))
+		}
+		if err := s.sendMessage(title, fileKey); err != nil {
+			return retryBeforeFirst(i, fmt.Errorf("failed to send message: %w", err))
+		}
 	}
 
 	return nil
 }
 
+// retryBeforeFirst returns err as a *WriteError taking nothing when it is
+// about part 0, before any message was sent. Retrying a later part would
+// send the earlier ones again.
+func retryBeforeFirst(part int, err error) error {
+	if part == 0 {
+		return &WriteError{Err: err}
+	}
+	return err
+}
+
+// prepareFiles returns the attachments for a metric: the CSV as is when it
+// fits the upload limit, otherwise gzipped or split into parts
+func (s *FeishuSink) prepareFiles(metricName string, data []common.ProcessedData, csvContent []byte) ([]feishuFile, error) {
+	base := fmt.Sprintf("%s_%s", metricName, time.Now().Format("20060102150405"))
+	if len(csvContent) <= s.maxUpload {
+		return []feishuFile{{name: base + ".csv", fileType: "csv", content: csvContent}}, nil
+	}
+
+	if s.oversized == feishuOversizedGzip {
+		compressed, err := gzipBytes(csvContent)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compress CSV content: %v", err)
+		}
+		if len(compressed) > s.maxUpload {
+			return nil, fmt.Errorf("CSV of metric %s is %d bytes after gzip, above the %d byte upload limit; use oversized: split",
+				metricName, len(compressed), s.maxUpload)
+		}
+		log.Printf("CSV of metric %s is %d bytes, uploading gzipped (%d bytes)", metricName, len(csvContent), len(compressed))
+		return []feishuFile{{name: base + ".csv.gz", fileType: "stream", content: compressed}}, nil
+	}
+
+	parts, err := splitCSVContent(data, s.formatValue, s.bom, s.provenance, s.maxUpload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to split CSV of metric %s: %v", metricName, err)
+	}
+	log.Printf("CSV of metric %s is %d bytes, uploading in %d parts", metricName, len(csvContent), len(parts))
+
+	files := make([]feishuFile, len(parts))
+	for i, part := range parts {
+		files[i] = feishuFile{name: fmt.Sprintf("%s_part%d.csv", base, i+1), fileType: "csv", content: part}
+	}
+	return files, nil
+}
+
 // Close cleans up resources
 func (s *FeishuSink) Close() error {
 	// No resources to clean up for Feishu sink
 	return nil
 }
 
+// Ping checks the app credentials by fetching an access token
+func (s *FeishuSink) Ping(ctx context.Context) error {
+	if err := s.ensureAccessToken(); err != nil {
+		return fmt.Errorf("failed to get Feishu access token: %v", err)
+	}
+	return nil
+}
+
 // ensureAccessToken gets a new token if current one is expired
 func (s *FeishuSink) ensureAccessToken() error {
 	if s.accessToken != "" && time.Now().Before(s.tokenExpiry) {
@@ -146,12 +256,16 @@ func (s *FeishuSink) ensureAccessToken() error {
 }
 
 // createCSVContent generates CSV content in memory
-func (s *FeishuSink) createCSVContent(metricName string, data []common.ProcessedData) ([]byte, error) {
+func createCSVContent(data []common.ProcessedData, formatValue valueFormatter, bom, provenance bool) ([]byte, error) {
 	buffer := &bytes.Buffer{}
+	if bom {
+		buffer.WriteString(utf8BOM)
+	}
 	writer := csv.NewWriter(buffer)
 
 	// Write header
-	header, err := createHeaderRow(data[0])
+	labelKeys := unionLabelKeys(data)
+	header, err := createHeaderRow(labelKeys, provenance)
 	if err != nil {
 		return nil, err
 	}
@@ -161,7 +275,7 @@ func (s *FeishuSink) createCSVContent(metricName string, data []common.Processed
 
 	// Write data rows
 	for _, item := range data {
-		row, err := createDataRow(item)
+		row, err := createDataRow(item, labelKeys, formatValue, provenance)
 		if err != nil {
 			return nil, err
 		}
@@ -178,8 +292,84 @@ func (s *FeishuSink) createCSVContent(metricName string, data []common.Processed
 	return buffer.Bytes(), nil
 }
 
-// createHeaderRow generates CSV header from ProcessedData structure
-func createHeaderRow(data common.ProcessedData) ([]string, error) {
+// splitCSVContent encodes data as CSV files of at most limit bytes each.
+// Every part repeats the BOM and header, so each one is a complete CSV.
+func splitCSVContent(data []common.ProcessedData, formatValue valueFormatter, bom, provenance bool, limit int) ([][]byte, error) {
+	labelKeys := unionLabelKeys(data)
+	header, err := createHeaderRow(labelKeys, provenance)
+	if err != nil {
+		return nil, err
+	}
+
+	// Encode the preamble once and each row on its own to measure it
+	row := &bytes.Buffer{}
+	encoder := csv.NewWriter(row)
+	encode := func(record []string) ([]byte, error) {
+		row.Reset()
+		if err := encoder.Write(record); err != nil {
+			return nil, err
+		}
+		encoder.Flush()
+		if err := encoder.Error(); err != nil {
+			return nil, err
+		}
+		return append([]byte(nil), row.Bytes()...), nil
+	}
+
+	preamble, err := encode(header)
+	if err != nil {
+		return nil, err
+	}
+	if bom {
+		preamble = append([]byte(utf8BOM), preamble...)
+	}
+
+	var parts [][]byte
+	var current []byte
+	for _, item := range data {
+		record, err := createDataRow(item, labelKeys, formatValue, provenance)
+		if err != nil {
+			return nil, err
+		}
+		line, err := encode(record)
+		if err != nil {
+			return nil, err
+		}
+		if len(preamble)+len(line) > limit {
+			return nil, fmt.Errorf("header and a single row take %d bytes, above the %d byte limit", len(preamble)+len(line), limit)
+		}
+
+		if current != nil && len(current)+len(line) > limit {
+			parts = append(parts, current)
+			current = nil
+		}
+		if current == nil {
+			current = append([]byte(nil), preamble...)
+		}
+		current = append(current, line...)
+	}
+	if current != nil {
+		parts = append(parts, current)
+	}
+	return parts, nil
+}
+
+// gzipBytes compresses content with gzip
+func gzipBytes(content []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(content); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// createHeaderRow generates CSV header from the fixed columns and label
+// keys, with job and run_id columns when provenance is set
+func createHeaderRow(labelKeys []string, provenance bool) ([]string, error) {
 	// Start with fixed columns
 	header := []string{
 		"prometheus_instance",
@@ -187,34 +377,26 @@ func createHeaderRow(data common.ProcessedData) ([]string, error) {
 		"timestamp",
 		"value",
 	}
-
-	// Add label keys sorted alphabetically for consistent ordering
-	labelKeys := make([]string, 0, len(data.Labels))
-	for k := range data.Labels {
-		labelKeys = append(labelKeys, k)
+	if provenance {
+		header = append(header, "job", "run_id")
 	}
-	sort.Strings(labelKeys)
 
 	header = append(header, labelKeys...)
 	return header, nil
 }
 
 // createDataRow converts ProcessedData to a CSV row
-func createDataRow(data common.ProcessedData) ([]string, error) {
+func createDataRow(data common.ProcessedData, labelKeys []string, formatValue valueFormatter, provenance bool) ([]string, error) {
 	// Start with fixed fields
 	row := []string{
 		data.PrometheusInstance,
 		data.MetricName,
 		data.Timestamp.Format(time.RFC3339),
-		fmt.Sprintf("%v", data.Value),
+		formatValue(data.Value),
 	}
-
-	// Get sorted label keys to match header order
-	labelKeys := make([]string, 0, len(data.Labels))
-	for k := range data.Labels {
-		labelKeys = append(labelKeys, k)
+	if provenance {
+		row = append(row, data.Job, data.RunID)
 	}
-	sort.Strings(labelKeys)
 
 	// Add label values in the same order as header
 	for _, k := range labelKeys {
@@ -224,8 +406,8 @@ func createDataRow(data common.ProcessedData) ([]string, error) {
 	return row, nil
 }
 
-// uploadFile uploads CSV content to Feishu
-func (s *FeishuSink) uploadFile(metricName string, content []byte) (string, error) {
+// uploadFile uploads an attachment to Feishu
+func (s *FeishuSink) uploadFile(file feishuFile) (string, error) {
 	url := "https://open.feishu.cn/open-apis/drive/v1/files/upload_all"
 
 	// Create multipart form data
@@ -233,16 +415,16 @@ func (s *FeishuSink) uploadFile(metricName string, content []byte) (string, erro
 	writer := multipart.NewWriter(body)
 
 	// Add file content
-	part, err := writer.CreateFormFile("file", fmt.Sprintf("%s_%s.csv", metricName, time.Now().Format("20060102150405")))
+	part, err := writer.CreateFormFile("file", file.name)
 	if err != nil {
 		return "", err
 	}
-	if _, err := part.Write(content); err != nil {
+	if _, err := part.Write(file.content); err != nil {
 		return "", err
 	}
 
 	// Add other fields
-	if err := writer.WriteField("file_type", "csv"); err != nil {
+	if err := writer.WriteField("file_type", file.fileType); err != nil {
 		return "", err
 	}
 	if err := writer.WriteField("folder_token", ""); err != nil {
@@ -268,6 +450,9 @@ func (s *FeishuSink) uploadFile(metricName string, content []byte) (string, erro
 	if err != nil {
 		return "", err
 	}
+	if resp.StatusCode != http.StatusOK {
+		return "", &StatusError{StatusCode: resp.StatusCode, Body: string(respBody)}
+	}
 
 	var uploadResp feishuUploadResponse
 	if err := json.Unmarshal(respBody, &uploadResp); err != nil {
@@ -282,7 +467,7 @@ func (s *FeishuSink) uploadFile(metricName string, content []byte) (string, erro
 }
 
 // sendMessage sends a message with file attachment
-func (s *FeishuSink) sendMessage(metricName, fileKey string) error {
+func (s *FeishuSink) sendMessage(title, fileKey string) error {
 	url := fmt.Sprintf("https://open.feishu.cn/open-apis/im/v1/messages?receive_id_type=%s", s.receiveIDType)
 
 	payload, err := json.Marshal(map[string]interface{}{
@@ -290,7 +475,7 @@ func (s *FeishuSink) sendMessage(metricName, fileKey string) error {
 		"msg_type":   "file",
 		"content": map[string]string{
 			"file_key": fileKey,
-			"title":    fmt.Sprintf("%s - %s", s.messageTitle, metricName),
+			"title":    title,
 		},
 	})
 	if err != nil {
@@ -312,7 +497,7 @@ func (s *FeishuSink) sendMessage(metricName, fileKey string) error {
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("message send failed: %s (status: %d)", string(body), resp.StatusCode)
+		return fmt.Errorf("message send failed: %w", &StatusError{StatusCode: resp.StatusCode, Body: string(body)})
 	}
 
 	return nil
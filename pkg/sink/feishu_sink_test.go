@@ -0,0 +1,143 @@
+package sink
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+func TestSplitCSVContentParts(t *testing.T) {
+	// Labels that need quoting, one spanning lines
+	data := valueRows(make([]float64, 200)...)
+	for i := range data {
+		data[i].Labels = map[string]string{"job": "tidb", "sql": fmt.Sprintf("SELECT a, \"b\"\nFROM t%d", i)}
+	}
+	formatValue, err := newValueFormatter("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	whole, err := createCSVContent(data, formatValue, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const limit = 2000
+	parts, err := splitCSVContent(data, formatValue, true, false, limit)
+	if err != nil {
+		t.Fatalf("splitCSVContent() error = %v", err)
+	}
+	if len(parts) < 2 {
+		t.Fatalf("split %d bytes into %d parts, want several of at most %d", len(whole), len(parts), limit)
+	}
+
+	var header []string
+	var rows [][]string
+	for i, part := range parts {
+		if len(part) > limit {
+			t.Errorf("part %d is %d bytes, above the %d byte limit", i+1, len(part), limit)
+		}
+		if !bytes.HasPrefix(part, []byte(utf8BOM)) {
+			t.Errorf("part %d does not start with the BOM", i+1)
+		}
+		records, err := csv.NewReader(bytes.NewReader(part[len(utf8BOM):])).ReadAll()
+		if err != nil {
+			t.Fatalf("part %d is not valid CSV: %v", i+1, err)
+		}
+		if i == 0 {
+			header = records[0]
+		} else if strings.Join(records[0], ",") != strings.Join(header, ",") {
+			t.Errorf("part %d header = %v, want %v", i+1, records[0], header)
+		}
+		rows = append(rows, records[1:]...)
+	}
+
+	// The parts hold every row once, in order, as the unsplit CSV does
+	wholeRecords, err := csv.NewReader(bytes.NewReader(whole[len(utf8BOM):])).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != len(wholeRecords)-1 {
+		t.Fatalf("parts hold %d rows, want %d", len(rows), len(wholeRecords)-1)
+	}
+	for i, row := range rows {
+		if strings.Join(row, ",") != strings.Join(wholeRecords[i+1], ",") {
+			t.Fatalf("row %d = %v, want %v", i, row, wholeRecords[i+1])
+		}
+	}
+}
+
+func TestSplitCSVContentRowAboveLimit(t *testing.T) {
+	formatValue, _ := newValueFormatter("", "")
+	_, err := splitCSVContent(valueRows(1), formatValue, false, false, 50)
+	if err == nil || !strings.Contains(err.Error(), "above the 50 byte limit") {
+		t.Errorf("splitCSVContent() error = %v, want a row above the limit", err)
+	}
+}
+
+func TestFeishuPrepareFiles(t *testing.T) {
+	data := valueRows(make([]float64, 100)...)
+
+	tests := []struct {
+		oversized string
+		maxUpload int
+		names     []string // Suffixes of the file names
+		fileType  string
+	}{
+		{"", 1 << 20, []string{".csv"}, "csv"},
+		{"split", 2500, []string{"_part1.csv", "_part2.csv"}, "csv"},
+		{"gzip", 2500, []string{".csv.gz"}, "stream"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.oversized, func(t *testing.T) {
+			s, err := NewFeishuSink(config.FeishuConfig{MaxUploadBytes: tt.maxUpload, Oversized: tt.oversized}, config.CSVConfig{})
+			if err != nil {
+				t.Fatalf("NewFeishuSink() error = %v", err)
+			}
+			content, err := createCSVContent(data, s.formatValue, s.bom, s.provenance)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			files, err := s.prepareFiles("qps", data, content)
+			if err != nil {
+				t.Fatalf("prepareFiles() error = %v", err)
+			}
+			if len(files) != len(tt.names) {
+				t.Fatalf("prepareFiles() = %d files, want %d", len(files), len(tt.names))
+			}
+			var rows int
+			for i, file := range files {
+				if !strings.HasPrefix(file.name, "qps_") || !strings.HasSuffix(file.name, tt.names[i]) {
+					t.Errorf("file %d is named %s, want qps_<time>%s", i+1, file.name, tt.names[i])
+				}
+				if file.fileType != tt.fileType || len(file.content) > tt.maxUpload {
+					t.Errorf("file %s is %s of %d bytes, want %s within %d", file.name, file.fileType, len(file.content), tt.fileType, tt.maxUpload)
+				}
+				body := file.content
+				if tt.oversized == "gzip" {
+					zr, err := gzip.NewReader(bytes.NewReader(body))
+					if err != nil {
+						t.Fatalf("file %s is not gzip: %v", file.name, err)
+					}
+					if body, err = io.ReadAll(zr); err != nil {
+						t.Fatal(err)
+					}
+				}
+				records, err := csv.NewReader(bytes.NewReader(body)).ReadAll()
+				if err != nil {
+					t.Fatalf("file %s is not valid CSV: %v", file.name, err)
+				}
+				rows += len(records) - 1
+			}
+			if rows != len(data) {
+				t.Errorf("files hold %d rows, want %d", rows, len(data))
+			}
+		})
+	}
+}
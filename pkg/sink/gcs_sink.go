@@ -0,0 +1,65 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"google.golang.org/api/option"
+)
+
+// gcsUploader uploads objects to a Cloud Storage bucket
+type gcsUploader struct {
+	client *storage.Client
+	bucket string
+}
+
+// NewGCSSink creates a sink uploading CSV objects to a Cloud Storage bucket
+func NewGCSSink(ctx context.Context, cfg config.GCSConfig) (*ObjectSink, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("gcs bucket is required")
+	}
+
+	// Emulators accept unauthenticated requests. The endpoint is the server
+	// root; the client expects the JSON API path.
+	var opts []option.ClientOption
+	if cfg.Endpoint != "" {
+		endpoint := strings.TrimSuffix(cfg.Endpoint, "/") + "/storage/v1/"
+		opts = append(opts, option.WithEndpoint(endpoint), option.WithoutAuthentication())
+	}
+
+	client, err := storage.NewClient(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Cloud Storage client: %v", err)
+	}
+
+	s, err := newObjectSink(ctx, &gcsUploader{client: client, bucket: cfg.Bucket}, cfg.ObjectStoreConfig)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// upload stores body as a single object, replacing any existing object
+func (u *gcsUploader) upload(ctx context.Context, key, contentType string, body []byte) error {
+	w := u.client.Bucket(u.bucket).Object(key).NewWriter(ctx)
+	w.ContentType = contentType
+	w.ChunkSize = 0 // The body is in memory; send it in one request
+
+	if _, err := w.Write(body); err != nil {
+		w.Close()
+		return fmt.Errorf("failed to upload to gs://%s/%s: %v", u.bucket, key, err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to upload to gs://%s/%s: %v", u.bucket, key, err)
+	}
+	return nil
+}
+
+// close releases the client's connections
+func (u *gcsUploader) close() error {
+	return u.client.Close()
+}
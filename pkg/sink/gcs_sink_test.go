@@ -0,0 +1,187 @@
+package sink
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+// fakeGCS serves the media uploads of the Cloud Storage JSON API and keeps
+// the objects in memory
+type fakeGCS struct {
+	*httptest.Server
+
+	mu           sync.Mutex
+	objects      map[string][]byte // Keyed by bucket/name
+	contentTypes map[string]string
+}
+
+func newFakeGCS(t *testing.T) *fakeGCS {
+	f := &fakeGCS{objects: make(map[string][]byte), contentTypes: make(map[string]string)}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serveUpload))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// serveUpload stores a multipart upload: a JSON metadata part followed by
+// the object's content
+func (f *fakeGCS) serveUpload(w http.ResponseWriter, r *http.Request) {
+	bucket, ok := strings.CutPrefix(r.URL.Path, "/upload/storage/v1/b/")
+	bucket, ok2 := strings.CutSuffix(bucket, "/o")
+	if r.Method != http.MethodPost || !ok || !ok2 || r.URL.Query().Get("uploadType") != "multipart" {
+		http.Error(w, "unexpected request "+r.Method+" "+r.URL.String(), http.StatusNotFound)
+		return
+	}
+
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	parts := multipart.NewReader(r.Body, params["boundary"])
+	var meta struct {
+		Name        string `json:"name"`
+		ContentType string `json:"contentType"`
+	}
+	part, err := parts.NextPart()
+	if err == nil {
+		err = json.NewDecoder(part).Decode(&meta)
+	}
+	if err == nil {
+		part, err = parts.NextPart()
+	}
+	var body []byte
+	if err == nil {
+		body, err = io.ReadAll(part)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	f.objects[bucket+"/"+meta.Name] = body
+	f.contentTypes[bucket+"/"+meta.Name] = meta.ContentType
+	f.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"bucket": bucket, "name": meta.Name, "size": strconv.Itoa(len(body))})
+}
+
+// object returns the stored object whose key starts with prefix
+func (f *fakeGCS) object(t *testing.T, prefix string) (string, []byte) {
+	t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for key, body := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			return key, body
+		}
+	}
+	t.Fatalf("no object %s* among %d", prefix, len(f.objects))
+	return "", nil
+}
+
+func TestGCSSinkUploadsOnClose(t *testing.T) {
+	server := newFakeGCS(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	s, err := NewGCSSink(ctx, config.GCSConfig{
+		Bucket:            "metrics",
+		Endpoint:          server.URL,
+		ObjectStoreConfig: config.ObjectStoreConfig{Prefix: "runs/{{.MetricName}}", Gzip: true},
+	})
+	if err != nil {
+		t.Fatalf("NewGCSSink() error = %v", err)
+	}
+
+	rows := valueRows(1, 2, 3)
+	if err := s.Write("qps", rows); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	// An interrupted run still uploads what it collected
+	cancel()
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	key, body := server.object(t, "metrics/runs/qps/qps_")
+	if !strings.HasSuffix(key, ".csv.gz") || server.contentTypes[key] != "application/gzip" {
+		t.Errorf("object %s has content type %q, want a .csv.gz of application/gzip", key, server.contentTypes[key])
+	}
+	records := readObjectCSV(t, body, true)
+	if values := column(records, "value"); !slices.Equal(values, []string{"1", "2", "3"}) {
+		t.Errorf("object values = %v, want [1 2 3]", values)
+	}
+	if manifest, _ := server.object(t, "metrics/runs/manifest_"); !strings.HasSuffix(manifest, ".json") {
+		t.Errorf("manifest key = %s, want a .json under the prefix", manifest)
+	}
+}
+
+func TestGCSSinkWidensHeader(t *testing.T) {
+	for _, gz := range []bool{false, true} {
+		t.Run(map[bool]string{false: "plain", true: "gzip"}[gz], func(t *testing.T) {
+			server := newFakeGCS(t)
+			s, err := NewGCSSink(context.Background(), config.GCSConfig{
+				Bucket:            "metrics",
+				Endpoint:          server.URL,
+				ObjectStoreConfig: config.ObjectStoreConfig{Gzip: gz},
+			})
+			if err != nil {
+				t.Fatalf("NewGCSSink() error = %v", err)
+			}
+
+			first, second := valueRows(1), valueRows(2)
+			second[0].Labels = map[string]string{"job": "tidb", "instance": "tidb-0"}
+			if err := s.Write("qps", first); err != nil {
+				t.Fatalf("Write() error = %v", err)
+			}
+			if err := s.Write("qps", second); err != nil {
+				t.Fatalf("Write() error = %v", err)
+			}
+			if err := s.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+
+			_, body := server.object(t, "metrics/qps_")
+			records := readObjectCSV(t, body, gz)
+			if got := column(records, "label_instance"); !slices.Equal(got, []string{"", "tidb-0"}) {
+				t.Errorf("label_instance = %v, want the earlier row empty and the later one kept", got)
+			}
+			if got := column(records, "label_job"); !slices.Equal(got, []string{"tidb", "tidb"}) {
+				t.Errorf("label_job = %v, want both rows' job", got)
+			}
+		})
+	}
+}
+
+// readObjectCSV parses an uploaded object
+func readObjectCSV(t *testing.T, body []byte, compressed bool) [][]string {
+	t.Helper()
+	var in io.Reader = bytes.NewReader(body)
+	if compressed {
+		gz, err := gzip.NewReader(in)
+		if err != nil {
+			t.Fatalf("object is not gzip: %v", err)
+		}
+		in = gz
+	}
+	records, err := csv.NewReader(in).ReadAll()
+	if err != nil {
+		t.Fatalf("object is not CSV: %v", err)
+	}
+	return records
+}
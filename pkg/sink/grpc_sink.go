@@ -0,0 +1,323 @@
+package sink
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	// defaultGRPCMethod is the Write method of proto/ingest.proto
+	defaultGRPCMethod = "/tidbmetricscrawler.ingest.v1.Ingest/Write"
+
+	// defaultGRPCBatchSize is the number of samples per WriteRequest
+	defaultGRPCBatchSize = 500
+
+	// defaultGRPCReconnects is how many times a failed stream is reopened per message
+	defaultGRPCReconnects = 3
+
+	// grpcCloseTimeout bounds waiting for the server's summary on close
+	grpcCloseTimeout = 30 * time.Second
+)
+
+// GRPCSink streams samples to an ingestion service over a client-streaming
+// RPC (see proto/ingest.proto). Sends block while the server applies HTTP/2
+// flow control, so a slow server slows the crawl instead of filling memory.
+type GRPCSink struct {
+	ctx           context.Context
+	conn          *grpc.ClientConn
+	method        string
+	metadata      metadata.MD
+	batchSize     int
+	maxReconnects int
+	stream        grpc.ClientStream // Nil until the first write and after a stream failure
+	streamSamples int               // Samples sent on the current stream
+	unconfirmed   int               // Samples sent on streams that failed before the server's summary
+}
+
+// grpcStreamDesc describes the client-streaming Write method
+var grpcStreamDesc = &grpc.StreamDesc{StreamName: "Write", ClientStreams: true}
+
+// NewGRPCSink creates a new gRPC sink. The stream is bound to ctx.
+func NewGRPCSink(ctx context.Context, cfg config.GRPCConfig) (*GRPCSink, error) {
+	if cfg.Target == "" {
+		return nil, fmt.Errorf("grpc target is required")
+	}
+
+	method := cfg.Method
+	if method == "" {
+		method = defaultGRPCMethod
+	}
+
+	batchSize := cfg.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultGRPCBatchSize
+	}
+
+	maxReconnects := cfg.MaxReconnects
+	if maxReconnects == 0 {
+		maxReconnects = defaultGRPCReconnects
+	} else if maxReconnects < 0 {
+		maxReconnects = 0
+	}
+
+	creds := credentials.NewTLS(&tls.Config{ServerName: cfg.TLSServerName})
+	if cfg.Insecure {
+		creds = insecure.NewCredentials()
+	}
+	conn, err := grpc.NewClient(cfg.Target, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gRPC client: %v", err)
+	}
+
+	return &GRPCSink{
+		ctx:           ctx,
+		conn:          conn,
+		method:        method,
+		metadata:      metadata.New(cfg.Metadata),
+		batchSize:     batchSize,
+		maxReconnects: maxReconnects,
+	}, nil
+}
+
+// Write sends the data as WriteRequest messages of up to batch_size samples
+func (s *GRPCSink) Write(metricName string, data []common.ProcessedData) error {
+	for start := 0; start < len(data); start += s.batchSize {
+		end := start + s.batchSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		msg := encodeWriteRequest(metricName, data[start:end])
+		if err := s.send(msg, end-start); err != nil {
+			return fmt.Errorf("failed to send metric %s: %v", metricName, err)
+		}
+	}
+	return nil
+}
+
+// Close half-closes the stream and waits for the server's summary
+func (s *GRPCSink) Close() error {
+	defer s.conn.Close()
+
+	var err error
+	if s.stream != nil {
+		err = s.finish()
+	}
+	if err == nil && s.unconfirmed > 0 {
+		err = fmt.Errorf("%d samples were sent on failed streams and may not have been stored", s.unconfirmed)
+	}
+	return err
+}
+
+// send sends one message, reopening the stream when it fails
+func (s *GRPCSink) send(msg grpcRawMessage, samples int) error {
+	for attempt := 0; ; attempt++ {
+		err := s.trySend(msg)
+		if err == nil {
+			s.streamSamples += samples
+			return nil
+		}
+
+		// Whatever the failed stream carried is unconfirmed
+		s.unconfirmed += s.streamSamples
+		s.stream, s.streamSamples = nil, 0
+
+		if attempt >= s.maxReconnects || s.ctx.Err() != nil {
+			return err
+		}
+		wait := time.Duration(1<<attempt) * time.Second
+		log.Printf("gRPC stream failed: %v, reconnecting in %v", err, wait)
+		if err := sleepContext(s.ctx, wait); err != nil {
+			return err
+		}
+	}
+}
+
+// trySend opens the stream if needed and sends msg on it
+func (s *GRPCSink) trySend(msg grpcRawMessage) error {
+	if s.stream == nil {
+		ctx := metadata.NewOutgoingContext(s.ctx, s.metadata)
+		stream, err := s.conn.NewStream(ctx, grpcStreamDesc, s.method, grpc.ForceCodec(grpcRawCodec{}))
+		if err != nil {
+			return fmt.Errorf("failed to open stream: %v", err)
+		}
+		s.stream = stream
+	}
+
+	err := s.stream.SendMsg(msg)
+	if errors.Is(err, io.EOF) {
+		// The stream was aborted; the status is only available from RecvMsg
+		var reply grpcRawMessage
+		if recvErr := s.stream.RecvMsg(&reply); recvErr != nil {
+			err = recvErr
+		}
+	}
+	return err
+}
+
+// finish half-closes the stream and checks the server's summary
+func (s *GRPCSink) finish() error {
+	if err := s.stream.CloseSend(); err != nil {
+		return fmt.Errorf("failed to close stream: %v", err)
+	}
+
+	done := make(chan error, 1)
+	var reply grpcRawMessage
+	go func() {
+		done <- s.stream.RecvMsg(&reply)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			s.unconfirmed += s.streamSamples
+			return fmt.Errorf("stream failed: %v", err)
+		}
+	case <-time.After(grpcCloseTimeout):
+		s.unconfirmed += s.streamSamples
+		return fmt.Errorf("timed out waiting for the server's summary")
+	}
+
+	summary, err := decodeWriteSummary(reply)
+	if err != nil {
+		return fmt.Errorf("invalid summary: %v", err)
+	}
+	log.Printf("gRPC server accepted %d and rejected %d of %d samples", summary.accepted, summary.rejected, s.streamSamples)
+	if summary.rejected > 0 {
+		return fmt.Errorf("server rejected %d samples: %s", summary.rejected, summary.message)
+	}
+	return nil
+}
+
+// grpcRawMessage is an encoded protobuf message
+type grpcRawMessage []byte
+
+// grpcRawCodec passes pre-encoded messages through. It is named "proto" so
+// servers decode them with their generated protobuf code.
+type grpcRawCodec struct{}
+
+func (grpcRawCodec) Marshal(v interface{}) ([]byte, error) {
+	msg, ok := v.(grpcRawMessage)
+	if !ok {
+		return nil, fmt.Errorf("unexpected message type %T", v)
+	}
+	return msg, nil
+}
+
+func (grpcRawCodec) Unmarshal(data []byte, v interface{}) error {
+	msg, ok := v.(*grpcRawMessage)
+	if !ok {
+		return fmt.Errorf("unexpected message type %T", v)
+	}
+	*msg = append((*msg)[:0], data...)
+	return nil
+}
+
+func (grpcRawCodec) Name() string {
+	return "proto"
+}
+
+// encodeWriteRequest encodes data as a WriteRequest
+func encodeWriteRequest(metricName string, data []common.ProcessedData) grpcRawMessage {
+	var msg []byte
+	for _, item := range data {
+		msg = protowire.AppendTag(msg, 1, protowire.BytesType)
+		msg = protowire.AppendBytes(msg, encodeSample(metricName, item))
+	}
+	return msg
+}
+
+// encodeSample encodes one Sample; fields with default values are omitted as in proto3
+func encodeSample(metricName string, item common.ProcessedData) []byte {
+	var b []byte
+	b = appendStringField(b, 1, metricName)
+	b = appendStringField(b, 2, item.PrometheusInstance)
+	if ts := item.Timestamp.UnixNano(); ts != 0 {
+		b = protowire.AppendTag(b, 3, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(ts))
+	}
+	if item.Value != 0 {
+		b = protowire.AppendTag(b, 4, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(item.Value))
+	}
+	for _, k := range common.SortedLabelKeys(item.Labels) {
+		var entry []byte
+		entry = appendStringField(entry, 1, k)
+		entry = appendStringField(entry, 2, item.Labels[k])
+		b = protowire.AppendTag(b, 5, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	b = appendStringField(b, 6, item.Job)
+	b = appendStringField(b, 7, item.RunID)
+	return b
+}
+
+// appendStringField appends a non-empty string field
+func appendStringField(b []byte, num protowire.Number, value string) []byte {
+	if value == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, value)
+}
+
+// grpcWriteSummary is the decoded WriteSummary
+type grpcWriteSummary struct {
+	accepted int64
+	rejected int64
+	message  string
+}
+
+// decodeWriteSummary decodes a WriteSummary, skipping unknown fields
+func decodeWriteSummary(b []byte) (grpcWriteSummary, error) {
+	var summary grpcWriteSummary
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return summary, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return summary, protowire.ParseError(n)
+			}
+			summary.accepted, b = int64(v), b[n:]
+		case num == 2 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return summary, protowire.ParseError(n)
+			}
+			summary.rejected, b = int64(v), b[n:]
+		case num == 3 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return summary, protowire.ParseError(n)
+			}
+			summary.message, b = v, b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return summary, protowire.ParseError(n)
+			}
+			b = b[n:]
+		}
+	}
+	return summary, nil
+}
@@ -0,0 +1,274 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// grpcSample is a decoded Sample
+type grpcSample struct {
+	metric    string
+	instance  string
+	timestamp int64
+	value     float64
+	labels    map[string]string
+}
+
+// fakeIngest implements the Ingest service of proto/ingest.proto over
+// bufconn, recording the samples of each stream. With failFirst the first
+// stream is aborted after its first message.
+type fakeIngest struct {
+	failFirst bool
+	rejected  int64
+	failed    chan struct{} // Closed once the first stream was aborted
+
+	mu      sync.Mutex
+	methods []string
+	md      []metadata.MD
+	streams [][]grpcSample
+}
+
+// newGRPCTestSink starts server and returns a sink connected to it
+func newGRPCTestSink(t *testing.T, server *fakeIngest) *GRPCSink {
+	t.Helper()
+	server.failed = make(chan struct{})
+	listener := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer(grpc.ForceServerCodec(grpcRawCodec{}), grpc.UnknownServiceHandler(server.handle))
+	go srv.Serve(listener)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &GRPCSink{
+		ctx:           context.Background(),
+		conn:          conn,
+		method:        defaultGRPCMethod,
+		metadata:      metadata.Pairs("x-tenant", "ops"),
+		batchSize:     2,
+		maxReconnects: defaultGRPCReconnects,
+	}
+}
+
+func (f *fakeIngest) handle(_ interface{}, stream grpc.ServerStream) error {
+	method, _ := grpc.MethodFromServerStream(stream)
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	f.mu.Lock()
+	index := len(f.streams)
+	f.methods = append(f.methods, method)
+	f.md = append(f.md, md)
+	f.streams = append(f.streams, nil)
+	f.mu.Unlock()
+
+	for {
+		var msg grpcRawMessage
+		err := stream.RecvMsg(&msg)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		samples, err := decodeWriteRequest(msg)
+		if err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		f.mu.Lock()
+		f.streams[index] = append(f.streams[index], samples...)
+		f.mu.Unlock()
+
+		if f.failFirst && index == 0 {
+			defer close(f.failed)
+			return status.Error(codes.Unavailable, "server restarting")
+		}
+	}
+
+	f.mu.Lock()
+	accepted := int64(len(f.streams[index])) - f.rejected
+	f.mu.Unlock()
+	var summary []byte
+	summary = protowire.AppendTag(summary, 1, protowire.VarintType)
+	summary = protowire.AppendVarint(summary, uint64(accepted))
+	if f.rejected > 0 {
+		summary = protowire.AppendTag(summary, 2, protowire.VarintType)
+		summary = protowire.AppendVarint(summary, uint64(f.rejected))
+		summary = appendStringField(summary, 3, "value out of range")
+	}
+	return stream.SendMsg(grpcRawMessage(summary))
+}
+
+// received returns the samples of each stream
+func (f *fakeIngest) received() [][]grpcSample {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([][]grpcSample(nil), f.streams...)
+}
+
+// decodeWriteRequest decodes the samples of a WriteRequest
+func decodeWriteRequest(b []byte) ([]grpcSample, error) {
+	var samples []grpcSample
+	err := consumeFields(b, func(num protowire.Number, v []byte, u uint64) error {
+		if num != 1 {
+			return nil
+		}
+		sample := grpcSample{labels: make(map[string]string)}
+		err := consumeFields(v, func(num protowire.Number, v []byte, u uint64) error {
+			switch num {
+			case 1:
+				sample.metric = string(v)
+			case 2:
+				sample.instance = string(v)
+			case 3:
+				sample.timestamp = int64(u)
+			case 4:
+				sample.value = math.Float64frombits(u)
+			case 5:
+				var key, value string
+				consumeFields(v, func(num protowire.Number, v []byte, _ uint64) error {
+					if num == 1 {
+						key = string(v)
+					} else {
+						value = string(v)
+					}
+					return nil
+				})
+				sample.labels[key] = value
+			}
+			return nil
+		})
+		samples = append(samples, sample)
+		return err
+	})
+	return samples, err
+}
+
+// consumeFields calls field with each field of a message: the bytes of
+// length-delimited fields, the number of the others
+func consumeFields(b []byte, field func(num protowire.Number, v []byte, u uint64) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		var v []byte
+		var u uint64
+		switch typ {
+		case protowire.BytesType:
+			v, n = protowire.ConsumeBytes(b)
+		case protowire.VarintType:
+			u, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			u, n = protowire.ConsumeFixed64(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if err := field(num, v, u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestGRPCSinkStreamsSamples(t *testing.T) {
+	server := &fakeIngest{}
+	s := newGRPCTestSink(t, server)
+
+	rows := valueRows(0, 1.5, -2)
+	if err := s.Write("qps", rows); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := s.Write("tps", valueRows(3)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	streams := server.received()
+	if len(streams) != 1 {
+		t.Fatalf("server saw %d streams, want every write on one", len(streams))
+	}
+	if server.methods[0] != defaultGRPCMethod || strings.Join(server.md[0].Get("x-tenant"), ",") != "ops" {
+		t.Errorf("stream called %s with metadata %v, want %s with x-tenant: ops", server.methods[0], server.md[0], defaultGRPCMethod)
+	}
+
+	samples := streams[0]
+	want := []grpcSample{
+		{metric: "qps", instance: "prom", timestamp: rows[0].Timestamp.UnixNano(), value: 0},
+		{metric: "qps", instance: "prom", timestamp: rows[1].Timestamp.UnixNano(), value: 1.5},
+		{metric: "qps", instance: "prom", timestamp: rows[2].Timestamp.UnixNano(), value: -2},
+		{metric: "tps", instance: "prom", timestamp: rows[0].Timestamp.UnixNano(), value: 3},
+	}
+	if len(samples) != len(want) {
+		t.Fatalf("server got %d samples, want %d", len(samples), len(want))
+	}
+	for i, got := range samples {
+		if got.metric != want[i].metric || got.instance != want[i].instance || got.timestamp != want[i].timestamp || got.value != want[i].value || got.labels["job"] != "tidb" {
+			t.Errorf("sample %d = %+v, want %+v with label job", i, got, want[i])
+		}
+	}
+}
+
+func TestGRPCSinkReportsRejected(t *testing.T) {
+	server := &fakeIngest{rejected: 1}
+	s := newGRPCTestSink(t, server)
+	if err := s.Write("qps", valueRows(1, 2)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	err := s.Close()
+	if err == nil || !strings.Contains(err.Error(), "server rejected 1 samples: value out of range") {
+		t.Errorf("Close() error = %v, want the rejected samples", err)
+	}
+}
+
+func TestGRPCSinkReconnects(t *testing.T) {
+	server := &fakeIngest{failFirst: true}
+	s := newGRPCTestSink(t, server)
+
+	if err := s.Write("qps", valueRows(1, 2)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	select {
+	case <-server.failed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the server never aborted the first stream")
+	}
+	time.Sleep(100 * time.Millisecond) // Let the client receive the status
+
+	// The next message finds the stream aborted and goes out on a new one
+	if err := s.Write("qps", valueRows(3)); err != nil {
+		t.Fatalf("Write() after the stream failed error = %v", err)
+	}
+	err := s.Close()
+
+	streams := server.received()
+	if len(streams) != 2 || len(streams[0]) != 2 || len(streams[1]) != 1 || streams[1][0].value != 3 {
+		t.Fatalf("server streams = %v, want the first two samples then a new stream with the third", streams)
+	}
+	if err == nil || !strings.Contains(err.Error(), "2 samples were sent on failed streams") {
+		t.Errorf("Close() error = %v, want the samples of the aborted stream reported", err)
+	}
+}
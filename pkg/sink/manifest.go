@@ -0,0 +1,129 @@
+package sink
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+)
+
+// RunReport describes a finished run for sinks that record it next to
+// their output
+type RunReport struct {
+	RunID        string         `json:"run_id"`
+	Duration     string         `json:"duration"`
+	Rows         map[string]int `json:"rows"`                    // Rows written per metric
+	EmptyMetrics []string       `json:"empty_metrics,omitempty"` // Metrics that produced no file
+	Failures     []RunFailure   `json:"failures,omitempty"`
+	Truncated    map[string]int `json:"truncated,omitempty"` // Samples dropped per metric by max_samples_per_batch
+}
+
+// RunFailure is a metric that failed on an instance
+type RunFailure struct {
+	Metric   string `json:"metric"`
+	Instance string `json:"instance"`
+	Error    string `json:"error"`
+}
+
+// RunRecorder is implemented by sinks that write the run report with their
+// output. RecordRun is called once, after the last Write and before Close.
+type RunRecorder interface {
+	RecordRun(report RunReport)
+}
+
+// RecordRun hands report to s if it is a RunRecorder
+func RecordRun(s Sink, report RunReport) {
+	if r, ok := s.(RunRecorder); ok {
+		r.RecordRun(report)
+	}
+}
+
+// manifest is the machine-readable index of the files written by a run
+type manifest struct {
+	GeneratedAt time.Time       `json:"generated_at"`
+	Run         *RunReport      `json:"run,omitempty"`
+	Files       []*manifestFile `json:"files"`
+}
+
+// manifestFile describes one written file
+type manifestFile struct {
+	Metric    string    `json:"metric"`
+	Path      string    `json:"path"` // Relative to output_dir, or the object key
+	Rows      int       `json:"rows"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Instances []string  `json:"instances"`
+	Bytes     int64     `json:"bytes"`
+	SHA256    string    `json:"sha256"`
+
+	instances map[string]struct{}
+}
+
+// newManifestFile starts the entry of a file written for metricName
+func newManifestFile(metricName, path string) *manifestFile {
+	return &manifestFile{
+		Metric:    metricName,
+		Path:      path,
+		instances: make(map[string]struct{}),
+	}
+}
+
+// add accounts for rows written to the file
+func (f *manifestFile) add(data []common.ProcessedData) {
+	for _, item := range data {
+		if f.Rows == 0 || item.Timestamp.Before(f.Start) {
+			f.Start = item.Timestamp
+		}
+		if f.Rows == 0 || item.Timestamp.After(f.End) {
+			f.End = item.Timestamp
+		}
+		f.Rows++
+		f.instances[item.PrometheusInstance] = struct{}{}
+	}
+}
+
+// setContent records the size and checksum of the finished file
+func (f *manifestFile) setContent(size int64, sum []byte) {
+	f.Bytes = size
+	f.SHA256 = hex.EncodeToString(sum)
+}
+
+// manifestName returns the manifest's file name. It carries the run time like
+// the data files, so runs sharing a directory keep their own manifests.
+func manifestName(runTime time.Time) string {
+	return fmt.Sprintf("manifest_%s.json", runTime.Format("20060102150405"))
+}
+
+// encodeManifest renders the manifest of files, sorted by metric name
+func encodeManifest(files map[string]*manifestFile, report *RunReport) ([]byte, error) {
+	m := manifest{
+		GeneratedAt: time.Now().UTC(),
+		Run:         report,
+		Files:       make([]*manifestFile, 0, len(files)),
+	}
+	for _, f := range files {
+		f.Instances = make([]string, 0, len(f.instances))
+		for instance := range f.instances {
+			f.Instances = append(f.Instances, instance)
+		}
+		sort.Strings(f.Instances)
+		m.Files = append(m.Files, f)
+	}
+	sort.Slice(m.Files, func(i, j int) bool { return m.Files[i].Metric < m.Files[j].Metric })
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode manifest: %v", err)
+	}
+	return append(data, '\n'), nil
+}
+
+// sha256Sum returns the SHA-256 digest of data
+func sha256Sum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
@@ -0,0 +1,142 @@
+package sink
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+// readManifest decodes the one manifest written to dir
+func readManifest(t *testing.T, dir string) manifest {
+	t.Helper()
+	paths, _ := filepath.Glob(filepath.Join(dir, "manifest_*.json"))
+	if len(paths) != 1 {
+		t.Fatalf("manifests %v, want one", paths)
+	}
+	data, err := os.ReadFile(paths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatalf("manifest is not valid JSON: %v", err)
+	}
+	return m
+}
+
+// checkManifestFile verifies that entry describes the file it names in dir
+// and returns the file's records
+func checkManifestFile(t *testing.T, dir string, entry *manifestFile) [][]string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(entry.Path)))
+	if err != nil {
+		t.Fatalf("manifest lists %s: %v", entry.Path, err)
+	}
+	sum := sha256.Sum256(data)
+	if entry.Bytes != int64(len(data)) || entry.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("%s: manifest has %d bytes and sha256 %s, file has %d and %x", entry.Path, entry.Bytes, entry.SHA256, len(data), sum)
+	}
+	records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestCSVManifestMatchesFiles(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewCSVSink(config.CSVConfig{OutputDir: dir})
+	if err != nil {
+		t.Fatalf("NewCSVSink() error = %v", err)
+	}
+
+	qps := valueRows(1, 2, 3)
+	qps[2].PrometheusInstance = "prom-b"
+	tps := valueRows(4, 5)
+	// qps arrives in two batches with tps between them
+	for _, write := range []struct {
+		metric string
+		rows   []common.ProcessedData
+	}{{"qps", qps[:2]}, {"tps", tps}, {"qps", qps[2:]}} {
+		if err := s.Write(write.metric, write.rows); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+	s.RecordRun(RunReport{RunID: "run-1", Rows: map[string]int{"qps": 3, "tps": 2}, EmptyMetrics: []string{"idle"}})
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	m := readManifest(t, dir)
+	if m.Run == nil || m.Run.RunID != "run-1" || !slices.Equal(m.Run.EmptyMetrics, []string{"idle"}) {
+		t.Errorf("manifest run = %+v, want the recorded report", m.Run)
+	}
+	if len(m.Files) != 2 || m.Files[0].Metric != "qps" || m.Files[1].Metric != "tps" {
+		t.Fatalf("manifest files = %+v, want qps and tps in order", m.Files)
+	}
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	want := []struct {
+		rows      int
+		end       time.Time
+		instances []string
+	}{
+		{3, start.Add(2 * time.Minute), []string{"prom", "prom-b"}},
+		{2, start.Add(time.Minute), []string{"prom"}},
+	}
+	for i, entry := range m.Files {
+		records := checkManifestFile(t, dir, entry)
+		if entry.Rows != want[i].rows || len(records)-1 != entry.Rows {
+			t.Errorf("%s: manifest has %d rows, file has %d, want %d", entry.Metric, entry.Rows, len(records)-1, want[i].rows)
+		}
+		if !entry.Start.Equal(start) || !entry.End.Equal(want[i].end) {
+			t.Errorf("%s: manifest covers %v to %v, want %v to %v", entry.Metric, entry.Start, entry.End, start, want[i].end)
+		}
+		if !slices.Equal(entry.Instances, want[i].instances) {
+			t.Errorf("%s: instances = %v, want %v", entry.Metric, entry.Instances, want[i].instances)
+		}
+	}
+
+	// Every data file in the directory is listed
+	if files := csvFiles(t, dir); len(files) != len(m.Files) {
+		t.Errorf("directory has %d CSV files, manifest lists %d", len(files), len(m.Files))
+	}
+}
+
+func TestCSVManifestSingleFile(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewCSVSink(config.CSVConfig{OutputDir: dir, SingleFile: true})
+	if err != nil {
+		t.Fatalf("NewCSVSink() error = %v", err)
+	}
+	if err := s.Write("qps", valueRows(1, 2, 3)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := s.Write("tps", valueRows(4)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	// Both metrics point at the one file, each with its own rows
+	m := readManifest(t, dir)
+	if len(m.Files) != 2 || m.Files[0].Path != m.Files[1].Path {
+		t.Fatalf("manifest files = %+v, want both metrics in one file", m.Files)
+	}
+	records := checkManifestFile(t, dir, m.Files[0])
+	checkManifestFile(t, dir, m.Files[1])
+	if m.Files[0].Rows != 3 || m.Files[1].Rows != 1 || len(records)-1 != 4 {
+		t.Errorf("manifest rows qps %d, tps %d, file %d, want 3, 1 and 4", m.Files[0].Rows, m.Files[1].Rows, len(records)-1)
+	}
+}
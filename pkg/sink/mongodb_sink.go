@@ -0,0 +1,178 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+const (
+	// defaultMongoBatchSize is the number of documents per InsertMany
+	defaultMongoBatchSize = 1000
+
+	// mongoTimeout bounds connecting and each insert
+	mongoTimeout = 30 * time.Second
+)
+
+// MongoSink inserts processed data into a MongoDB collection, one document per sample
+type MongoSink struct {
+	ctx        context.Context
+	client     *mongo.Client
+	collection *mongo.Collection
+	batchSize  int
+	batch      []interface{} // Pending documents
+}
+
+// mongoDocument is the stored form of a sample
+type mongoDocument struct {
+	MetricName         string            `bson:"metric_name"`
+	PrometheusInstance string            `bson:"prometheus_instance"`
+	Timestamp          time.Time         `bson:"timestamp"`
+	Value              float64           `bson:"value"`
+	Labels             map[string]string `bson:"labels,omitempty"`
+	Job                string            `bson:"job,omitempty"`
+	RunID              string            `bson:"run_id,omitempty"`
+	Checksum           string            `bson:"checksum,omitempty"`
+	SeriesName         string            `bson:"series_name,omitempty"`
+}
+
+// NewMongoSink creates a new MongoDB sink. Inserts are bound to ctx.
+func NewMongoSink(ctx context.Context, cfg config.MongoDBConfig) (*MongoSink, error) {
+	if cfg.URI == "" || cfg.Database == "" || cfg.Collection == "" {
+		return nil, fmt.Errorf("mongodb uri, database and collection are required")
+	}
+
+	batchSize := cfg.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultMongoBatchSize
+	}
+
+	connectCtx, cancel := context.WithTimeout(ctx, mongoTimeout)
+	defer cancel()
+
+	client, err := mongo.Connect(connectCtx, options.Client().ApplyURI(cfg.URI))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to MongoDB: %v", err)
+	}
+	collection := client.Database(cfg.Database).Collection(cfg.Collection)
+
+	if cfg.CreateIndex {
+		log.Printf("Creating index on metric_name and timestamp of %s.%s", cfg.Database, cfg.Collection)
+		_, err := collection.Indexes().CreateOne(connectCtx, mongo.IndexModel{
+			Keys: bson.D{{Key: "metric_name", Value: 1}, {Key: "timestamp", Value: 1}},
+		})
+		if err != nil {
+			client.Disconnect(ctx)
+			return nil, fmt.Errorf("failed to create index: %v", err)
+		}
+	}
+
+	return &MongoSink{
+		ctx:        ctx,
+		client:     client,
+		collection: collection,
+		batchSize:  batchSize,
+		batch:      make([]interface{}, 0, batchSize),
+	}, nil
+}
+
+// Write buffers documents and inserts them whenever a batch is full
+func (s *MongoSink) Write(metricName string, data []common.ProcessedData) error {
+	for _, item := range data {
+		s.batch = append(s.batch, mongoDocument{
+			MetricName:         metricName,
+			PrometheusInstance: item.PrometheusInstance,
+			Timestamp:          item.Timestamp.UTC(),
+			Value:              item.Value,
+			Labels:             item.Labels,
+			Job:                item.Job,
+			RunID:              item.RunID,
+			Checksum:           item.Checksum,
+			SeriesName:         item.SeriesName,
+		})
+
+		if len(s.batch) >= s.batchSize {
+			if err := s.flush(s.ctx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Close inserts any remaining documents and disconnects. The final insert
+// outlives the run context, so the documents of an interrupted run are
+// still stored.
+func (s *MongoSink) Close() error {
+	flushErr := s.flush(context.WithoutCancel(s.ctx))
+
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	if err := s.client.Disconnect(ctx); err != nil && flushErr == nil {
+		return fmt.Errorf("failed to disconnect from MongoDB: %v", err)
+	}
+
+	if flushErr != nil {
+		return fmt.Errorf("failed to flush final batch: %v", flushErr)
+	}
+	return nil
+}
+
+// Ping checks that the primary is reachable and accepts the credentials
+func (s *MongoSink) Ping(ctx context.Context) error {
+	if err := s.client.Ping(ctx, readpref.Primary()); err != nil {
+		return fmt.Errorf("failed to ping MongoDB: %v", err)
+	}
+	return nil
+}
+
+// flush inserts the pending documents with one unordered InsertMany, so a
+// rejected document does not stop the rest of the batch
+func (s *MongoSink) flush(ctx context.Context) error {
+	if len(s.batch) == 0 {
+		return nil
+	}
+
+	log.Printf("Inserting batch of %d documents into MongoDB", len(s.batch))
+	docs := s.batch
+	s.batch = make([]interface{}, 0, s.batchSize)
+
+	ctx, cancel := context.WithTimeout(ctx, mongoTimeout)
+	defer cancel()
+
+	_, err := s.collection.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	if err == nil {
+		return nil
+	}
+
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) || len(bulkErr.WriteErrors) == 0 {
+		return fmt.Errorf("insert failed: %v", err)
+	}
+	return mongoWriteErrors(bulkErr, len(docs))
+}
+
+// mongoWriteErrors logs the rejected documents of a bulk insert and returns
+// an error summarizing them
+func mongoWriteErrors(bulkErr mongo.BulkWriteException, total int) error {
+	for i, writeErr := range bulkErr.WriteErrors {
+		if i == maxLoggedBulkErrors {
+			log.Printf("... and %d more failed documents", len(bulkErr.WriteErrors)-maxLoggedBulkErrors)
+			break
+		}
+		log.Printf("Document %d failed: %s (code %d)", writeErr.Index, writeErr.Message, writeErr.Code)
+	}
+
+	first := bulkErr.WriteErrors[0]
+	return fmt.Errorf("%d of %d documents failed, first error: %s (code %d)",
+		len(bulkErr.WriteErrors), total, first.Message, first.Code)
+}
@@ -0,0 +1,148 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// newMockMongoSink creates a sink inserting through mt's mock deployment
+func newMockMongoSink(mt *mtest.T, batchSize int) *MongoSink {
+	return &MongoSink{
+		ctx:        context.Background(),
+		client:     mt.Client,
+		collection: mt.Coll,
+		batchSize:  batchSize,
+	}
+}
+
+// insertedDocuments returns the documents of the next insert command sent
+func insertedDocuments(mt *mtest.T) []bson.Raw {
+	mt.Helper()
+	started := mt.GetStartedEvent()
+	if started == nil || started.CommandName != "insert" {
+		mt.Fatalf("command = %v, want insert", started)
+	}
+	if ordered, ok := started.Command.Lookup("ordered").BooleanOK(); !ok || ordered {
+		mt.Errorf("insert is ordered, want unordered so one bad document does not stop the rest")
+	}
+	values, err := started.Command.Lookup("documents").Array().Values()
+	if err != nil {
+		mt.Fatal(err)
+	}
+	docs := make([]bson.Raw, len(values))
+	for i, v := range values {
+		docs[i] = v.Document()
+	}
+	return docs
+}
+
+func TestMongoSinkBatchInsert(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("batches", func(mt *mtest.T) {
+		s := newMockMongoSink(mt, 2)
+		mt.AddMockResponses(mtest.CreateSuccessResponse(), mtest.CreateSuccessResponse())
+
+		rows := valueRows(1, 2, 3)
+		rows[0].Job, rows[0].RunID, rows[0].Checksum, rows[0].SeriesName = "nightly", "run-1", "abc", `qps{job="tidb"}`
+		rows[0].Timestamp = time.Date(2024, 1, 1, 8, 0, 0, 0, time.FixedZone("CST", 8*3600))
+		if err := s.Write("qps", rows); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+
+		// A full batch is inserted by Write, the rest by Close
+		first := insertedDocuments(mt)
+		if len(first) != 2 {
+			t.Fatalf("first insert has %d documents, want 2", len(first))
+		}
+		if mt.GetStartedEvent() != nil {
+			t.Fatal("the partial batch was inserted before Close")
+		}
+
+		var doc struct {
+			MetricName         string            `bson:"metric_name"`
+			PrometheusInstance string            `bson:"prometheus_instance"`
+			Timestamp          time.Time         `bson:"timestamp"`
+			Value              float64           `bson:"value"`
+			Labels             map[string]string `bson:"labels"`
+			Job                string            `bson:"job"`
+			RunID              string            `bson:"run_id"`
+			Checksum           string            `bson:"checksum"`
+			SeriesName         string            `bson:"series_name"`
+		}
+		if err := bson.Unmarshal(first[0], &doc); err != nil {
+			t.Fatal(err)
+		}
+		if doc.MetricName != "qps" || doc.PrometheusInstance != "prom" || doc.Value != 1 || doc.Labels["job"] != "tidb" {
+			t.Errorf("document = %+v, want qps from prom valued 1 with label job", doc)
+		}
+		if !doc.Timestamp.Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)) {
+			t.Errorf("timestamp = %v, want the same instant in UTC", doc.Timestamp)
+		}
+		if doc.Job != "nightly" || doc.RunID != "run-1" || doc.Checksum != "abc" || doc.SeriesName != `qps{job="tidb"}` {
+			t.Errorf("document = %+v, want the provenance, checksum and series name", doc)
+		}
+
+		// Empty optional fields are left out
+		for _, key := range []string{"job", "run_id", "checksum", "series_name"} {
+			if _, err := first[1].LookupErr(key); err == nil {
+				t.Errorf("second document has an empty %s field", key)
+			}
+		}
+
+		if err := s.Close(); err != nil {
+			t.Fatalf("Close() error = %v", err)
+		}
+		mt.Client = nil // Disconnected by Close; mtest would disconnect it again
+		if last := insertedDocuments(mt); len(last) != 1 {
+			t.Errorf("Close inserted %d documents, want the 1 pending", len(last))
+		}
+	})
+
+	mt.Run("close after cancel", func(mt *mtest.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		s := newMockMongoSink(mt, 10)
+		s.ctx = ctx
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+
+		if err := s.Write("qps", valueRows(1, 2)); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+		cancel() // Interrupted before the sink is closed
+		if err := s.Close(); err != nil {
+			t.Fatalf("Close() error = %v, want the last batch stored", err)
+		}
+		mt.Client = nil
+		if last := insertedDocuments(mt); len(last) != 2 {
+			t.Errorf("Close inserted %d documents, want the 2 pending", len(last))
+		}
+	})
+
+	mt.Run("write errors", func(mt *mtest.T) {
+		var logs bytes.Buffer
+		log.SetOutput(&logs)
+		defer log.SetOutput(os.Stderr)
+
+		s := newMockMongoSink(mt, 3)
+		mt.AddMockResponses(mtest.CreateWriteErrorsResponse(
+			mtest.WriteError{Index: 0, Code: 11000, Message: "duplicate key"},
+			mtest.WriteError{Index: 2, Code: 11000, Message: "duplicate key"},
+		))
+
+		err := s.Write("qps", valueRows(1, 2, 3))
+		if err == nil || !strings.Contains(err.Error(), "2 of 3 documents failed, first error: duplicate key (code 11000)") {
+			t.Errorf("Write() error = %v, want the failed documents counted", err)
+		}
+		if !strings.Contains(logs.String(), "Document 2 failed: duplicate key") {
+			t.Errorf("rejected documents not logged: %q", logs.String())
+		}
+	})
+}
@@ -0,0 +1,118 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+)
+
+// MultiSink fans writes out to several child sinks
+type MultiSink struct {
+	sinks    []Sink
+	parallel bool // Write to all children concurrently instead of in order
+}
+
+// NewMultiSink creates a sink writing to every child. In parallel mode each
+// Write goes to all children concurrently; serial mode preserves child order.
+func NewMultiSink(sinks []Sink, parallel bool) *MultiSink {
+	return &MultiSink{
+		sinks:    sinks,
+		parallel: parallel,
+	}
+}
+
+// Write sends data to every child sink. A failing child does not stop the
+// others; all child errors are joined.
+func (s *MultiSink) Write(metricName string, data []common.ProcessedData) error {
+	if !s.parallel {
+		var errs []error
+		for i, child := range s.sinks {
+			if err := child.Write(metricName, data); err != nil {
+				errs = append(errs, fmt.Errorf("sink %d: %v", i, err))
+			}
+		}
+		return errors.Join(errs...)
+	}
+
+	errs := make([]error, len(s.sinks))
+	var wg sync.WaitGroup
+	for i, child := range s.sinks {
+		wg.Add(1)
+		go func(i int, child Sink) {
+			defer wg.Done()
+			if err := child.Write(metricName, data); err != nil {
+				errs[i] = fmt.Errorf("sink %d: %v", i, err)
+			}
+		}(i, child)
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// Ping checks every child sink, joining their errors
+func (s *MultiSink) Ping(ctx context.Context) error {
+	var errs []error
+	for i, child := range s.sinks {
+		if err := Ping(ctx, child); err != nil {
+			errs = append(errs, fmt.Errorf("sink %d: %v", i, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// RecordRun hands the run report to every child
+func (s *MultiSink) RecordRun(report RunReport) {
+	for _, child := range s.sinks {
+		RecordRun(child, report)
+	}
+}
+
+// Close closes every child sink, joining their errors
+func (s *MultiSink) Close() error {
+	var errs []error
+	for i, child := range s.sinks {
+		if err := child.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("sink %d: %v", i, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// canWatermark reports whether every child is a Watermarker
+func (s *MultiSink) canWatermark() bool {
+	for _, child := range s.sinks {
+		if _, ok := AsWatermarker(child); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// LastTimestamp returns the oldest watermark of the children, so no child
+// misses data. It reports false unless every child is a Watermarker with a
+// stored timestamp.
+func (s *MultiSink) LastTimestamp(instance, metricName string) (time.Time, bool, error) {
+	var oldest time.Time
+	for i, child := range s.sinks {
+		w, ok := AsWatermarker(child)
+		if !ok {
+			return time.Time{}, false, nil
+		}
+		last, ok, err := w.LastTimestamp(instance, metricName)
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf("sink %d: %v", i, err)
+		}
+		if !ok {
+			return time.Time{}, false, nil
+		}
+		if oldest.IsZero() || last.Before(oldest) {
+			oldest = last
+		}
+	}
+	return oldest, !oldest.IsZero(), nil
+}
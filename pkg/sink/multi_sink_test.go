@@ -0,0 +1,81 @@
+package sink
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+)
+
+// closeErrorSink is a fakeSink whose Close fails
+type closeErrorSink struct {
+	*fakeSink
+}
+
+func (s closeErrorSink) Close() error {
+	s.fakeSink.Close()
+	return errors.New("flush failed")
+}
+
+func TestMultiSinkChildErrorDoesNotStopOthers(t *testing.T) {
+	for _, parallel := range []bool{false, true} {
+		t.Run(map[bool]string{false: "serial", true: "parallel"}[parallel], func(t *testing.T) {
+			first, failing, last := newFakeSink(), newFakeSink(), newFakeSink()
+			failing.write = func(call int, metricName string, data []common.ProcessedData) error {
+				return errors.New("disk full")
+			}
+			s := NewMultiSink([]Sink{first, closeErrorSink{failing}, last}, parallel)
+
+			rows := valueRows(1, 2, 3)
+			err := s.Write("qps", rows)
+			if err == nil || !strings.Contains(err.Error(), "sink 1: disk full") {
+				t.Errorf("Write() error = %v, want the failing child's error", err)
+			}
+			for i, child := range []*fakeSink{first, last} {
+				if got := len(child.metricRows("qps")); got != len(rows) {
+					t.Errorf("child %d got %d rows, want %d", i*2, got, len(rows))
+				}
+			}
+
+			err = s.Close()
+			if err == nil || !strings.Contains(err.Error(), "sink 1: flush failed") {
+				t.Errorf("Close() error = %v, want the failing child's error", err)
+			}
+			for i, child := range []*fakeSink{first, failing, last} {
+				if child.closed != 1 {
+					t.Errorf("child %d closed %d times, want 1", i, child.closed)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkMultiSink compares serial and parallel writes to children that
+// each take a millisecond per write
+func BenchmarkMultiSink(b *testing.B) {
+	rows := valueRows(1, 2, 3)
+	for _, parallel := range []bool{false, true} {
+		for _, children := range []int{2, 4} {
+			b.Run(fmt.Sprintf("parallel=%t/children=%d", parallel, children), func(b *testing.B) {
+				sinks := make([]Sink, children)
+				for i := range sinks {
+					child := newFakeSink()
+					child.write = func(call int, metricName string, data []common.ProcessedData) error {
+						time.Sleep(time.Millisecond)
+						return nil
+					}
+					sinks[i] = child
+				}
+				s := NewMultiSink(sinks, parallel)
+				for i := 0; i < b.N; i++ {
+					if err := s.Write("qps", rows); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
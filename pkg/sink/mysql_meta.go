@@ -0,0 +1,59 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+)
+
+// metaTableSQL returns the CREATE TABLE IF NOT EXISTS statement of the
+// table recording each metric's query and unit per run
+func metaTableSQL(table string, schema mysqlSchema) string {
+	options := fmt.Sprintf("ENGINE=%s DEFAULT CHARSET=%s", schema.engine, schema.charset)
+	if schema.collation != "" {
+		options += " COLLATE=" + schema.collation
+	}
+
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (\n"+
+		"\tid BIGINT AUTO_INCREMENT PRIMARY KEY,\n"+
+		"\trun_id CHAR(36) NOT NULL,\n"+
+		"\tjob VARCHAR(255) NOT NULL DEFAULT '',\n"+
+		"\tmetric_name VARCHAR(255) NOT NULL,\n"+
+		"\t`query` TEXT NOT NULL,\n"+
+		"\tunit VARCHAR(64) NOT NULL DEFAULT '',\n"+
+		"\t`type` VARCHAR(32) NOT NULL DEFAULT '',\n"+
+		"\thelp TEXT,\n"+
+		"\tcreated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,\n"+
+		"\tUNIQUE KEY uk_run_metric (run_id, metric_name)\n"+
+		") %s", table, options)
+}
+
+// recordMeta stores the query and unit of a configured metric in the meta
+// table, once per run and metric. The run is taken from the first row. Type
+// and help are only written when metadata_lookup found them, so meta tables
+// created before those columns existed keep working without the lookup.
+func (s *MySQLSink) recordMeta(metricName string, first common.ProcessedData) error {
+	if s.cfg.MetaTable == "" || s.described[metricName] {
+		return nil
+	}
+	meta, ok := s.cfg.Meta[metricName]
+	if !ok {
+		return nil // Derived metrics such as <metric>_gaps have no query of their own
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, s.insertTimeout)
+	defer cancel()
+
+	query := fmt.Sprintf("INSERT IGNORE INTO %s (run_id, job, metric_name, `query`, unit) VALUES (?, ?, ?, ?, ?)", s.cfg.MetaTable)
+	args := []interface{}{first.RunID, first.Job, metricName, meta.Query, meta.Unit}
+	if meta.Type != "" || meta.Help != "" {
+		query = fmt.Sprintf("INSERT IGNORE INTO %s (run_id, job, metric_name, `query`, unit, `type`, help) VALUES (?, ?, ?, ?, ?, ?, ?)", s.cfg.MetaTable)
+		args = append(args, meta.Type, meta.Help)
+	}
+	if _, err := s.db.ExecContext(ctx, query, args...); err != nil {
+		return fmt.Errorf("failed to record metadata of metric %s: %w", metricName, err)
+	}
+	s.described[metricName] = true
+	return nil
+}
@@ -0,0 +1,70 @@
+package sink
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+func TestMetaTableSQL(t *testing.T) {
+	got := metaTableSQL("metrics_meta", mysqlSchema{engine: "InnoDB", charset: "utf8mb4"})
+	for _, want := range []string{"CREATE TABLE IF NOT EXISTS metrics_meta (", "metric_name VARCHAR(255) NOT NULL", "`query` TEXT NOT NULL", "unit VARCHAR(64)", "UNIQUE KEY uk_run_metric (run_id, metric_name)"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("metaTableSQL() = %s, want it to contain %q", got, want)
+		}
+	}
+}
+
+func TestMySQLRecordsMetricMeta(t *testing.T) {
+	s, mock := newMockMySQLSink(t, context.Background(), config.MySQLConfig{
+		MetaTable: "metrics_meta",
+		Meta: map[string]config.MetricMeta{
+			"qps": {Query: "sum(rate(tidb_server_query_total[1m]))", Unit: "ops"},
+		},
+	})
+	rows := testRows(2)
+	for i := range rows {
+		rows[i].RunID, rows[i].Job = "run-1", "nightly"
+	}
+
+	// qps is described once however often it is written; qps_gaps has no
+	// query of its own
+	mock.ExpectExec("INSERT IGNORE INTO metrics_meta").
+		WithArgs("run-1", "nightly", "qps", "sum(rate(tidb_server_query_total[1m]))", "ops").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO prometheus_metrics").WillReturnResult(sqlmock.NewResult(0, 6))
+	mock.ExpectClose()
+
+	for _, metric := range []string{"qps", "qps", "qps_gaps"} {
+		if err := s.Write(metric, rows); err != nil {
+			t.Fatalf("Write(%s) error = %v", metric, err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMySQLMetaTableOff(t *testing.T) {
+	s, mock := newMockMySQLSink(t, context.Background(), config.MySQLConfig{
+		Meta: map[string]config.MetricMeta{"qps": {Query: "qps"}},
+	})
+	mock.ExpectExec("INSERT INTO prometheus_metrics").WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectClose()
+
+	if err := s.Write("qps", testRows(2)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("without meta_table: %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+package sink
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+// purgeBatchSize bounds the rows removed by one DELETE so that large runs
+// stay within TiDB's transaction size limit
+const purgeBatchSize = 10000
+
+// PurgeMySQLRun deletes the rows written by runID from the table configured
+// in cfg and returns how many were removed. With dryRun the rows are only
+// counted. The table must have been written with provenance enabled.
+func PurgeMySQLRun(ctx context.Context, cfg config.MySQLConfig, runID string, dryRun bool) (int64, error) {
+	if cfg.DSN == "" {
+		return 0, fmt.Errorf("MySQL DSN is required")
+	}
+	if !cfg.Provenance {
+		return 0, fmt.Errorf("provenance is disabled, rows carry no run ID")
+	}
+	if runID == "" {
+		return 0, fmt.Errorf("run ID is required")
+	}
+
+	cfg = cfg.WithDefaults()
+	tableName := cfg.Table
+	schema := newMySQLSchema(cfg, tableName, false)
+
+	dsn, _, err := mysqlSessionDSN(cfg)
+	if err != nil {
+		return 0, err
+	}
+
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return 0, fmt.Errorf("failed to connect to MySQL: %v", err)
+	}
+	defer db.Close()
+
+	return purgeRun(ctx, db, tableName, schema.runID, runID, dryRun)
+}
+
+// purgeRun deletes or, with dryRun, counts the rows of runID in tableName,
+// deleting in batches of purgeBatchSize
+func purgeRun(ctx context.Context, db *sql.DB, tableName, runIDColumn, runID string, dryRun bool) (int64, error) {
+	if dryRun {
+		query := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s = ?", tableName, quoteIdent(runIDColumn))
+		var count int64
+		if err := db.QueryRowContext(ctx, query, runID).Scan(&count); err != nil {
+			return 0, fmt.Errorf("failed to count rows: %v", err)
+		}
+		return count, nil
+	}
+
+	query := fmt.Sprintf("DELETE FROM %s WHERE %s = ? LIMIT %d", tableName, quoteIdent(runIDColumn), purgeBatchSize)
+	var total int64
+	for {
+		result, err := db.ExecContext(ctx, query, runID)
+		if err != nil {
+			return total, fmt.Errorf("failed to delete rows: %v", err)
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return total, fmt.Errorf("failed to get affected rows: %v", err)
+		}
+		total += affected
+		if affected < purgeBatchSize {
+			return total, nil
+		}
+		log.Printf("Deleted %d rows of run %s so far", total, runID)
+	}
+}
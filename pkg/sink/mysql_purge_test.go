@@ -0,0 +1,102 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+const testRunID = "0b7e4c1a-8f5e-4d1b-9a57-3c2f6d9e8a10"
+
+func TestPurgeRunDeletesInBatches(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Deleting stops at the first batch short of purgeBatchSize
+	deleteSQL := regexp.QuoteMeta("DELETE FROM prometheus_metrics WHERE `run_id` = ? LIMIT 10000")
+	for _, affected := range []int64{purgeBatchSize, purgeBatchSize, 42} {
+		mock.ExpectExec("^" + deleteSQL + "$").WithArgs(testRunID).WillReturnResult(sqlmock.NewResult(0, affected))
+	}
+
+	total, err := purgeRun(context.Background(), db, "prometheus_metrics", "run_id", testRunID, false)
+	if err != nil {
+		t.Fatalf("purgeRun() error = %v", err)
+	}
+	if total != 2*purgeBatchSize+42 {
+		t.Errorf("purgeRun() = %d rows, want %d", total, 2*purgeBatchSize+42)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPurgeRunDryRunCounts(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("^" + regexp.QuoteMeta("SELECT COUNT(*) FROM metrics.qps WHERE `crawl_run` = ?") + "$").
+		WithArgs(testRunID).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1234))
+
+	total, err := purgeRun(context.Background(), db, "metrics.qps", "crawl_run", testRunID, true)
+	if err != nil {
+		t.Fatalf("purgeRun() error = %v", err)
+	}
+	if total != 1234 {
+		t.Errorf("purgeRun() = %d rows, want 1234", total)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("a dry run did more than count: %v", err)
+	}
+}
+
+func TestPurgeRunReportsDeletedBeforeError(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("DELETE FROM").WillReturnResult(sqlmock.NewResult(0, purgeBatchSize))
+	mock.ExpectExec("DELETE FROM").WillReturnError(errors.New("lost connection"))
+
+	total, err := purgeRun(context.Background(), db, "prometheus_metrics", "run_id", testRunID, false)
+	if err == nil || !strings.Contains(err.Error(), "lost connection") {
+		t.Errorf("purgeRun() error = %v, want the failed DELETE", err)
+	}
+	if total != purgeBatchSize {
+		t.Errorf("purgeRun() = %d rows, want the %d deleted before the error", total, purgeBatchSize)
+	}
+}
+
+func TestPurgeMySQLRunValidation(t *testing.T) {
+	tests := []struct {
+		name  string
+		cfg   config.MySQLConfig
+		runID string
+		want  string
+	}{
+		{"no DSN", config.MySQLConfig{Provenance: true}, testRunID, "DSN is required"},
+		{"no provenance", config.MySQLConfig{DSN: "user@/db"}, testRunID, "provenance is disabled"},
+		{"no run ID", config.MySQLConfig{DSN: "user@/db", Provenance: true}, "", "run ID is required"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := PurgeMySQLRun(context.Background(), tt.cfg, tt.runID, false)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("PurgeMySQLRun() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
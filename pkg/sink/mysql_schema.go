@@ -0,0 +1,210 @@
+package sink
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+// mysqlSchema describes the layout of the metrics table
+type mysqlSchema struct {
+	table        string
+	instance     string // Column names
+	metricName   string
+	timestamp    string
+	value        string
+	labels       string
+	labelsHash   string
+	job          string
+	runID        string
+	checksum     string
+	seriesName   string
+	valueType    string // SQL type of the value column
+	decimal      bool   // Value column is DECIMAL, so values are bound as exact decimal strings
+	engine       string
+	charset      string
+	collation    string
+	extraIndexes []string
+	dedup        bool // Include labels_hash and a unique key per point
+	provenance   bool // Include job and run_id
+	rowChecksum  bool // Include checksum
+	series       bool // Include seriesName
+	nullValue    bool // Value column is nullable, storing NULL for NaN and ±Inf
+}
+
+// newMySQLSchema builds the table layout from configuration, applying defaults
+func newMySQLSchema(cfg config.MySQLConfig, tableName string, dedup bool) mysqlSchema {
+	return mysqlSchema{
+		table:        tableName,
+		instance:     defaultString(cfg.Columns.PrometheusInstance, "prometheus_instance"),
+		metricName:   defaultString(cfg.Columns.MetricName, "metric_name"),
+		timestamp:    defaultString(cfg.Columns.Timestamp, "timestamp"),
+		value:        defaultString(cfg.Columns.Value, "value"),
+		labels:       defaultString(cfg.Columns.Labels, "labels"),
+		labelsHash:   defaultString(cfg.Columns.LabelsHash, "labels_hash"),
+		job:          defaultString(cfg.Columns.Job, "job"),
+		runID:        defaultString(cfg.Columns.RunID, "run_id"),
+		checksum:     defaultString(cfg.Columns.Checksum, "row_checksum"),
+		seriesName:   defaultString(cfg.Columns.SeriesName, "series_name"),
+		valueType:    "DOUBLE",
+		engine:       defaultString(cfg.Engine, "InnoDB"),
+		charset:      defaultString(cfg.Charset, "utf8mb4"),
+		collation:    cfg.Collation,
+		extraIndexes: cfg.ExtraIndexes,
+		dedup:        dedup,
+		provenance:   cfg.Provenance,
+		rowChecksum:  cfg.Checksum,
+		series:       cfg.SeriesName,
+		nullValue:    cfg.NonFinite == nonFiniteNull,
+	}
+}
+
+// insertColumns returns the quoted columns written by each insert, in row order
+func (s mysqlSchema) insertColumns() []string {
+	columns := []string{s.instance, s.metricName, s.timestamp, s.value, s.labels}
+	if s.dedup {
+		columns = append(columns, s.labelsHash)
+	}
+	if s.provenance {
+		columns = append(columns, s.job, s.runID)
+	}
+	if s.rowChecksum {
+		columns = append(columns, s.checksum)
+	}
+	if s.series {
+		columns = append(columns, s.seriesName)
+	}
+	for i, c := range columns {
+		columns[i] = quoteIdent(c)
+	}
+	return columns
+}
+
+// valueNullability returns the NULL constraint of the value column
+func (s mysqlSchema) valueNullability() string {
+	if s.nullValue {
+		return "NULL"
+	}
+	return "NOT NULL"
+}
+
+// mysqlColumn is an optional column of the metrics table and the indexes
+// built on it
+type mysqlColumn struct {
+	name       string
+	definition string
+	indexes    []string
+}
+
+// optionalColumns returns the configured columns beyond the base layout, in
+// table order. Tables created before a column was enabled are migrated to
+// them.
+func (s mysqlSchema) optionalColumns() []mysqlColumn {
+	var columns []mysqlColumn
+	if s.dedup {
+		columns = append(columns, mysqlColumn{
+			name:       s.labelsHash,
+			definition: fmt.Sprintf("%s CHAR(40) NOT NULL", quoteIdent(s.labelsHash)),
+			indexes: []string{fmt.Sprintf("UNIQUE KEY uk_point (%s, %s, %s, %s)",
+				quoteIdent(s.instance), quoteIdent(s.metricName), quoteIdent(s.timestamp), quoteIdent(s.labelsHash))},
+		})
+	}
+	if s.provenance {
+		columns = append(columns,
+			mysqlColumn{
+				name:       s.job,
+				definition: fmt.Sprintf("%s VARCHAR(255) NOT NULL DEFAULT ''", quoteIdent(s.job)),
+			},
+			mysqlColumn{
+				name:       s.runID,
+				definition: fmt.Sprintf("%s CHAR(36) NOT NULL DEFAULT ''", quoteIdent(s.runID)),
+				indexes:    []string{fmt.Sprintf("INDEX idx_run_id (%s)", quoteIdent(s.runID))},
+			},
+		)
+	}
+	if s.rowChecksum {
+		columns = append(columns, mysqlColumn{
+			name:       s.checksum,
+			definition: fmt.Sprintf("%s CHAR(64) NOT NULL DEFAULT ''", quoteIdent(s.checksum)),
+			indexes:    []string{fmt.Sprintf("INDEX idx_row_checksum (%s)", quoteIdent(s.checksum))},
+		})
+	}
+	if s.series {
+		columns = append(columns, mysqlColumn{
+			name:       s.seriesName,
+			definition: fmt.Sprintf("%s VARCHAR(255) NOT NULL DEFAULT ''", quoteIdent(s.seriesName)),
+		})
+	}
+	return columns
+}
+
+// createTableSQL returns the CREATE TABLE IF NOT EXISTS statement for the schema
+func (s mysqlSchema) createTableSQL() string {
+	definitions := []string{
+		"id BIGINT AUTO_INCREMENT PRIMARY KEY",
+		fmt.Sprintf("%s VARCHAR(255) NOT NULL", quoteIdent(s.instance)),
+		fmt.Sprintf("%s VARCHAR(255) NOT NULL", quoteIdent(s.metricName)),
+		fmt.Sprintf("%s DATETIME NOT NULL", quoteIdent(s.timestamp)),
+		fmt.Sprintf("%s %s %s", quoteIdent(s.value), s.valueType, s.valueNullability()),
+		fmt.Sprintf("%s JSON", quoteIdent(s.labels)),
+		"created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP",
+	}
+
+	for _, column := range s.optionalColumns() {
+		definitions = append(definitions, column.definition)
+		definitions = append(definitions, column.indexes...)
+	}
+
+	definitions = append(definitions,
+		fmt.Sprintf("INDEX idx_instance_metric (%s, %s)", quoteIdent(s.instance), quoteIdent(s.metricName)),
+		fmt.Sprintf("INDEX idx_timestamp (%s)", quoteIdent(s.timestamp)),
+	)
+	definitions = append(definitions, s.extraIndexes...)
+
+	options := fmt.Sprintf("ENGINE=%s DEFAULT CHARSET=%s", s.engine, s.charset)
+	if s.collation != "" {
+		options += " COLLATE=" + s.collation
+	}
+
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (\n\t%s\n) %s",
+		s.table, strings.Join(definitions, ",\n\t"), options)
+}
+
+// decimalTypePattern matches value_type "decimal(p,s)"
+var decimalTypePattern = regexp.MustCompile(`^(?i)decimal\(\s*(\d+)\s*,\s*(\d+)\s*\)$`)
+
+// parseMySQLValueType validates value_type and returns the SQL type of the
+// value column and whether it is DECIMAL
+func parseMySQLValueType(valueType string) (string, bool, error) {
+	if valueType == "" || strings.EqualFold(valueType, "double") {
+		return "DOUBLE", false, nil
+	}
+
+	m := decimalTypePattern.FindStringSubmatch(strings.TrimSpace(valueType))
+	if m == nil {
+		return "", false, fmt.Errorf("unsupported value_type %q, expected double or decimal(p,s)", valueType)
+	}
+	precision, _ := strconv.Atoi(m[1])
+	scale, _ := strconv.Atoi(m[2])
+	// Limits of MySQL and TiDB
+	if precision < 1 || precision > 65 || scale > 30 || scale > precision {
+		return "", false, fmt.Errorf("invalid value_type %q: precision must be 1-65 and scale 0-30 and at most the precision", valueType)
+	}
+	return fmt.Sprintf("DECIMAL(%d,%d)", precision, scale), true, nil
+}
+
+// quoteIdent quotes a MySQL identifier so reserved words like `timestamp` are safe
+func quoteIdent(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+// defaultString returns value, or def if value is empty
+func defaultString(value, def string) string {
+	if value == "" {
+		return def
+	}
+	return value
+}
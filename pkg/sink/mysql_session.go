@@ -0,0 +1,58 @@
+package sink
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+// sessionVariablePattern matches the names accepted in session_variables
+var sessionVariablePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// mysqlSessionDSN parses the DSN and adds the configured TLS settings,
+// connection charset and session variables. The driver applies them on every
+// new connection, so all pooled connections share the same session settings.
+func mysqlSessionDSN(cfg config.MySQLConfig) (string, *mysql.Config, error) {
+	dsnCfg, err := mysql.ParseDSN(cfg.DSN)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid MySQL DSN: %v", err)
+	}
+
+	if err := applyMySQLTLS(cfg.TLS, dsnCfg); err != nil {
+		return "", nil, err
+	}
+
+	if cfg.SessionCharset != "" {
+		if err := dsnCfg.Apply(mysql.Charset(cfg.SessionCharset, cfg.SessionCollation)); err != nil {
+			return "", nil, err
+		}
+	} else if cfg.SessionCollation != "" {
+		return "", nil, fmt.Errorf("session_collation requires session_charset")
+	}
+
+	for name, value := range cfg.SessionVariables {
+		if !sessionVariablePattern.MatchString(name) {
+			return "", nil, fmt.Errorf("invalid session variable name %q", name)
+		}
+		if dsnCfg.Params == nil {
+			dsnCfg.Params = make(map[string]string)
+		}
+		dsnCfg.Params[name] = sessionValue(value)
+	}
+
+	return dsnCfg.FormatDSN(), dsnCfg, nil
+}
+
+// sessionValue renders a session variable value for SET: numbers as is,
+// anything else as a quoted string literal
+func sessionValue(value string) string {
+	if _, err := strconv.ParseFloat(value, 64); err == nil {
+		return value
+	}
+	escaped := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value)
+	return "'" + escaped + "'"
+}
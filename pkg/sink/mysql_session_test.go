@@ -0,0 +1,103 @@
+package sink
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+func TestMySQLSessionAppliedOnConnect(t *testing.T) {
+	server := newFakeMySQL(t, nil)
+	cfg := config.MySQLConfig{
+		DSN:              "crawler@tcp(" + server.addr() + ")/metrics",
+		SessionCharset:   "utf8mb4",
+		SessionCollation: "utf8mb4_bin",
+		SessionVariables: map[string]string{
+			"tidb_mem_quota_query": "1073741824",
+			"sql_mode":             "STRICT_TRANS_TABLES",
+		},
+		TruncateTable: true, // A statement to run after the session is set up
+	}
+
+	s, err := NewMySQLSink(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("NewMySQLSink() error = %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	conns := server.connections()
+	if len(conns) == 0 {
+		t.Fatal("the sink never connected")
+	}
+	for i, conn := range conns {
+		if len(conn.queries) < 2 {
+			t.Fatalf("connection %d ran %q, want SET NAMES and SET first", i, conn.queries)
+		}
+		if conn.queries[0] != "SET NAMES utf8mb4 COLLATE utf8mb4_bin" {
+			t.Errorf("connection %d first ran %q, want SET NAMES utf8mb4 COLLATE utf8mb4_bin", i, conn.queries[0])
+		}
+		// Variables are set in one statement, in map order
+		set := conn.queries[1]
+		for _, assignment := range []string{"tidb_mem_quota_query = 1073741824", "sql_mode = 'STRICT_TRANS_TABLES'"} {
+			if !strings.HasPrefix(set, "SET ") || !strings.Contains(set, assignment) {
+				t.Errorf("connection %d then ran %q, want SET with %s", i, set, assignment)
+			}
+		}
+	}
+
+	var truncated bool
+	for _, conn := range conns {
+		for j, query := range conn.queries {
+			if query == "TRUNCATE TABLE prometheus_metrics" {
+				truncated = true
+				if j < 2 {
+					t.Errorf("TRUNCATE ran before the session settings: %q", conn.queries)
+				}
+			}
+		}
+	}
+	if !truncated {
+		t.Error("the table was not truncated")
+	}
+}
+
+func TestMySQLSessionDSN(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.MySQLConfig
+		want string // Substring of the DSN, or of the error
+		err  bool
+	}{
+		{"variables", config.MySQLConfig{SessionVariables: map[string]string{"time_zone": "+00:00", "max_execution_time": "60000"}}, "max_execution_time=60000&time_zone=%27%2B00%3A00%27", false},
+		{"quoted value", config.MySQLConfig{SessionVariables: map[string]string{"sql_mode": `it's\`}}, "sql_mode=%27it%5C%27s%5C%5C%27", false},
+		{"charset", config.MySQLConfig{SessionCharset: "utf8mb4"}, "charset=utf8mb4", false},
+		{"bad name", config.MySQLConfig{SessionVariables: map[string]string{"sql_mode; DROP TABLE t": "1"}}, "invalid session variable name", true},
+		{"collation only", config.MySQLConfig{SessionCollation: "utf8mb4_bin"}, "session_collation requires session_charset", true},
+		{"bad DSN", config.MySQLConfig{DSN: "tcp(no closing"}, "invalid MySQL DSN", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			if cfg.DSN == "" {
+				cfg.DSN = "crawler@tcp(localhost:4000)/metrics"
+			}
+			dsn, _, err := mysqlSessionDSN(cfg)
+			if tt.err {
+				if err == nil || !strings.Contains(err.Error(), tt.want) {
+					t.Errorf("mysqlSessionDSN() error = %v, want %q", err, tt.want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("mysqlSessionDSN() error = %v", err)
+			}
+			if !strings.Contains(dsn, tt.want) {
+				t.Errorf("mysqlSessionDSN() = %s, want %s", dsn, tt.want)
+			}
+		})
+	}
+}
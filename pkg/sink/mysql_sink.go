@@ -1,96 +1,330 @@
 package sink
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math"
+	"strconv"
 	"strings"
+	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 	"github.com/meiking/tidb-metrics-crawler/pkg/common"
 	"github.com/meiking/tidb-metrics-crawler/pkg/config"
 )
 
+const (
+	// maxInsertAttempts is how many times a batch insert is tried on deadlock/write conflict
+	maxInsertAttempts = 3
+
+	// MySQL deadlock and TiDB write conflict error codes, both safe to retry
+	errCodeDeadlock          = 1213
+	errCodeTiDBWriteConflict = 9007
+
+	// onConflictIgnore makes reruns idempotent by skipping duplicate rows
+	onConflictIgnore = "ignore"
+
+	// mysqlDateTimeLayout is the DATETIME literal format
+	mysqlDateTimeLayout = "2006-01-02 15:04:05.999999"
+)
+
 // MySQLSink stores processed data directly in MySQL database
 type MySQLSink struct {
-	db        *sql.DB
-	cfg       config.MySQLConfig
-	tableName string
-	batchSize int
-	batchData [][]interface{} // Buffer for batch inserts
+	ctx           context.Context
+	db            *sql.DB
+	cfg           config.MySQLConfig
+	tableName     string
+	schema        mysqlSchema
+	columns       []string // Quoted columns written by each insert, in row order
+	ignoreDups    bool     // Use INSERT IGNORE with a labels_hash unique key
+	batchSize     int
+	insertTimeout time.Duration
+	loc           *time.Location  // Time zone of stored DATETIME values
+	storeUTC      bool            // Bind timestamps as UTC literals regardless of the DSN's loc
+	batchData     [][]interface{} // Buffer for batch inserts
+	described     map[string]bool // Metrics recorded in the meta table this run
 }
 
-// NewMySQLSink creates a new MySQL sink
-func NewMySQLSink(cfg config.MySQLConfig) (*MySQLSink, error) {
-	log.Printf("Initializing MySQL sink with DSN: %s, createTable: %v, truncateTable: %v", cfg.DSN, cfg.CreateTable, cfg.TruncateTable)
+// NewMySQLSink creates a new MySQL sink. Inserts are bound to ctx.
+func NewMySQLSink(ctx context.Context, cfg config.MySQLConfig) (*MySQLSink, error) {
+	log.Printf("Initializing MySQL sink with DSN: %s, createTable: %v, truncateTable: %v", config.RedactDSN(cfg.DSN), cfg.CreateTable, cfg.TruncateTable)
 
-	// Set defaults
-	tableName := cfg.Table
-	if tableName == "" {
-		tableName = "prometheus_metrics"
-	}
-
-	batchSize := cfg.BatchSize
-	if batchSize <= 0 {
-		batchSize = 1000
-	}
+	cfg = cfg.WithDefaults()
 
 	// Validate configuration
 	if cfg.DSN == "" {
 		return nil, fmt.Errorf("MySQL DSN is required")
 	}
+	dsn, dsnCfg, err := mysqlSessionDSN(cfg)
+	if err != nil {
+		return nil, err
+	}
+	s, err := newMySQLSink(ctx, cfg, dsnCfg.Loc)
+	if err != nil {
+		return nil, err
+	}
 
 	// Connect to MySQL
-	db, err := sql.Open("mysql", cfg.DSN)
+	db, err := sql.Open("mysql", dsn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to MySQL: %v", err)
 	}
 
+	if err := configurePool(db, cfg); err != nil {
+		db.Close()
+		return nil, err
+	}
+
 	// Test the connection
-	if err := db.Ping(); err != nil {
+	if err := db.PingContext(ctx); err != nil {
 		db.Close()
 		return nil, fmt.Errorf("failed to ping MySQL: %v", err)
 	}
 
+	s.db = db
+	if err := s.prepareTables(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// newMySQLSink validates cfg, which has its defaults applied, and returns a
+// sink without a database. dsnLoc is the time zone set in the DSN.
+func newMySQLSink(ctx context.Context, cfg config.MySQLConfig, dsnLoc *time.Location) (*MySQLSink, error) {
+	tableName, batchSize := cfg.Table, cfg.BatchSize
+
+	switch cfg.OnConflict {
+	case "", onConflictIgnore:
+	default:
+		return nil, fmt.Errorf("unsupported on_conflict mode: %s", cfg.OnConflict)
+	}
+	ignoreDups := cfg.OnConflict == onConflictIgnore
+	schema := newMySQLSchema(cfg, tableName, ignoreDups)
+	valueType, decimal, err := parseMySQLValueType(cfg.ValueType)
+	if err != nil {
+		return nil, err
+	}
+	schema.valueType, schema.decimal = valueType, decimal
+
+	storeUTC := cfg.StoreUTC == nil || *cfg.StoreUTC
+
+	insertTimeout, err := time.ParseDuration(cfg.InsertTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("invalid insert_timeout: %v", err)
+	}
+
+	loc := dsnLoc
+	if storeUTC {
+		loc = time.UTC
+	}
+
+	return &MySQLSink{
+		ctx:           ctx,
+		cfg:           cfg,
+		tableName:     tableName,
+		schema:        schema,
+		columns:       schema.insertColumns(),
+		ignoreDups:    ignoreDups,
+		batchSize:     batchSize,
+		insertTimeout: insertTimeout,
+		loc:           loc,
+		storeUTC:      storeUTC,
+		batchData:     make([][]interface{}, 0, batchSize),
+		described:     make(map[string]bool),
+	}, nil
+}
+
+// prepareTables creates and truncates the tables as configured
+func (s *MySQLSink) prepareTables() error {
 	// Create table if needed
-	if cfg.CreateTable {
-		log.Printf("Creating table %s if it does not exist", tableName)
-		if err := createMetricsTable(db, tableName); err != nil {
-			db.Close()
-			return nil, fmt.Errorf("failed to create table: %v", err)
+	if s.cfg.CreateTable {
+		log.Printf("Creating table %s if it does not exist", s.tableName)
+		if err := createMetricsTable(s.db, s.schema); err != nil {
+			return fmt.Errorf("failed to create table: %v", err)
+		}
+		if err := s.migrateTable(); err != nil {
+			return fmt.Errorf("failed to migrate table: %v", err)
+		}
+		if s.cfg.MetaTable != "" {
+			if _, err := s.db.Exec(metaTableSQL(s.cfg.MetaTable, s.schema)); err != nil {
+				return fmt.Errorf("failed to create meta table: %v", err)
+			}
 		}
 	}
 
 	// Truncate table if requested
-	if cfg.TruncateTable {
-		_, err := db.Exec(fmt.Sprintf("TRUNCATE TABLE %s", tableName))
+	if s.cfg.TruncateTable {
+		if _, err := s.db.Exec(fmt.Sprintf("TRUNCATE TABLE %s", s.tableName)); err != nil {
+			return fmt.Errorf("failed to truncate table: %v", err)
+		}
+	}
+	return nil
+}
+
+// migrateTable adds the configured optional columns and their indexes to a
+// table created before they were enabled. Stored rows get their labels_hash
+// computed, so the unique key covers them as well.
+func (s *MySQLSink) migrateTable() error {
+	existing, err := s.tableColumns()
+	if err != nil {
+		return err
+	}
+	for _, column := range s.schema.optionalColumns() {
+		if existing[strings.ToLower(column.name)] {
+			continue
+		}
+		log.Printf("Adding column %s to table %s", column.name, s.tableName)
+		if _, err := s.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", s.tableName, column.definition)); err != nil {
+			return fmt.Errorf("failed to add column %s: %v", column.name, err)
+		}
+		if column.name == s.schema.labelsHash {
+			if err := s.backfillLabelsHash(existing[strings.ToLower(s.schema.seriesName)]); err != nil {
+				return err
+			}
+		}
+		for _, index := range column.indexes {
+			if _, err := s.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD %s", s.tableName, index)); err != nil {
+				return fmt.Errorf("failed to add %s: %v", index, err)
+			}
+		}
+	}
+	return nil
+}
+
+// tableColumns returns the lower-cased column names of the metrics table
+func (s *MySQLSink) tableColumns() (map[string]bool, error) {
+	query := "SELECT COLUMN_NAME FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ?"
+	args := []interface{}{strings.Trim(s.tableName, "`")}
+	if database, table, ok := strings.Cut(s.tableName, "."); ok {
+		query = "SELECT COLUMN_NAME FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ?"
+		args = []interface{}{strings.Trim(database, "`"), strings.Trim(table, "`")}
+	}
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list columns: %v", err)
+	}
+	defer rows.Close()
+
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("failed to list columns: %v", err)
+		}
+		columns[strings.ToLower(name)] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list columns: %v", err)
+	}
+	return columns, nil
+}
+
+// backfillLabelsHash sets labels_hash of rows stored before the column was
+// added, hashing labels the way writes do
+func (s *MySQLSink) backfillLabelsHash(hasSeriesName bool) error {
+	seriesName := "''"
+	if hasSeriesName {
+		seriesName = quoteIdent(s.schema.seriesName)
+	}
+	selectSQL := fmt.Sprintf("SELECT id, %s, %s FROM %s WHERE %s = '' AND id > ? ORDER BY id LIMIT %d",
+		quoteIdent(s.schema.labels), seriesName, s.tableName, quoteIdent(s.schema.labelsHash), s.batchSize)
+	updateSQL := fmt.Sprintf("UPDATE %s SET %s = ? WHERE id = ?", s.tableName, quoteIdent(s.schema.labelsHash))
+
+	var lastID, updated int64
+	for {
+		hashes, err := s.labelsHashes(selectSQL, lastID)
 		if err != nil {
-			db.Close()
-			return nil, fmt.Errorf("failed to truncate table: %v", err)
+			return fmt.Errorf("failed to read rows to backfill: %v", err)
+		}
+		if len(hashes) == 0 {
+			break
 		}
+		for _, h := range hashes {
+			if _, err := s.db.Exec(updateSQL, h.hash, h.id); err != nil {
+				return fmt.Errorf("failed to backfill %s: %v", s.schema.labelsHash, err)
+			}
+			lastID = h.id
+		}
+		updated += int64(len(hashes))
+	}
+	if updated > 0 {
+		log.Printf("Backfilled %s of %d rows", s.schema.labelsHash, updated)
 	}
+	return nil
+}
 
-	return &MySQLSink{
-		db:        db,
-		cfg:       cfg,
-		tableName: tableName,
-		batchSize: batchSize,
-		batchData: make([][]interface{}, 0, batchSize),
-	}, nil
+// rowHash is the labels_hash of a stored row
+type rowHash struct {
+	id   int64
+	hash string
+}
+
+// labelsHashes reads one page of rows after lastID and hashes their labels
+func (s *MySQLSink) labelsHashes(query string, lastID int64) ([]rowHash, error) {
+	rows, err := s.db.Query(query, lastID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hashes []rowHash
+	for rows.Next() {
+		var (
+			id         int64
+			labelsJSON sql.NullString
+			seriesName string
+		)
+		if err := rows.Scan(&id, &labelsJSON, &seriesName); err != nil {
+			return nil, err
+		}
+		item := common.ProcessedData{SeriesName: seriesName}
+		if labelsJSON.Valid {
+			if err := json.Unmarshal([]byte(labelsJSON.String), &item.Labels); err != nil {
+				return nil, fmt.Errorf("row %d has invalid labels: %v", id, err)
+			}
+		}
+		hashes = append(hashes, rowHash{id: id, hash: common.SeriesHash(item)})
+	}
+	return hashes, rows.Err()
+}
+
+// configurePool applies the pool settings, so idle connections are recycled
+// before the server closes them
+func configurePool(db *sql.DB, cfg config.MySQLConfig) error {
+	connMaxLifetime, err := time.ParseDuration(cfg.ConnMaxLifetime)
+	if err != nil {
+		return fmt.Errorf("invalid conn_max_lifetime: %v", err)
+	}
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.SetConnMaxLifetime(connMaxLifetime)
+	return nil
 }
 
-// Write processes data and saves to MySQL (using batch inserts)
+// Write processes data and saves to MySQL (using batch inserts). When an
+// insert fails, its rows stay buffered for the next one and the returned
+// *WriteError counts the rows of data taken so far.
 func (s *MySQLSink) Write(metricName string, data []common.ProcessedData) error {
 	if len(data) == 0 {
 		return nil
 	}
+	if err := s.recordMeta(metricName, data[0]); err != nil {
+		return &WriteError{Err: err}
+	}
 
 	// Convert processed data to database records
-	for _, item := range data {
+	skipped := 0
+	for i, item := range data {
 		// Flush batch when it reaches the configured size
 		if len(s.batchData) >= s.batchSize {
-			if err := s.flushBatch(); err != nil {
-				return err
+			if err := s.flushBatch(s.ctx); err != nil {
+				return &WriteError{Written: i, Err: err}
 			}
 		}
 
@@ -100,24 +334,69 @@ func (s *MySQLSink) Write(metricName string, data []common.ProcessedData) error
 			return fmt.Errorf("failed to convert labels to JSON: %v", err)
 		}
 
+		var value interface{} = item.Value
+		if s.schema.nullValue && !isFinite(item.Value) {
+			// Stored as NULL, which needs a nullable value column
+			value = nil
+		} else if s.schema.decimal {
+			// DECIMAL has no representation for NaN and ±Inf
+			if math.IsNaN(item.Value) || math.IsInf(item.Value, 0) {
+				skipped++
+				continue
+			}
+			// The shortest representation reproduces the value Prometheus
+			// sent; the server rounds it to the column's scale
+			value = strconv.FormatFloat(item.Value, 'f', -1, 64)
+		}
+
+		// The driver would convert a time.Time to the DSN's loc, so the
+		// stored wall clock would depend on client configuration
+		var timestamp interface{} = item.Timestamp
+		if s.storeUTC {
+			timestamp = item.Timestamp.UTC().Format(mysqlDateTimeLayout)
+		}
+
 		// Add to batch
-		s.batchData = append(s.batchData, []interface{}{
+		row := []interface{}{
 			item.PrometheusInstance,
 			metricName,
-			item.Timestamp,
-			item.Value,
+			timestamp,
+			value,
 			labelsJSON,
-		})
+		}
+		if s.ignoreDups {
+			row = append(row, common.SeriesHash(item))
+		}
+		if s.schema.provenance {
+			row = append(row, item.Job, item.RunID)
+		}
+		if s.schema.rowChecksum {
+			// Rows are stamped by processor.row_checksum; hash them here otherwise
+			checksum := item.Checksum
+			if checksum == "" {
+				checksum = common.RowChecksum(item)
+			}
+			row = append(row, checksum)
+		}
+		if s.schema.series {
+			row = append(row, item.SeriesName)
+		}
+		s.batchData = append(s.batchData, row)
 	}
 
+	if skipped > 0 {
+		log.Printf("Skipped %d non-finite values of metric %s", skipped, metricName)
+	}
 	return nil
 }
 
-// Close cleans up resources and flushes remaining batch data
+// Close cleans up resources and flushes remaining batch data. The final
+// flush outlives the run context, so the rows of an interrupted run are
+// still stored; insert_timeout bounds it.
 func (s *MySQLSink) Close() error {
 	// Flush any remaining data in batch
 	if len(s.batchData) > 0 {
-		if err := s.flushBatch(); err != nil {
+		if err := s.flushBatch(context.WithoutCancel(s.ctx)); err != nil {
 			return fmt.Errorf("failed to flush final batch: %v", err)
 		}
 	}
@@ -126,36 +405,107 @@ func (s *MySQLSink) Close() error {
 	return s.db.Close()
 }
 
-// flushBatch inserts the current batch of data into MySQL
-func (s *MySQLSink) flushBatch() error {
+// Ping checks the database connection
+func (s *MySQLSink) Ping(ctx context.Context) error {
+	if err := s.db.PingContext(ctx); err != nil {
+		return fmt.Errorf("failed to ping MySQL: %v", err)
+	}
+	return nil
+}
+
+// LastTimestamp returns the newest stored timestamp of the metric from instance
+func (s *MySQLSink) LastTimestamp(instance, metricName string) (time.Time, bool, error) {
+	query := fmt.Sprintf("SELECT MAX(%s) FROM %s WHERE %s = ? AND %s = ?",
+		quoteIdent(s.schema.timestamp), s.tableName, quoteIdent(s.schema.instance), quoteIdent(s.schema.metricName))
+
+	ctx, cancel := context.WithTimeout(s.ctx, s.insertTimeout)
+	defer cancel()
+
+	// Scanned as a string so it works with and without parseTime in the DSN
+	var last sql.NullString
+	if err := s.db.QueryRowContext(ctx, query, instance, metricName).Scan(&last); err != nil {
+		return time.Time{}, false, fmt.Errorf("failed to query last timestamp: %v", err)
+	}
+	if !last.Valid {
+		return time.Time{}, false, nil
+	}
+
+	t, err := parseMySQLDateTime(last.String, s.loc)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("invalid last timestamp %q: %v", last.String, err)
+	}
+	return t, true, nil
+}
+
+// parseMySQLDateTime parses a DATETIME as returned by the driver, RFC 3339
+// when parseTime is set and "YYYY-MM-DD HH:MM:SS" otherwise, reading the
+// stored wall clock in loc
+func parseMySQLDateTime(value string, loc *time.Location) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		// The driver attached its own loc, which may differ from loc
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), loc), nil
+	}
+	return time.ParseInLocation(mysqlDateTimeLayout, value, loc)
+}
+
+// flushBatch inserts the current batch of data into MySQL, giving up when
+// ctx is cancelled
+func (s *MySQLSink) flushBatch(ctx context.Context) error {
 	log.Printf("Inserting batch of %d records into MySQL", len(s.batchData))
 	if len(s.batchData) == 0 {
 		return nil
 	}
 
 	// Create placeholders for batch insert
+	rowPlaceholder := "(" + strings.TrimSuffix(strings.Repeat("?, ", len(s.columns)), ", ") + ")"
 	placeholders := make([]string, len(s.batchData))
 	for i := range placeholders {
-		placeholders[i] = "(?, ?, ?, ?, ?)"
+		placeholders[i] = rowPlaceholder
 	}
 
 	// Build query
+	verb := "INSERT"
+	if s.ignoreDups {
+		verb = "INSERT IGNORE"
+	}
 	query := fmt.Sprintf(
-		"INSERT INTO %s (prometheus_instance, metric_name, timestamp, value, labels) VALUES %s",
+		"%s INTO %s (%s) VALUES %s",
+		verb,
 		s.tableName,
+		strings.Join(s.columns, ", "),
 		strings.Join(placeholders, ","),
 	)
 
 	// Flatten the batch data for the query
-	args := make([]interface{}, 0, len(s.batchData)*5)
+	args := make([]interface{}, 0, len(s.batchData)*len(s.columns))
 	for _, row := range s.batchData {
 		args = append(args, row...)
 	}
 
-	// Execute the insert
-	_, err := s.db.Exec(query, args...)
-	if err != nil {
-		return fmt.Errorf("insert failed: %v", err)
+	// Execute the insert, retrying on deadlock/write conflict
+	retryDelay := 500 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		inserted, err := s.execInsert(ctx, query, args)
+		if err == nil {
+			if s.ignoreDups && inserted < int64(len(s.batchData)) {
+				log.Printf("Skipped %d duplicate records", int64(len(s.batchData))-inserted)
+			}
+			break
+		}
+
+		if !isRetryableWriteError(err) || attempt == maxInsertAttempts {
+			return fmt.Errorf("insert failed: %w", err)
+		}
+
+		log.Printf("Retry %d/%d for MySQL insert (error: %v). Waiting %v...",
+			attempt, maxInsertAttempts, err, retryDelay)
+
+		select {
+		case <-time.After(retryDelay):
+		case <-ctx.Done():
+			return fmt.Errorf("insert cancelled: %w", ctx.Err())
+		}
+		retryDelay *= 2
 	}
 
 	// Clear the batch
@@ -164,21 +514,31 @@ func (s *MySQLSink) flushBatch() error {
 	return nil
 }
 
-// createMetricsTable creates the metrics table if it doesn't exist
-func createMetricsTable(db *sql.DB, tableName string) error {
-	query := fmt.Sprintf(`
-		CREATE TABLE IF NOT EXISTS %s (
-			id BIGINT AUTO_INCREMENT PRIMARY KEY,
-			prometheus_instance VARCHAR(255) NOT NULL,
-			metric_name VARCHAR(255) NOT NULL,
-			timestamp DATETIME NOT NULL,
-			value DOUBLE NOT NULL,
-			labels JSON,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			INDEX idx_instance_metric (prometheus_instance, metric_name),
-			INDEX idx_timestamp (timestamp)
-		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`, tableName)
-
-	_, err := db.Exec(query)
+// execInsert runs a single insert attempt bounded by the insert timeout,
+// returning the number of rows inserted
+func (s *MySQLSink) execInsert(ctx context.Context, query string, args []interface{}) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.insertTimeout)
+	defer cancel()
+
+	result, err := s.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// isRetryableWriteError reports whether err is a deadlock or TiDB write conflict
+func isRetryableWriteError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) {
+		return false
+	}
+	return mysqlErr.Number == errCodeDeadlock || mysqlErr.Number == errCodeTiDBWriteConflict
+}
+
+// createMetricsTable creates the metrics table if it doesn't exist. With
+// dedup set it adds a labels_hash column and a unique key identifying a point.
+func createMetricsTable(db *sql.DB, schema mysqlSchema) error {
+	_, err := db.Exec(schema.createTableSQL())
 	return err
 }
@@ -0,0 +1,550 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"log"
+	"math"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+// nopDriver opens connections that accept nothing, enough to exercise the
+// connection pool
+type nopDriver struct{}
+
+func (nopDriver) Open(name string) (driver.Conn, error) { return nopConn{}, nil }
+
+type nopConn struct{}
+
+func (nopConn) Prepare(query string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (nopConn) Close() error                              { return nil }
+func (nopConn) Begin() (driver.Tx, error)                 { return nil, errors.New("not supported") }
+
+func init() {
+	sql.Register("nop", nopDriver{})
+}
+
+func TestConfigurePool(t *testing.T) {
+	db, err := sql.Open("nop", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	cfg := config.MySQLConfig{MaxOpenConns: 4, MaxIdleConns: 2, ConnMaxLifetime: "1ms"}.WithDefaults()
+	if err := configurePool(db, cfg); err != nil {
+		t.Fatalf("configurePool() error = %v", err)
+	}
+	if got := db.Stats().MaxOpenConnections; got != 4 {
+		t.Errorf("max open connections = %d, want 4", got)
+	}
+
+	// Hold every connection at once, then return them: only max_idle_conns stay open
+	ctx := context.Background()
+	var conns []*sql.Conn
+	for i := 0; i < 4; i++ {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+	if stats := db.Stats(); stats.Idle != 2 || stats.MaxIdleClosed != 2 {
+		t.Errorf("idle = %d and closed as surplus = %d, want 2 and 2", stats.Idle, stats.MaxIdleClosed)
+	}
+
+	// Connections older than conn_max_lifetime are replaced on their next use
+	time.Sleep(5 * time.Millisecond)
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if got := db.Stats().MaxLifetimeClosed; got == 0 {
+		t.Errorf("no connection was closed for exceeding conn_max_lifetime")
+	}
+}
+
+func TestConfigurePoolInvalidLifetime(t *testing.T) {
+	db, err := sql.Open("nop", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	cfg := config.MySQLConfig{ConnMaxLifetime: "soon"}.WithDefaults()
+	if err := configurePool(db, cfg); err == nil {
+		t.Fatal("configurePool() accepted an invalid conn_max_lifetime")
+	}
+}
+
+// newMockMySQLSink creates a MySQL sink writing to a sqlmock database
+func newMockMySQLSink(t *testing.T, ctx context.Context, cfg config.MySQLConfig) (*MySQLSink, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newMySQLSink(ctx, cfg.WithDefaults(), time.UTC)
+	if err != nil {
+		t.Fatalf("newMySQLSink() error = %v", err)
+	}
+	s.db = db
+	return s, mock
+}
+
+// testRows returns n rows of metric qps a minute apart
+func testRows(n int) []common.ProcessedData {
+	rows := make([]common.ProcessedData, n)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := range rows {
+		rows[i] = common.ProcessedData{
+			PrometheusInstance: "prom",
+			MetricName:         "qps",
+			Timestamp:          start.Add(time.Duration(i) * time.Minute),
+			Value:              float64(i),
+			Labels:             map[string]string{"job": "tidb"},
+		}
+	}
+	return rows
+}
+
+func TestMySQLInsertRetriesDeadlock(t *testing.T) {
+	for _, code := range []uint16{errCodeDeadlock, errCodeTiDBWriteConflict} {
+		s, mock := newMockMySQLSink(t, context.Background(), config.MySQLConfig{})
+		mock.ExpectExec("INSERT INTO prometheus_metrics").WillReturnError(&mysql.MySQLError{Number: code, Message: "conflict"})
+		mock.ExpectExec("INSERT INTO prometheus_metrics").WillReturnResult(sqlmock.NewResult(0, 2))
+		mock.ExpectClose()
+
+		if err := s.Write("qps", testRows(2)); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+		if err := s.Close(); err != nil {
+			t.Fatalf("error %d: Close() error = %v, want the retry to succeed", code, err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("error %d: %v", code, err)
+		}
+	}
+}
+
+func TestMySQLInsertDoesNotRetryOtherErrors(t *testing.T) {
+	s, mock := newMockMySQLSink(t, context.Background(), config.MySQLConfig{})
+	mock.ExpectExec("INSERT INTO prometheus_metrics").WillReturnError(&mysql.MySQLError{Number: 1146, Message: "table doesn't exist"})
+
+	s.Write("qps", testRows(1))
+	if err := s.flushBatch(context.Background()); err == nil {
+		t.Fatal("flushBatch() succeeded, want the insert error")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMySQLCloseFlushesAfterCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s, mock := newMockMySQLSink(t, ctx, config.MySQLConfig{})
+	mock.ExpectExec("INSERT INTO prometheus_metrics").WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectClose()
+
+	if err := s.Write("qps", testRows(3)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	cancel() // Interrupted before the sink is closed
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v, want the last batch stored", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMySQLDuplicateBatchInsertsNothing(t *testing.T) {
+	s, mock := newMockMySQLSink(t, context.Background(), config.MySQLConfig{OnConflict: onConflictIgnore})
+	rows := testRows(3)
+	hash := common.SeriesHash(rows[0])
+
+	// The unique key on (instance, metric, timestamp, labels_hash) makes the
+	// server skip every row of a rerun
+	for _, inserted := range []int64{3, 0} {
+		mock.ExpectExec("INSERT IGNORE INTO prometheus_metrics").
+			WithArgs(
+				"prom", "qps", "2024-01-01 00:00:00", float64(0), `{"job":"tidb"}`, hash,
+				"prom", "qps", "2024-01-01 00:01:00", float64(1), `{"job":"tidb"}`, hash,
+				"prom", "qps", "2024-01-01 00:02:00", float64(2), `{"job":"tidb"}`, hash,
+			).
+			WillReturnResult(sqlmock.NewResult(0, inserted))
+	}
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	for batch := 0; batch < 2; batch++ {
+		if err := s.Write("qps", rows); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+		if err := s.flushBatch(context.Background()); err != nil {
+			t.Fatalf("batch %d: flushBatch() error = %v", batch, err)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+	if !strings.Contains(logs.String(), "Skipped 3 duplicate records") {
+		t.Errorf("log = %q, want the rerun's 3 rows reported as duplicates", logs.String())
+	}
+}
+
+func TestMySQLMigratesExistingTable(t *testing.T) {
+	cfg := config.MySQLConfig{CreateTable: true, OnConflict: onConflictIgnore, Provenance: true, SeriesName: true}
+	s, mock := newMockMySQLSink(t, context.Background(), cfg)
+	s.batchSize = 2
+
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS prometheus_metrics").WillReturnResult(sqlmock.NewResult(0, 0))
+	// The table predates dedup and provenance, but has series_name
+	mock.ExpectQuery("SELECT COLUMN_NAME FROM information_schema.COLUMNS").
+		WithArgs("prometheus_metrics").
+		WillReturnRows(sqlmock.NewRows([]string{"COLUMN_NAME"}).
+			AddRow("id").AddRow("prometheus_instance").AddRow("metric_name").AddRow("timestamp").
+			AddRow("value").AddRow("labels").AddRow("created_at").AddRow("SERIES_NAME"))
+
+	mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE prometheus_metrics ADD COLUMN `labels_hash` CHAR(40) NOT NULL")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	backfill := regexp.QuoteMeta("SELECT id, `labels`, `series_name` FROM prometheus_metrics WHERE `labels_hash` = '' AND id > ? ORDER BY id LIMIT 2")
+	update := regexp.QuoteMeta("UPDATE prometheus_metrics SET `labels_hash` = ? WHERE id = ?")
+	mock.ExpectQuery(backfill).WithArgs(0).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "labels", "series_name"}).
+			AddRow(1, `{"job":"tidb"}`, "").
+			AddRow(4, `{"job":"tidb"}`, "tidb_qps"))
+	mock.ExpectExec(update).WithArgs(common.LabelsHash(map[string]string{"job": "tidb"}), 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(update).WithArgs(common.LabelsHash(map[string]string{"job": "tidb", "__name__": "tidb_qps"}), 4).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(backfill).WithArgs(4).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "labels", "series_name"}).AddRow(7, nil, ""))
+	mock.ExpectExec(update).WithArgs(common.LabelsHash(nil), 7).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(backfill).WithArgs(7).WillReturnRows(sqlmock.NewRows([]string{"id", "labels", "series_name"}))
+	mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE prometheus_metrics ADD UNIQUE KEY uk_point (`prometheus_instance`, `metric_name`, `timestamp`, `labels_hash`)")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE prometheus_metrics ADD COLUMN `job` VARCHAR(255) NOT NULL DEFAULT ''")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE prometheus_metrics ADD COLUMN `run_id` CHAR(36) NOT NULL DEFAULT ''")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE prometheus_metrics ADD INDEX idx_run_id (`run_id`)")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err := s.prepareTables(); err != nil {
+		t.Fatalf("prepareTables() error = %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMySQLMigrationSkipsCurrentTable(t *testing.T) {
+	cfg := config.MySQLConfig{CreateTable: true, Checksum: true, Table: "metrics.points"}
+	s, mock := newMockMySQLSink(t, context.Background(), cfg)
+
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS metrics.points").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT COLUMN_NAME FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = \\? AND TABLE_NAME = \\?").
+		WithArgs("metrics", "points").
+		WillReturnRows(sqlmock.NewRows([]string{"COLUMN_NAME"}).AddRow("id").AddRow("row_checksum"))
+
+	if err := s.prepareTables(); err != nil {
+		t.Fatalf("prepareTables() error = %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMySQLInsertMappedColumns(t *testing.T) {
+	cfg := config.MySQLConfig{
+		Table:      "points",
+		OnConflict: onConflictIgnore,
+		Columns: config.MySQLColumns{
+			PrometheusInstance: "source",
+			MetricName:         "name",
+			Timestamp:          "ts",
+			Value:              "val",
+			Labels:             "tags",
+			LabelsHash:         "tags_hash",
+		},
+	}
+	s, mock := newMockMySQLSink(t, context.Background(), cfg)
+	rows := testRows(1)
+
+	if create := s.schema.createTableSQL(); !strings.Contains(create, "UNIQUE KEY uk_point (`source`, `name`, `ts`, `tags_hash`)") {
+		t.Errorf("createTableSQL() = %s, want the unique key on the mapped columns", create)
+	}
+	mock.ExpectExec(regexp.QuoteMeta("INSERT IGNORE INTO points (`source`, `name`, `ts`, `val`, `tags`, `tags_hash`) VALUES (?, ?, ?, ?, ?, ?)")).
+		WithArgs("prom", "qps", "2024-01-01 00:00:00", float64(0), `{"job":"tidb"}`, common.SeriesHash(rows[0])).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := s.Write("qps", rows); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := s.flushBatch(context.Background()); err != nil {
+		t.Fatalf("flushBatch() error = %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMySQLInsertProvenance(t *testing.T) {
+	s, mock := newMockMySQLSink(t, context.Background(), config.MySQLConfig{Provenance: true})
+	rows := testRows(1)
+	rows[0].Job, rows[0].RunID = "nightly", "5f0c6f4e-3a1b-4c2d-9e8f-0a1b2c3d4e5f"
+
+	if create := s.schema.createTableSQL(); !strings.Contains(create, "`run_id` CHAR(36) NOT NULL DEFAULT ''") || !strings.Contains(create, "INDEX idx_run_id (`run_id`)") {
+		t.Errorf("createTableSQL() = %s, want an indexed run_id column", create)
+	}
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO prometheus_metrics (`prometheus_instance`, `metric_name`, `timestamp`, `value`, `labels`, `job`, `run_id`) VALUES")).
+		WithArgs("prom", "qps", "2024-01-01 00:00:00", float64(0), `{"job":"tidb"}`, "nightly", "5f0c6f4e-3a1b-4c2d-9e8f-0a1b2c3d4e5f").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := s.Write("qps", rows); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := s.flushBatch(context.Background()); err != nil {
+		t.Fatalf("flushBatch() error = %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMySQLDecimalValues(t *testing.T) {
+	s, mock := newMockMySQLSink(t, context.Background(), config.MySQLConfig{ValueType: "decimal(30,10)"})
+	if create := s.schema.createTableSQL(); !strings.Contains(create, "`value` DECIMAL(30,10)") {
+		t.Errorf("createTableSQL() = %s, want a DECIMAL(30,10) value column", create)
+	}
+
+	// Values a DOUBLE column or %g would not keep exact, and NaN, which
+	// DECIMAL cannot store
+	values := []float64{0.1, 1234567890.123456, 0.0000000001, 1e21, -2.5, math.NaN()}
+	want := []string{"0.1", "1234567890.123456", "0.0000000001", "1000000000000000000000", "-2.5"}
+	rows := valueRows(values...)
+	for i, exact := range want {
+		mock.ExpectExec("INSERT INTO prometheus_metrics").
+			WithArgs("prom", "qps", rows[i].Timestamp.Format(mysqlDateTimeLayout), exact, `{"job":"tidb"}`).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+
+	s.batchSize = 1
+	if err := s.Write("qps", rows); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := s.flushBatch(context.Background()); err != nil {
+		t.Fatalf("flushBatch() error = %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	// Each bound string parses back to the value Prometheus sent
+	for i, exact := range want {
+		if got, err := strconv.ParseFloat(exact, 64); err != nil || got != values[i] {
+			t.Errorf("%q parses to %v, want %v", exact, got, values[i])
+		}
+	}
+}
+
+func TestMySQLNonFiniteNull(t *testing.T) {
+	s, mock := newMockMySQLSink(t, context.Background(), config.MySQLConfig{NonFinite: nonFiniteNull})
+	if create := s.schema.createTableSQL(); !strings.Contains(create, "`value` DOUBLE NULL") {
+		t.Errorf("createTableSQL() = %s, want a nullable value column", create)
+	}
+
+	rows := valueRows(1.5, math.NaN(), math.Inf(1), math.Inf(-1))
+	mock.ExpectExec("INSERT INTO prometheus_metrics").
+		WithArgs(
+			"prom", "qps", "2024-01-01 00:00:00", 1.5, `{"job":"tidb"}`,
+			"prom", "qps", "2024-01-01 00:01:00", nil, `{"job":"tidb"}`,
+			"prom", "qps", "2024-01-01 00:02:00", nil, `{"job":"tidb"}`,
+			"prom", "qps", "2024-01-01 00:03:00", nil, `{"job":"tidb"}`,
+		).
+		WillReturnResult(sqlmock.NewResult(0, 4))
+
+	if err := s.Write("qps", rows); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := s.flushBatch(context.Background()); err != nil {
+		t.Fatalf("flushBatch() error = %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestParseMySQLValueType(t *testing.T) {
+	tests := []struct {
+		valueType string
+		want      string
+		decimal   bool
+		err       bool
+	}{
+		{"", "DOUBLE", false, false},
+		{"Double", "DOUBLE", false, false},
+		{"decimal(20,6)", "DECIMAL(20,6)", true, false},
+		{" DECIMAL( 65 , 30 ) ", "DECIMAL(65,30)", true, false},
+		{"decimal(66,2)", "", false, true},
+		{"decimal(10,31)", "", false, true},
+		{"decimal(4,6)", "", false, true},
+		{"float", "", false, true},
+	}
+	for _, tt := range tests {
+		got, decimal, err := parseMySQLValueType(tt.valueType)
+		if (err != nil) != tt.err || got != tt.want || decimal != tt.decimal {
+			t.Errorf("parseMySQLValueType(%q) = %q, %v, %v, want %q, %v, error %v", tt.valueType, got, decimal, err, tt.want, tt.decimal, tt.err)
+		}
+	}
+}
+
+func TestMySQLStoreUTCRoundTrip(t *testing.T) {
+	instant := time.Date(2024, 3, 10, 2, 30, 0, 0, time.UTC) // US daylight saving starts this day
+	for _, zone := range []string{"UTC", "Asia/Shanghai", "America/New_York"} {
+		t.Run(zone, func(t *testing.T) {
+			loc, err := time.LoadLocation(zone)
+			if err != nil {
+				t.Skipf("time zone %s unavailable: %v", zone, err)
+			}
+			s, mock := newMockMySQLSink(t, context.Background(), config.MySQLConfig{})
+			rows := testRows(1)
+			rows[0].Timestamp = instant.In(loc) // As the processor's timezone setting renders it
+
+			// Stored as the UTC wall clock, whatever zone the row carries
+			mock.ExpectExec("INSERT INTO prometheus_metrics").
+				WithArgs("prom", "qps", "2024-03-10 02:30:00", float64(0), `{"job":"tidb"}`).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			if err := s.Write("qps", rows); err != nil {
+				t.Fatalf("Write() error = %v", err)
+			}
+			if err := s.flushBatch(context.Background()); err != nil {
+				t.Fatalf("flushBatch() error = %v", err)
+			}
+
+			// Read back without parseTime, and with it under a DSN loc the
+			// driver attaches to the stored wall clock
+			for _, stored := range []string{"2024-03-10 02:30:00", "2024-03-10T02:30:00+08:00"} {
+				mock.ExpectQuery("SELECT MAX").WithArgs("prom", "qps").
+					WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(stored))
+				last, ok, err := s.LastTimestamp("prom", "qps")
+				if err != nil || !ok {
+					t.Fatalf("LastTimestamp() = %v, %v, %v", last, ok, err)
+				}
+				if !last.Equal(instant) {
+					t.Errorf("stored %q read back as %v, want %v", stored, last, instant)
+				}
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestMySQLStoreLocalTime(t *testing.T) {
+	loc, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Skipf("time zone unavailable: %v", err)
+	}
+	storeUTC := false
+	s, err := newMySQLSink(context.Background(), config.MySQLConfig{StoreUTC: &storeUTC}.WithDefaults(), loc)
+	if err != nil {
+		t.Fatalf("newMySQLSink() error = %v", err)
+	}
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.db = db
+
+	// Without store_utc the wall clock is read in the DSN's loc
+	instant := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	mock.ExpectQuery("SELECT MAX").WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow("2024-01-01 08:00:00"))
+	last, _, err := s.LastTimestamp("prom", "qps")
+	if err != nil {
+		t.Fatalf("LastTimestamp() error = %v", err)
+	}
+	if !last.Equal(instant) {
+		t.Errorf("read back %v, want %v", last, instant)
+	}
+}
+
+func TestMySQLBadDSNFailsBeforeWrites(t *testing.T) {
+	// A port nothing listens on
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := listener.Addr().String()
+	listener.Close()
+
+	for _, dsn := range []string{
+		"not a dsn",
+		"crawler:secret@tcp(" + closed + ")/metrics?timeout=2s",
+	} {
+		cfg := config.SinkConfig{
+			Type:  "mysql",
+			MySQL: config.MySQLConfig{DSN: dsn}.WithDefaults(),
+			Retry: &config.RetryConfig{Attempts: 3},
+			Async: true,
+		}
+		s, err := NewSink(context.Background(), cfg)
+		if err == nil {
+			s.Close()
+			t.Errorf("NewSink() with DSN %q succeeded, want it to fail before any write", dsn)
+		}
+	}
+}
+
+func TestMySQLPreCheckThroughDecorators(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newMySQLSink(context.Background(), config.MySQLConfig{}.WithDefaults(), time.UTC)
+	if err != nil {
+		t.Fatalf("newMySQLSink() error = %v", err)
+	}
+	s.db = db
+	retrying, err := NewRetryingSink(context.Background(), s, config.RetryConfig{Attempts: 3})
+	if err != nil {
+		t.Fatalf("NewRetryingSink() error = %v", err)
+	}
+	decorated := NewAsyncSink(context.Background(), NewSkipNonFiniteSink(retrying), 4)
+
+	// The server went away after the sink connected: the pre-check fails
+	// and no insert is attempted
+	mock.ExpectPing().WillReturnError(&mysql.MySQLError{Number: 1045, Message: "Access denied for user 'crawler'"})
+	err = Ping(context.Background(), decorated)
+	if err == nil || !strings.Contains(err.Error(), "failed to ping MySQL") || !strings.Contains(err.Error(), "Access denied") {
+		t.Errorf("Ping() error = %v, want the MySQL ping error", err)
+	}
+	mock.ExpectClose()
+	if err := decorated.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,70 @@
+package sink
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"os"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+// applyMySQLTLS registers the tls section with the driver and selects it in
+// the DSN. The driver only carries TLS settings through a DSN by name, so the
+// name is derived from the settings: sinks sharing them share a registration.
+func applyMySQLTLS(cfg *config.MySQLTLSConfig, dsnCfg *mysql.Config) error {
+	if cfg == nil {
+		return nil
+	}
+	if dsnCfg.TLSConfig != "" {
+		return fmt.Errorf("mysql tls is set both in the DSN (tls=%s) and in the tls section", dsnCfg.TLSConfig)
+	}
+
+	tlsCfg, err := newMySQLTLSConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%q %q %q %q %t", cfg.CAFile, cfg.CertFile, cfg.KeyFile, cfg.ServerName, cfg.Insecure)))
+	name := "crawler-" + hex.EncodeToString(sum[:8])
+	if err := mysql.RegisterTLSConfig(name, tlsCfg); err != nil {
+		return fmt.Errorf("failed to register mysql tls config: %v", err)
+	}
+	dsnCfg.TLSConfig = name
+	return nil
+}
+
+// newMySQLTLSConfig loads the CA bundle and client certificate of cfg
+func newMySQLTLSConfig(cfg *config.MySQLTLSConfig) (*tls.Config, error) {
+	tlsCfg := &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.Insecure,
+	}
+
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read mysql tls ca_file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates found in mysql tls ca_file %s", cfg.CAFile)
+		}
+		tlsCfg.RootCAs = pool
+	}
+
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return nil, fmt.Errorf("mysql tls cert_file and key_file must be set together")
+	}
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load mysql tls client certificate: %v", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	return tlsCfg, nil
+}
@@ -0,0 +1,197 @@
+package sink
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+// testCA issues certificates for TLS tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+// newTestCA creates a self-signed CA
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "crawler test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a certificate for name signed by the CA, with its PEM
+// certificate and key
+func (ca *testCA) issue(t *testing.T, name string, usage x509.ExtKeyUsage) (tls.Certificate, []byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, certPEM, keyPEM
+}
+
+// writeTestFile writes content to name in dir and returns its path
+func writeTestFile(t *testing.T, dir, name string, content []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, content, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMySQLTLSClientCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	serverCert, _, _ := ca.issue(t, "tidb.test", x509.ExtKeyUsageServerAuth)
+	_, clientCert, clientKey := ca.issue(t, "crawler", x509.ExtKeyUsageClientAuth)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+
+	// The server only accepts clients presenting a certificate from the CA
+	server := newFakeMySQL(t, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	})
+
+	dir := t.TempDir()
+	tlsCfg := &config.MySQLTLSConfig{
+		CAFile:     writeTestFile(t, dir, "ca.pem", ca.pem),
+		CertFile:   writeTestFile(t, dir, "client.pem", clientCert),
+		KeyFile:    writeTestFile(t, dir, "client-key.pem", clientKey),
+		ServerName: "tidb.test", // The server listens on 127.0.0.1
+	}
+	cfg := config.MySQLConfig{
+		DSN:           "crawler@tcp(" + server.addr() + ")/metrics",
+		TLS:           tlsCfg,
+		TruncateTable: true, // A statement to run over the connection
+	}
+
+	// The DSN selects the registered config by name
+	_, dsnCfg, err := mysqlSessionDSN(cfg)
+	if err != nil {
+		t.Fatalf("mysqlSessionDSN() error = %v", err)
+	}
+	if !strings.HasPrefix(dsnCfg.TLSConfig, "crawler-") {
+		t.Fatalf("DSN tls = %q, want the registered config", dsnCfg.TLSConfig)
+	}
+
+	s, err := NewMySQLSink(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("NewMySQLSink() error = %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	conns := server.connections()
+	if len(conns) == 0 {
+		t.Fatal("the sink never connected")
+	}
+	var queries int
+	for i, conn := range conns {
+		if !conn.tls {
+			t.Errorf("connection %d did not switch to TLS", i)
+		}
+		queries += len(conn.queries)
+	}
+	if queries == 0 {
+		t.Error("no statement ran over the TLS connections")
+	}
+
+	// Without the client certificate the server refuses the handshake
+	cfg.TLS = &config.MySQLTLSConfig{CAFile: tlsCfg.CAFile, ServerName: "tidb.test"}
+	if _, err := NewMySQLSink(context.Background(), cfg); err == nil {
+		t.Error("NewMySQLSink() connected without the client certificate the server requires")
+	}
+	for i, conn := range server.connections()[len(conns):] {
+		if conn.tls {
+			t.Errorf("connection %d without a client certificate completed the TLS handshake", len(conns)+i)
+		}
+	}
+}
+
+func TestNewMySQLTLSConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	notPEM := writeTestFile(t, dir, "ca.txt", []byte("not a certificate"))
+	tests := []struct {
+		name string
+		cfg  config.MySQLTLSConfig
+		want string
+	}{
+		{"missing CA", config.MySQLTLSConfig{CAFile: filepath.Join(dir, "missing.pem")}, "failed to read mysql tls ca_file"},
+		{"CA without certificates", config.MySQLTLSConfig{CAFile: notPEM}, "no PEM certificates found"},
+		{"cert without key", config.MySQLTLSConfig{CertFile: notPEM}, "must be set together"},
+		{"unreadable key pair", config.MySQLTLSConfig{CertFile: notPEM, KeyFile: notPEM}, "failed to load mysql tls client certificate"},
+	}
+	for _, tt := range tests {
+		if _, err := newMySQLTLSConfig(&tt.cfg); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: newMySQLTLSConfig() error = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestMySQLTLSSetTwice(t *testing.T) {
+	dsnCfg := mysql.NewConfig()
+	dsnCfg.TLSConfig = "skip-verify"
+	if err := applyMySQLTLS(&config.MySQLTLSConfig{Insecure: true}, dsnCfg); err == nil {
+		t.Error("applyMySQLTLS() accepted tls in both the DSN and the tls section")
+	}
+}
@@ -0,0 +1,137 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+// Policies for NaN and ±Inf values, chosen per sink with non_finite
+const (
+	nonFiniteSkip   = "skip"   // Drop the row
+	nonFiniteNull   = "null"   // SQL NULL or JSON null
+	nonFiniteEmpty  = "empty"  // Empty cell
+	nonFiniteString = "string" // NaN, +Inf or -Inf as text
+)
+
+// nonFiniteSupport lists the policies beyond skip that each sink type can
+// represent. Skipping is done by a wrapper, so it works with every sink.
+var nonFiniteSupport = map[string][]string{
+	"csv":           {nonFiniteEmpty, nonFiniteString},
+	"feishu":        {nonFiniteEmpty, nonFiniteString},
+	"wecom":         {nonFiniteEmpty, nonFiniteString},
+	"slack":         {nonFiniteEmpty, nonFiniteString},
+	"discord":       {nonFiniteEmpty, nonFiniteString},
+	"email":         {nonFiniteEmpty, nonFiniteString},
+	"gcs":           {nonFiniteEmpty, nonFiniteString},
+	"azblob":        {nonFiniteEmpty, nonFiniteString},
+	"table":         {nonFiniteEmpty, nonFiniteString},
+	"mysql":         {nonFiniteNull},
+	"elasticsearch": {nonFiniteNull},
+}
+
+// checkNonFinite reports whether sinkType can apply the non_finite policy
+func checkNonFinite(sinkType, policy string) error {
+	switch policy {
+	case "", nonFiniteSkip:
+		return nil
+	case nonFiniteNull, nonFiniteEmpty, nonFiniteString:
+	default:
+		return fmt.Errorf("unsupported non_finite policy: %s", policy)
+	}
+
+	for _, supported := range nonFiniteSupport[sinkType] {
+		if supported == policy {
+			return nil
+		}
+	}
+	accepted := append([]string{nonFiniteSkip}, nonFiniteSupport[sinkType]...)
+	return fmt.Errorf("%s sink does not support non_finite %s (supported: %s)", sinkType, policy, strings.Join(accepted, ", "))
+}
+
+// withNonFinite copies the sink's non_finite policy into the settings its
+// constructor reads
+func withNonFinite(cfg config.SinkConfig) config.SinkConfig {
+	cfg.CSV.NonFinite = cfg.NonFinite
+	cfg.MySQL.NonFinite = cfg.NonFinite
+	cfg.Elasticsearch.NonFinite = cfg.NonFinite
+	cfg.Table.NonFinite = cfg.NonFinite
+	cfg.GCS.NonFinite = cfg.NonFinite
+	cfg.AzBlob.NonFinite = cfg.NonFinite
+	return cfg
+}
+
+// isFinite reports whether v is neither NaN nor ±Inf
+func isFinite(v float64) bool {
+	return !math.IsNaN(v) && !math.IsInf(v, 0)
+}
+
+// SkipNonFiniteSink wraps a sink and drops rows whose value is NaN or ±Inf
+// before they reach it
+type SkipNonFiniteSink struct {
+	sink Sink
+}
+
+// NewSkipNonFiniteSink wraps s
+func NewSkipNonFiniteSink(s Sink) *SkipNonFiniteSink {
+	return &SkipNonFiniteSink{sink: s}
+}
+
+// Write writes the rows with finite values to the wrapped sink
+func (s *SkipNonFiniteSink) Write(metricName string, data []common.ProcessedData) error {
+	kept := data
+	for i, item := range data {
+		if isFinite(item.Value) {
+			continue
+		}
+		// Copy only once a row has to go, so finite batches are passed through
+		kept = append([]common.ProcessedData(nil), data[:i]...)
+		for _, rest := range data[i+1:] {
+			if isFinite(rest.Value) {
+				kept = append(kept, rest)
+			}
+		}
+		log.Printf("Skipped %d non-finite values of metric %s", len(data)-len(kept), metricName)
+		break
+	}
+	if len(kept) == 0 {
+		return nil
+	}
+	return s.sink.Write(metricName, kept)
+}
+
+// Close closes the wrapped sink
+func (s *SkipNonFiniteSink) Close() error {
+	return s.sink.Close()
+}
+
+// Ping checks the wrapped sink
+func (s *SkipNonFiniteSink) Ping(ctx context.Context) error {
+	return Ping(ctx, s.sink)
+}
+
+// RecordRun forwards the run report to the wrapped sink
+func (s *SkipNonFiniteSink) RecordRun(report RunReport) {
+	RecordRun(s.sink, report)
+}
+
+// canWatermark reports whether the wrapped sink is a Watermarker
+func (s *SkipNonFiniteSink) canWatermark() bool {
+	_, ok := AsWatermarker(s.sink)
+	return ok
+}
+
+// LastTimestamp forwards to the wrapped sink when it is a Watermarker
+func (s *SkipNonFiniteSink) LastTimestamp(instance, metricName string) (time.Time, bool, error) {
+	w, ok := AsWatermarker(s.sink)
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	return w.LastTimestamp(instance, metricName)
+}
@@ -0,0 +1,62 @@
+package sink
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+func TestCheckNonFinite(t *testing.T) {
+	tests := []struct {
+		sinkType, policy string
+		ok               bool
+	}{
+		{"csv", "", true},
+		{"csv", nonFiniteEmpty, true},
+		{"csv", nonFiniteString, true},
+		{"csv", nonFiniteNull, false},
+		{"mysql", nonFiniteNull, true},
+		{"mysql", nonFiniteEmpty, false},
+		{"elasticsearch", nonFiniteNull, true},
+		{"elasticsearch", nonFiniteString, false},
+		{"influxdb", nonFiniteSkip, true}, // Every sink can skip
+		{"influxdb", nonFiniteNull, false},
+		{"csv", "zero", false},
+	}
+	for _, tt := range tests {
+		if err := checkNonFinite(tt.sinkType, tt.policy); (err == nil) != tt.ok {
+			t.Errorf("checkNonFinite(%s, %q) error = %v, want ok %v", tt.sinkType, tt.policy, err, tt.ok)
+		}
+	}
+}
+
+func TestSkipNonFiniteSink(t *testing.T) {
+	inner := newFakeSink()
+	s := NewSkipNonFiniteSink(inner)
+	if err := s.Write("qps", valueRows(1, math.NaN(), 2, math.Inf(1), math.Inf(-1))); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := s.Write("qps", valueRows(math.NaN())); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	var values []float64
+	for _, row := range inner.rows["qps"] {
+		values = append(values, row.Value)
+	}
+	if len(values) != 2 || values[0] != 1 || values[1] != 2 {
+		t.Errorf("wrapped sink got %v, want only the finite values", values)
+	}
+	if inner.calls != 1 {
+		t.Errorf("wrapped sink got %d writes, want none for a batch of NaN", inner.calls)
+	}
+}
+
+func TestNewSinkRejectsUnsupportedNonFinite(t *testing.T) {
+	_, err := NewSink(context.Background(), config.SinkConfig{Type: "csv", NonFinite: nonFiniteNull, CSV: config.CSVConfig{OutputDir: t.TempDir()}})
+	if err == nil {
+		t.Error("NewSink() accepted non_finite null for a CSV sink")
+	}
+}
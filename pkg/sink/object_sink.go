@@ -0,0 +1,328 @@
+package sink
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+// objectUploader stores a complete object in a bucket or container
+type objectUploader interface {
+	upload(ctx context.Context, key, contentType string, body []byte) error
+}
+
+// ObjectSink buffers each metric as a CSV object and uploads it on Close.
+// The storage backend is provided by an objectUploader.
+type ObjectSink struct {
+	ctx         context.Context
+	uploader    objectUploader
+	prefix      *template.Template
+	gzip        bool
+	formatValue valueFormatter
+	provenance  bool // Write job and run_id columns
+	runTime     time.Time
+	partitions  map[string]*objectPartition // Keyed by metric name
+	report      *RunReport
+}
+
+// objectPartition is the buffered content of a single object
+type objectPartition struct {
+	buf       bytes.Buffer
+	gz        *gzip.Writer // Nil unless gzip is enabled
+	writer    *csv.Writer
+	labelKeys []string
+	entry     *manifestFile // Path is filled in on upload
+}
+
+// objectKeyData is the data available to the prefix template
+type objectKeyData struct {
+	MetricName string
+	Time       time.Time
+}
+
+// newObjectSink creates an object sink writing through uploader
+func newObjectSink(ctx context.Context, uploader objectUploader, cfg config.ObjectStoreConfig) (*ObjectSink, error) {
+	formatValue, err := newValueFormatter(cfg.FloatFormat, cfg.NonFinite)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix, err := template.New("prefix").Option("missingkey=error").Parse(cfg.Prefix)
+	if err != nil {
+		return nil, fmt.Errorf("invalid prefix: %v", err)
+	}
+
+	return &ObjectSink{
+		ctx:         ctx,
+		uploader:    uploader,
+		prefix:      prefix,
+		gzip:        cfg.Gzip,
+		formatValue: formatValue,
+		provenance:  cfg.Provenance,
+		runTime:     time.Now(),
+		partitions:  make(map[string]*objectPartition),
+	}, nil
+}
+
+// Write appends data to the metric's buffered object
+func (s *ObjectSink) Write(metricName string, data []common.ProcessedData) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	part, exists := s.partitions[metricName]
+	if !exists {
+		var err error
+		if part, err = s.newPartition(unionLabelKeys(data)); err != nil {
+			return err
+		}
+		part.entry = newManifestFile(metricName, "")
+		s.partitions[metricName] = part
+	}
+
+	// Labels first seen in this batch widen the buffered object first
+	if labelKeys, grown := widenLabelKeys(part.labelKeys, data); grown {
+		if err := s.widenPartition(metricName, labelKeys); err != nil {
+			return err
+		}
+		part = s.partitions[metricName]
+	}
+
+	for _, item := range data {
+		row, err := createDataRow(item, part.labelKeys, s.formatValue, s.provenance)
+		if err != nil {
+			return err
+		}
+		if err := part.writer.Write(row); err != nil {
+			return fmt.Errorf("failed to write CSV row: %v", err)
+		}
+	}
+
+	part.writer.Flush()
+	if err := part.writer.Error(); err != nil {
+		return err
+	}
+
+	part.entry.add(data)
+	return nil
+}
+
+// RecordRun keeps the run report for the manifest
+func (s *ObjectSink) RecordRun(report RunReport) {
+	s.report = &report
+}
+
+// Close uploads every buffered object, then the manifest listing the
+// uploaded ones. The uploads outlive a cancelled run, so what was collected
+// before an interrupt is still stored.
+func (s *ObjectSink) Close() error {
+	ctx := context.WithoutCancel(s.ctx)
+	names := make([]string, 0, len(s.partitions))
+	for name := range s.partitions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []error
+	uploaded := make(map[string]*manifestFile, len(names))
+	for _, name := range names {
+		part := s.partitions[name]
+		if err := s.uploadPartition(ctx, name, part); err != nil {
+			errs = append(errs, fmt.Errorf("metric %s: %v", name, err))
+		} else {
+			uploaded[name] = part.entry
+		}
+		delete(s.partitions, name)
+	}
+
+	if len(names) > 0 || s.report != nil {
+		if err := s.uploadManifest(ctx, uploaded); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	s.report = nil
+
+	if c, ok := s.uploader.(interface{ close() error }); ok {
+		if err := c.close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close storage client: %v", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// uploadManifest uploads the index of files next to the objects
+func (s *ObjectSink) uploadManifest(ctx context.Context, files map[string]*manifestFile) error {
+	data, err := encodeManifest(files, s.report)
+	if err != nil {
+		return err
+	}
+
+	var prefix strings.Builder
+	if err := s.prefix.Execute(&prefix, objectKeyData{Time: s.runTime}); err != nil {
+		return fmt.Errorf("failed to render manifest prefix: %v", err)
+	}
+	key := strings.TrimPrefix(path.Join(prefix.String(), manifestName(s.runTime)), "/")
+
+	log.Printf("Uploading manifest of %d file(s) to object %s", len(files), key)
+	if err := s.uploader.upload(ctx, key, "application/json", data); err != nil {
+		return fmt.Errorf("failed to upload manifest: %v", err)
+	}
+	return nil
+}
+
+// newPartition starts a buffered object with its header row
+func (s *ObjectSink) newPartition(labelKeys []string) (*objectPartition, error) {
+	part := &objectPartition{labelKeys: labelKeys}
+
+	var w io.Writer = &part.buf
+	if s.gzip {
+		part.gz = gzip.NewWriter(&part.buf)
+		w = part.gz
+	}
+	part.writer = csv.NewWriter(w)
+
+	header, err := objectHeaderRow(labelKeys, s.provenance)
+	if err != nil {
+		return nil, err
+	}
+	if err := part.writer.Write(header); err != nil {
+		return nil, fmt.Errorf("failed to write CSV header: %v", err)
+	}
+
+	return part, nil
+}
+
+// widenPartition re-encodes a metric's buffered object under a header with
+// labelKeys, for labels first seen after it was started. Rows already
+// buffered get the new columns empty, so the header ends up the union of
+// every batch.
+func (s *ObjectSink) widenPartition(metricName string, labelKeys []string) error {
+	old := s.partitions[metricName]
+	old.writer.Flush()
+	if err := old.writer.Error(); err != nil {
+		return err
+	}
+
+	var in io.Reader = &old.buf
+	if old.gz != nil {
+		if err := old.gz.Close(); err != nil {
+			return fmt.Errorf("failed to compress: %v", err)
+		}
+		gz, err := gzip.NewReader(&old.buf)
+		if err != nil {
+			return fmt.Errorf("failed to widen object: %v", err)
+		}
+		in = gz
+	}
+
+	part, err := s.newPartition(labelKeys)
+	if err != nil {
+		return err
+	}
+	part.entry = old.entry
+
+	// Copy the rows, matching columns by name
+	reader := csv.NewReader(in)
+	reader.ReuseRecord = true
+	oldHeader, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("failed to widen object: %v", err)
+	}
+	columns := make(map[string]int, len(oldHeader))
+	for i, name := range oldHeader {
+		columns[name] = i
+	}
+	header, err := objectHeaderRow(labelKeys, s.provenance)
+	if err != nil {
+		return err
+	}
+	row := make([]string, len(header))
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to widen object: %v", err)
+		}
+		for i, name := range header {
+			row[i] = ""
+			if j, ok := columns[name]; ok {
+				row[i] = record[j]
+			}
+		}
+		if err := part.writer.Write(row); err != nil {
+			return fmt.Errorf("failed to write CSV row: %v", err)
+		}
+	}
+
+	s.partitions[metricName] = part
+	log.Printf("Widened the header of the %s object to the labels %v", metricName, labelKeys)
+	return nil
+}
+
+// objectHeaderRow returns the header of an object with labelKeys. Label
+// columns are prefixed as in the CSV sink.
+func objectHeaderRow(labelKeys []string, provenance bool) ([]string, error) {
+	columns := make([]string, len(labelKeys))
+	for i, key := range labelKeys {
+		columns[i] = "label_" + key
+	}
+	return createHeaderRow(columns, provenance)
+}
+
+// uploadPartition finishes the object and uploads it
+func (s *ObjectSink) uploadPartition(ctx context.Context, metricName string, part *objectPartition) error {
+	part.writer.Flush()
+	if err := part.writer.Error(); err != nil {
+		return err
+	}
+
+	contentType := "text/csv"
+	if part.gz != nil {
+		if err := part.gz.Close(); err != nil {
+			return fmt.Errorf("failed to compress: %v", err)
+		}
+		contentType = "application/gzip"
+	}
+
+	key, err := s.objectKey(metricName)
+	if err != nil {
+		return err
+	}
+
+	part.entry.Path = key
+	part.entry.setContent(int64(part.buf.Len()), sha256Sum(part.buf.Bytes()))
+
+	log.Printf("Uploading %d bytes to object %s", part.buf.Len(), key)
+	return s.uploader.upload(ctx, key, contentType, part.buf.Bytes())
+}
+
+// objectKey returns the key of the metric's object under the rendered prefix
+func (s *ObjectSink) objectKey(metricName string) (string, error) {
+	var prefix strings.Builder
+	if err := s.prefix.Execute(&prefix, objectKeyData{MetricName: metricName, Time: s.runTime}); err != nil {
+		return "", fmt.Errorf("failed to render prefix: %v", err)
+	}
+
+	name := fmt.Sprintf("%s_%s.csv", metricName, s.runTime.Format("20060102150405"))
+	if s.gzip {
+		name += ".gz"
+	}
+
+	return strings.TrimPrefix(path.Join(prefix.String(), name), "/"), nil
+}
@@ -0,0 +1,237 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"github.com/meiking/tidb-metrics-crawler/pkg/version"
+	collectorpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	otlpProtocolGRPC = "grpc"
+	otlpProtocolHTTP = "http"
+
+	// otlpExportTimeout bounds a single export request
+	otlpExportTimeout = 30 * time.Second
+
+	// otlpScopeName identifies the crawler as the instrumentation scope
+	otlpScopeName = "tidb-metrics-crawler"
+)
+
+// OTLPSink exports samples as OTLP metrics to an OpenTelemetry collector.
+// Each sample becomes a data point carrying its original timestamp.
+type OTLPSink struct {
+	ctx        context.Context
+	protocol   string
+	endpoint   string
+	headers    map[string]string
+	sumMetrics map[string]bool
+	conn       *grpc.ClientConn // Nil for http
+	client     collectorpb.MetricsServiceClient
+	httpClient *http.Client
+}
+
+// NewOTLPSink creates a new OTLP sink. Exports are bound to ctx.
+func NewOTLPSink(ctx context.Context, cfg config.OTLPConfig) (*OTLPSink, error) {
+	if cfg.Endpoint == "" {
+		return nil, fmt.Errorf("otlp endpoint is required")
+	}
+
+	s := &OTLPSink{
+		ctx:        ctx,
+		protocol:   cfg.Protocol,
+		endpoint:   cfg.Endpoint,
+		headers:    cfg.Headers,
+		sumMetrics: make(map[string]bool, len(cfg.SumMetrics)),
+	}
+	for _, name := range cfg.SumMetrics {
+		s.sumMetrics[name] = true
+	}
+
+	switch cfg.Protocol {
+	case "", otlpProtocolGRPC:
+		s.protocol = otlpProtocolGRPC
+		creds := credentials.NewTLS(&tls.Config{})
+		if cfg.Insecure {
+			creds = insecure.NewCredentials()
+		}
+		conn, err := grpc.NewClient(cfg.Endpoint, grpc.WithTransportCredentials(creds))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create gRPC client: %v", err)
+		}
+		s.conn = conn
+		s.client = collectorpb.NewMetricsServiceClient(conn)
+	case otlpProtocolHTTP:
+		s.httpClient = &http.Client{
+			Timeout: otlpExportTimeout,
+		}
+	default:
+		return nil, fmt.Errorf("unsupported otlp protocol: %s", cfg.Protocol)
+	}
+
+	return s, nil
+}
+
+// Write exports the data as one metric
+func (s *OTLPSink) Write(metricName string, data []common.ProcessedData) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	req := s.buildRequest(metricName, data)
+
+	var partial *collectorpb.ExportMetricsPartialSuccess
+	var err error
+	if s.protocol == otlpProtocolGRPC {
+		partial, err = s.exportGRPC(req)
+	} else {
+		partial, err = s.exportHTTP(req)
+	}
+	if err != nil {
+		return &WriteError{Err: fmt.Errorf("failed to export metric %s: %w", metricName, err)}
+	}
+
+	if partial.GetRejectedDataPoints() > 0 {
+		return fmt.Errorf("collector rejected %d of %d data points of metric %s: %s",
+			partial.GetRejectedDataPoints(), len(data), metricName, partial.GetErrorMessage())
+	}
+	return nil
+}
+
+// Close releases the gRPC connection
+func (s *OTLPSink) Close() error {
+	if s.conn != nil {
+		return s.conn.Close()
+	}
+	return nil
+}
+
+// buildRequest converts data into an export request with one metric
+func (s *OTLPSink) buildRequest(metricName string, data []common.ProcessedData) *collectorpb.ExportMetricsServiceRequest {
+	points := make([]*metricspb.NumberDataPoint, 0, len(data))
+	for _, item := range data {
+		points = append(points, &metricspb.NumberDataPoint{
+			Attributes:   otlpAttributes(item),
+			TimeUnixNano: uint64(item.Timestamp.UnixNano()),
+			Value:        &metricspb.NumberDataPoint_AsDouble{AsDouble: item.Value},
+		})
+	}
+
+	metric := &metricspb.Metric{Name: metricName}
+	if s.sumMetrics[metricName] {
+		metric.Data = &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+			DataPoints:             points,
+			AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+			IsMonotonic:            true,
+		}}
+	} else {
+		metric.Data = &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{DataPoints: points}}
+	}
+
+	return &collectorpb.ExportMetricsServiceRequest{
+		ResourceMetrics: []*metricspb.ResourceMetrics{{
+			Resource: &resourcepb.Resource{
+				Attributes: []*commonpb.KeyValue{stringAttribute("service.name", otlpScopeName)},
+			},
+			ScopeMetrics: []*metricspb.ScopeMetrics{{
+				Scope:   &commonpb.InstrumentationScope{Name: otlpScopeName, Version: version.Version},
+				Metrics: []*metricspb.Metric{metric},
+			}},
+		}},
+	}
+}
+
+// otlpAttributes returns the sample's Prometheus instance and provenance
+// followed by its labels sorted by key
+func otlpAttributes(item common.ProcessedData) []*commonpb.KeyValue {
+	keys := common.SortedLabelKeys(item.Labels)
+	attrs := make([]*commonpb.KeyValue, 0, len(keys)+3)
+	attrs = append(attrs, stringAttribute("prometheus_instance", item.PrometheusInstance))
+	if item.Job != "" {
+		attrs = append(attrs, stringAttribute("job", item.Job))
+	}
+	if item.RunID != "" {
+		attrs = append(attrs, stringAttribute("run_id", item.RunID))
+	}
+	for _, k := range keys {
+		attrs = append(attrs, stringAttribute(k, item.Labels[k]))
+	}
+	return attrs
+}
+
+// stringAttribute builds a string-valued attribute
+func stringAttribute(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{
+		Key:   key,
+		Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}},
+	}
+}
+
+// exportGRPC sends the request over gRPC with the configured headers as metadata
+func (s *OTLPSink) exportGRPC(req *collectorpb.ExportMetricsServiceRequest) (*collectorpb.ExportMetricsPartialSuccess, error) {
+	ctx, cancel := context.WithTimeout(s.ctx, otlpExportTimeout)
+	defer cancel()
+
+	if len(s.headers) > 0 {
+		ctx = metadata.NewOutgoingContext(ctx, metadata.New(s.headers))
+	}
+
+	resp, err := s.client.Export(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.GetPartialSuccess(), nil
+}
+
+// exportHTTP posts the request as binary protobuf
+func (s *OTLPSink) exportHTTP(req *collectorpb.ExportMetricsServiceRequest) (*collectorpb.ExportMetricsPartialSuccess, error) {
+	body, err := proto.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(s.ctx, http.MethodPost, s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	for name, value := range s.headers {
+		httpReq.Header.Set(name, value)
+	}
+
+	resp, err := s.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("export failed: %w", &StatusError{StatusCode: resp.StatusCode, Body: string(respBody)})
+	}
+
+	var exportResp collectorpb.ExportMetricsServiceResponse
+	if err := proto.Unmarshal(respBody, &exportResp); err != nil {
+		return nil, fmt.Errorf("invalid export response: %v", err)
+	}
+	return exportResp.GetPartialSuccess(), nil
+}
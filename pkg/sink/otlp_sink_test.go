@@ -0,0 +1,131 @@
+package sink
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	collectorpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// newFakeCollector serves OTLP/HTTP exports, passing each request to
+// export and replying with its response
+func newFakeCollector(t *testing.T, export func(r *http.Request, req *collectorpb.ExportMetricsServiceRequest) *collectorpb.ExportMetricsServiceResponse) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var req collectorpb.ExportMetricsServiceRequest
+		if r.Header.Get("Content-Type") != "application/x-protobuf" || proto.Unmarshal(body, &req) != nil {
+			http.Error(w, "expected a protobuf export request", http.StatusBadRequest)
+			return
+		}
+		resp, _ := proto.Marshal(export(r, &req))
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Write(resp)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// attributes returns a data point's attributes as a map
+func attributes(point *metricspb.NumberDataPoint) map[string]string {
+	attrs := make(map[string]string, len(point.Attributes))
+	for _, kv := range point.Attributes {
+		attrs[kv.Key] = kv.Value.GetStringValue()
+	}
+	return attrs
+}
+
+func TestOTLPSinkDataPoints(t *testing.T) {
+	var (
+		received *collectorpb.ExportMetricsServiceRequest
+		header   string
+	)
+	server := newFakeCollector(t, func(r *http.Request, req *collectorpb.ExportMetricsServiceRequest) *collectorpb.ExportMetricsServiceResponse {
+		received, header = req, r.Header.Get("X-Scope-OrgID")
+		return &collectorpb.ExportMetricsServiceResponse{}
+	})
+	s, err := NewOTLPSink(context.Background(), config.OTLPConfig{
+		Protocol: "http",
+		Endpoint: server.URL + "/v1/metrics",
+		Headers:  map[string]string{"X-Scope-OrgID": "tenant-1"},
+	})
+	if err != nil {
+		t.Fatalf("NewOTLPSink() error = %v", err)
+	}
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	rows := []common.ProcessedData{
+		{PrometheusInstance: "prom", Timestamp: start, Value: 1.5, Labels: map[string]string{"instance": "tidb-0", "job": "tidb"}, RunID: "run-1"},
+		{PrometheusInstance: "prom", Timestamp: start.Add(15 * time.Second), Value: 2.5, Labels: map[string]string{"instance": "tidb-1"}},
+	}
+	if err := s.Write("qps", rows); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if header != "tenant-1" {
+		t.Errorf("X-Scope-OrgID = %q, want the configured header", header)
+	}
+
+	metrics := received.ResourceMetrics[0].ScopeMetrics[0].Metrics
+	if len(metrics) != 1 || metrics[0].Name != "qps" || metrics[0].GetGauge() == nil {
+		t.Fatalf("metrics = %v, want one gauge named qps", metrics)
+	}
+	points := metrics[0].GetGauge().DataPoints
+	if len(points) != 2 {
+		t.Fatalf("got %d data points, want 2", len(points))
+	}
+	for i, point := range points {
+		if got := time.Unix(0, int64(point.TimeUnixNano)); !got.Equal(rows[i].Timestamp) {
+			t.Errorf("point %d time = %v, want the sample's %v", i, got, rows[i].Timestamp)
+		}
+		if point.GetAsDouble() != rows[i].Value {
+			t.Errorf("point %d value = %v, want %v", i, point.GetAsDouble(), rows[i].Value)
+		}
+	}
+	if got := attributes(points[0]); len(got) != 4 || got["prometheus_instance"] != "prom" || got["run_id"] != "run-1" ||
+		got["instance"] != "tidb-0" || got["job"] != "tidb" {
+		t.Errorf("point 0 attributes = %v, want the instance, run ID and labels", got)
+	}
+	if got := attributes(points[1]); len(got) != 2 || got["instance"] != "tidb-1" {
+		t.Errorf("point 1 attributes = %v, want no empty provenance", got)
+	}
+}
+
+func TestOTLPSinkSumMetrics(t *testing.T) {
+	s, err := NewOTLPSink(context.Background(), config.OTLPConfig{Protocol: "http", Endpoint: "http://collector", SumMetrics: []string{"requests_total"}})
+	if err != nil {
+		t.Fatalf("NewOTLPSink() error = %v", err)
+	}
+	metric := s.buildRequest("requests_total", valueRows(10)).ResourceMetrics[0].ScopeMetrics[0].Metrics[0]
+	sum := metric.GetSum()
+	if sum == nil || !sum.IsMonotonic || sum.AggregationTemporality != metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE {
+		t.Fatalf("metric = %v, want a cumulative monotonic sum", metric)
+	}
+	if sum.DataPoints[0].GetAsDouble() != 10 {
+		t.Errorf("value = %v, want 10", sum.DataPoints[0].GetAsDouble())
+	}
+}
+
+func TestOTLPSinkPartialSuccess(t *testing.T) {
+	server := newFakeCollector(t, func(r *http.Request, req *collectorpb.ExportMetricsServiceRequest) *collectorpb.ExportMetricsServiceResponse {
+		return &collectorpb.ExportMetricsServiceResponse{PartialSuccess: &collectorpb.ExportMetricsPartialSuccess{
+			RejectedDataPoints: 1,
+			ErrorMessage:       "too old",
+		}}
+	})
+	s, err := NewOTLPSink(context.Background(), config.OTLPConfig{Protocol: "http", Endpoint: server.URL})
+	if err != nil {
+		t.Fatalf("NewOTLPSink() error = %v", err)
+	}
+	err = s.Write("qps", valueRows(1, 2))
+	if err == nil || !strings.Contains(err.Error(), "rejected 1 of 2 data points of metric qps: too old") {
+		t.Errorf("Write() error = %v, want the rejected points reported", err)
+	}
+}
@@ -0,0 +1,195 @@
+package sink
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"github.com/meiking/tidb-metrics-crawler/pkg/version"
+	"github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/compress"
+)
+
+// defaultParquetRowGroupSize is the number of rows per row group
+const defaultParquetRowGroupSize = 100000
+
+// ParquetSink writes processed data to one Parquet file per metric. Label
+// columns are the union of the labels in the metric's first write, like the
+// CSV header; each is an optional string column named label_<key>.
+type ParquetSink struct {
+	outputDir    string
+	rowGroupSize int
+	codec        compress.Codec
+	files        map[string]*parquetFile
+}
+
+// parquetFile is an open Parquet file of one metric
+type parquetFile struct {
+	file      *os.File
+	writer    *parquet.Writer
+	columns   []string // Column names in schema order
+	labelKeys []string
+	row       parquet.Row // Reused between rows
+}
+
+// NewParquetSink creates a new Parquet sink
+func NewParquetSink(cfg config.ParquetConfig) (*ParquetSink, error) {
+	rowGroupSize := cfg.RowGroupSize
+	if rowGroupSize <= 0 {
+		rowGroupSize = defaultParquetRowGroupSize
+	}
+
+	var codec compress.Codec
+	switch cfg.Compression {
+	case "", "snappy":
+		codec = &parquet.Snappy
+	case "gzip":
+		codec = &parquet.Gzip
+	case "none":
+		codec = &parquet.Uncompressed
+	default:
+		return nil, fmt.Errorf("unsupported parquet compression: %s", cfg.Compression)
+	}
+
+	// Create output directory if it doesn't exist
+	if err := os.MkdirAll(cfg.OutputDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create output directory: %v", err)
+	}
+
+	return &ParquetSink{
+		outputDir:    cfg.OutputDir,
+		rowGroupSize: rowGroupSize,
+		codec:        codec,
+		files:        make(map[string]*parquetFile),
+	}, nil
+}
+
+// Write appends rows to the metric's file. The writer buffers them and
+// writes a row group whenever row_group_size rows are pending.
+func (s *ParquetSink) Write(metricName string, data []common.ProcessedData) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	pf, exists := s.files[metricName]
+	if !exists {
+		var err error
+		if pf, err = s.createFile(metricName, unionLabelKeys(data)); err != nil {
+			return err
+		}
+		s.files[metricName] = pf
+	}
+
+	warnUnknownLabels(metricName, pf.labelKeys, data)
+	for _, item := range data {
+		if _, err := pf.writer.WriteRows([]parquet.Row{pf.buildRow(item)}); err != nil {
+			return fmt.Errorf("failed to write Parquet row: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// Close writes the remaining rows and footers and closes all files
+func (s *ParquetSink) Close() error {
+	var lastErr error
+
+	for name, pf := range s.files {
+		err := pf.writer.Close()
+		if closeErr := pf.file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			lastErr = fmt.Errorf("error closing file %s: %v", name, err)
+		}
+		delete(s.files, name)
+	}
+
+	return lastErr
+}
+
+// parquetSchema returns the schema of a metric's file with labelKeys as
+// label columns
+func parquetSchema(labelKeys []string) *parquet.Schema {
+	columns := parquet.Group{
+		"prometheus_instance": parquet.String(),
+		"metric_name":         parquet.String(),
+		"timestamp":           parquet.Timestamp(parquet.Microsecond),
+		"value":               parquet.Leaf(parquet.DoubleType),
+		"job":                 parquet.String(),
+		"run_id":              parquet.String(),
+	}
+	for _, key := range labelKeys {
+		columns["label_"+key] = parquet.Optional(parquet.String())
+	}
+	return parquet.NewSchema("metrics", columns)
+}
+
+// createFile opens a new Parquet file for a metric
+func (s *ParquetSink) createFile(metricName string, labelKeys []string) (*parquetFile, error) {
+	timestamp := time.Now().Format("20060102150405")
+	path := filepath.Join(s.outputDir, fmt.Sprintf("%s_%s.parquet", metricName, timestamp))
+
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Parquet file: %v", err)
+	}
+
+	schema := parquetSchema(labelKeys)
+	writer := parquet.NewWriter(file, schema,
+		parquet.Compression(s.codec),
+		parquet.MaxRowsPerRowGroup(int64(s.rowGroupSize)),
+		parquet.CreatedBy("tidb-metrics-crawler", version.Version, ""),
+	)
+
+	// The schema orders columns by name
+	columns := make([]string, 0, len(schema.Columns()))
+	for _, path := range schema.Columns() {
+		columns = append(columns, path[0])
+	}
+
+	return &parquetFile{
+		file:      file,
+		writer:    writer,
+		columns:   columns,
+		labelKeys: labelKeys,
+		row:       make(parquet.Row, len(columns)),
+	}, nil
+}
+
+// buildRow converts a data point into a row in schema order. Labels the
+// point lacks are null.
+func (pf *parquetFile) buildRow(item common.ProcessedData) parquet.Row {
+	for i, column := range pf.columns {
+		var value parquet.Value
+		switch column {
+		case "prometheus_instance":
+			value = parquet.ByteArrayValue([]byte(item.PrometheusInstance))
+		case "metric_name":
+			value = parquet.ByteArrayValue([]byte(item.MetricName))
+		case "timestamp":
+			value = parquet.Int64Value(item.Timestamp.UnixMicro())
+		case "value":
+			value = parquet.DoubleValue(item.Value)
+		case "job":
+			value = parquet.ByteArrayValue([]byte(item.Job))
+		case "run_id":
+			value = parquet.ByteArrayValue([]byte(item.RunID))
+		default:
+			// An optional label column: defined only when the point has the label
+			if label, ok := item.Labels[strings.TrimPrefix(column, "label_")]; ok {
+				value = parquet.ByteArrayValue([]byte(label)).Level(0, 1, i)
+			} else {
+				value = parquet.NullValue().Level(0, 0, i)
+			}
+			pf.row[i] = value
+			continue
+		}
+		pf.row[i] = value.Level(0, 0, i)
+	}
+	return pf.row
+}
@@ -0,0 +1,117 @@
+package sink
+
+import (
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"github.com/parquet-go/parquet-go"
+)
+
+// parquetRow is a row of a qps file as read back with parquet-go
+type parquetRow struct {
+	PrometheusInstance string    `parquet:"prometheus_instance"`
+	MetricName         string    `parquet:"metric_name"`
+	Timestamp          time.Time `parquet:"timestamp,timestamp(microsecond)"`
+	Value              float64   `parquet:"value"`
+	Job                string    `parquet:"job"`
+	RunID              string    `parquet:"run_id"`
+	LabelJob           *string   `parquet:"label_job,optional"`
+	LabelInstance      *string   `parquet:"label_instance,optional"`
+}
+
+func TestParquetSinkReadBack(t *testing.T) {
+	for _, compression := range []string{"snappy", "gzip", "none"} {
+		t.Run(compression, func(t *testing.T) {
+			dir := t.TempDir()
+			s, err := NewParquetSink(config.ParquetConfig{OutputDir: dir, RowGroupSize: 2, Compression: compression})
+			if err != nil {
+				t.Fatalf("NewParquetSink() error = %v", err)
+			}
+
+			rows := valueRows(1.5, math.NaN(), 3, 4.25, 5)
+			for i := range rows {
+				rows[i].Job, rows[i].RunID = "nightly", "run-1"
+				rows[i].Labels = map[string]string{"job": "tidb", "instance": "tidb-0"}
+			}
+			delete(rows[3].Labels, "instance") // Null in its label column
+			if err := s.Write("qps", rows[:3]); err != nil {
+				t.Fatalf("Write() error = %v", err)
+			}
+			if err := s.Write("qps", rows[3:]); err != nil {
+				t.Fatalf("Write() error = %v", err)
+			}
+			if err := s.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+
+			paths, _ := filepath.Glob(filepath.Join(dir, "qps_*.parquet"))
+			if len(paths) != 1 {
+				t.Fatalf("got files %v, want one qps file", paths)
+			}
+			got, err := parquet.ReadFile[parquetRow](paths[0])
+			if err != nil {
+				t.Fatalf("ReadFile() error = %v", err)
+			}
+			if len(got) != len(rows) {
+				t.Fatalf("read %d rows, want %d", len(got), len(rows))
+			}
+			for i, want := range rows {
+				checkParquetRow(t, i, got[i], want)
+			}
+
+			f, err := parquet.OpenFile(openTestFile(t, paths[0]))
+			if err != nil {
+				t.Fatalf("OpenFile() error = %v", err)
+			}
+			if n := len(f.RowGroups()); n != 3 {
+				t.Errorf("file has %d row groups, want 3 of at most 2 rows", n)
+			}
+		})
+	}
+}
+
+// checkParquetRow compares row i as read back with the point written
+func checkParquetRow(t *testing.T, i int, got parquetRow, want common.ProcessedData) {
+	t.Helper()
+	if got.PrometheusInstance != want.PrometheusInstance || got.MetricName != want.MetricName ||
+		got.Job != want.Job || got.RunID != want.RunID {
+		t.Errorf("row %d = %+v, want instance, metric and provenance of %+v", i, got, want)
+	}
+	if !got.Timestamp.Equal(want.Timestamp) {
+		t.Errorf("row %d timestamp = %v, want %v", i, got.Timestamp, want.Timestamp)
+	}
+	if got.Value != want.Value && !(math.IsNaN(got.Value) && math.IsNaN(want.Value)) {
+		t.Errorf("row %d value = %v, want %v", i, got.Value, want.Value)
+	}
+	for name, label := range map[string]*string{"job": got.LabelJob, "instance": got.LabelInstance} {
+		wantValue, ok := want.Labels[name]
+		switch {
+		case !ok && label != nil:
+			t.Errorf("row %d label %s = %q, want null", i, name, *label)
+		case ok && (label == nil || *label != wantValue):
+			t.Errorf("row %d label %s = %v, want %q", i, name, label, wantValue)
+		}
+	}
+}
+
+// openTestFile opens path for reading until the test ends, returning it
+// with its size
+func openTestFile(t *testing.T, path string) (io.ReaderAt, int64) {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, info.Size()
+}
@@ -0,0 +1,148 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"github.com/redis/go-redis/v9"
+)
+
+// defaultRedisKeyTemplate keys each series by metric and label hash
+const defaultRedisKeyTemplate = "tidb-metrics:{{.MetricName}}:{{.LabelsHash}}"
+
+// RedisSink keeps the latest value of each series in a Redis hash
+type RedisSink struct {
+	ctx         context.Context
+	client      *redis.Client
+	keyTemplate *template.Template
+	ttl         time.Duration
+}
+
+// redisKeyData is the data available to the key template
+type redisKeyData struct {
+	MetricName string
+	Instance   string
+	Labels     map[string]string
+	LabelsHash string
+}
+
+// NewRedisSink creates a new Redis sink
+func NewRedisSink(ctx context.Context, cfg config.RedisConfig) (*RedisSink, error) {
+	if cfg.Addr == "" {
+		return nil, fmt.Errorf("redis addr is required")
+	}
+
+	keyTemplateStr := cfg.KeyTemplate
+	if keyTemplateStr == "" {
+		keyTemplateStr = defaultRedisKeyTemplate
+	}
+
+	keyTemplate, err := template.New("key").Option("missingkey=error").Parse(keyTemplateStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key_template: %v", err)
+	}
+
+	var ttl time.Duration
+	if cfg.TTL != "" {
+		if ttl, err = common.ParseDuration(cfg.TTL); err != nil {
+			return nil, fmt.Errorf("invalid ttl: %v", err)
+		}
+	}
+
+	client := redis.NewClient(&redis.Options{
+		Addr:     cfg.Addr,
+		DB:       cfg.DB,
+		Password: cfg.Password,
+	})
+
+	// Test the connection
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to ping Redis: %v", err)
+	}
+
+	return &RedisSink{
+		ctx:         ctx,
+		client:      client,
+		keyTemplate: keyTemplate,
+		ttl:         ttl,
+	}, nil
+}
+
+// Write stores the most recent sample of each series in the batch, pipelining all commands
+func (s *RedisSink) Write(metricName string, data []common.ProcessedData) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	// Only the latest sample per key needs to be written
+	latest := make(map[string]common.ProcessedData)
+	for _, item := range data {
+		key, err := s.key(metricName, item)
+		if err != nil {
+			return err
+		}
+		if prev, exists := latest[key]; !exists || !item.Timestamp.Before(prev.Timestamp) {
+			latest[key] = item
+		}
+	}
+
+	pipe := s.client.Pipeline()
+	for key, item := range latest {
+		labelsJSON, err := common.MapToJSONString(item.Labels)
+		if err != nil {
+			return fmt.Errorf("failed to convert labels to JSON: %v", err)
+		}
+
+		pipe.HSet(s.ctx, key,
+			"metric_name", metricName,
+			"prometheus_instance", item.PrometheusInstance,
+			"value", item.Value,
+			"timestamp", item.Timestamp.Unix(),
+			"labels", labelsJSON,
+			"job", item.Job,
+			"run_id", item.RunID,
+		)
+		if s.ttl > 0 {
+			pipe.Expire(s.ctx, key, s.ttl)
+		}
+	}
+
+	if _, err := pipe.Exec(s.ctx); err != nil {
+		return fmt.Errorf("redis pipeline failed: %v", err)
+	}
+
+	return nil
+}
+
+// Ping checks the Redis connection
+func (s *RedisSink) Ping(ctx context.Context) error {
+	if err := s.client.Ping(ctx).Err(); err != nil {
+		return fmt.Errorf("failed to ping Redis: %v", err)
+	}
+	return nil
+}
+
+// Close closes the Redis client
+func (s *RedisSink) Close() error {
+	return s.client.Close()
+}
+
+// key renders the key template for a row
+func (s *RedisSink) key(metricName string, item common.ProcessedData) (string, error) {
+	var b strings.Builder
+	if err := s.keyTemplate.Execute(&b, redisKeyData{
+		MetricName: metricName,
+		Instance:   item.PrometheusInstance,
+		Labels:     item.Labels,
+		LabelsHash: common.LabelsHash(item.Labels),
+	}); err != nil {
+		return "", fmt.Errorf("failed to render key_template: %v", err)
+	}
+	return b.String(), nil
+}
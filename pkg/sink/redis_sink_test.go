@@ -0,0 +1,84 @@
+package sink
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+func newTestRedisSink(t *testing.T, cfg config.RedisConfig) (*RedisSink, *miniredis.Miniredis) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	cfg.Addr = server.Addr()
+	s, err := NewRedisSink(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("NewRedisSink() error = %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, server
+}
+
+func TestRedisSinkKeepsLatestPerSeries(t *testing.T) {
+	s, server := newTestRedisSink(t, config.RedisConfig{TTL: "1h"})
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tidb := map[string]string{"instance": "tidb-0"}
+	tikv := map[string]string{"instance": "tikv-0"}
+	rows := []common.ProcessedData{
+		{PrometheusInstance: "prom", Timestamp: start.Add(time.Minute), Value: 2, Labels: tidb, RunID: "run-1"},
+		{PrometheusInstance: "prom", Timestamp: start, Value: 1, Labels: tidb, RunID: "run-1"},
+		{PrometheusInstance: "prom", Timestamp: start, Value: 10, Labels: tikv, RunID: "run-1"},
+	}
+	if err := s.Write("qps", rows); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	if keys := server.Keys(); len(keys) != 2 {
+		t.Fatalf("keys = %v, want one per series", keys)
+	}
+	key := "tidb-metrics:qps:" + common.LabelsHash(tidb)
+	want := map[string]string{
+		"metric_name":         "qps",
+		"prometheus_instance": "prom",
+		"value":               "2",
+		"timestamp":           "1704067260",
+		"labels":              `{"instance":"tidb-0"}`,
+		"job":                 "",
+		"run_id":              "run-1",
+	}
+	for field, value := range want {
+		if got := server.HGet(key, field); got != value {
+			t.Errorf("%s %s = %q, want %q", key, field, got, value)
+		}
+	}
+	if got := server.TTL(key); got != time.Hour {
+		t.Errorf("TTL of %s = %v, want 1h", key, got)
+	}
+	if got := server.HGet("tidb-metrics:qps:"+common.LabelsHash(tikv), "value"); got != "10" {
+		t.Errorf("tikv value = %q, want 10", got)
+	}
+}
+
+func TestRedisSinkKeyTemplateWithoutTTL(t *testing.T) {
+	s, server := newTestRedisSink(t, config.RedisConfig{KeyTemplate: "{{.Instance}}/{{.MetricName}}/{{.Labels.instance}}"})
+
+	rows := []common.ProcessedData{{PrometheusInstance: "prom", Value: 1, Labels: map[string]string{"instance": "tidb-0"}}}
+	if err := s.Write("qps", rows); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if !server.Exists("prom/qps/tidb-0") {
+		t.Fatalf("keys = %v, want prom/qps/tidb-0", server.Keys())
+	}
+	if got := server.TTL("prom/qps/tidb-0"); got != 0 {
+		t.Errorf("TTL = %v, want none without ttl", got)
+	}
+
+	// A label missing from the row fails the write instead of colliding keys
+	if err := s.Write("qps", []common.ProcessedData{{Labels: map[string]string{}}}); err == nil {
+		t.Error("Write() of a row without the templated label succeeded")
+	}
+}
@@ -0,0 +1,167 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+// Constructor creates a sink from its configuration. ctx bounds any network
+// I/O the sink performs. Sinks registered outside this repository read their
+// settings from cfg.Options, e.g. with cfg.Options.Decode(&myConfig).
+type Constructor func(ctx context.Context, cfg config.SinkConfig) (Sink, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Constructor)
+)
+
+// Register makes a sink available as sink type name. It is meant to be
+// called from init functions and panics if name is already registered.
+func Register(name string, constructor Constructor) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if constructor == nil {
+		panic("sink: Register constructor is nil")
+	}
+	if _, dup := registry[name]; dup {
+		panic(fmt.Sprintf("sink: Register called twice for sink %s", name))
+	}
+	registry[name] = constructor
+}
+
+// Types returns the registered sink types in sorted order
+func Types() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	types := make([]string, 0, len(registry))
+	for name := range registry {
+		types = append(types, name)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// lookup returns the constructor registered under name, ignoring case, and
+// the name it was registered as
+func lookup(name string) (Constructor, string, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	if constructor, ok := registry[name]; ok {
+		return constructor, name, true
+	}
+	for registered, constructor := range registry {
+		if strings.EqualFold(registered, name) {
+			return constructor, registered, true
+		}
+	}
+	return nil, "", false
+}
+
+// suggestType returns the registered sink type name was most likely meant to
+// be: one starting with name, if name has at least 3 characters, or else the
+// closest at most 2 edits away. It returns "" when none is close.
+func suggestType(name string) string {
+	name = strings.ToLower(name)
+	best, bestDistance := "", 3
+	for _, registered := range Types() {
+		lower := strings.ToLower(registered)
+		if len(name) >= 3 && strings.HasPrefix(lower, name) {
+			return registered
+		}
+		if d := editDistance(name, lower); d < bestDistance {
+			best, bestDistance = registered, d
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+// Built-in sinks are registered through the same mechanism as custom ones
+func init() {
+	Register("csv", func(ctx context.Context, cfg config.SinkConfig) (Sink, error) {
+		return NewCSVSink(cfg.CSV)
+	})
+	Register("feishu", func(ctx context.Context, cfg config.SinkConfig) (Sink, error) {
+		return NewFeishuSink(cfg.Feishu, cfg.CSV)
+	})
+	Register("mysql", func(ctx context.Context, cfg config.SinkConfig) (Sink, error) {
+		return NewMySQLSink(ctx, cfg.MySQL)
+	})
+	Register("redis", func(ctx context.Context, cfg config.SinkConfig) (Sink, error) {
+		return NewRedisSink(ctx, cfg.Redis)
+	})
+	Register("dingtalk", func(ctx context.Context, cfg config.SinkConfig) (Sink, error) {
+		return NewDingTalkSink(cfg.DingTalk)
+	})
+	Register("wecom", func(ctx context.Context, cfg config.SinkConfig) (Sink, error) {
+		return NewWeComSink(cfg.WeCom, cfg.CSV)
+	})
+	Register("slack", func(ctx context.Context, cfg config.SinkConfig) (Sink, error) {
+		return NewSlackSink(cfg.Slack, cfg.CSV)
+	})
+	Register("discord", func(ctx context.Context, cfg config.SinkConfig) (Sink, error) {
+		return NewDiscordSink(cfg.Discord, cfg.CSV)
+	})
+	Register("email", func(ctx context.Context, cfg config.SinkConfig) (Sink, error) {
+		return NewEmailSink(cfg.Email, cfg.CSV)
+	})
+	Register("elasticsearch", func(ctx context.Context, cfg config.SinkConfig) (Sink, error) {
+		return NewElasticsearchSink(ctx, cfg.Elasticsearch)
+	})
+	Register("otlp", func(ctx context.Context, cfg config.SinkConfig) (Sink, error) {
+		return NewOTLPSink(ctx, cfg.OTLP)
+	})
+	Register("parquet", func(ctx context.Context, cfg config.SinkConfig) (Sink, error) {
+		return NewParquetSink(cfg.Parquet)
+	})
+	Register("mongodb", func(ctx context.Context, cfg config.SinkConfig) (Sink, error) {
+		return NewMongoSink(ctx, cfg.MongoDB)
+	})
+	Register("grpc", func(ctx context.Context, cfg config.SinkConfig) (Sink, error) {
+		return NewGRPCSink(ctx, cfg.GRPC)
+	})
+	Register("table", func(ctx context.Context, cfg config.SinkConfig) (Sink, error) {
+		return NewTableSink(cfg.Table)
+	})
+	Register("gcs", func(ctx context.Context, cfg config.SinkConfig) (Sink, error) {
+		return NewGCSSink(ctx, cfg.GCS)
+	})
+	Register("azblob", func(ctx context.Context, cfg config.SinkConfig) (Sink, error) {
+		return NewAzBlobSink(ctx, cfg.AzBlob)
+	})
+	Register("vm_import", func(ctx context.Context, cfg config.SinkConfig) (Sink, error) {
+		return NewVMImportSink(ctx, cfg.VMImport)
+	})
+	Register("arrow", func(ctx context.Context, cfg config.SinkConfig) (Sink, error) {
+		return NewArrowSink(cfg.Arrow)
+	})
+}
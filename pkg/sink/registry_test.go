@@ -0,0 +1,164 @@
+package sink
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"gopkg.in/yaml.v3"
+)
+
+// prefixSink is a custom sink configured through options
+type prefixSink struct {
+	*fakeSink
+	prefix string
+}
+
+func (s *prefixSink) Write(metricName string, data []common.ProcessedData) error {
+	return s.fakeSink.Write(s.prefix+metricName, data)
+}
+
+func TestRegisterCustomSink(t *testing.T) {
+	const name = "test_prefix"
+	var created *prefixSink
+	Register(name, func(ctx context.Context, cfg config.SinkConfig) (Sink, error) {
+		var opts struct {
+			Prefix string `yaml:"prefix"`
+		}
+		if err := cfg.Options.Decode(&opts); err != nil {
+			return nil, err
+		}
+		created = &prefixSink{fakeSink: newFakeSink(), prefix: opts.Prefix}
+		return created, nil
+	})
+	defer func() {
+		registryMu.Lock()
+		delete(registry, name)
+		registryMu.Unlock()
+	}()
+
+	if !slices.Contains(Types(), name) {
+		t.Errorf("Types() = %v, want %s listed", Types(), name)
+	}
+
+	var cfg config.SinkConfig
+	if err := yaml.Unmarshal([]byte("type: test_prefix\noptions:\n  prefix: lab_\n"), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSink(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("NewSink() error = %v", err)
+	}
+	if err := s.Write("qps", valueRows(1, 2)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if got := len(created.metricRows("lab_qps")); got != 2 {
+		t.Errorf("custom sink got %d rows of lab_qps, want 2 written with the configured prefix", got)
+	}
+
+	// Registered sinks get the same decorators as built-in ones
+	cfg.Async = true
+	s, err = NewSink(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("NewSink() error = %v", err)
+	}
+	if _, ok := s.(*AsyncSink); !ok {
+		t.Errorf("NewSink() with async = %T, want an AsyncSink", s)
+	}
+	s.Close()
+}
+
+func TestRegisterPanics(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		constructor Constructor
+	}{
+		{"csv", func(ctx context.Context, cfg config.SinkConfig) (Sink, error) { return nil, nil }}, // Already registered
+		{"test_nil", nil},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Register(%q) did not panic", tc.name)
+				}
+			}()
+			Register(tc.name, tc.constructor)
+		}()
+	}
+}
+
+func TestSinkTypeCaseInsensitive(t *testing.T) {
+	for _, sinkType := range []string{"csv", "CSV", "Csv"} {
+		var cfg config.SinkConfig
+		cfg.Type = sinkType
+		cfg.CSV.OutputDir = t.TempDir()
+		s, err := NewSink(context.Background(), cfg)
+		if err != nil {
+			t.Errorf("NewSink(type %q) error = %v", sinkType, err)
+			continue
+		}
+		if _, ok := s.(*CSVSink); !ok {
+			t.Errorf("NewSink(type %q) = %T, want a CSVSink", sinkType, s)
+		}
+		s.Close()
+	}
+
+	if _, name, ok := lookup("MySQL"); !ok || name != "mysql" {
+		t.Errorf("lookup(MySQL) = %q, %v, want the registered name mysql", name, ok)
+	}
+}
+
+func TestUnknownSinkTypeSuggestion(t *testing.T) {
+	tests := []struct {
+		sinkType string
+		want     string
+	}{
+		{"mysq", "mysql"}, // Prefix
+		{"MYSQ", "mysql"}, // Prefix, ignoring case
+		{"csvv", "csv"},   // One edit
+		{"cs", "csv"},     // Too short for a prefix, one edit
+		{"elastic", "elasticsearch"},
+		{"rdis", "redis"},
+		{"kafka", ""},
+		{"xyz", ""},
+	}
+	for _, tt := range tests {
+		if got := suggestType(tt.sinkType); got != tt.want {
+			t.Errorf("suggestType(%q) = %q, want %q", tt.sinkType, got, tt.want)
+		}
+	}
+
+	var cfg config.SinkConfig
+	cfg.Type = "mysq"
+	_, err := NewSink(context.Background(), cfg)
+	if err == nil || !strings.HasPrefix(err.Error(), `unsupported sink type: "mysq", did you mean "mysql"? (available: `) || !strings.Contains(err.Error(), "csv, ") {
+		t.Errorf("NewSink(type mysq) error = %v, want the suggestion and the available types", err)
+	}
+	cfg.Type = "kafka"
+	_, err = NewSink(context.Background(), cfg)
+	if err == nil || !strings.HasPrefix(err.Error(), `unsupported sink type: "kafka" (available: `) {
+		t.Errorf("NewSink(type kafka) error = %v, want the available types without a suggestion", err)
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"csv", "", 3},
+		{"mysql", "mysql", 0},
+		{"mysq", "mysql", 1},
+		{"rdis", "redis", 1},
+		{"kitten", "sitting", 3},
+	}
+	for _, tt := range tests {
+		if got := editDistance(tt.a, tt.b); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package sink
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/meiking/tidb-metrics-crawler/pkg/backoff"
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const defaultRetryAttempts = 3
+
+// defaultRetryBackoff is the backoff of sink writes unless retry sets it
+var defaultRetryBackoff = backoff.Backoff{
+	Base:       time.Second,
+	Max:        30 * time.Second,
+	Multiplier: 2,
+}
+
+// RetryingSink wraps a sink and retries writes that fail with transient
+// errors, backing off exponentially. Only failures reported as a *WriteError
+// are retried, since only those say how much of the data the sink already
+// took; retrying any other failed Write could store rows twice. Close is not
+// retried.
+type RetryingSink struct {
+	ctx      context.Context
+	sink     Sink
+	attempts int
+	backoff  *backoff.Backoff
+}
+
+// WriteError is a failed Write that took the first Written rows of its data,
+// which are stored or buffered by the sink, and none of the rest. Sending
+// the rest again cannot duplicate rows, so a RetryingSink retries it when Err
+// is transient.
+type WriteError struct {
+	Written int
+	Err     error
+}
+
+func (e *WriteError) Error() string { return e.Err.Error() }
+func (e *WriteError) Unwrap() error { return e.Err }
+
+// StatusError is an HTTP response with an unexpected status
+type StatusError struct {
+	StatusCode int
+	Body       string // Response body, usually the server's explanation
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s (status: %d)", e.Body, e.StatusCode)
+}
+
+// NewRetryingSink wraps s. Waiting between attempts stops when ctx is done.
+func NewRetryingSink(ctx context.Context, s Sink, cfg config.RetryConfig) (*RetryingSink, error) {
+	attempts := cfg.Attempts
+	if attempts <= 0 {
+		attempts = defaultRetryAttempts
+	}
+
+	b, err := backoff.FromConfig(cfg, defaultRetryBackoff)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RetryingSink{
+		ctx:      ctx,
+		sink:     s,
+		attempts: attempts,
+		backoff:  b,
+	}, nil
+}
+
+// Write writes to the wrapped sink, retrying transient failures with the
+// rows the sink did not take
+func (s *RetryingSink) Write(metricName string, data []common.ProcessedData) error {
+	for attempt := 1; ; attempt++ {
+		err := s.sink.Write(metricName, data)
+		if err == nil {
+			return nil
+		}
+		var writeErr *WriteError
+		if attempt == s.attempts || !errors.As(err, &writeErr) || !isRetryableError(writeErr.Err) {
+			return err
+		}
+		data = data[writeErr.Written:]
+
+		delay := s.backoff.NextDelay(attempt)
+		log.Printf("Retry %d/%d for sink write of %d records of metric %s (error: %v). Waiting %v...",
+			attempt, s.attempts-1, len(data), metricName, err, delay)
+		if err := sleepContext(s.ctx, delay); err != nil {
+			return fmt.Errorf("sink write cancelled: %v", err)
+		}
+	}
+}
+
+// Close closes the wrapped sink
+func (s *RetryingSink) Close() error {
+	return s.sink.Close()
+}
+
+// Ping checks the wrapped sink
+func (s *RetryingSink) Ping(ctx context.Context) error {
+	return Ping(ctx, s.sink)
+}
+
+// RecordRun forwards the run report to the wrapped sink
+func (s *RetryingSink) RecordRun(report RunReport) {
+	RecordRun(s.sink, report)
+}
+
+// canWatermark reports whether the wrapped sink is a Watermarker
+func (s *RetryingSink) canWatermark() bool {
+	_, ok := AsWatermarker(s.sink)
+	return ok
+}
+
+// LastTimestamp forwards to the wrapped sink when it is a Watermarker
+func (s *RetryingSink) LastTimestamp(instance, metricName string) (time.Time, bool, error) {
+	w, ok := AsWatermarker(s.sink)
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	return w.LastTimestamp(instance, metricName)
+}
+
+// sleepContext waits for d or until ctx is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// isRetryableError reports whether err is transient: a timeout, a dropped
+// or refused connection, an HTTP 408, 429 or 5xx response, an unavailable or
+// exhausted gRPC server, or a MySQL deadlock or write conflict. Sinks wrap
+// the errors they return with %w so these types survive.
+func isRetryableError(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) ||
+		isRetryableWriteError(err) {
+		return true
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		code := statusErr.StatusCode
+		return code == http.StatusRequestTimeout || code == http.StatusTooManyRequests || code >= 500
+	}
+
+	switch status.Code(err) {
+	case codes.Unavailable, codes.ResourceExhausted:
+		return true
+	}
+	return false
+}
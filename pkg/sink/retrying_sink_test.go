@@ -0,0 +1,190 @@
+package sink
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net/http"
+	"syscall"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// quickRetries retries up to attempts times without waiting
+func quickRetries(attempts int) config.RetryConfig {
+	return config.RetryConfig{Attempts: attempts, Backoff: "1ms", MaxBackoff: "1ms"}
+}
+
+// newTestRetryingSink wraps s with quick retries
+func newTestRetryingSink(t *testing.T, s Sink, attempts int) *RetryingSink {
+	t.Helper()
+	r, err := NewRetryingSink(context.Background(), s, quickRetries(attempts))
+	if err != nil {
+		t.Fatalf("NewRetryingSink() error = %v", err)
+	}
+	return r
+}
+
+// unavailable is a transient write failure that took nothing
+var unavailable = &WriteError{Err: fmt.Errorf("request failed: %w", &StatusError{StatusCode: http.StatusServiceUnavailable, Body: "busy"})}
+
+func TestRetryingSinkRetriesThenSucceeds(t *testing.T) {
+	inner := newFakeSink()
+	inner.write = func(call int, metricName string, data []common.ProcessedData) error {
+		if call <= 2 {
+			return unavailable
+		}
+		return nil
+	}
+	s := newTestRetryingSink(t, inner, 3)
+
+	if err := s.Write("qps", testRows(4)); err != nil {
+		t.Fatalf("Write() error = %v, want the third attempt to succeed", err)
+	}
+	if got := inner.writeCalls(); got != 3 {
+		t.Errorf("wrapped sink got %d writes, want 3", got)
+	}
+	if got := len(inner.metricRows("qps")); got != 4 {
+		t.Errorf("wrapped sink stored %d rows, want 4", got)
+	}
+}
+
+func TestRetryingSinkGivesUpAfterAttempts(t *testing.T) {
+	inner := newFakeSink()
+	inner.write = func(call int, metricName string, data []common.ProcessedData) error {
+		return unavailable
+	}
+	s := newTestRetryingSink(t, inner, 4)
+
+	err := s.Write("qps", testRows(1))
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Write() error = %v, want the last attempt's", err)
+	}
+	if got := inner.writeCalls(); got != 4 {
+		t.Errorf("wrapped sink got %d writes, want 4 attempts", got)
+	}
+}
+
+func TestRetryingSinkResendsOnlyRowsNotTaken(t *testing.T) {
+	inner := newFakeSink()
+	var sent [][]common.ProcessedData
+	inner.write = func(call int, metricName string, data []common.ProcessedData) error {
+		sent = append(sent, data)
+		if call == 1 {
+			// Took the first 2 rows before the connection dropped
+			return &WriteError{Written: 2, Err: fmt.Errorf("insert failed: %w", syscall.ECONNRESET)}
+		}
+		return nil
+	}
+	s := newTestRetryingSink(t, inner, 3)
+
+	rows := testRows(5)
+	if err := s.Write("qps", rows); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if len(sent) != 2 || len(sent[1]) != 3 || !sent[1][0].Timestamp.Equal(rows[2].Timestamp) {
+		t.Errorf("retry sent %d writes, last of %d rows, want the 3 rows not taken", len(sent), len(sent[len(sent)-1]))
+	}
+}
+
+func TestRetryingSinkDoesNotRetry(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{"no WriteError", fmt.Errorf("insert failed: %w", syscall.ECONNRESET)},
+		{"permanent error", &WriteError{Err: &StatusError{StatusCode: http.StatusBadRequest, Body: "bad payload"}}},
+		{"cancelled", &WriteError{Err: context.Canceled}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner := newFakeSink()
+			inner.write = func(call int, metricName string, data []common.ProcessedData) error {
+				return tt.err
+			}
+			s := newTestRetryingSink(t, inner, 3)
+
+			if err := s.Write("qps", testRows(1)); err == nil {
+				t.Fatal("Write() succeeded")
+			}
+			if got := inner.writeCalls(); got != 1 {
+				t.Errorf("wrapped sink got %d writes, want 1", got)
+			}
+		})
+	}
+}
+
+func TestIsRetryableError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"connection reset", fmt.Errorf("send: %w", syscall.ECONNRESET), true},
+		{"connection refused", fmt.Errorf("send: %w", syscall.ECONNREFUSED), true},
+		{"broken pipe", fmt.Errorf("send: %w", syscall.EPIPE), true},
+		{"bad connection", fmt.Errorf("insert failed: %w", driver.ErrBadConn), true},
+		{"invalid connection", fmt.Errorf("insert failed: %w", mysql.ErrInvalidConn), true},
+		{"deadlock", fmt.Errorf("insert failed: %w", &mysql.MySQLError{Number: errCodeDeadlock}), true},
+		{"status 408", &StatusError{StatusCode: http.StatusRequestTimeout}, true},
+		{"status 429", &StatusError{StatusCode: http.StatusTooManyRequests}, true},
+		{"status 502", fmt.Errorf("request failed: %w", &StatusError{StatusCode: http.StatusBadGateway}), true},
+		{"gRPC unavailable", fmt.Errorf("export: %w", status.Error(codes.Unavailable, "down")), true},
+		{"status 404", &StatusError{StatusCode: http.StatusNotFound}, false},
+		{"gRPC invalid argument", status.Error(codes.InvalidArgument, "bad"), false},
+		{"duplicate key", &mysql.MySQLError{Number: 1062, Message: "Duplicate entry"}, false},
+		{"cancelled", fmt.Errorf("insert cancelled: %w", context.Canceled), false},
+		// Only types count; a message that looks transient is not enough
+		{"message only", errors.New("request failed: busy (status: 503)"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRetryableError(tt.err); got != tt.want {
+				t.Errorf("isRetryableError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+// insertArgs returns the arguments of an insert of rows with the default schema
+func insertArgs(rows []common.ProcessedData) []driver.Value {
+	var args []driver.Value
+	for _, row := range rows {
+		labels, _ := common.MapToJSONString(row.Labels)
+		args = append(args, row.PrometheusInstance, row.MetricName, row.Timestamp.UTC().Format(mysqlDateTimeLayout), row.Value, labels)
+	}
+	return args
+}
+
+func TestRetryingMySQLSinkStoresEveryRowOnce(t *testing.T) {
+	s, mock := newMockMySQLSink(t, context.Background(), config.MySQLConfig{BatchSize: 2})
+	rows := testRows(5)
+
+	// The first insert drops the connection; its rows stay buffered for the retry
+	mock.ExpectExec("INSERT INTO prometheus_metrics").WithArgs(insertArgs(rows[:2])...).WillReturnError(mysql.ErrInvalidConn)
+	mock.ExpectExec("INSERT INTO prometheus_metrics").WithArgs(insertArgs(rows[:2])...).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec("INSERT INTO prometheus_metrics").WithArgs(insertArgs(rows[2:4])...).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec("INSERT INTO prometheus_metrics").WithArgs(insertArgs(rows[4:])...).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectClose()
+
+	r := newTestRetryingSink(t, s, 3)
+	if err := r.Write("qps", rows); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,97 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+)
+
+// robotResponse is the reply of DingTalk and WeCom robot APIs
+type robotResponse struct {
+	ErrCode int    `json:"errcode"`
+	ErrMsg  string `json:"errmsg"`
+}
+
+// postRobotMessage sends a JSON message to a robot webhook and checks the reply
+func postRobotMessage(client *http.Client, url string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return checkRobotResponse(resp, nil)
+}
+
+// checkRobotResponse decodes a robot reply into out, which must embed the
+// errcode/errmsg fields, and fails on a non-zero errcode
+func checkRobotResponse(resp *http.Response, out interface{}) error {
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("request failed: %w", &StatusError{StatusCode: resp.StatusCode, Body: string(respBody)})
+	}
+
+	var result robotResponse
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return fmt.Errorf("invalid response: %v", err)
+	}
+	if result.ErrCode != 0 {
+		return fmt.Errorf("request failed: %s (errcode: %d)", result.ErrMsg, result.ErrCode)
+	}
+
+	if out != nil {
+		return json.Unmarshal(respBody, out)
+	}
+	return nil
+}
+
+// dataSummary describes a batch of data for chat messages
+type dataSummary struct {
+	Rows        int
+	Series      int
+	First, Last time.Time
+}
+
+// summarize counts the rows and distinct series in data and finds its time range
+func summarize(data []common.ProcessedData) dataSummary {
+	series := make(map[string]struct{})
+	summary := dataSummary{Rows: len(data)}
+	for i, item := range data {
+		series[item.PrometheusInstance+"\xff"+common.LabelsHash(item.Labels)] = struct{}{}
+		if i == 0 || item.Timestamp.Before(summary.First) {
+			summary.First = item.Timestamp
+		}
+		if i == 0 || item.Timestamp.After(summary.Last) {
+			summary.Last = item.Timestamp
+		}
+	}
+	summary.Series = len(series)
+	return summary
+}
+
+// summarizeData renders a markdown summary of a batch of data for chat messages
+func summarizeData(title, metricName string, data []common.ProcessedData) string {
+	summary := summarize(data)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "### %s - %s\n", title, metricName)
+	fmt.Fprintf(&b, "- Rows: %d\n", summary.Rows)
+	fmt.Fprintf(&b, "- Series: %d\n", summary.Series)
+	fmt.Fprintf(&b, "- Time range: %s ~ %s\n", summary.First.Format(time.RFC3339), summary.Last.Format(time.RFC3339))
+	return b.String()
+}
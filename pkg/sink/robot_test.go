@@ -0,0 +1,87 @@
+package sink
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// robotRequest is a request received by a fake robot webhook
+type robotRequest struct {
+	path        string
+	query       url.Values
+	contentType string
+	body        []byte
+}
+
+// robotServer is a fake chat robot webhook. reply, when set, writes the
+// response to each request; otherwise requests succeed with errcode 0.
+type robotServer struct {
+	*httptest.Server
+	reply func(w http.ResponseWriter, r *http.Request)
+
+	mu       sync.Mutex
+	requests []robotRequest
+}
+
+func newRobotServer(t *testing.T) *robotServer {
+	s := &robotServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		s.mu.Lock()
+		s.requests = append(s.requests, robotRequest{
+			path:        r.URL.Path,
+			query:       r.URL.Query(),
+			contentType: r.Header.Get("Content-Type"),
+			body:        body,
+		})
+		s.mu.Unlock()
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if s.reply != nil {
+			s.reply(w, r)
+			return
+		}
+		w.Write([]byte(`{"errcode":0,"errmsg":"ok"}`))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// received returns the requests so far
+func (s *robotServer) received() []robotRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]robotRequest(nil), s.requests...)
+}
+
+func TestPostRobotMessageErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   string
+	}{
+		{"errcode", http.StatusOK, `{"errcode":310000,"errmsg":"keywords not in content"}`, "keywords not in content (errcode: 310000)"},
+		{"status", http.StatusBadGateway, "upstream down", "502"},
+		{"not JSON", http.StatusOK, "<html>", "invalid response"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			server := newRobotServer(t)
+			server.reply = func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.status)
+				w.Write([]byte(tc.body))
+			}
+			err := postRobotMessage(http.DefaultClient, server.URL, map[string]string{"msgtype": "text"})
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("postRobotMessage() error = %v, want %q", err, tc.want)
+			}
+		})
+	}
+}
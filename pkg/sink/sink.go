@@ -1,6 +1,11 @@
 package sink
 
-import "github.com/meiking/tidb-metrics-crawler/pkg/common"
+import (
+	"context"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+)
 
 // Sink defines the interface for output destinations
 type Sink interface {
@@ -10,3 +15,46 @@ type Sink interface {
 	// Close cleans up any resources used by the sink
 	Close() error
 }
+
+// Watermarker is implemented by sinks that can report how far data has
+// already been stored, enabling incremental runs
+type Watermarker interface {
+	// LastTimestamp returns the newest stored timestamp of metricName from
+	// instance, or false if nothing has been stored yet
+	LastTimestamp(instance, metricName string) (time.Time, bool, error)
+}
+
+// watermarkForwarder is implemented by decorators, which have a
+// LastTimestamp method whatever they wrap and are only Watermarkers when the
+// sinks they wrap are
+type watermarkForwarder interface {
+	canWatermark() bool
+}
+
+// AsWatermarker returns s as a Watermarker if it can report watermarks,
+// looking through decorators to the sinks they wrap
+func AsWatermarker(s Sink) (Watermarker, bool) {
+	w, ok := s.(Watermarker)
+	if !ok {
+		return nil, false
+	}
+	if f, ok := s.(watermarkForwarder); ok && !f.canWatermark() {
+		return nil, false
+	}
+	return w, true
+}
+
+// Pinger is implemented by sinks that can check their destination is
+// reachable and accepts the configured credentials before any data is fetched
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Ping checks s if it is a Pinger. Other sinks, such as file sinks, have
+// nothing to check and always succeed.
+func Ping(ctx context.Context, s Sink) error {
+	if p, ok := s.(Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package sink
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAsWatermarker(t *testing.T) {
+	// Every decorator has a LastTimestamp method; only those wrapping a
+	// Watermarker count as one
+	plain := func() Sink { return newFakeSink() }
+	watermarked := func() Sink {
+		return &watermarkSink{fakeSink: newFakeSink(), last: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	}
+	retrying := func(t *testing.T, s Sink) Sink { return newTestRetryingSink(t, s, 2) }
+
+	tests := []struct {
+		name string
+		sink func(t *testing.T) Sink
+		want bool
+	}{
+		{"plain", func(t *testing.T) Sink { return plain() }, false},
+		{"watermarker", func(t *testing.T) Sink { return watermarked() }, true},
+		{"async of plain", func(t *testing.T) Sink { return NewAsyncSink(context.Background(), plain(), 0) }, false},
+		{"async of watermarker", func(t *testing.T) Sink { return NewAsyncSink(context.Background(), watermarked(), 0) }, true},
+		{"retrying of plain", func(t *testing.T) Sink { return retrying(t, plain()) }, false},
+		{"retrying of watermarker", func(t *testing.T) Sink { return retrying(t, watermarked()) }, true},
+		{"skip non-finite of plain", func(t *testing.T) Sink { return NewSkipNonFiniteSink(plain()) }, false},
+		{"snapshot of plain", func(t *testing.T) Sink { return NewSnapshotSink(plain(), 10) }, false},
+		{"nested decorators of plain", func(t *testing.T) Sink { return NewSnapshotSink(NewSkipNonFiniteSink(retrying(t, plain())), 10) }, false},
+		{"nested decorators of watermarker", func(t *testing.T) Sink {
+			return NewSnapshotSink(NewSkipNonFiniteSink(retrying(t, watermarked())), 10)
+		}, true},
+		{"multi of watermarkers", func(t *testing.T) Sink { return NewMultiSink([]Sink{watermarked(), watermarked()}, false) }, true},
+		{"multi with a plain child", func(t *testing.T) Sink { return NewMultiSink([]Sink{watermarked(), plain()}, false) }, false},
+		{"multi with a decorated plain child", func(t *testing.T) Sink {
+			return NewMultiSink([]Sink{watermarked(), NewSkipNonFiniteSink(plain())}, false)
+		}, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := tc.sink(t)
+			defer s.Close()
+
+			w, ok := AsWatermarker(s)
+			if ok != tc.want {
+				t.Fatalf("AsWatermarker() = %v, want %v", ok, tc.want)
+			}
+			if !ok {
+				return
+			}
+			last, found, err := w.LastTimestamp("prom", "qps")
+			if err != nil || !found || !last.Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)) {
+				t.Errorf("LastTimestamp() = %v, %v, %v, want the wrapped sink's watermark", last, found, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+const (
+	// defaultSlackAPIURL is the base URL of the Slack Web API
+	defaultSlackAPIURL = "https://slack.com/api"
+
+	// maxSlackAttempts is how many times a request is tried when rate limited
+	maxSlackAttempts = 5
+)
+
+// SlackSink posts a summary of each metric to a Slack channel and uploads
+// the metric's CSV alongside it
+type SlackSink struct {
+	token        string
+	channel      string
+	messageTitle string
+	thread       bool
+	threadTS     string // Parent message of the run when threading
+	formatValue  valueFormatter
+	bom          bool
+	provenance   bool
+	apiURL       string
+	httpClient   *http.Client
+}
+
+// slackResponse holds the fields of Slack API replies used by the sink
+type slackResponse struct {
+	OK        bool   `json:"ok"`
+	Error     string `json:"error"`
+	TS        string `json:"ts"`
+	UploadURL string `json:"upload_url"`
+	FileID    string `json:"file_id"`
+}
+
+// NewSlackSink creates a new Slack sink. CSV attachments are formatted
+// according to csvCfg.
+func NewSlackSink(cfg config.SlackConfig, csvCfg config.CSVConfig) (*SlackSink, error) {
+	if cfg.BotToken == "" || cfg.Channel == "" {
+		return nil, fmt.Errorf("slack bot_token and channel are required")
+	}
+
+	formatValue, err := newValueFormatter(csvCfg.FloatFormat, csvCfg.NonFinite)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SlackSink{
+		token:        cfg.BotToken,
+		channel:      cfg.Channel,
+		messageTitle: cfg.MessageTitle,
+		thread:       cfg.Thread,
+		formatValue:  formatValue,
+		bom:          csvCfg.BOM,
+		provenance:   csvCfg.Provenance,
+		apiURL:       defaultSlackAPIURL,
+		httpClient: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+	}, nil
+}
+
+// Write posts a summary of the data and uploads it as a CSV file
+func (s *SlackSink) Write(metricName string, data []common.ProcessedData) error {
+	if len(data) == 0 {
+		return nil // Nothing to send
+	}
+
+	// Start the run's thread with the first metric
+	if s.thread && s.threadTS == "" {
+		ts, err := s.postMessage(fmt.Sprintf("*%s*", s.messageTitle), "")
+		if err != nil {
+			return fmt.Errorf("failed to start thread: %v", err)
+		}
+		s.threadTS = ts
+	}
+
+	summary := summarize(data)
+	text := fmt.Sprintf("*%s - %s*\nRows: %d, series: %d, time range: %s ~ %s",
+		s.messageTitle, metricName, summary.Rows, summary.Series,
+		summary.First.Format(time.RFC3339), summary.Last.Format(time.RFC3339))
+	if _, err := s.postMessage(text, s.threadTS); err != nil {
+		return fmt.Errorf("failed to send message: %v", err)
+	}
+
+	csvContent, err := createCSVContent(data, s.formatValue, s.bom, s.provenance)
+	if err != nil {
+		return fmt.Errorf("failed to create CSV content: %v", err)
+	}
+
+	filename := fmt.Sprintf("%s_%s.csv", metricName, time.Now().Format("20060102150405"))
+	if err := s.uploadFile(filename, csvContent, s.threadTS); err != nil {
+		return fmt.Errorf("failed to upload file: %v", err)
+	}
+
+	return nil
+}
+
+// Close cleans up resources
+func (s *SlackSink) Close() error {
+	return nil
+}
+
+// Ping checks the bot token with auth.test
+func (s *SlackSink) Ping(ctx context.Context) error {
+	_, err := s.callAPI("auth.test", url.Values{})
+	return err
+}
+
+// postMessage posts text to the channel, in a thread if threadTS is set,
+// and returns the message timestamp
+func (s *SlackSink) postMessage(text, threadTS string) (string, error) {
+	params := url.Values{
+		"channel": {s.channel},
+		"text":    {text},
+	}
+	if threadTS != "" {
+		params.Set("thread_ts", threadTS)
+	}
+
+	resp, err := s.callAPI("chat.postMessage", params)
+	if err != nil {
+		return "", err
+	}
+	return resp.TS, nil
+}
+
+// uploadFile shares content in the channel using the external upload flow:
+// reserve an upload URL, send the bytes, then complete the upload
+func (s *SlackSink) uploadFile(filename string, content []byte, threadTS string) error {
+	reserved, err := s.callAPI("files.getUploadURLExternal", url.Values{
+		"filename": {filename},
+		"length":   {strconv.Itoa(len(content))},
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.doWithRetry(func() (*http.Request, error) {
+		return http.NewRequest(http.MethodPost, reserved.UploadURL, bytes.NewReader(content))
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("upload failed: %s (status: %d)", string(body), resp.StatusCode)
+	}
+
+	files, err := json.Marshal([]map[string]string{{"id": reserved.FileID, "title": filename}})
+	if err != nil {
+		return err
+	}
+
+	params := url.Values{
+		"files":      {string(files)},
+		"channel_id": {s.channel},
+	}
+	if threadTS != "" {
+		params.Set("thread_ts", threadTS)
+	}
+	_, err = s.callAPI("files.completeUploadExternal", params)
+	return err
+}
+
+// callAPI calls a Web API method with form-encoded params and checks the reply
+func (s *SlackSink) callAPI(method string, params url.Values) (*slackResponse, error) {
+	resp, err := s.doWithRetry(func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, s.apiURL+"/"+method, strings.NewReader(params.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", s.token))
+		return req, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s failed: %s (status: %d)", method, string(respBody), resp.StatusCode)
+	}
+
+	var result slackResponse
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return nil, fmt.Errorf("%s returned invalid response: %v", method, err)
+	}
+	if !result.OK {
+		return nil, fmt.Errorf("%s failed: %s", method, result.Error)
+	}
+	return &result, nil
+}
+
+// doWithRetry sends the request built by newRequest, waiting and retrying
+// while Slack answers 429 Too Many Requests
+func (s *SlackSink) doWithRetry(newRequest func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := s.httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusTooManyRequests || attempt == maxSlackAttempts {
+			return resp, nil
+		}
+		resp.Body.Close()
+
+		// Retry-After is in seconds; back off exponentially when it is missing
+		wait := time.Duration(1<<(attempt-1)) * time.Second
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds >= 0 {
+			wait = time.Duration(seconds) * time.Second
+		}
+		log.Printf("Slack rate limited, retry %d/%d in %v", attempt, maxSlackAttempts-1, wait)
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,176 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+// slackCall is a request received by the fake Slack API
+type slackCall struct {
+	method string // API method, or "upload" for the file bytes
+	form   url.Values
+	body   string
+}
+
+// fakeSlack serves the Web API methods and the reserved upload URL
+type fakeSlack struct {
+	*httptest.Server
+	rateLimited int // Requests to answer with 429 before serving
+
+	mu    sync.Mutex
+	calls []slackCall
+}
+
+func newFakeSlack(t *testing.T) *fakeSlack {
+	f := &fakeSlack{}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeSlack) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.rateLimited > 0 {
+		f.rateLimited--
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+
+	if r.URL.Path == "/upload/F1" {
+		body, _ := io.ReadAll(r.Body)
+		f.calls = append(f.calls, slackCall{method: "upload", body: string(body)})
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer xoxb-token" {
+		json.NewEncoder(w).Encode(map[string]any{"ok": false, "error": "not_authed"})
+		return
+	}
+	r.ParseForm()
+	method := strings.TrimPrefix(r.URL.Path, "/api/")
+	f.calls = append(f.calls, slackCall{method: method, form: r.PostForm})
+
+	reply := map[string]any{"ok": true}
+	switch method {
+	case "chat.postMessage":
+		reply["ts"] = fmt.Sprintf("1700000000.%06d", len(f.calls))
+	case "files.getUploadURLExternal":
+		reply["upload_url"] = f.URL + "/upload/F1"
+		reply["file_id"] = "F1"
+	}
+	json.NewEncoder(w).Encode(reply)
+}
+
+// received returns the calls so far
+func (f *fakeSlack) received() []slackCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]slackCall(nil), f.calls...)
+}
+
+func newTestSlackSink(t *testing.T, server *fakeSlack, cfg config.SlackConfig) *SlackSink {
+	t.Helper()
+	cfg.BotToken = "xoxb-token"
+	cfg.Channel = "C123"
+	s, err := NewSlackSink(cfg, config.CSVConfig{})
+	if err != nil {
+		t.Fatalf("NewSlackSink() error = %v", err)
+	}
+	s.apiURL = server.URL + "/api"
+	return s
+}
+
+func TestSlackSinkPostsThenUploads(t *testing.T) {
+	server := newFakeSlack(t)
+	s := newTestSlackSink(t, server, config.SlackConfig{MessageTitle: "Daily"})
+
+	if err := s.Write("qps", valueRows(1, 2)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	calls := server.received()
+	var methods []string
+	for _, call := range calls {
+		methods = append(methods, call.method)
+	}
+	want := []string{"chat.postMessage", "files.getUploadURLExternal", "upload", "files.completeUploadExternal"}
+	if strings.Join(methods, ",") != strings.Join(want, ",") {
+		t.Fatalf("calls = %v, want %v", methods, want)
+	}
+
+	post, reserve, upload, complete := calls[0], calls[1], calls[2], calls[3]
+	if post.form.Get("channel") != "C123" || !strings.HasPrefix(post.form.Get("text"), "*Daily - qps*\nRows: 2") || post.form.Has("thread_ts") {
+		t.Errorf("chat.postMessage form = %v, want the summary in the channel", post.form)
+	}
+	filename := reserve.form.Get("filename")
+	if !strings.HasPrefix(filename, "qps_") || !strings.HasSuffix(filename, ".csv") || reserve.form.Get("length") != fmt.Sprint(len(upload.body)) {
+		t.Errorf("files.getUploadURLExternal form = %v, want the CSV name and its %d bytes", reserve.form, len(upload.body))
+	}
+	if !strings.HasPrefix(upload.body, "prometheus_instance,metric_name,timestamp,value,") {
+		t.Errorf("uploaded %q, want the CSV", upload.body)
+	}
+	var files []map[string]string
+	if err := json.Unmarshal([]byte(complete.form.Get("files")), &files); err != nil {
+		t.Fatalf("files = %q: %v", complete.form.Get("files"), err)
+	}
+	if len(files) != 1 || files[0]["id"] != "F1" || files[0]["title"] != filename || complete.form.Get("channel_id") != "C123" {
+		t.Errorf("files.completeUploadExternal form = %v, want file F1 shared in C123", complete.form)
+	}
+}
+
+func TestSlackSinkThreadsRun(t *testing.T) {
+	server := newFakeSlack(t)
+	s := newTestSlackSink(t, server, config.SlackConfig{MessageTitle: "Daily", Thread: true})
+
+	for _, metric := range []string{"qps", "latency"} {
+		if err := s.Write(metric, valueRows(1)); err != nil {
+			t.Fatalf("Write(%s) error = %v", metric, err)
+		}
+	}
+
+	calls := server.received()
+	parent := calls[0]
+	if parent.method != "chat.postMessage" || parent.form.Get("text") != "*Daily*" || parent.form.Has("thread_ts") {
+		t.Fatalf("first call = %s %v, want the run's parent message", parent.method, parent.form)
+	}
+	threadTS := "1700000000.000001"
+	var threaded int
+	for _, call := range calls[1:] {
+		if call.method == "chat.postMessage" && call.form.Get("text") == "*Daily*" {
+			t.Error("the parent message was posted again for the second metric")
+		}
+		if call.method == "chat.postMessage" || call.method == "files.completeUploadExternal" {
+			if got := call.form.Get("thread_ts"); got != threadTS {
+				t.Errorf("%s thread_ts = %q, want %q", call.method, got, threadTS)
+			}
+			threaded++
+		}
+	}
+	if threaded != 4 {
+		t.Errorf("%d messages and uploads in the thread, want 2 per metric", threaded)
+	}
+}
+
+func TestSlackSinkRetriesRateLimit(t *testing.T) {
+	server := newFakeSlack(t)
+	server.rateLimited = 2
+	s := newTestSlackSink(t, server, config.SlackConfig{})
+
+	if err := s.Ping(context.Background()); err != nil {
+		t.Fatalf("Ping() error = %v, want the rate limit retried", err)
+	}
+	if calls := server.received(); len(calls) != 1 || calls[0].method != "auth.test" {
+		t.Errorf("calls = %v, want one auth.test served", calls)
+	}
+}
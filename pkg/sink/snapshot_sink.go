@@ -0,0 +1,118 @@
+package sink
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+)
+
+// DefaultSnapshotRows is how many rows of each metric a SnapshotSink keeps
+// unless told otherwise
+const DefaultSnapshotRows = 10000
+
+// SnapshotSink wraps a sink and keeps the most recent rows of each metric in
+// memory, so they can be served while and after a run without reading the
+// sink back
+type SnapshotSink struct {
+	sink    Sink
+	maxRows int
+
+	mu     sync.RWMutex
+	rows   map[string][]common.ProcessedData // Oldest first, at most maxRows per metric
+	closed bool
+}
+
+// NewSnapshotSink wraps s, keeping up to maxRows rows per metric
+// (DefaultSnapshotRows if not positive)
+func NewSnapshotSink(s Sink, maxRows int) *SnapshotSink {
+	if maxRows <= 0 {
+		maxRows = DefaultSnapshotRows
+	}
+	return &SnapshotSink{sink: s, maxRows: maxRows, rows: make(map[string][]common.ProcessedData)}
+}
+
+// Write keeps a copy of data and writes it to the wrapped sink
+func (s *SnapshotSink) Write(metricName string, data []common.ProcessedData) error {
+	s.mu.Lock()
+	rows := append(s.rows[metricName], data...)
+	if len(rows) > s.maxRows {
+		rows = rows[len(rows)-s.maxRows:]
+	}
+	s.rows[metricName] = rows
+	s.mu.Unlock()
+
+	return s.sink.Write(metricName, data)
+}
+
+// Metrics returns the names of the metrics with rows, sorted
+func (s *SnapshotSink) Metrics() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	names := make([]string, 0, len(s.rows))
+	for name := range s.rows {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Latest returns the kept rows of a metric, oldest first, only those from
+// instance unless it is empty. The bool is false for metrics without rows.
+func (s *SnapshotSink) Latest(metricName, instance string) ([]common.ProcessedData, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rows, ok := s.rows[metricName]
+	if !ok {
+		return nil, false
+	}
+	out := make([]common.ProcessedData, 0, len(rows))
+	for _, row := range rows {
+		if instance == "" || row.PrometheusInstance == instance {
+			out = append(out, row)
+		}
+	}
+	return out, true
+}
+
+// Close closes the wrapped sink once; the kept rows stay available
+func (s *SnapshotSink) Close() error {
+	s.mu.Lock()
+	closed := s.closed
+	s.closed = true
+	s.mu.Unlock()
+
+	if closed {
+		return nil
+	}
+	return s.sink.Close()
+}
+
+// Ping checks the wrapped sink
+func (s *SnapshotSink) Ping(ctx context.Context) error {
+	return Ping(ctx, s.sink)
+}
+
+// RecordRun forwards the run report to the wrapped sink
+func (s *SnapshotSink) RecordRun(report RunReport) {
+	RecordRun(s.sink, report)
+}
+
+// canWatermark reports whether the wrapped sink is a Watermarker
+func (s *SnapshotSink) canWatermark() bool {
+	_, ok := AsWatermarker(s.sink)
+	return ok
+}
+
+// LastTimestamp forwards to the wrapped sink when it is a Watermarker
+func (s *SnapshotSink) LastTimestamp(instance, metricName string) (time.Time, bool, error) {
+	w, ok := AsWatermarker(s.sink)
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	return w.LastTimestamp(instance, metricName)
+}
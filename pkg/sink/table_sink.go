@@ -0,0 +1,186 @@
+package sink
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+const (
+	defaultTableMaxRows    = 50
+	defaultTableLabelWidth = 32
+
+	tableColorAuto   = "auto"
+	tableColorAlways = "always"
+	tableColorNever  = "never"
+
+	ansiBold  = "\x1b[1m"
+	ansiCyan  = "\x1b[36m"
+	ansiReset = "\x1b[0m"
+
+	// tableColumnGap separates table columns
+	tableColumnGap = "  "
+)
+
+// TableSink prints each write as an aligned table on stdout for
+// interactive debugging
+type TableSink struct {
+	out         io.Writer
+	maxRows     int
+	labelWidth  int
+	color       bool
+	formatValue valueFormatter
+}
+
+// NewTableSink creates a table sink writing to stdout. Colors are used on
+// a terminal unless disabled by color: never or the NO_COLOR variable.
+func NewTableSink(cfg config.TableConfig) (*TableSink, error) {
+	formatValue, err := newValueFormatter(cfg.FloatFormat, cfg.NonFinite)
+	if err != nil {
+		return nil, err
+	}
+
+	var color bool
+	switch cfg.Color {
+	case "", tableColorAuto:
+		color = isTerminal(os.Stdout) && os.Getenv("NO_COLOR") == ""
+	case tableColorAlways:
+		color = true
+	case tableColorNever:
+	default:
+		return nil, fmt.Errorf("unsupported table color mode: %s", cfg.Color)
+	}
+
+	maxRows := cfg.MaxRows
+	if maxRows == 0 {
+		maxRows = defaultTableMaxRows
+	}
+	labelWidth := cfg.MaxLabelWidth
+	if labelWidth <= 0 {
+		labelWidth = defaultTableLabelWidth
+	}
+
+	return &TableSink{
+		out:         os.Stdout,
+		maxRows:     maxRows,
+		labelWidth:  labelWidth,
+		color:       color,
+		formatValue: formatValue,
+	}, nil
+}
+
+// Write prints the data as a table, summarizing rows beyond max_rows
+func (s *TableSink) Write(metricName string, data []common.ProcessedData) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	shown := data
+	if s.maxRows > 0 && len(shown) > s.maxRows {
+		shown = shown[:s.maxRows]
+	}
+
+	labelKeys := unionLabelKeys(shown)
+	header := []string{"PROMETHEUS", "TIMESTAMP", "VALUE"}
+	for _, key := range labelKeys {
+		header = append(header, strings.ToUpper(key))
+	}
+
+	rows := make([][]string, 0, len(shown))
+	for _, item := range shown {
+		row := []string{
+			item.PrometheusInstance,
+			item.Timestamp.Format(time.RFC3339),
+			s.formatValue(item.Value),
+		}
+		for _, key := range labelKeys {
+			row = append(row, truncateCell(item.Labels[key], s.labelWidth))
+		}
+		rows = append(rows, row)
+	}
+
+	w := bufio.NewWriter(s.out)
+	fmt.Fprintf(w, "%s (%d rows)\n", s.paint(ansiCyan, metricName), len(data))
+	widths := columnWidths(header, rows)
+	fmt.Fprintln(w, s.paint(ansiBold, formatTableRow(header, widths)))
+	for _, row := range rows {
+		fmt.Fprintln(w, formatTableRow(row, widths))
+	}
+	if hidden := len(data) - len(shown); hidden > 0 {
+		fmt.Fprintf(w, "... and %d more\n", hidden)
+	}
+	fmt.Fprintln(w)
+
+	return w.Flush()
+}
+
+// Close cleans up resources
+func (s *TableSink) Close() error {
+	return nil
+}
+
+// paint wraps text in an ANSI style when colors are enabled
+func (s *TableSink) paint(style, text string) string {
+	if !s.color {
+		return text
+	}
+	return style + text + ansiReset
+}
+
+// columnWidths returns the widest cell of each column, in runes
+func columnWidths(header []string, rows [][]string) []int {
+	widths := make([]int, len(header))
+	for i, cell := range header {
+		widths[i] = utf8.RuneCountInString(cell)
+	}
+	for _, row := range rows {
+		for i, cell := range row {
+			if n := utf8.RuneCountInString(cell); n > widths[i] {
+				widths[i] = n
+			}
+		}
+	}
+	return widths
+}
+
+// formatTableRow pads every cell but the last to its column width
+func formatTableRow(cells []string, widths []int) string {
+	var b strings.Builder
+	for i, cell := range cells {
+		if i > 0 {
+			b.WriteString(tableColumnGap)
+		}
+		b.WriteString(cell)
+		if i < len(cells)-1 {
+			b.WriteString(strings.Repeat(" ", widths[i]-utf8.RuneCountInString(cell)))
+		}
+	}
+	return b.String()
+}
+
+// truncateCell shortens s to at most width runes, marking the cut with "..."
+func truncateCell(s string, width int) string {
+	if utf8.RuneCountInString(s) <= width {
+		return s
+	}
+	if width <= 3 {
+		return string([]rune(s)[:width])
+	}
+	return string([]rune(s)[:width-3]) + "..."
+}
+
+// isTerminal reports whether f is a character device such as a terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,117 @@
+package sink
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+// newBufferedTableSink creates a table sink printing to a buffer, without colors
+func newBufferedTableSink(t *testing.T, cfg config.TableConfig) (*TableSink, *bytes.Buffer) {
+	t.Helper()
+	cfg.Color = tableColorNever
+	s, err := NewTableSink(cfg)
+	if err != nil {
+		t.Fatalf("NewTableSink() error = %v", err)
+	}
+	var out bytes.Buffer
+	s.out = &out
+	return s, &out
+}
+
+func TestTableSinkAlignsColumns(t *testing.T) {
+	s, out := newBufferedTableSink(t, config.TableConfig{MaxLabelWidth: 12})
+	ts := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	data := []common.ProcessedData{
+		{PrometheusInstance: "prom", Timestamp: ts, Value: 1, Labels: map[string]string{"job": "tidb", "zone": "東京"}},
+		{PrometheusInstance: "prometheus-b", Timestamp: ts, Value: 1234.5, Labels: map[string]string{"job": "tikv-server-cluster-a"}},
+	}
+	if err := s.Write("qps", data); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	// Columns are as wide as their widest cell in runes, the long job is
+	// cut to 12 runes, and the last column is not padded
+	want := strings.Join([]string{
+		"qps (2 rows)",
+		"PROMETHEUS    TIMESTAMP             VALUE   JOB           ZONE",
+		"prom          2024-01-01T00:00:00Z  1       tidb          東京",
+		"prometheus-b  2024-01-01T00:00:00Z  1234.5  tikv-serv...  ",
+		"",
+		"",
+	}, "\n")
+	if got := out.String(); got != want {
+		t.Errorf("table =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestTableSinkMaxRows(t *testing.T) {
+	tests := []struct {
+		maxRows int
+		printed int
+		summary string
+	}{
+		{0, 50, "... and 10 more"}, // Default
+		{5, 5, "... and 55 more"},
+		{-1, 60, ""},
+	}
+	for _, tt := range tests {
+		s, out := newBufferedTableSink(t, config.TableConfig{MaxRows: tt.maxRows})
+		if err := s.Write("qps", valueRows(make([]float64, 60)...)); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+
+		lines := strings.Split(strings.TrimRight(out.String(), "\n"), "\n")
+		if lines[0] != "qps (60 rows)" {
+			t.Errorf("max_rows %d: title = %q, want the full row count", tt.maxRows, lines[0])
+		}
+		rows := len(lines) - 2 // Title and header
+		if tt.summary != "" {
+			rows--
+			if last := lines[len(lines)-1]; last != tt.summary {
+				t.Errorf("max_rows %d: last line = %q, want %q", tt.maxRows, last, tt.summary)
+			}
+		}
+		if rows != tt.printed {
+			t.Errorf("max_rows %d: printed %d rows, want %d", tt.maxRows, rows, tt.printed)
+		}
+	}
+}
+
+func TestTruncateCell(t *testing.T) {
+	tests := []struct {
+		s     string
+		width int
+		want  string
+	}{
+		{"tidb", 4, "tidb"},
+		{"tidb-0", 5, "ti..."},
+		{"tidb", 3, "tid"},
+		{"東京都港区", 4, "東..."},
+		{"", 2, ""},
+	}
+	for _, tt := range tests {
+		if got := truncateCell(tt.s, tt.width); got != tt.want {
+			t.Errorf("truncateCell(%q, %d) = %q, want %q", tt.s, tt.width, got, tt.want)
+		}
+	}
+}
+
+func TestTableSinkColors(t *testing.T) {
+	s, out := newBufferedTableSink(t, config.TableConfig{})
+	s.color = true
+	if err := s.Write("qps", valueRows(1)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if !strings.HasPrefix(out.String(), ansiCyan+"qps"+ansiReset) {
+		t.Errorf("title %q is not colored", strings.SplitN(out.String(), "\n", 2)[0])
+	}
+
+	if _, err := NewTableSink(config.TableConfig{Color: "rainbow"}); err == nil {
+		t.Error("NewTableSink() accepted an unknown color mode")
+	}
+}
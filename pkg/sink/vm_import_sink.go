@@ -0,0 +1,160 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+// VMImportSink writes samples to VictoriaMetrics through its JSON line
+// import API, one line per series and Write
+type VMImportSink struct {
+	ctx         context.Context
+	url         string
+	username    string
+	password    string
+	bearerToken string
+	gzip        bool
+	httpClient  *http.Client
+}
+
+// vmImportLine is one series in the import format
+type vmImportLine struct {
+	Metric     map[string]string `json:"metric"`
+	Values     []float64         `json:"values"`
+	Timestamps []int64           `json:"timestamps"` // Unix milliseconds
+}
+
+// NewVMImportSink creates a new VictoriaMetrics import sink. Requests are bound to ctx.
+func NewVMImportSink(ctx context.Context, cfg config.VMImportConfig) (*VMImportSink, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("vm_import url is required")
+	}
+	if cfg.BearerToken != "" && cfg.Username != "" {
+		return nil, fmt.Errorf("vm_import bearer_token and username are mutually exclusive")
+	}
+
+	return &VMImportSink{
+		ctx:         ctx,
+		url:         cfg.URL,
+		username:    cfg.Username,
+		password:    cfg.Password,
+		bearerToken: cfg.BearerToken,
+		gzip:        cfg.Gzip == nil || *cfg.Gzip,
+		httpClient: &http.Client{
+			Timeout: 60 * time.Second,
+		},
+	}, nil
+}
+
+// Write imports the data, grouped into one line per series
+func (s *VMImportSink) Write(metricName string, data []common.ProcessedData) error {
+	body, series, skipped, err := encodeVMImport(metricName, data)
+	if err != nil {
+		return err
+	}
+	if skipped > 0 {
+		log.Printf("Skipped %d non-finite values of metric %s", skipped, metricName)
+	}
+	if series == 0 {
+		return nil
+	}
+
+	if err := s.post(body); err != nil {
+		return &WriteError{Err: fmt.Errorf("failed to import metric %s: %w", metricName, err)}
+	}
+	return nil
+}
+
+// Close has nothing to flush, as every Write is sent immediately
+func (s *VMImportSink) Close() error {
+	return nil
+}
+
+// encodeVMImport renders data as import lines, one per series in order of
+// first appearance. The metric name goes into __name__ and the Prometheus
+// instance into a prometheus_instance label, so series from different
+// instances stay apart. JSON has no representation for NaN and ±Inf, so
+// those samples are skipped and counted.
+func encodeVMImport(metricName string, data []common.ProcessedData) ([]byte, int, int, error) {
+	var lines []*vmImportLine
+	index := make(map[string]*vmImportLine)
+	skipped := 0
+	for _, item := range data {
+		if math.IsNaN(item.Value) || math.IsInf(item.Value, 0) {
+			skipped++
+			continue
+		}
+
+		key := item.PrometheusInstance + "\xff" + common.LabelsHash(item.Labels)
+		line, ok := index[key]
+		if !ok {
+			metric := make(map[string]string, len(item.Labels)+2)
+			for k, v := range item.Labels {
+				metric[k] = v
+			}
+			metric["__name__"] = metricName
+			metric["prometheus_instance"] = item.PrometheusInstance
+			line = &vmImportLine{Metric: metric}
+			index[key] = line
+			lines = append(lines, line)
+		}
+		line.Values = append(line.Values, item.Value)
+		line.Timestamps = append(line.Timestamps, item.Timestamp.UnixMilli())
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, line := range lines {
+		// Encode ends every line with a newline
+		if err := encoder.Encode(line); err != nil {
+			return nil, 0, 0, fmt.Errorf("failed to encode import line: %v", err)
+		}
+	}
+	return buf.Bytes(), len(lines), skipped, nil
+}
+
+// post sends import lines, gzip-compressed unless disabled
+func (s *VMImportSink) post(body []byte) error {
+	if s.gzip {
+		var err error
+		if body, err = gzipBytes(body); err != nil {
+			return fmt.Errorf("failed to compress: %v", err)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(s.ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if s.bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.bearerToken)
+	} else if s.username != "" {
+		req.SetBasicAuth(s.username, s.password)
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("import failed: %w", &StatusError{StatusCode: resp.StatusCode, Body: string(respBody)})
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package sink
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+func TestEncodeVMImportLines(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tidb0 := map[string]string{"instance": "tidb-0", "job": "tidb"}
+	tidb1 := map[string]string{"instance": "tidb-1", "job": "tidb"}
+	// Interleaved samples of three series: two label sets on one Prometheus
+	// and the first label set again on another
+	rows := []common.ProcessedData{
+		{PrometheusInstance: "prom", Timestamp: start, Value: 1, Labels: tidb0},
+		{PrometheusInstance: "prom", Timestamp: start, Value: 10, Labels: tidb1},
+		{PrometheusInstance: "prom-b", Timestamp: start, Value: 100, Labels: tidb0},
+		{PrometheusInstance: "prom", Timestamp: start.Add(15 * time.Second), Value: 2.5, Labels: tidb0},
+		{PrometheusInstance: "prom", Timestamp: start.Add(15 * time.Second), Value: math.NaN(), Labels: tidb1},
+		{PrometheusInstance: "prom", Timestamp: start.Add(30 * time.Second), Value: 20, Labels: tidb1},
+	}
+
+	body, series, skipped, err := encodeVMImport("qps", rows)
+	if err != nil {
+		t.Fatalf("encodeVMImport() error = %v", err)
+	}
+	if series != 3 || skipped != 1 {
+		t.Errorf("encodeVMImport() = %d series, %d skipped, want 3 and the NaN", series, skipped)
+	}
+	want := `{"metric":{"__name__":"qps","instance":"tidb-0","job":"tidb","prometheus_instance":"prom"},"values":[1,2.5],"timestamps":[1704067200000,1704067215000]}
+{"metric":{"__name__":"qps","instance":"tidb-1","job":"tidb","prometheus_instance":"prom"},"values":[10,20],"timestamps":[1704067200000,1704067230000]}
+{"metric":{"__name__":"qps","instance":"tidb-0","job":"tidb","prometheus_instance":"prom-b"},"values":[100],"timestamps":[1704067200000]}
+`
+	if string(body) != want {
+		t.Errorf("import lines =\n%s\nwant\n%s", body, want)
+	}
+}
+
+func TestVMImportSinkPostsGzip(t *testing.T) {
+	var (
+		lines  string
+		header http.Header
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, "expected a gzip body", http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(zr)
+		lines = string(body)
+	}))
+	defer server.Close()
+
+	s, err := NewVMImportSink(context.Background(), config.VMImportConfig{URL: server.URL + "/api/v1/import", BearerToken: "secret"})
+	if err != nil {
+		t.Fatalf("NewVMImportSink() error = %v", err)
+	}
+	if err := s.Write("qps", valueRows(1, 2)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if header.Get("Content-Encoding") != "gzip" || header.Get("Authorization") != "Bearer secret" {
+		t.Errorf("request headers = %v, want gzip encoding and the bearer token", header)
+	}
+	if strings.Count(lines, "\n") != 1 || !strings.Contains(lines, `"values":[1,2]`) {
+		t.Errorf("server got %q, want one line with both values", lines)
+	}
+}
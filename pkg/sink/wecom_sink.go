@@ -0,0 +1,152 @@
+package sink
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/common"
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+// WeComSink posts a summary of each metric to a WeCom group robot,
+// optionally followed by the metric's CSV as a file message
+type WeComSink struct {
+	webhook      string
+	messageTitle string
+	uploadCSV    bool
+	formatValue  valueFormatter
+	bom          bool
+	provenance   bool
+	httpClient   *http.Client
+}
+
+// WeCom media upload response structure
+type wecomUploadResponse struct {
+	MediaID string `json:"media_id"`
+}
+
+// NewWeComSink creates a new WeCom sink. CSV attachments are formatted
+// according to csvCfg.
+func NewWeComSink(cfg config.WeComConfig, csvCfg config.CSVConfig) (*WeComSink, error) {
+	if cfg.Webhook == "" {
+		return nil, fmt.Errorf("wecom webhook is required")
+	}
+
+	formatValue, err := newValueFormatter(csvCfg.FloatFormat, csvCfg.NonFinite)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WeComSink{
+		webhook:      cfg.Webhook,
+		messageTitle: cfg.MessageTitle,
+		uploadCSV:    cfg.UploadCSV,
+		formatValue:  formatValue,
+		bom:          csvCfg.BOM,
+		provenance:   csvCfg.Provenance,
+		httpClient: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+	}, nil
+}
+
+// Write sends a markdown summary of the data and, if enabled, the CSV file
+func (s *WeComSink) Write(metricName string, data []common.ProcessedData) error {
+	if len(data) == 0 {
+		return nil // Nothing to send
+	}
+
+	summary := map[string]interface{}{
+		"msgtype": "markdown",
+		"markdown": map[string]string{
+			"content": summarizeData(s.messageTitle, metricName, data),
+		},
+	}
+	// Nothing is sent yet, so only this step can be retried
+	if err := postRobotMessage(s.httpClient, s.webhook, summary); err != nil {
+		return &WriteError{Err: fmt.Errorf("failed to send message: %w", err)}
+	}
+
+	if !s.uploadCSV {
+		return nil
+	}
+
+	csvContent, err := createCSVContent(data, s.formatValue, s.bom, s.provenance)
+	if err != nil {
+		return fmt.Errorf("failed to create CSV content: %v", err)
+	}
+
+	mediaID, err := s.uploadMedia(metricName, csvContent)
+	if err != nil {
+		return fmt.Errorf("failed to upload file: %v", err)
+	}
+
+	file := map[string]interface{}{
+		"msgtype": "file",
+		"file": map[string]string{
+			"media_id": mediaID,
+		},
+	}
+	if err := postRobotMessage(s.httpClient, s.webhook, file); err != nil {
+		return fmt.Errorf("failed to send file message: %v", err)
+	}
+
+	return nil
+}
+
+// Close cleans up resources
+func (s *WeComSink) Close() error {
+	return nil
+}
+
+// uploadMedia uploads CSV content as a temporary file, returning its media_id
+func (s *WeComSink) uploadMedia(metricName string, content []byte) (string, error) {
+	uploadURL, err := s.uploadURL()
+	if err != nil {
+		return "", err
+	}
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	part, err := writer.CreateFormFile("media", fmt.Sprintf("%s_%s.csv", metricName, time.Now().Format("20060102150405")))
+	if err != nil {
+		return "", err
+	}
+	if _, err := part.Write(content); err != nil {
+		return "", err
+	}
+	writer.Close()
+
+	resp, err := s.httpClient.Post(uploadURL, writer.FormDataContentType(), body)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var uploadResp wecomUploadResponse
+	if err := checkRobotResponse(resp, &uploadResp); err != nil {
+		return "", err
+	}
+	return uploadResp.MediaID, nil
+}
+
+// uploadURL derives the media upload endpoint from the send webhook,
+// e.g. .../webhook/send?key=K becomes .../webhook/upload_media?key=K&type=file
+func (s *WeComSink) uploadURL() (string, error) {
+	u, err := url.Parse(s.webhook)
+	if err != nil {
+		return "", fmt.Errorf("invalid webhook: %v", err)
+	}
+
+	u.Path = strings.TrimSuffix(u.Path, "/send") + "/upload_media"
+	query := u.Query()
+	query.Set("type", "file")
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
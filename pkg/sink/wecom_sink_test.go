@@ -0,0 +1,111 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/meiking/tidb-metrics-crawler/pkg/config"
+)
+
+func TestWeComSinkPostsSummaryAndFile(t *testing.T) {
+	server := newRobotServer(t)
+	server.reply = func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/upload_media") {
+			w.Write([]byte(`{"errcode":0,"errmsg":"ok","type":"file","media_id":"m-42"}`))
+			return
+		}
+		w.Write([]byte(`{"errcode":0,"errmsg":"ok"}`))
+	}
+	s, err := NewWeComSink(config.WeComConfig{
+		Webhook:      server.URL + "/cgi-bin/webhook/send?key=K",
+		MessageTitle: "Daily",
+		UploadCSV:    true,
+	}, config.CSVConfig{})
+	if err != nil {
+		t.Fatalf("NewWeComSink() error = %v", err)
+	}
+
+	if err := s.Write("qps", valueRows(1, 2)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	requests := server.received()
+	if len(requests) != 3 {
+		t.Fatalf("got %d requests, want summary, upload and file message", len(requests))
+	}
+
+	// The summary goes first, as a markdown message
+	var summary struct {
+		MsgType  string `json:"msgtype"`
+		Markdown struct {
+			Content string `json:"content"`
+		} `json:"markdown"`
+	}
+	if err := json.Unmarshal(requests[0].body, &summary); err != nil {
+		t.Fatalf("summary %s is not JSON: %v", requests[0].body, err)
+	}
+	if requests[0].path != "/cgi-bin/webhook/send" || summary.MsgType != "markdown" || !strings.Contains(summary.Markdown.Content, "### Daily - qps") {
+		t.Errorf("summary = %s %s, want a markdown message to the webhook", requests[0].path, requests[0].body)
+	}
+
+	// The CSV is uploaded next to the send webhook, with the same key
+	upload := requests[1]
+	if upload.path != "/cgi-bin/webhook/upload_media" || upload.query.Get("key") != "K" || upload.query.Get("type") != "file" {
+		t.Errorf("upload = %s?%s, want upload_media with the key and type=file", upload.path, upload.query.Encode())
+	}
+	_, params, err := mime.ParseMediaType(upload.contentType)
+	if err != nil {
+		t.Fatalf("upload content type %q: %v", upload.contentType, err)
+	}
+	part, err := multipart.NewReader(bytes.NewReader(upload.body), params["boundary"]).NextPart()
+	if err != nil {
+		t.Fatalf("upload is not multipart: %v", err)
+	}
+	if part.FormName() != "media" || !strings.HasPrefix(part.FileName(), "qps_") || !strings.HasSuffix(part.FileName(), ".csv") {
+		t.Errorf("upload part = %s %s, want media qps_*.csv", part.FormName(), part.FileName())
+	}
+	content, _ := io.ReadAll(part)
+	records, err := csv.NewReader(bytes.NewReader(content)).ReadAll()
+	if err != nil {
+		t.Fatalf("uploaded file is not CSV: %v", err)
+	}
+	if values := column(records, "value"); !slices.Equal(values, []string{"1", "2"}) {
+		t.Errorf("uploaded values = %v, want [1 2]", values)
+	}
+
+	// Then the file message refers to the uploaded media
+	var file struct {
+		MsgType string `json:"msgtype"`
+		File    struct {
+			MediaID string `json:"media_id"`
+		} `json:"file"`
+	}
+	if err := json.Unmarshal(requests[2].body, &file); err != nil {
+		t.Fatalf("file message %s is not JSON: %v", requests[2].body, err)
+	}
+	if requests[2].path != "/cgi-bin/webhook/send" || file.MsgType != "file" || file.File.MediaID != "m-42" {
+		t.Errorf("file message = %s %s, want media m-42 sent to the webhook", requests[2].path, requests[2].body)
+	}
+}
+
+func TestWeComSinkSummaryOnly(t *testing.T) {
+	server := newRobotServer(t)
+	s, err := NewWeComSink(config.WeComConfig{Webhook: server.URL + "/cgi-bin/webhook/send?key=K"}, config.CSVConfig{})
+	if err != nil {
+		t.Fatalf("NewWeComSink() error = %v", err)
+	}
+	if err := s.Write("qps", valueRows(1)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if requests := server.received(); len(requests) != 1 || !bytes.Contains(requests[0].body, []byte(`"msgtype":"markdown"`)) {
+		t.Errorf("got %d requests, want only the summary without upload_csv", len(requests))
+	}
+}
@@ -0,0 +1,25 @@
+package version
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Build metadata, set at build time via -ldflags, e.g.
+// -X github.com/meiking/tidb-metrics-crawler/pkg/version.Version=v1.2.3
+var (
+	Version   = "dev"
+	Commit    = "unknown" // Git commit the binary was built from
+	BuildDate = "unknown" // UTC build time, RFC3339
+)
+
+// UserAgent returns the User-Agent header identifying this crawler
+func UserAgent() string {
+	return "tidb-metrics-crawler/" + Version
+}
+
+// BuildInfo describes the build for version output and bug reports
+func BuildInfo() string {
+	return fmt.Sprintf("tidb-metrics-crawler %s (commit %s, built %s, %s %s/%s)",
+		Version, Commit, BuildDate, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
@@ -0,0 +1,35 @@
+package version
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestBuildInfo(t *testing.T) {
+	defer func(version, commit, date string) {
+		Version, Commit, BuildDate = version, commit, date
+	}(Version, Commit, BuildDate)
+	platform := runtime.Version() + " " + runtime.GOOS + "/" + runtime.GOARCH
+
+	tests := []struct {
+		name                    string
+		version, commit, date   string
+		wantInfo, wantUserAgent string
+	}{
+		{"without ldflags", "dev", "unknown", "unknown",
+			"tidb-metrics-crawler dev (commit unknown, built unknown, " + platform + ")", "tidb-metrics-crawler/dev"},
+		{"release build", "v1.2.3", "3aa59a6", "2024-01-01T00:00:00Z",
+			"tidb-metrics-crawler v1.2.3 (commit 3aa59a6, built 2024-01-01T00:00:00Z, " + platform + ")", "tidb-metrics-crawler/v1.2.3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			Version, Commit, BuildDate = tt.version, tt.commit, tt.date
+			if got := BuildInfo(); got != tt.wantInfo {
+				t.Errorf("BuildInfo() = %q, want %q", got, tt.wantInfo)
+			}
+			if got := UserAgent(); got != tt.wantUserAgent {
+				t.Errorf("UserAgent() = %q, want %q", got, tt.wantUserAgent)
+			}
+		})
+	}
+}